@@ -408,20 +408,86 @@ func GetPrefs(ctx context.Context) (*ipn.Prefs, error) {
 	return &p, nil
 }
 
+// LoginProfile returns the named login profile, as selected with
+// "tailscale up --profile", or the default profile if name is empty.
+func LoginProfile(ctx context.Context, name string) (*ipn.LoginProfile, error) {
+	return getLoginProfile(ctx, "/localapi/v0/login-profile?name="+url.QueryEscape(name))
+}
+
+// CurrentLoginProfile returns the login profile tailscaled is using.
+func CurrentLoginProfile(ctx context.Context) (*ipn.LoginProfile, error) {
+	return getLoginProfile(ctx, "/localapi/v0/login-profile")
+}
+
+func getLoginProfile(ctx context.Context, path string) (*ipn.LoginProfile, error) {
+	body, err := get200(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	lp := new(ipn.LoginProfile)
+	if err := json.Unmarshal(body, lp); err != nil {
+		return nil, fmt.Errorf("invalid login profile JSON: %w", err)
+	}
+	return lp, nil
+}
+
 func EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	return EditPrefsIfMatch(ctx, mp, "")
+}
+
+// GetPrefsETag is like GetPrefs, but also returns the prefs' ETag,
+// for use with EditPrefsIfMatch.
+func GetPrefsETag(ctx context.Context) (*ipn.Prefs, string, error) {
+	p, hdr, err := sendPrefs(ctx, "GET", nil, "")
+	if err != nil {
+		return nil, "", err
+	}
+	return p, strings.Trim(hdr.Get("ETag"), `"`), nil
+}
+
+// EditPrefsIfMatch is like EditPrefs, but if etag is non-empty, the edit
+// is only made if the prefs still have that ETag, as returned by
+// GetPrefsETag. If another client changed them in the meantime,
+// it returns ipn.ErrPrefsChanged.
+func EditPrefsIfMatch(ctx context.Context, mp *ipn.MaskedPrefs, etag string) (*ipn.Prefs, error) {
 	mpj, err := json.Marshal(mp)
 	if err != nil {
 		return nil, err
 	}
-	body, err := send(ctx, "PATCH", "/localapi/v0/prefs", http.StatusOK, bytes.NewReader(mpj))
+	p, _, err := sendPrefs(ctx, "PATCH", bytes.NewReader(mpj), etag)
+	return p, err
+}
+
+func sendPrefs(ctx context.Context, method string, body io.Reader, ifMatch string) (*ipn.Prefs, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://local-tailscaled.sock/localapi/v0/prefs", body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ifMatch != "" {
+		req.Header.Set("If-Match", `"`+ifMatch+`"`)
+	}
+	res, err := doLocalRequestNiceError(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	slurp, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusPreconditionFailed:
+		return nil, nil, ipn.ErrPrefsChanged
+	default:
+		err = fmt.Errorf("%v: %s", res.Status, bytes.TrimSpace(slurp))
+		return nil, nil, bestError(err, slurp)
 	}
 	var p ipn.Prefs
-	if err := json.Unmarshal(body, &p); err != nil {
-		return nil, fmt.Errorf("invalid prefs JSON: %w", err)
+	if err := json.Unmarshal(slurp, &p); err != nil {
+		return nil, nil, fmt.Errorf("invalid prefs JSON: %w", err)
 	}
-	return &p, nil
+	return &p, res.Header, nil
 }
 
 func Logout(ctx context.Context) error {
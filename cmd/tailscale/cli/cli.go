@@ -125,6 +125,41 @@ func CleanUpArgs(args []string) []string {
 	return out
 }
 
+// expandArgsFiles returns args with each "@path" argument replaced by
+// the arguments in the file at path, or for "@-", read from stdin.
+// Arguments in a file are separated by whitespace, including newlines,
+// and lines starting with "#" are comments. Arguments in a file aren't
+// expanded again, even if they start with "@".
+func expandArgsFiles(args []string, stdin io.Reader) ([]string, error) {
+	var out []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			out = append(out, arg)
+			continue
+		}
+		var b []byte
+		var err error
+		if path := arg[1:]; path == "-" {
+			if stdin == nil {
+				return nil, errors.New("@-: no stdin to read arguments from")
+			}
+			b, err = io.ReadAll(stdin)
+		} else {
+			b, err = os.ReadFile(path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading arguments from %s: %w", arg, err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "#") {
+				continue
+			}
+			out = append(out, strings.Fields(line)...)
+		}
+	}
+	return out, nil
+}
+
 // Run runs the CLI. The args do not include the binary name.
 func Run(args []string) (err error) {
 	if len(args) == 1 && (args[0] == "-V" || args[0] == "--version") {
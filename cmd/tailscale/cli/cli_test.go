@@ -6,12 +6,26 @@
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/google/go-cmp/cmp"
@@ -19,6 +33,7 @@
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tstest"
+	"tailscale.com/types/key"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/preftype"
 	"tailscale.com/version/distro"
@@ -160,6 +175,141 @@ func TestCheckForAccidentalSettingReverts(t *testing.T) {
 			},
 			want: accidentalUpPrefix + " --advertise-routes=10.0.42.0/24 --advertise-exit-node",
 		},
+		{
+			name:  "error_advertised_route_comment_removed",
+			flags: []string{"--hostname=foo"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("10.0.42.0/24"),
+				},
+				AdvertiseRouteComments: map[netaddr.IPPrefix]string{
+					netaddr.MustParseIPPrefix("10.0.42.0/24"): "lab",
+				},
+			},
+			want: accidentalUpPrefix + " --hostname=foo --advertise-routes=10.0.42.0/24#lab",
+		},
+		{
+			name:  "advertised_routes_cleared_with_dash",
+			flags: []string{"--advertise-routes=-"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("10.0.42.0/24"),
+				},
+			},
+			want: "",
+		},
+		{
+			name:  "advertised_routes_cleared_keeps_exit_node",
+			flags: []string{"--advertise-routes=-"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("10.0.42.0/24"),
+					netaddr.MustParseIPPrefix("0.0.0.0/0"),
+					netaddr.MustParseIPPrefix("::/0"),
+				},
+			},
+			want: accidentalUpPrefix + " --advertise-routes=- --advertise-exit-node",
+		},
+		{
+			name:  "advertised_route_comment_kept",
+			flags: []string{"--advertise-routes=10.0.42.0/24#lab"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("10.0.42.0/24"),
+				},
+				AdvertiseRouteComments: map[netaddr.IPPrefix]string{
+					netaddr.MustParseIPPrefix("10.0.42.0/24"): "lab",
+				},
+			},
+			want: "",
+		},
+		{
+			name:  "accept_dns_split_from_true",
+			flags: []string{"--accept-dns=split"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+			want: "",
+		},
+		{
+			name:  "error_accept_dns_split_lost",
+			flags: []string{"--shields-up"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				CorpDNSSplitOnly: true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+			want: accidentalUpPrefix + " --shields-up --accept-dns=split",
+		},
+		{
+			name:  "error_accept_dns_split_shields_up_removed",
+			flags: []string{"--accept-dns=split"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				ShieldsUp:        true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+			want: accidentalUpPrefix + " --accept-dns=split --shields-up",
+		},
+		{
+			name:  "accept_dns_prefer_magic_kept",
+			flags: []string{"--accept-dns=prefer-magic"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				CorpDNSMagicOnly: true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+			want: "",
+		},
+		{
+			name:  "error_accept_dns_prefer_magic_lost",
+			flags: []string{"--shields-up"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				CorpDNSMagicOnly: true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+			want: accidentalUpPrefix + " --shields-up --accept-dns=prefer-magic",
+		},
+		{
+			name:  "accept_dns_split_to_prefer_magic",
+			flags: []string{"--accept-dns=prefer-magic"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				CorpDNSSplitOnly: true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+			want: "",
+		},
 		{
 			name:  "advertised_routes_exit_node_removed_explicit",
 			flags: []string{"--advertise-routes=10.0.42.0/24", "--advertise-exit-node=false"},
@@ -270,7 +420,7 @@ func TestCheckForAccidentalSettingReverts(t *testing.T) {
 				OperatorUser:  "alice",
 			},
 			curUser: "eve",
-			want:    accidentalUpPrefix + " --force-reauth --accept-dns=false --accept-routes --advertise-exit-node --advertise-routes=10.0.0.0/16 --advertise-tags=tag:foo,tag:bar --exit-node=100.64.5.6 --host-routes=false --hostname=myhostname --netfilter-mode=nodivert --operator=alice --shields-up",
+			want:    accidentalUpPrefix + " --force-reauth --accept-dns=false --accept-routes --advertise-exit-node --advertise-routes=10.0.0.0/16 --advertise-tags=tag:bar,tag:foo --exit-node=100.64.5.6 --host-routes=false --hostname=myhostname --netfilter-mode=nodivert --operator=alice --shields-up",
 		},
 		{
 			name:  "remove_all_implicit_except_hostname",
@@ -293,7 +443,7 @@ func TestCheckForAccidentalSettingReverts(t *testing.T) {
 				OperatorUser:  "alice",
 			},
 			curUser: "eve",
-			want:    accidentalUpPrefix + " --hostname=newhostname --accept-dns=false --accept-routes --advertise-routes=10.0.0.0/16 --advertise-tags=tag:foo,tag:bar --exit-node=100.64.5.6 --host-routes=false --netfilter-mode=nodivert --operator=alice --shields-up",
+			want:    accidentalUpPrefix + " --hostname=newhostname --accept-dns=false --accept-routes --advertise-routes=10.0.0.0/16 --advertise-tags=tag:bar,tag:foo --exit-node=100.64.5.6 --host-routes=false --netfilter-mode=nodivert --operator=alice --shields-up",
 		},
 		{
 			name:  "loggedout_is_implicit",
@@ -324,6 +474,115 @@ func TestCheckForAccidentalSettingReverts(t *testing.T) {
 			goos: "windows",
 			want: "", // not an error
 		},
+		{
+			name:  "losing_hostname_with_space",
+			flags: []string{"--accept-dns"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				Hostname:         "my host",
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				AllowSingleHosts: true,
+			},
+			want: accidentalUpPrefix + " --accept-dns --hostname='my host'",
+		},
+		{
+			name:  "losing_hostname_with_space_windows",
+			flags: []string{"--accept-dns"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				Hostname:         "my host",
+				CorpDNS:          true,
+				RouteAll:         true,
+				AllowSingleHosts: true,
+			},
+			goos: "windows",
+			want: accidentalUpPrefix + ` --accept-dns --hostname="my host"`,
+		},
+		{
+			name:  "losing_tags",
+			flags: []string{"--accept-dns"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AdvertiseTags:    []string{"tag:foo", "tag:bar"},
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				AllowSingleHosts: true,
+			},
+			want: accidentalUpPrefix + " --accept-dns --advertise-tags=tag:bar,tag:foo",
+		},
+		{
+			name:  "losing_tags_windows",
+			flags: []string{"--accept-dns"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AdvertiseTags:    []string{"tag:foo", "tag:bar"},
+				CorpDNS:          true,
+				RouteAll:         true,
+				AllowSingleHosts: true,
+			},
+			goos: "windows",
+			want: accidentalUpPrefix + ` --accept-dns --advertise-tags="tag:bar,tag:foo"`,
+		},
+		{
+			name:  "tags_reordered",
+			flags: []string{"--advertise-tags=tag:bar,tag:foo"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AdvertiseTags:    []string{"tag:foo", "tag:bar"},
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				AllowSingleHosts: true,
+			},
+			want: "",
+		},
+		{
+			name:  "masquerade_alias_changing_explicitly",
+			flags: []string{"--masquerade=false"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+			want: "",
+		},
+		{
+			name:  "losing_netfilter_backend",
+			flags: []string{"--hostname=foo"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				NetfilterBackend: preftype.NetfilterBackendNftables,
+			},
+			want: accidentalUpPrefix + " --hostname=foo --netfilter-mode=on/nftables",
+		},
+		{
+			name:  "losing_masquerade",
+			flags: []string{"--hostname=foo"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				NoSNAT:           true,
+			},
+			want: accidentalUpPrefix + " --hostname=foo --snat-subnet-routes=false",
+		},
+		{
+			name:  "losing_masquerade_to",
+			flags: []string{"--hostname=foo"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				MasqueradeTo:     netaddr.MustParseIP("192.168.1.2"),
+			},
+			want: accidentalUpPrefix + " --hostname=foo --masquerade-to=192.168.1.2",
+		},
 		{
 			name:  "ignore_netfilter_change_non_linux",
 			flags: []string{"--accept-dns"},
@@ -516,7 +775,62 @@ func upArgsFromOSArgs(goos string, flagArgs ...string) (args upArgsT) {
 	return
 }
 
+func TestFmtFlagValueArg(t *testing.T) {
+	tests := []struct {
+		goos string
+		val  any
+		want string
+	}{
+		{"linux", true, "--f"},
+		{"windows", true, "--f"},
+		{"linux", "", "--f="},
+		{"windows", "", "--f="},
+		{"linux", `C:\dir\file`, `--f=C:\\dir\\file`},
+		{"windows", `C:\dir\file`, `--f=C:\dir\file`},
+		{"linux", "a b", "--f='a b'"},
+		{"windows", "a b", `--f="a b"`},
+		{"linux", "a,b", "--f=a,b"},
+		{"windows", "a,b", `--f="a,b"`},
+		{"windows", "$x `y` \"z\"", "--f=\"`$x ``y`` `\"z`\"\""},
+	}
+	for _, tt := range tests {
+		if got := fmtFlagValueArg(tt.goos, "f", tt.val); got != tt.want {
+			t.Errorf("fmtFlagValueArg(%q, %q, %#v) = %s; want %s", tt.goos, "f", tt.val, got, tt.want)
+		}
+	}
+}
+
 func TestPrefsFromUpArgs(t *testing.T) {
+	exitNodeStatus := &ipnstate.Status{
+		BackendState: "Running",
+		Self: &ipnstate.PeerStatus{
+			HostName:     "laptop",
+			DNSName:      "laptop.example.ts.net.",
+			TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+		},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				ID:             "nGW",
+				HostName:       "Gateway",
+				DNSName:        "gateway.example.ts.net.",
+				TailscaleIPs:   []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+				ExitNodeOption: true,
+			},
+			key.NewNode().Public(): {
+				ID:             "nGW2",
+				HostName:       "gateway",
+				DNSName:        "gateway-1.example.ts.net.",
+				TailscaleIPs:   []netaddr.IP{netaddr.MustParseIP("100.64.0.3")},
+				ExitNodeOption: true,
+			},
+			key.NewNode().Public(): {
+				ID:           "nWeb",
+				HostName:     "web",
+				DNSName:      "web.example.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.4")},
+			},
+		},
+	}
 	tests := []struct {
 		name     string
 		args     upArgsT
@@ -567,6 +881,66 @@ func TestPrefsFromUpArgs(t *testing.T) {
 				NetfilterMode: preftype.NetfilterOn,
 			},
 		},
+		{
+			name: "advertise_routes_dash_clears",
+			args: upArgsFromOSArgs("linux", "--advertise-routes=-"),
+			want: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				WantRunning:      true,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				AdvertiseRoutes:  []netaddr.IPPrefix{},
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+		},
+		{
+			name: "accept_dns_split",
+			args: upArgsFromOSArgs("linux", "--accept-dns=split"),
+			want: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				WantRunning:      true,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				CorpDNSSplitOnly: true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+		},
+		{
+			name: "accept_dns_prefer_magic",
+			args: upArgsFromOSArgs("linux", "--accept-dns=prefer-magic"),
+			want: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				WantRunning:      true,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				CorpDNSMagicOnly: true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+		},
+		{
+			name: "advertise_tags_repeated",
+			args: upArgsFromOSArgs("linux", "--advertise-tags=tag:a,tag:b", "--advertise-tags", "tag:c", "--advertise-tags=tag:a"),
+			want: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				WantRunning:      true,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				AdvertiseTags:    []string{"tag:a", "tag:b", "tag:c"},
+			},
+		},
+		{
+			name: "advertise_tags_reversed",
+			args: upArgsFromOSArgs("linux", "--advertise-tags=tag:c,tag:b,tag:a,tag:b"),
+			want: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				WantRunning:      true,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				AdvertiseTags:    []string{"tag:a", "tag:b", "tag:c"},
+			},
+		},
 		{
 			name: "error_advertise_route_invalid_ip",
 			args: upArgsT{
@@ -596,18 +970,55 @@ func TestPrefsFromUpArgs(t *testing.T) {
 			wantErr: `--exit-node-allow-lan-access can only be used with --exit-node`,
 		},
 		{
-			name: "error_tag_prefix",
+			name: "error_ssh_windows",
+			goos: "windows",
 			args: upArgsT{
-				advertiseTags: "foo",
+				runSSH: true,
 			},
-			wantErr: `tag: "foo": tags must start with 'tag:'`,
+			wantErr: `--ssh is not supported on windows; the Tailscale SSH server only runs on Linux and macOS`,
 		},
 		{
-			name: "error_long_hostname",
+			name: "error_ssh_freebsd",
+			goos: "freebsd",
 			args: upArgsT{
-				hostname: strings.Repeat("a", 300),
+				runSSH: true,
 			},
-			wantErr: `hostname too long: 300 bytes (max 256)`,
+			wantErr: `--ssh is not supported on freebsd; the Tailscale SSH server only runs on Linux and macOS`,
+		},
+		{
+			name: "error_tag_prefix",
+			args: upArgsT{
+				advertiseTags: "foo",
+			},
+			wantErr: `tag: "foo": tags must start with 'tag:'`,
+		},
+		{
+			name: "error_long_hostname",
+			args: upArgsT{
+				hostname: strings.Repeat("a", 300),
+			},
+			wantErr: `hostname too long: 300 bytes (max 256)`,
+		},
+		{
+			name: "error_hostname_leading_hyphen",
+			args: upArgsT{
+				hostname: "-foo",
+			},
+			wantErr: `invalid --hostname="-foo": can't start or end with a hyphen`,
+		},
+		{
+			name: "error_hostname_trailing_hyphen",
+			args: upArgsT{
+				hostname: "foo-",
+			},
+			wantErr: `invalid --hostname="foo-": can't start or end with a hyphen`,
+		},
+		{
+			name: "error_hostname_no_label_chars",
+			args: upArgsT{
+				hostname: "___",
+			},
+			wantErr: `invalid --hostname="___": must contain a letter or digit`,
 		},
 		{
 			name: "error_linux_netfilter_empty",
@@ -623,6 +1034,33 @@ func TestPrefsFromUpArgs(t *testing.T) {
 			},
 			wantErr: `invalid value --netfilter-mode="bogus"`,
 		},
+		{
+			name: "netfilter_nftables",
+			args: upArgsT{
+				netfilterMode: "nodivert/nftables",
+			},
+			want: &ipn.Prefs{
+				WantRunning:      true,
+				NoSNAT:           true,
+				NetfilterMode:    preftype.NetfilterNoDivert,
+				NetfilterBackend: preftype.NetfilterBackendNftables,
+			},
+			wantWarn: "netfilter=nodivert; add iptables calls to ts-* chains manually.",
+		},
+		{
+			name: "error_netfilter_bogus_backend",
+			args: upArgsT{
+				netfilterMode: "on/ebtables",
+			},
+			wantErr: `invalid value --netfilter-mode=on/ebtables; the only backend is nftables`,
+		},
+		{
+			name: "error_netfilter_off_nftables",
+			args: upArgsT{
+				netfilterMode: "off/nftables",
+			},
+			wantErr: `--netfilter-mode=off/nftables makes no sense; off doesn't use a backend`,
+		},
 		{
 			name: "error_exit_node_ip_is_self_ip",
 			args: upArgsT{
@@ -633,6 +1071,66 @@ func TestPrefsFromUpArgs(t *testing.T) {
 			},
 			wantErr: `cannot use 100.105.106.107 as an exit node as it is a local IP address to this machine; did you mean --advertise-exit-node?`,
 		},
+		{
+			name: "exit_node_by_dns_name",
+			args: upArgsT{
+				exitNodeIP:    "gateway.example.ts.net",
+				netfilterMode: "on",
+			},
+			st: exitNodeStatus,
+			want: &ipn.Prefs{
+				WantRunning:   true,
+				NetfilterMode: preftype.NetfilterOn,
+				NoSNAT:        true,
+				ExitNodeID:    "nGW",
+			},
+		},
+		{
+			name: "exit_node_by_dns_base_name",
+			args: upArgsT{
+				exitNodeIP:    "Gateway-1",
+				netfilterMode: "on",
+			},
+			st: exitNodeStatus,
+			want: &ipn.Prefs{
+				WantRunning:   true,
+				NetfilterMode: preftype.NetfilterOn,
+				NoSNAT:        true,
+				ExitNodeID:    "nGW2",
+			},
+		},
+		{
+			name: "error_exit_node_name_ambiguous",
+			args: upArgsT{
+				exitNodeIP: "gateway",
+			},
+			st:      exitNodeStatus,
+			wantErr: `exit node name "gateway" is ambiguous; it matches gateway-1.example.ts.net (100.64.0.3), gateway.example.ts.net (100.64.0.2); use its MagicDNS name or Tailscale IP`,
+		},
+		{
+			name: "error_exit_node_name_unknown",
+			args: upArgsT{
+				exitNodeIP: "nope",
+			},
+			st:      exitNodeStatus,
+			wantErr: `invalid value "nope" for --exit-node; must be IP or unique node name; exit nodes available: gateway-1.example.ts.net (100.64.0.3), gateway.example.ts.net (100.64.0.2)`,
+		},
+		{
+			name: "error_exit_node_name_not_exit_node",
+			args: upArgsT{
+				exitNodeIP: "web",
+			},
+			st:      exitNodeStatus,
+			wantErr: `node "web" is not advertising an exit node`,
+		},
+		{
+			name: "error_exit_node_name_is_self",
+			args: upArgsT{
+				exitNodeIP: "laptop",
+			},
+			st:      exitNodeStatus,
+			wantErr: `cannot use laptop as an exit node as it is this machine; did you mean --advertise-exit-node?`,
+		},
 		{
 			name: "warn_linux_netfilter_nodivert",
 			goos: "linux",
@@ -660,15 +1158,57 @@ func TestPrefsFromUpArgs(t *testing.T) {
 			},
 		},
 		{
-			name: "via_route_good",
+			name: "warn_lan_access_private_route",
 			goos: "linux",
 			args: upArgsT{
-				advertiseRoutes: "fd7a:115c:a1e0:b1a::bb:10.0.0.0/112",
-				netfilterMode: "off",
+				advertiseRoutes:        "192.168.1.0/24",
+				exitNodeIP:             "100.64.5.6",
+				exitNodeAllowLANAccess: true,
+				netfilterMode:          "on",
+			},
+			wantWarn: "--advertise-routes=192.168.1.0/24 overlaps the private range 192.168.0.0/16; with --exit-node-allow-lan-access, traffic for it may go to your LAN or to the advertised subnet ambiguously",
+			want: &ipn.Prefs{
+				WantRunning:            true,
+				NetfilterMode:          preftype.NetfilterOn,
+				NoSNAT:                 true,
+				AdvertiseRoutes:        []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.1.0/24")},
+				ExitNodeIP:             netaddr.MustParseIP("100.64.5.6"),
+				ExitNodeAllowLANAccess: true,
+			},
+		},
+		{
+			name: "lan_access_public_route",
+			goos: "linux",
+			args: upArgsT{
+				advertiseRoutes:        "203.0.113.0/24,0.0.0.0/0,::/0",
+				exitNodeIP:             "100.64.5.6",
+				exitNodeAllowLANAccess: true,
+				netfilterMode:          "on",
 			},
 			want: &ipn.Prefs{
 				WantRunning:   true,
+				NetfilterMode: preftype.NetfilterOn,
 				NoSNAT:        true,
+				AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("0.0.0.0/0"),
+					netaddr.MustParseIPPrefix("::/0"),
+					netaddr.MustParseIPPrefix("203.0.113.0/24"),
+				},
+				ExitNodeIP:             netaddr.MustParseIP("100.64.5.6"),
+				ExitNodeAllowLANAccess: true,
+			},
+		},
+		{
+			name: "via_route_good",
+			goos: "linux",
+			args: upArgsT{
+				advertiseRoutes: "fd7a:115c:a1e0:b1a::bb:10.0.0.0/112",
+				netfilterMode:   "off",
+			},
+			wantWarn: "netfilter=off; configure iptables yourself.",
+			want: &ipn.Prefs{
+				WantRunning: true,
+				NoSNAT:      true,
 				AdvertiseRoutes: []netaddr.IPPrefix{
 					netaddr.MustParseIPPrefix("fd7a:115c:a1e0:b1a::bb:10.0.0.0/112"),
 				},
@@ -679,7 +1219,7 @@ func TestPrefsFromUpArgs(t *testing.T) {
 			goos: "linux",
 			args: upArgsT{
 				advertiseRoutes: "fd7a:115c:a1e0:b1a::/64",
-				netfilterMode: "off",
+				netfilterMode:   "off",
 			},
 			wantErr: "fd7a:115c:a1e0:b1a::/64 4-in-6 prefix must be at least a /96",
 		},
@@ -688,10 +1228,244 @@ func TestPrefsFromUpArgs(t *testing.T) {
 			goos: "linux",
 			args: upArgsT{
 				advertiseRoutes: "fd7a:115c:a1e0:b1a:1234:5678::/112",
-				netfilterMode: "off",
+				netfilterMode:   "off",
 			},
 			wantErr: "route fd7a:115c:a1e0:b1a:1234:5678::/112 contains invalid site ID 12345678; must be 0xff or less",
 		},
+		{
+			name: "advertise_routes_comments",
+			goos: "linux",
+			args: upArgsT{
+				advertiseRoutes: "10.0.0.0/8#datacenter,192.168.0.0/24,10.1.0.0/16# lab ,10.2.0.0/16#",
+				netfilterMode:   "off",
+			},
+			wantWarn: "--advertise-routes=10.1.0.0/16 is redundant; it's already covered by 10.0.0.0/8\n" +
+				"--advertise-routes=10.2.0.0/16 is redundant; it's already covered by 10.0.0.0/8\n" +
+				"netfilter=off; configure iptables yourself.",
+			want: &ipn.Prefs{
+				WantRunning: true,
+				NoSNAT:      true,
+				AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("10.0.0.0/8"),
+					netaddr.MustParseIPPrefix("10.1.0.0/16"),
+					netaddr.MustParseIPPrefix("10.2.0.0/16"),
+					netaddr.MustParseIPPrefix("192.168.0.0/24"),
+				},
+				AdvertiseRouteComments: map[netaddr.IPPrefix]string{
+					netaddr.MustParseIPPrefix("10.0.0.0/8"):  "datacenter",
+					netaddr.MustParseIPPrefix("10.1.0.0/16"): "lab",
+				},
+			},
+		},
+		{
+			name: "warn_redundant_route_ipv4",
+			goos: "linux",
+			args: upArgsT{
+				advertiseRoutes: "10.1.0.0/16,10.0.0.0/8",
+				netfilterMode:   "on",
+			},
+			wantWarn: "--advertise-routes=10.1.0.0/16 is redundant; it's already covered by 10.0.0.0/8",
+			want: &ipn.Prefs{
+				WantRunning:   true,
+				NetfilterMode: preftype.NetfilterOn,
+				NoSNAT:        true,
+				AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("10.0.0.0/8"),
+					netaddr.MustParseIPPrefix("10.1.0.0/16"),
+				},
+			},
+		},
+		{
+			name: "warn_redundant_route_ipv6",
+			goos: "linux",
+			args: upArgsT{
+				advertiseRoutes: "2001:db8::/32,2001:db8:1::/48",
+				netfilterMode:   "on",
+			},
+			wantWarn: "--advertise-routes=2001:db8:1::/48 is redundant; it's already covered by 2001:db8::/32",
+			want: &ipn.Prefs{
+				WantRunning:   true,
+				NetfilterMode: preftype.NetfilterOn,
+				NoSNAT:        true,
+				AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("2001:db8::/32"),
+					netaddr.MustParseIPPrefix("2001:db8:1::/48"),
+				},
+			},
+		},
+		{
+			name: "advertise_routes_no_overlap",
+			goos: "linux",
+			args: upArgsT{
+				advertiseRoutes:       "10.0.0.0/24,10.0.1.0/24,10.0.1.0/24,2001:db8::/48",
+				advertiseDefaultRoute: true,
+				netfilterMode:         "on",
+			},
+			want: &ipn.Prefs{
+				WantRunning:   true,
+				NetfilterMode: preftype.NetfilterOn,
+				NoSNAT:        true,
+				AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("0.0.0.0/0"),
+					netaddr.MustParseIPPrefix("::/0"),
+					netaddr.MustParseIPPrefix("10.0.0.0/24"),
+					netaddr.MustParseIPPrefix("10.0.1.0/24"),
+					netaddr.MustParseIPPrefix("2001:db8::/48"),
+				},
+			},
+		},
+		{
+			name: "advertise_routes_comment_on_exit_route",
+			goos: "linux",
+			args: upArgsT{
+				advertiseRoutes: "0.0.0.0/0#internet,::/0",
+				netfilterMode:   "off",
+			},
+			wantErr: "0.0.0.0/0 can't have a comment; use --advertise-exit-node instead",
+		},
+		{
+			name: "accept_routes_no_default",
+			goos: "windows",
+			args: upArgsT{
+				acceptRoutes:          true,
+				acceptRoutesNoDefault: true,
+			},
+			want: &ipn.Prefs{
+				WantRunning:       true,
+				RouteAll:          true,
+				RouteAllNoDefault: true,
+				NetfilterMode:     preftype.NetfilterOn,
+			},
+		},
+		{
+			name: "accept_routes_filter",
+			goos: "windows",
+			args: upArgsT{
+				acceptRoutes:       true,
+				acceptRoutesFilter: "fd00:20::/32,10.20.0.0/16,10.20.0.0/16",
+			},
+			want: &ipn.Prefs{
+				WantRunning:    true,
+				RouteAll:       true,
+				RouteAllFilter: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.20.0.0/16"), netaddr.MustParseIPPrefix("fd00:20::/32")},
+				NetfilterMode:  preftype.NetfilterOn,
+			},
+		},
+		{
+			name: "accept_routes_filter_non_address_bits",
+			goos: "windows",
+			args: upArgsT{
+				acceptRoutes:       true,
+				acceptRoutesFilter: "10.20.1.0/16",
+			},
+			wantErr: "invalid --accept-routes-filter: 10.20.1.0/16 has non-address bits set; expected 10.20.0.0/16",
+		},
+		{
+			name: "accept_routes_filter_invalid",
+			goos: "windows",
+			args: upArgsT{
+				acceptRoutes:       true,
+				acceptRoutesFilter: "10.20.0.0/16,foo",
+			},
+			wantErr: `invalid --accept-routes-filter: "foo" is not a valid IP address or CIDR prefix`,
+		},
+		{
+			name: "accept_routes_filter_without_accept_routes",
+			goos: "windows",
+			args: upArgsT{
+				acceptRoutesFilter: "10.20.0.0/16",
+			},
+			wantErr: "--accept-routes-filter can only be used with --accept-routes",
+		},
+		{
+			name: "dns_backend",
+			goos: "linux",
+			args: upArgsT{
+				dnsBackend:    "systemd-resolved",
+				netfilterMode: "on",
+			},
+			want: &ipn.Prefs{
+				WantRunning:   true,
+				NoSNAT:        true,
+				NetfilterMode: preftype.NetfilterOn,
+				DNSBackend:    "systemd-resolved",
+			},
+		},
+		{
+			name: "dns_backend_invalid",
+			goos: "linux",
+			args: upArgsT{
+				dnsBackend:    "dnsmasq",
+				netfilterMode: "on",
+			},
+			wantErr: `invalid value --dns="dnsmasq"; must be one of systemd-resolved, resolvconf, network-manager, direct`,
+		},
+		{
+			name: "masquerade_to",
+			goos: "linux",
+			args: upArgsT{
+				snat:          true,
+				masqueradeTo:  "192.168.1.2",
+				netfilterMode: "on",
+			},
+			want: &ipn.Prefs{
+				WantRunning:   true,
+				NetfilterMode: preftype.NetfilterOn,
+				MasqueradeTo:  netaddr.MustParseIP("192.168.1.2"),
+			},
+		},
+		{
+			name: "error_masquerade_to_without_snat",
+			goos: "linux",
+			args: upArgsT{
+				masqueradeTo:  "192.168.1.2",
+				netfilterMode: "on",
+			},
+			wantErr: `--masquerade-to can't be used with --snat-subnet-routes=false`,
+		},
+		{
+			name: "error_masquerade_to_invalid",
+			goos: "linux",
+			args: upArgsT{
+				snat:          true,
+				masqueradeTo:  "192.168.1.300",
+				netfilterMode: "on",
+			},
+			wantErr: `invalid value --masquerade-to="192.168.1.300"; must be an IP address`,
+		},
+		{
+			name: "oauth_without_tags",
+			args: upArgsT{
+				oauthClientID:     "id",
+				oauthSecretOrFile: "secret",
+			},
+			wantErr: "--oauth-client-id requires --advertise-tags; auth keys made with OAuth clients must be tagged",
+		},
+		{
+			name: "oauth_without_secret",
+			args: upArgsT{
+				oauthClientID: "id",
+				advertiseTags: "tag:foo",
+			},
+			wantErr: "--oauth-client-id requires --oauth-client-secret",
+		},
+		{
+			name: "oauth_and_authkey",
+			args: upArgsT{
+				oauthClientID:     "id",
+				oauthSecretOrFile: "secret",
+				authKeyOrFile:     "tskey-foo",
+				advertiseTags:     "tag:foo",
+			},
+			wantErr: "--auth-key and --oauth-client-id can't be used together",
+		},
+		{
+			name: "oauth_secret_without_id",
+			args: upArgsT{
+				oauthSecretOrFile: "secret",
+			},
+			wantErr: "--oauth-client-secret requires --oauth-client-id",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -730,42 +1504,321 @@ func TestPrefsFromUpArgs(t *testing.T) {
 				)
 
 			}
+			if gotWarn := strings.TrimSpace(warnBuf.String()); gotWarn != tt.wantWarn {
+				t.Errorf("warning = %q; want %q", gotWarn, tt.wantWarn)
+			}
 		})
 	}
 
 }
 
-func TestPrefFlagMapping(t *testing.T) {
-	prefHasFlag := map[string]bool{}
-	for _, pv := range prefsOfFlag {
-		for _, pref := range pv {
-			prefHasFlag[pref] = true
-		}
+func TestPrefsFromUpFlags(t *testing.T) {
+	prefs, mp, err := PrefsFromUpFlags([]string{"--accept-routes", "--hostname=foo", "--authkey=tskey-x"}, "linux", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !prefs.RouteAll || prefs.Hostname != "foo" || !prefs.WantRunning {
+		t.Errorf("prefs = %v; want accept-routes, hostname foo, want running", prefs.Pretty())
+	}
+	if !mp.Prefs.Equals(prefs) {
+		t.Errorf("MaskedPrefs.Prefs = %v; want %v", mp.Prefs.Pretty(), prefs.Pretty())
+	}
+	wantMP := &ipn.MaskedPrefs{
+		Prefs:          *prefs,
+		RouteAllSet:    true,
+		HostnameSet:    true,
+		WantRunningSet: true,
+	}
+	if !reflect.DeepEqual(mp, wantMP) {
+		t.Errorf("MaskedPrefs = %v; want %v", mp.Pretty(), wantMP.Pretty())
 	}
 
-	prefType := reflect.TypeOf(ipn.Prefs{})
-	for i := 0; i < prefType.NumField(); i++ {
-		prefName := prefType.Field(i).Name
-		if prefHasFlag[prefName] {
-			continue
-		}
-		switch prefName {
-		case "WantRunning", "Persist", "LoggedOut":
-			// All explicitly handled (ignored) by checkForAccidentalSettingReverts.
-			continue
-		case "OSVersion", "DeviceModel":
-			// Only used by Android, which doesn't have a CLI mode anyway, so
-			// fine to not map.
-			continue
-		case "NotepadURLs":
-			// TODO(bradfitz): https://github.com/tailscale/tailscale/issues/1830
-			continue
+	_, mp, err = PrefsFromUpFlags([]string{"--reset"}, "linux", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mp.CorpDNSSet || !mp.AdvertiseRoutesSet || !mp.OperatorUserSet {
+		t.Errorf("with --reset, MaskedPrefs = %v; want all prefs set", mp.Pretty())
+	}
+
+	// Nothing is looked up on this machine.
+	for _, args := range [][]string{
+		{"--operator=no-such-user-ts-operator"},
+		{"--netfilter-mode=on/nftables"},
+	} {
+		if _, _, err := PrefsFromUpFlags(args, "linux", nil, nil); err != nil {
+			t.Errorf("PrefsFromUpFlags(%q): %v", args, err)
 		}
-		t.Errorf("unexpected new ipn.Pref field %q is not handled by up.go (see addPrefFlagMapping and checkForAccidentalSettingReverts)", prefName)
 	}
-}
 
-func TestFlagAppliesToOS(t *testing.T) {
+	var warned bool
+	if _, _, err := PrefsFromUpFlags([]string{"--netfilter-mode=off"}, "linux", nil, func(string, ...any) { warned = true }); err != nil {
+		t.Fatal(err)
+	}
+	if !warned {
+		t.Error("--netfilter-mode=off didn't warn")
+	}
+
+	for _, args := range [][]string{
+		{"--bogus"},
+		{"--accept-routes", "extra"},
+		{"--exit-node=some-peer"},
+		{"--role=bogus"},
+		{"--hostname=auto-unique"},
+		{"--hostname=@short"},
+		{"--advertise-routes=@routes.txt"},
+	} {
+		if _, _, err := PrefsFromUpFlags(args, "linux", nil, nil); err == nil {
+			t.Errorf("PrefsFromUpFlags(%q) succeeded; want error", args)
+		}
+	}
+}
+
+func TestNormalizeControlURL(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{in: "", want: ""},
+		{in: "https://controlplane.tailscale.com", want: "https://controlplane.tailscale.com"},
+		{in: "https://controlplane.tailscale.com/", want: "https://controlplane.tailscale.com"},
+		{in: "http://localhost:8080", want: "http://localhost:8080"},
+		{in: "https://corp.example.com/tailscale/", want: "https://corp.example.com/tailscale"},
+		{in: "https://corp.example.com/tailscale", want: "https://corp.example.com/tailscale"},
+		{in: "corp.example.com", wantErr: `invalid --login-server="corp.example.com": must be an http or https URL`},
+		{in: "ftp://corp.example.com", wantErr: `invalid --login-server="ftp://corp.example.com": must be an http or https URL`},
+		{in: "https://corp.example.com/?x=1", wantErr: `invalid --login-server="https://corp.example.com/?x=1": can't have a query or fragment`},
+	}
+	for _, tt := range tests {
+		got, err := normalizeControlURL(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("normalizeControlURL(%q) error = %v; want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeControlURL(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeControlURL(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+		// A normalized URL normalizes to itself, so it doesn't look
+		// like a changed setting on the next "tailscale up".
+		if again, _ := normalizeControlURL(got); again != got {
+			t.Errorf("normalizeControlURL(%q) = %q; not stable", got, again)
+		}
+	}
+}
+
+func TestAuthURLQR(t *testing.T) {
+	const authURL = "https://login.tailscale.com/a/0123456789abcdef"
+	q, err := authURLQR(authURL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	width := utf8.RuneCountInString(strings.SplitN(q, "\n", 2)[0])
+	if _, err := authURLQR(authURL, width); err != nil {
+		t.Errorf("QR code %d wide doesn't fit in %d columns: %v", width, width, err)
+	}
+	if _, err := authURLQR(authURL, width-1); err == nil {
+		t.Errorf("QR code %d wide fits in %d columns", width, width-1)
+	}
+}
+
+func TestCheckHostname(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "foo", want: "foo"},
+		{in: "Foo-Bar", want: "Foo-Bar"},
+		{in: "foo.", want: "foo"},
+		{in: "my laptop", want: "my-laptop"},
+		{in: "my_laptop", want: "my-laptop"},
+		{in: "My_Laptop", want: "my-laptop"},
+		{in: "foo.example.com", want: "foo-example-com"},
+		{in: "-foo", wantErr: true},
+		{in: "foo-", wantErr: true},
+		{in: "...", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := checkHostname(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkHostname(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("checkHostname(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUniqueHostname(t *testing.T) {
+	const id1, id2 = "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210"
+	h1 := uniqueHostname("vm.example.com", id1)
+	if !strings.HasPrefix(h1, "vm-") || len(h1) != len("vm-")+8 {
+		t.Errorf("uniqueHostname = %q; want vm- and 8 hex digits", h1)
+	}
+	if strings.Contains(h1, id1[:8]) {
+		t.Errorf("uniqueHostname = %q; contains the machine ID", h1)
+	}
+	if h2 := uniqueHostname("vm", id1); h2 != h1 {
+		t.Errorf("uniqueHostname not stable: %q != %q", h2, h1)
+	}
+	if h2 := uniqueHostname("vm", id2); h2 == h1 {
+		t.Errorf("different machine IDs both gave %q", h1)
+	}
+
+	oldFiles := machineIDFiles
+	defer func() { machineIDFiles = oldFiles }()
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty")
+	idFile := filepath.Join(dir, "machine-id")
+	if err := os.WriteFile(empty, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(idFile, []byte(id2+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	osHostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	machineIDFiles = []string{filepath.Join(dir, "missing"), empty, idFile}
+	got, err := autoUniqueHostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uniqueHostname(osHostname, id2); got != want {
+		t.Errorf("autoUniqueHostname = %q; want %q", got, want)
+	}
+	machineIDFiles = []string{empty}
+	if _, err := autoUniqueHostname(); err == nil {
+		t.Error("autoUniqueHostname succeeded with no machine ID")
+	}
+}
+
+func TestDerivedHostname(t *testing.T) {
+	oldOSHostname := osHostname
+	defer func() { osHostname = oldOSHostname }()
+
+	tests := []struct {
+		osName   string
+		flag     string
+		want     string // prefs.Hostname
+		wantWarn bool
+		wantErr  string
+	}{
+		{osName: "vm.corp.example.com", flag: "@short", want: "vm"},
+		{osName: "vm.corp.example.com.", flag: "@fqdn", want: "vm-corp-example-com"},
+		{osName: "vm", flag: "@fqdn", want: "vm"},
+		{osName: "My_VM.corp", flag: "@short", want: "my-vm", wantWarn: true},
+		{osName: "vm_1.corp", flag: "@fqdn", want: "vm-1-corp", wantWarn: true},
+		{osName: "-vm.corp", flag: "@short", wantErr: "can't start or end with a hyphen"},
+		{osName: ".corp", flag: "@short", wantErr: "OS hostname is empty"},
+		{osName: "vm", flag: "@long", wantErr: "values starting with @ are @short and @fqdn"},
+		{osName: "vm.corp", flag: "literal.name", want: "literal-name", wantWarn: true},
+		{osName: "vm.corp", flag: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.osName+"/"+tt.flag, func(t *testing.T) {
+			osHostname = func() (string, error) { return tt.osName, nil }
+			var warned bool
+			warnf := func(format string, args ...any) { warned = true }
+			args := upArgsFromOSArgs("linux", "--hostname="+tt.flag)
+			var prefs *ipn.Prefs
+			err := resolveUpArgsOnHost(&args, warnf, "linux")
+			if err == nil {
+				prefs, err = prefsFromUpArgs(args, warnf, new(ipnstate.Status), "linux")
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v; want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prefs.Hostname != tt.want {
+				t.Errorf("Hostname = %q; want %q", prefs.Hostname, tt.want)
+			}
+			if warned != tt.wantWarn {
+				t.Errorf("warned = %v; want %v", warned, tt.wantWarn)
+			}
+		})
+	}
+
+	osHostname = func() (string, error) { return "", errors.New("no hostname") }
+	args := upArgsFromOSArgs("linux", "--hostname=@short")
+	if err := resolveUpArgsOnHost(&args, t.Logf, "linux"); err == nil {
+		t.Error("@short succeeded without an OS hostname")
+	}
+}
+
+func TestPrefFlagMapping(t *testing.T) {
+	if err := checkPrefFlagMapping(); err != nil {
+		t.Errorf("up flags and ipn.Prefs are out of sync:\n%v", err)
+	}
+}
+
+func TestCheckPrefFlagMappingDrift(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func() (undo func())
+		wantErr string
+	}{
+		{
+			name: "unmapped_flag",
+			mutate: func() func() {
+				old := prefsOfFlag["shields-up"]
+				delete(prefsOfFlag, "shields-up")
+				return func() { prefsOfFlag["shields-up"] = old }
+			},
+			wantErr: "up flag --shields-up has no ipn.Prefs mapping",
+		},
+		{
+			name: "stale_mapping",
+			mutate: func() func() {
+				prefsOfFlag["no-such-flag"] = []string{"ShieldsUp"}
+				return func() { delete(prefsOfFlag, "no-such-flag") }
+			},
+			wantErr: "mapping for --no-such-flag, which isn't an up flag",
+		},
+		{
+			name: "unreachable_pref",
+			mutate: func() func() {
+				old := prefsOfFlag["operator"]
+				prefsOfFlag["operator"] = nil
+				return func() { prefsOfFlag["operator"] = old }
+			},
+			wantErr: `ipn.Pref field "OperatorUser" is not handled`,
+		},
+		{
+			name: "exempt_pref_with_flag",
+			mutate: func() func() {
+				prefsWithoutFlag["ShieldsUp"] = "test"
+				return func() { delete(prefsWithoutFlag, "ShieldsUp") }
+			},
+			wantErr: `"ShieldsUp" is set by an up flag but listed in prefsWithoutFlag`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer tt.mutate()()
+			err := checkPrefFlagMapping()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkPrefFlagMapping = %v; want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFlagAppliesToOS(t *testing.T) {
 	for _, goos := range geese {
 		var upArgs upArgsT
 		fs := newUpFlagSet(goos, &upArgs)
@@ -829,19 +1882,27 @@ func TestUpdatePrefs(t *testing.T) {
 			},
 			env: upCheckEnv{backendState: "Running"},
 			wantJustEditMP: &ipn.MaskedPrefs{
+				AdvertiseRouteCommentsSet: true,
 				AdvertiseRoutesSet:        true,
 				AdvertiseTagsSet:          true,
 				AllowSingleHostsSet:       true,
 				ControlURLSet:             true,
 				CorpDNSSet:                true,
+				CorpDNSSplitOnlySet:       true,
+				CorpDNSMagicOnlySet:       true,
 				ExitNodeAllowLANAccessSet: true,
 				ExitNodeIDSet:             true,
 				ExitNodeIPSet:             true,
 				HostnameSet:               true,
 				NetfilterModeSet:          true,
+				NetfilterBackendSet:       true,
+				DNSBackendSet:             true,
 				NoSNATSet:                 true,
+				MasqueradeToSet:           true,
 				OperatorUserSet:           true,
 				RouteAllSet:               true,
+				RouteAllNoDefaultSet:      true,
+				RouteAllFilterSet:         true,
 				RunSSHSet:                 true,
 				ShieldsUpSet:              true,
 				WantRunningSet:            true,
@@ -885,6 +1946,80 @@ func TestUpdatePrefs(t *testing.T) {
 			},
 			env: upCheckEnv{backendState: "Running"},
 		},
+		{
+			name:  "no_exit_node_this_session",
+			flags: []string{"--no-exit-node-this-session"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:             ipn.DefaultControlURL,
+				Persist:                &persist.Persist{LoginName: "crawshaw.github"},
+				AllowSingleHosts:       true,
+				CorpDNS:                true,
+				NetfilterMode:          preftype.NetfilterOn,
+				ExitNodeID:             "StableExit",
+				ExitNodeAllowLANAccess: true,
+			},
+			env: upCheckEnv{backendState: "Running"},
+			wantJustEditMP: &ipn.MaskedPrefs{
+				ExitNodeSuspendedSet: true,
+				WantRunningSet:       true,
+			},
+		},
+		{
+			// The suspension lasts until the next down, so an up
+			// that doesn't mention it neither complains nor ends it.
+			name:  "exit_node_suspended_plain_edit",
+			flags: []string{"--hostname=bar"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:        ipn.DefaultControlURL,
+				Persist:           &persist.Persist{LoginName: "crawshaw.github"},
+				AllowSingleHosts:  true,
+				CorpDNS:           true,
+				NetfilterMode:     preftype.NetfilterOn,
+				Hostname:          "foo",
+				ExitNodeSuspended: true,
+			},
+			env: upCheckEnv{backendState: "Running"},
+			wantJustEditMP: &ipn.MaskedPrefs{
+				HostnameSet:    true,
+				WantRunningSet: true,
+			},
+		},
+		{
+			// curPrefs are those saved for the profile being
+			// switched to, whose settings --profile alone keeps.
+			name:  "switch_profile",
+			flags: []string{"--profile=work"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       "https://ctl.example.com",
+				Persist:          &persist.Persist{LoginName: "someone@example.com"},
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				ShieldsUp:        true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+			env:          upCheckEnv{backendState: "Stopped"},
+			wantSimpleUp: true,
+		},
+		{
+			name:  "switch_profile_with_flags",
+			flags: []string{"--profile=work", "--login-server=https://ctl.example.com"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       "https://ctl.example.com",
+				Persist:          &persist.Persist{LoginName: "someone@example.com"},
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				ShieldsUp:        true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+			env:          upCheckEnv{backendState: "Stopped"},
+			wantErrSubtr: "--shields-up",
+		},
+		{
+			name:     "switch_to_new_profile",
+			flags:    []string{"--profile=work", "--login-server=https://ctl.example.com"},
+			curPrefs: ipn.NewPrefs(),
+			env:      upCheckEnv{backendState: "Stopped"},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -925,6 +2060,138 @@ func TestUpdatePrefs(t *testing.T) {
 	}
 }
 
+func TestResetExcept(t *testing.T) {
+	curPrefs := &ipn.Prefs{
+		ControlURL:       ipn.DefaultControlURL,
+		Persist:          &persist.Persist{LoginName: "crawshaw.github"},
+		AllowSingleHosts: true,
+		CorpDNS:          true,
+		NetfilterMode:    preftype.NetfilterOn,
+		Hostname:         "myhost",
+		OperatorUser:     "alice",
+		ShieldsUp:        true,
+		NoSNAT:           true,
+		AdvertiseTags:    []string{"tag:foo"},
+	}
+	tests := []struct {
+		name    string
+		flags   []string
+		want    func(p *ipn.Prefs)
+		wantErr string
+	}{
+		{
+			name:  "keep_hostname_and_operator",
+			flags: []string{"--reset", "--except=hostname,operator"},
+			want: func(p *ipn.Prefs) {
+				p.Hostname = "myhost"
+				p.OperatorUser = "alice"
+			},
+		},
+		{
+			name:  "repeated",
+			flags: []string{"--reset", "--except=shields-up", "--except", "advertise-tags"},
+			want: func(p *ipn.Prefs) {
+				p.ShieldsUp = true
+				p.AdvertiseTags = []string{"tag:foo"}
+			},
+		},
+		{
+			name:  "explicit_flag_wins",
+			flags: []string{"--reset", "--except=hostname,operator", "--hostname=other"},
+			want: func(p *ipn.Prefs) {
+				p.Hostname = "other"
+				p.OperatorUser = "alice"
+			},
+		},
+		{
+			name:  "alias",
+			flags: []string{"--reset", "--except=masquerade"},
+			want:  func(p *ipn.Prefs) { p.NoSNAT = true },
+		},
+		{
+			name:    "not_a_setting",
+			flags:   []string{"--reset", "--except=auth-key"},
+			wantErr: "--auth-key in --except isn't a setting that --reset changes",
+		},
+		{
+			name:    "unknown_flag",
+			flags:   []string{"--reset", "--except=hostname,bogus"},
+			wantErr: `unknown flag "bogus" in --except`,
+		},
+		{
+			name:    "not_on_this_os",
+			flags:   []string{"--reset", "--except=unattended"},
+			wantErr: `unknown flag "unattended" in --except`,
+		},
+		{
+			name:    "without_reset",
+			flags:   []string{"--except=hostname"},
+			wantErr: "--except can only be used with --reset",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := upCheckEnv{goos: "linux", backendState: "Running"}
+			env.flagSet = newUpFlagSet(env.goos, &env.upArgs)
+			if err := env.flagSet.Parse(CleanUpArgs(tt.flags)); err != nil {
+				t.Fatal(err)
+			}
+			prefs, err := prefsFromUpArgs(env.upArgs, t.Logf, new(ipnstate.Status), env.goos)
+			if err == nil {
+				_, _, err = updatePrefs(prefs, curPrefs.Clone(), env)
+			}
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// What the same flags without --except would give,
+			// plus the settings kept.
+			var noExcept upCheckEnv
+			fs := newUpFlagSet("linux", &noExcept.upArgs)
+			fs.Parse(CleanUpArgs(tt.flags))
+			noExcept.upArgs.except = ""
+			want, err := prefsFromUpArgs(noExcept.upArgs, t.Logf, new(ipnstate.Status), "linux")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want(want)
+			if !prefs.Equals(want) {
+				t.Errorf("prefs = %v; want %v", prefs.Pretty(), want.Pretty())
+			}
+		})
+	}
+}
+
+func TestProfileFlag(t *testing.T) {
+	var upArgs upArgsT
+	fs := newUpFlagSet("linux", &upArgs)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if upArgs.profileSet {
+		t.Fatal("profileSet without --profile")
+	}
+	f := fs.Lookup("profile")
+	for _, v := range []string{"work", "home-2_b", ""} {
+		if err := f.Value.Set(v); err != nil {
+			t.Errorf("--profile=%q: %v", v, err)
+		} else if upArgs.profile != v || !upArgs.profileSet {
+			t.Errorf("--profile=%q: got profile %q, set=%v", v, upArgs.profile, upArgs.profileSet)
+		}
+	}
+	for _, v := range []string{"Work", "a/b", strings.Repeat("a", 65)} {
+		if err := f.Value.Set(v); err == nil {
+			t.Errorf("--profile=%q: want error", v)
+		}
+	}
+}
+
 var cmpIP = cmp.Comparer(func(a, b netaddr.IP) bool {
 	return a == b
 })
@@ -954,3 +2221,1475 @@ func TestCleanUpArgs(t *testing.T) {
 		c.Assert(got, qt.DeepEquals, tt.want)
 	}
 }
+
+func TestExpandArgsFiles(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "up.flags")
+	if err := os.WriteFile(file, []byte("# fleet settings\n--hostname=foo  --accept-routes\n\n  # indented comment\n--advertise-tags\ttag:a,tag:b\n@not-expanded\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := expandArgsFiles([]string{"--reset", "@" + file, "--qr"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"--reset", "--hostname=foo", "--accept-routes", "--advertise-tags", "tag:a,tag:b", "@not-expanded", "--qr"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	got, err = expandArgsFiles([]string{"@-"}, strings.NewReader("--ssh\n--shields-up\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"--ssh", "--shields-up"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("from stdin, got %q; want %q", got, want)
+	}
+
+	if _, err := expandArgsFiles([]string{"@-"}, nil); err == nil {
+		t.Error("@- with no stdin succeeded")
+	}
+	if _, err := expandArgsFiles([]string{"@" + filepath.Join(dir, "missing")}, nil); err == nil {
+		t.Error("missing file succeeded")
+	}
+}
+
+func TestParseUpFlagsFiles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "up.flags")
+	if err := os.WriteFile(file, []byte("--hostname=foo\n--accept-routes\n--authkey=secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var upArgs upArgsT
+	fs := newUpFlagSet("linux", &upArgs)
+	fs.Parse([]string{"--shields-up", "@" + file, "--advertise-tags=tag:a"})
+	args, err := parseUpFlagsFiles(fs, fs.Args(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 0 {
+		t.Errorf("left over args %q", args)
+	}
+	if !upArgs.shieldsUp || upArgs.hostname != "foo" || !upArgs.acceptRoutes || upArgs.authKeyOrFile != "secret" || upArgs.advertiseTags != "tag:a" {
+		t.Errorf("flags not all parsed: %+v", upArgs)
+	}
+
+	// The file's flags are specified as far as the up checker is
+	// concerned, so changing those settings isn't an accidental revert.
+	curPrefs := &ipn.Prefs{
+		ControlURL:       ipn.DefaultControlURL,
+		AllowSingleHosts: true,
+		CorpDNS:          true,
+		NetfilterMode:    preftype.NetfilterOn,
+		Hostname:         "bar",
+	}
+	newPrefs, err := prefsFromUpArgs(upArgs, t.Logf, new(ipnstate.Status), "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkForAccidentalSettingReverts(newPrefs, curPrefs, upCheckEnv{goos: "linux", flagSet: fs}); err != nil {
+		t.Errorf("up checker: %v", err)
+	}
+
+	// Without an @flagsfile, args are left alone.
+	if args, err := parseUpFlagsFiles(fs, []string{"extra"}, nil); err != nil || !reflect.DeepEqual(args, []string{"extra"}) {
+		t.Errorf("parseUpFlagsFiles(extra) = %q, %v", args, err)
+	}
+}
+
+func TestExpandUpRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		goos    string // empty means linux
+		flags   []string
+		want    upArgsT // only the fields a preset may change are compared
+		wantErr string
+	}{
+		{
+			name:  "no_role",
+			flags: []string{},
+			want:  upArgsT{acceptDNS: true, snat: true},
+		},
+		{
+			name:  "client",
+			flags: []string{"--role=client"},
+			want:  upArgsT{acceptRoutes: true, acceptDNS: true, snat: true},
+		},
+		{
+			name:  "exit_node",
+			flags: []string{"--role=exit-node"},
+			want:  upArgsT{advertiseDefaultRoute: true, snat: true},
+		},
+		{
+			name:  "exit_node_explicit_override",
+			flags: []string{"--role=exit-node", "--accept-dns"},
+			want:  upArgsT{advertiseDefaultRoute: true, acceptDNS: true, snat: true},
+		},
+		{
+			name:  "subnet_router",
+			flags: []string{"--role=subnet-router", "--advertise-routes=10.0.0.0/8"},
+			want:  upArgsT{advertiseRoutes: "10.0.0.0/8", snat: true},
+		},
+		{
+			name:  "gateway_windows",
+			goos:  "windows",
+			flags: []string{"--role=gateway", "--advertise-routes=10.0.0.0/8"},
+			want:  upArgsT{advertiseRoutes: "10.0.0.0/8", advertiseDefaultRoute: true, acceptRoutes: true},
+		},
+		{
+			name:    "subnet_router_without_routes",
+			flags:   []string{"--role=subnet-router"},
+			wantErr: "--role=subnet-router requires --advertise-routes",
+		},
+		{
+			name:    "subnet_router_clearing_routes",
+			flags:   []string{"--role=subnet-router", "--advertise-routes=-"},
+			wantErr: "--role=subnet-router requires --advertise-routes",
+		},
+		{
+			name:    "unknown_role",
+			flags:   []string{"--role=bogus"},
+			wantErr: `invalid value --role="bogus"; must be one of client, subnet-router, exit-node, gateway`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			goos := tt.goos
+			if goos == "" {
+				goos = "linux"
+			}
+			var args upArgsT
+			fs := newUpFlagSet(goos, &args)
+			if err := fs.Parse(tt.flags); err != nil {
+				t.Fatal(err)
+			}
+			err := expandUpRole(fs, &args)
+			if tt.wantErr != "" {
+				if got := fmt.Sprint(err); got != tt.wantErr {
+					t.Fatalf("wrong error.\n got error: %v\nwant error: %v\n", got, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := upArgsT{
+				acceptRoutes:          args.acceptRoutes,
+				acceptDNS:             args.acceptDNS,
+				advertiseRoutes:       args.advertiseRoutes,
+				advertiseDefaultRoute: args.advertiseDefaultRoute,
+				snat:                  args.snat,
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectCaptivePortal(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    bool
+	}{
+		{
+			name: "no_portal",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/key" {
+					http.NotFound(w, r)
+					return
+				}
+				io.WriteString(w, `{"legacyPublicKey":"mkey:0000","publicKey":"mkey:0000"}`)
+			},
+			want: false,
+		},
+		{
+			name: "redirect",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "http://portal.example/login", http.StatusFound)
+			},
+			want: true,
+		},
+		{
+			name: "login_page",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "<html>Welcome to Airport Wi-Fi</html>")
+			},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(tt.handler)
+			defer ts.Close()
+			if got := detectCaptivePortal(context.Background(), ts.URL+"/"); got != tt.want {
+				t.Errorf("detectCaptivePortal = %v; want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("untrusted_cert", func(t *testing.T) {
+		// The client doesn't trust httptest's certificate, as it
+		// wouldn't trust a portal's.
+		ts := httptest.NewTLSServer(http.NotFoundHandler())
+		defer ts.Close()
+		ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+		if !detectCaptivePortal(context.Background(), ts.URL) {
+			t.Error("detectCaptivePortal = false for an untrusted certificate; want true")
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		ts := httptest.NewServer(http.NotFoundHandler())
+		ts.Close()
+		if detectCaptivePortal(context.Background(), ts.URL) {
+			t.Error("detectCaptivePortal = true for unreachable URL; want false")
+		}
+	})
+}
+
+func TestMintOAuthAuthKey(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "client_credentials" || r.FormValue("client_id") != "id" || r.FormValue("client_secret") != "secret" {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, `{"access_token":"tok","token_type":"Bearer","expires_in":3600}`)
+	})
+	mux.HandleFunc("/api/v2/tailnet/-/keys", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Capabilities struct {
+				Devices struct {
+					Create struct {
+						Reusable      bool
+						Ephemeral     bool
+						Preauthorized bool
+						Tags          []string
+					}
+				}
+			}
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c := req.Capabilities.Devices.Create
+		if c.Reusable || !c.Ephemeral || !c.Preauthorized || !reflect.DeepEqual(c.Tags, []string{"tag:foo"}) {
+			http.Error(w, fmt.Sprintf("unexpected key capabilities %+v", c), http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, `{"id":"k123","key":"tskey-minted"}`)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	key, err := mintOAuthAuthKey(context.Background(), ts.URL+"/", "id", "secret", []string{"tag:foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "tskey-minted" {
+		t.Errorf("key = %q; want %q", key, "tskey-minted")
+	}
+
+	_, err = mintOAuthAuthKey(context.Background(), ts.URL, "id", "wrong", []string{"tag:foo"})
+	if err == nil || !strings.Contains(err.Error(), "getting OAuth access token") {
+		t.Errorf("with bad secret, got error %v; want OAuth access token error", err)
+	}
+}
+
+func TestFindPeer(t *testing.T) {
+	gw := &ipnstate.PeerStatus{
+		HostName:     "Gateway",
+		DNSName:      "gateway.example.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+	}
+	web1 := &ipnstate.PeerStatus{
+		HostName:     "web",
+		DNSName:      "web.example.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.3")},
+	}
+	web2 := &ipnstate.PeerStatus{
+		HostName:     "web",
+		DNSName:      "web-1.example.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.4")},
+	}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): gw,
+			key.NewNode().Public(): web1,
+			key.NewNode().Public(): web2,
+		},
+	}
+	tests := []struct {
+		name    string
+		want    *ipnstate.PeerStatus
+		wantErr string
+	}{
+		{name: "gateway", want: gw},
+		{name: "GATEWAY", want: gw},
+		{name: "gateway.example.ts.net", want: gw},
+		{name: "gateway.example.ts.net.", want: gw},
+		{name: "100.64.0.2", want: gw},
+		{name: "web-1", want: web2},
+		{name: "web.example.ts.net", want: web1},
+		{name: "web", wantErr: `peer name "web" is ambiguous; use its MagicDNS name or Tailscale IP`},
+		{name: "nope", wantErr: `no peer named "nope"`},
+		{name: "100.64.0.9", wantErr: "no peer with Tailscale IP 100.64.0.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := findPeer(st, tt.name)
+			if tt.wantErr != "" {
+				if fmt.Sprint(err) != tt.wantErr {
+					t.Fatalf("got error %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got peer %q; want %q", got.DNSName, tt.want.DNSName)
+			}
+		})
+	}
+}
+
+func TestPickExitNode(t *testing.T) {
+	exitNode := func(name, ip string, online bool) *ipnstate.PeerStatus {
+		return &ipnstate.PeerStatus{
+			DNSName:        name + ".example.ts.net.",
+			TailscaleIPs:   []netaddr.IP{netaddr.MustParseIP(ip)},
+			Online:         online,
+			ExitNodeOption: true,
+		}
+	}
+	near := exitNode("near", "100.64.0.2", true)
+	far := exitNode("far", "100.64.0.3", true)
+	silent := exitNode("silent", "100.64.0.4", true)
+	offline := exitNode("offline", "100.64.0.5", false)
+	plain := &ipnstate.PeerStatus{
+		DNSName:      "plain.example.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.6")},
+		Online:       true,
+	}
+	latencies := map[string]time.Duration{
+		"100.64.0.2": 20 * time.Millisecond,
+		"100.64.0.3": 90 * time.Millisecond,
+		"100.64.0.5": time.Millisecond, // offline; never pinged
+		"100.64.0.6": time.Millisecond, // not an exit node; never pinged
+	}
+	latency := func(ip netaddr.IP) (time.Duration, bool) {
+		d, ok := latencies[ip.String()]
+		return d, ok
+	}
+	status := func(peers ...*ipnstate.PeerStatus) *ipnstate.Status {
+		st := &ipnstate.Status{Peer: map[key.NodePublic]*ipnstate.PeerStatus{}}
+		for _, ps := range peers {
+			st.Peer[key.NewNode().Public()] = ps
+		}
+		return st
+	}
+
+	tests := []struct {
+		name        string
+		st          *ipnstate.Status
+		want        *ipnstate.PeerStatus
+		wantLatency time.Duration
+		wantErr     string
+	}{
+		{
+			name:        "lowest_latency",
+			st:          status(far, near, silent, offline, plain),
+			want:        near,
+			wantLatency: 20 * time.Millisecond,
+		},
+		{
+			name:        "skips_unanswered",
+			st:          status(far, silent),
+			want:        far,
+			wantLatency: 90 * time.Millisecond,
+		},
+		{
+			name:    "none_answered",
+			st:      status(silent),
+			wantErr: "--exit-node=auto: none of the exit nodes answered a ping: silent.example.ts.net (100.64.0.4)",
+		},
+		{
+			name:    "no_exit_nodes",
+			st:      status(offline, plain),
+			wantErr: "--exit-node=auto: no online peers are offering to be an exit node",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotLatency, err := pickExitNode(tt.st, latency)
+			if tt.wantErr != "" {
+				if fmt.Sprint(err) != tt.wantErr {
+					t.Fatalf("got error %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || gotLatency != tt.wantLatency {
+				t.Errorf("got %v, %v; want %v, %v", got.DNSName, gotLatency, tt.want.DNSName, tt.wantLatency)
+			}
+		})
+	}
+}
+
+func TestIsTransientUpError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"deadline", fmt.Errorf("waiting: %w", context.DeadlineExceeded), true},
+		{"conn_refused", &url.Error{Op: "Get", URL: "https://controlplane.example.com/key", Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, true},
+		{"net_unreachable", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, true},
+		{"dns_timeout", &net.DNSError{Err: "i/o timeout", Name: "controlplane.example.com", IsTimeout: true}, true},
+		{"canceled", context.Canceled, false},
+		{"rejected", errors.New("invalid key: unable to validate API key"), false},
+	}
+	for _, tt := range tests {
+		if got := isTransientUpError(tt.err); got != tt.want {
+			t.Errorf("%s: isTransientUpError(%v) = %v; want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryUp(t *testing.T) {
+	oldStderr := Stderr
+	defer func() { Stderr = oldStderr }()
+	Stderr = io.Discard
+
+	transient := fmt.Errorf("fetching key: %w", syscall.ECONNREFUSED)
+	permanent := errors.New("invalid key")
+	tests := []struct {
+		name      string
+		retries   int
+		errs      []error // returned by successive attempts; nil after they run out
+		wantErr   error
+		wantCalls int
+	}{
+		{"success", 3, nil, nil, 1},
+		{"no_retry", 0, []error{transient}, transient, 1},
+		{"recovers", 3, []error{transient, transient}, nil, 3},
+		{"gives_up", 2, []error{transient, transient, transient, transient}, transient, 3},
+		{"permanent", 3, []error{transient, permanent, transient}, permanent, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retryUp(context.Background(), tt.retries, time.Millisecond, func(context.Context) error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("err = %v; want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("run called %d times; want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRunUpRetryingCopiesArgs(t *testing.T) {
+	oldStderr, oldArgs, oldAttempt, oldBackoff := Stderr, upArgs, runUpAttempt, upRetryBackoff
+	defer func() {
+		Stderr, upArgs, runUpAttempt, upRetryBackoff = oldStderr, oldArgs, oldAttempt, oldBackoff
+	}()
+	Stderr = io.Discard
+	upRetryBackoff = time.Millisecond
+
+	upArgs = upArgsT{retry: 2, exitNodeIP: "auto", hostname: "auto-unique"}
+	var seen []string
+	runUpAttempt = func(context.Context, []string) error {
+		seen = append(seen, upArgs.exitNodeIP+" "+upArgs.hostname)
+		// As runUp does when it resolves them.
+		upArgs.exitNodeIP = "gateway.example.ts.net"
+		upArgs.hostname = fmt.Sprintf("host-%d", len(seen))
+		return fmt.Errorf("fetching key: %w", syscall.ECONNREFUSED)
+	}
+	if err := runUpRetrying(context.Background(), nil); err == nil {
+		t.Fatal("runUpRetrying succeeded; want the last attempt's error")
+	}
+	want := []string{"auto auto-unique", "auto auto-unique", "auto auto-unique"}
+	if !reflect.DeepEqual(seen, want) {
+		t.Errorf("attempts saw %q; want %q", seen, want)
+	}
+}
+
+func TestPollForPeer(t *testing.T) {
+	gwIP := netaddr.MustParseIP("100.64.0.2")
+	statusAfter := func(polls int, reachableAfter int) func(context.Context) (*ipnstate.Status, error) {
+		n := 0
+		return func(context.Context) (*ipnstate.Status, error) {
+			n++
+			st := &ipnstate.Status{Peer: map[key.NodePublic]*ipnstate.PeerStatus{}}
+			if n < polls {
+				return st, nil // peer not in netmap yet
+			}
+			ps := &ipnstate.PeerStatus{HostName: "gateway", TailscaleIPs: []netaddr.IP{gwIP}}
+			if reachableAfter > 0 && n >= reachableAfter {
+				ps.CurAddr = "192.168.0.2:41641"
+			}
+			st.Peer[key.NewNode().Public()] = ps
+			return st, nil
+		}
+	}
+	noPong := func(netaddr.IP) bool { return false }
+
+	t.Run("becomes_reachable", func(t *testing.T) {
+		err := pollForPeer(context.Background(), "gateway", statusAfter(2, 4), noPong, time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("pong", func(t *testing.T) {
+		var pinged netaddr.IP
+		pong := func(ip netaddr.IP) bool {
+			pinged = ip
+			return true
+		}
+		if err := pollForPeer(context.Background(), "gateway", statusAfter(1, 0), pong, time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if pinged != gwIP {
+			t.Errorf("pinged %v; want %v", pinged, gwIP)
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		err := pollForPeer(ctx, "gateway", statusAfter(1000, 0), noPong, time.Millisecond)
+		if err == nil || !strings.Contains(err.Error(), `no peer named "gateway"`) {
+			t.Fatalf("got error %v; want timeout mentioning missing peer", err)
+		}
+	})
+}
+
+func TestWarnCollector(t *testing.T) {
+	var printed []string
+	wc := &warnCollector{logf: func(format string, args ...any) {
+		printed = append(printed, fmt.Sprintf(format, args...))
+	}}
+
+	args := upArgsFromOSArgs("linux")
+	if _, err := prefsFromUpArgs(args, wc.warnf, new(ipnstate.Status), "linux"); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.err(); err != nil {
+		t.Fatalf("err = %v with no warnings; want nil", err)
+	}
+
+	args = upArgsFromOSArgs("linux", "--netfilter-mode=nodivert")
+	if _, err := prefsFromUpArgs(args, wc.warnf, new(ipnstate.Status), "linux"); err != nil {
+		t.Fatal(err)
+	}
+	wc.warnf("IP forwarding is disabled")
+	if len(printed) != 2 {
+		t.Errorf("printed %q; want each warning printed as it happens", printed)
+	}
+	const want = "--strict: 2 warning(s):\n" +
+		"\tnetfilter=nodivert; add iptables calls to ts-* chains manually.\n" +
+		"\tIP forwarding is disabled"
+	if err := wc.err(); err == nil || err.Error() != want {
+		t.Errorf("err = %v; want %q", err, want)
+	}
+}
+
+func TestKeepSuspendedExitNode(t *testing.T) {
+	curPrefs := &ipn.Prefs{
+		ExitNodeID:             "StableExit",
+		ExitNodeAllowLANAccess: true,
+	}
+	tests := []struct {
+		name  string
+		flags []string
+		want  *ipn.Prefs
+	}{
+		{
+			name:  "keeps_current",
+			flags: []string{"--no-exit-node-this-session"},
+			want: &ipn.Prefs{
+				ExitNodeID:             "StableExit",
+				ExitNodeAllowLANAccess: true,
+			},
+		},
+		{
+			name:  "explicit_flags_win",
+			flags: []string{"--no-exit-node-this-session", "--exit-node=100.64.0.5", "--exit-node-allow-lan-access=false"},
+			want: &ipn.Prefs{
+				ExitNodeIP: netaddr.MustParseIP("100.64.0.5"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args upArgsT
+			fs := newUpFlagSet("linux", &args)
+			if err := fs.Parse(tt.flags); err != nil {
+				t.Fatal(err)
+			}
+			prefs, err := prefsFromUpArgs(args, t.Logf, new(ipnstate.Status), "linux")
+			if err != nil {
+				t.Fatal(err)
+			}
+			keepSuspendedExitNode(prefs, curPrefs, fs)
+			got := &ipn.Prefs{
+				ExitNodeID:             prefs.ExitNodeID,
+				ExitNodeIP:             prefs.ExitNodeIP,
+				ExitNodeAllowLANAccess: prefs.ExitNodeAllowLANAccess,
+			}
+			if !got.Equals(tt.want) {
+				t.Errorf("got %v; want %v", got.Pretty(), tt.want.Pretty())
+			}
+		})
+	}
+}
+
+func TestPrintUpDryRun(t *testing.T) {
+	oldStdout := Stdout
+	defer func() { Stdout = oldStdout }()
+
+	cur := &ipn.Prefs{
+		ControlURL:       ipn.DefaultControlURL,
+		AllowSingleHosts: true,
+		CorpDNS:          true,
+		NetfilterMode:    preftype.NetfilterOn,
+		Hostname:         "a",
+	}
+	changed := cur.Clone()
+	changed.RouteAll = true
+	changed.Hostname = "b"
+	changed.WantRunning = true
+
+	tests := []struct {
+		name     string
+		newPrefs *ipn.Prefs
+		want     string
+	}{
+		{
+			name:     "changes",
+			newPrefs: changed,
+			want: "Dry run; tailscale up would change:\n" +
+				"\t--accept-routes: false -> true\n" +
+				"\t--hostname: \"a\" -> \"b\"\n" +
+				"\tWantRunning: false -> true\n",
+		},
+		{
+			name:     "no_changes",
+			newPrefs: cur.Clone(),
+			want:     "Dry run; tailscale up would change nothing.\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			Stdout = &buf
+			printUpDryRun(upCheckEnv{goos: "linux"}, cur, tt.newPrefs)
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintUpDryRunExitNodeByName(t *testing.T) {
+	oldStdout := Stdout
+	defer func() { Stdout = oldStdout }()
+
+	st := &ipnstate.Status{
+		BackendState: "Running",
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				ID:             "nA",
+				HostName:       "exit-a",
+				DNSName:        "exit-a.example.ts.net.",
+				TailscaleIPs:   []netaddr.IP{netaddr.MustParseIP("100.64.0.10")},
+				ExitNodeOption: true,
+			},
+			key.NewNode().Public(): {
+				ID:             "nB",
+				HostName:       "exit-b",
+				DNSName:        "exit-b.example.ts.net.",
+				TailscaleIPs:   []netaddr.IP{netaddr.MustParseIP("100.64.0.11")},
+				ExitNodeOption: true,
+			},
+		},
+	}
+	cur := &ipn.Prefs{
+		ControlURL:       ipn.DefaultControlURL,
+		AllowSingleHosts: true,
+		CorpDNS:          true,
+		NetfilterMode:    preftype.NetfilterOn,
+		WantRunning:      true,
+		ExitNodeID:       "nA",
+	}
+	var upArgs upArgsT
+	fs := newUpFlagSet("linux", &upArgs)
+	fs.Parse([]string{"--exit-node=exit-b"})
+	newPrefs, err := prefsFromUpArgs(upArgs, t.Logf, st, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newPrefs.ExitNodeID != "nB" {
+		t.Fatalf("ExitNodeID = %q; want nB", newPrefs.ExitNodeID)
+	}
+	newPrefs.ControlURL = cur.ControlURL
+
+	var buf bytes.Buffer
+	Stdout = &buf
+	printUpDryRun(upCheckEnv{
+		goos:          "linux",
+		flagSet:       fs,
+		curExitNodeIP: exitNodeIP(cur, st),
+		st:            st,
+	}, cur, newPrefs)
+	want := "Dry run; tailscale up would change:\n" +
+		"\t--exit-node: \"100.64.0.10\" -> \"100.64.0.11\"\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPrintPrefsJSON(t *testing.T) {
+	oldStdout := Stdout
+	defer func() { Stdout = oldStdout }()
+
+	var buf bytes.Buffer
+	Stdout = &buf
+	args := upArgsFromOSArgs("linux", "--json-prefs", "--hostname=foo", "--advertise-routes=10.0.0.0/24", "--shields-up")
+	if err := printPrefsJSON(args, t.Logf, "linux"); err != nil {
+		t.Fatal(err)
+	}
+	var got ipn.Prefs
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("output isn't JSON prefs: %v\n%s", err, buf.Bytes())
+	}
+	want, err := prefsFromUpArgs(args, t.Logf, new(ipnstate.Status), "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equals(want) {
+		t.Errorf("got %v; want %v", got.Pretty(), want.Pretty())
+	}
+	if got.Hostname != "foo" || !got.ShieldsUp || len(got.AdvertiseRoutes) != 1 {
+		t.Errorf("flags not reflected in prefs: %v", got.Pretty())
+	}
+
+	for _, flagArgs := range [][]string{
+		{"--json-prefs", "--dry-run"},
+		{"--json-prefs", "--exit-node=auto"},
+		{"--json-prefs", "--exit-node=some-peer"},
+	} {
+		buf.Reset()
+		if err := printPrefsJSON(upArgsFromOSArgs("linux", flagArgs...), t.Logf, "linux"); err == nil {
+			t.Errorf("%q: succeeded; want error", flagArgs)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%q: printed %q on error", flagArgs, buf.Bytes())
+		}
+	}
+}
+
+func TestPrintResetReverts(t *testing.T) {
+	oldStderr := Stderr
+	defer func() { Stderr = oldStderr }()
+
+	cur := &ipn.Prefs{
+		ControlURL:       ipn.DefaultControlURL,
+		AllowSingleHosts: true,
+		CorpDNS:          true,
+		NetfilterMode:    preftype.NetfilterOn,
+		Hostname:         "a",
+		RouteAll:         true,
+		ShieldsUp:        true,
+	}
+	tests := []struct {
+		name  string
+		flags []string
+		want  string
+	}{
+		{
+			name:  "reverts",
+			flags: []string{"--reset", "--hostname=b"},
+			want: "--reset will revert these settings to their defaults:\n" +
+				"\t--accept-routes: true -> false\n" +
+				"\t--shields-up: true -> false\n",
+		},
+		{
+			name:  "all_given",
+			flags: []string{"--reset", "--hostname=b", "--accept-routes", "--shields-up"},
+			want:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upArgs upArgsT
+			flagSet := newUpFlagSet("linux", &upArgs)
+			flagSet.Parse(tt.flags)
+			newPrefs, err := prefsFromUpArgs(upArgs, t.Logf, new(ipnstate.Status), "linux")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			Stderr = &buf
+			reverted := printResetReverts(upCheckEnv{goos: "linux", flagSet: flagSet}, cur, newPrefs)
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+			if reverted != (tt.want != "") {
+				t.Errorf("printResetReverts = %v; want %v", reverted, tt.want != "")
+			}
+		})
+	}
+}
+
+func TestUpJSONVersion(t *testing.T) {
+	oldStdout := Stdout
+	defer func() { Stdout = oldStdout }()
+
+	modes := map[string]func(){
+		"auth_url": func() {
+			printUpJSON(upAuthURLJSON("https://login.example.com/a/0123456789", "NeedsLogin"))
+		},
+		"running": func() {
+			printUpDoneJSON(ipn.Running, "")
+		},
+		"error": func() {
+			printUpDoneJSON(ipn.NeedsLogin, "some error")
+		},
+	}
+	for name, print := range modes {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			Stdout = &buf
+			print()
+			var doc map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+				t.Fatalf("output isn't a JSON object: %v\n%s", err, buf.Bytes())
+			}
+			if got, want := doc["version"], float64(upJSONVersion); got != want {
+				t.Errorf("version = %v; want %v in %s", got, want, buf.Bytes())
+			}
+		})
+	}
+}
+
+func TestAdvertiseRoutesFile(t *testing.T) {
+	dir := t.TempDir()
+	prefsFromFile := func(file string) (*ipn.Prefs, error) {
+		args := upArgsFromOSArgs("linux", "--advertise-routes=@"+file)
+		if err := resolveUpArgsOnHost(&args, t.Logf, "linux"); err != nil {
+			return nil, err
+		}
+		return prefsFromUpArgs(args, t.Logf, new(ipnstate.Status), "linux")
+	}
+	tests := []struct {
+		name    string
+		content string
+		want    []netaddr.IPPrefix
+		wantErr string
+	}{
+		{
+			name: "routes",
+			content: "# office\n" +
+				"10.0.0.0/8\n" +
+				"\n" +
+				"  192.168.0.0/24  # lab\n",
+			want: []netaddr.IPPrefix{
+				netaddr.MustParseIPPrefix("10.0.0.0/8"),
+				netaddr.MustParseIPPrefix("192.168.0.0/24"),
+			},
+		},
+		{
+			name:    "bad_line",
+			content: "10.0.0.0/8\n\nnot-a-route\n",
+			wantErr: `bad_line:3: "not-a-route" is not a valid IP address or CIDR prefix`,
+		},
+		{
+			name:    "masked_bits",
+			content: "10.0.0.1/8\n",
+			wantErr: "masked_bits:1: 10.0.0.1/8 has non-address bits set; expected 10.0.0.0/8",
+		},
+		{
+			name:    "default_route_pair",
+			content: "0.0.0.0/0\n",
+			wantErr: "0.0.0.0/0 advertised without its IPv6 counterpart, please also advertise ::/0",
+		},
+		{
+			name:    "empty",
+			content: "# nothing yet\n",
+			want:    []netaddr.IPPrefix{},
+		},
+		{
+			name:    "comment_with_comma",
+			content: "10.0.0.0/8 # office, floor 2\n",
+			wantErr: "comment_with_comma:1: route comments can't contain commas",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			prefs, err := prefsFromFile(file)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasSuffix(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v; want one ending in %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(prefs.AdvertiseRoutes, tt.want) {
+				t.Errorf("AdvertiseRoutes = %v; want %v", prefs.AdvertiseRoutes, tt.want)
+			}
+		})
+	}
+
+	// The same routes and comments inline and from a file give the
+	// same prefs.
+	file := filepath.Join(dir, "same_as_inline")
+	if err := os.WriteFile(file, []byte("# site A\n10.0.0.0/8 # office\n192.168.0.0/24#lab\nfd00:1::/64\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	inline, err := prefsFromUpArgs(upArgsFromOSArgs("linux", "--advertise-routes=10.0.0.0/8#office,192.168.0.0/24#lab,fd00:1::/64"), t.Logf, new(ipnstate.Status), "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromFile, err := prefsFromFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inline.AdvertiseRouteComments) != 2 {
+		t.Errorf("inline AdvertiseRouteComments = %v; want 2", inline.AdvertiseRouteComments)
+	}
+	if !reflect.DeepEqual(fromFile, inline) {
+		t.Errorf("prefs from file = %v (comments %v); want %v (comments %v) as given inline", fromFile.Pretty(), fromFile.AdvertiseRouteComments, inline.Pretty(), inline.AdvertiseRouteComments)
+	}
+
+	if _, err := prefsFromFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("no error for missing routes file")
+	}
+}
+
+func TestReadSecretOrFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "authkey")
+	if err := os.WriteFile(file, []byte("  tskey-from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TS_TEST_AUTHKEY", "tskey-from-env\n")
+	t.Setenv("TS_TEST_EMPTY", "")
+
+	tests := []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{in: "", want: ""},
+		{in: "tskey-literal", want: "tskey-literal"},
+		{in: "file:" + file, want: "tskey-from-file"},
+		{in: "env:TS_TEST_AUTHKEY", want: "tskey-from-env"},
+		{in: "env:TS_TEST_EMPTY", wantErr: `environment variable "TS_TEST_EMPTY" named by "env:TS_TEST_EMPTY" is empty or not set`},
+		{in: "env:TS_TEST_UNSET_AUTHKEY", wantErr: `environment variable "TS_TEST_UNSET_AUTHKEY" named by "env:TS_TEST_UNSET_AUTHKEY" is empty or not set`},
+		{in: "file:" + file + ".missing", wantErr: "no such file or directory"},
+	}
+	for _, tt := range tests {
+		got, err := readSecretOrFile(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("readSecretOrFile(%q) = %q, %v; want error containing %q", tt.in, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("readSecretOrFile(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestRiskChecker(t *testing.T) {
+	if _, err := newRiskChecker("netfilter-off,bogus", t.Logf, t.Logf); err == nil {
+		t.Error("newRiskChecker accepted an unknown risk")
+	}
+
+	var logged, accepted []string
+	rc, err := newRiskChecker(" netfilter-off ,,", func(format string, args ...any) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}, func(format string, args ...any) {
+		accepted = append(accepted, fmt.Sprintf(format, args...))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upArgs := upArgsFromOSArgs("linux", "--netfilter-mode=off")
+	if _, err := prefsFromUpArgs(upArgs, rc.warnf, nil, "linux"); err != nil {
+		t.Fatal(err)
+	}
+	rc.warnf("not a risk: %d", 42)
+	if want := []string{"netfilter=off; configure iptables yourself. (accepted with --accept-risk=netfilter-off)"}; !reflect.DeepEqual(accepted, want) {
+		t.Errorf("accepted = %q; want %q", accepted, want)
+	}
+	if want := []string{"not a risk: 42"}; !reflect.DeepEqual(logged, want) {
+		t.Errorf("logged = %q; want %q", logged, want)
+	}
+	if err := rc.err(); err != nil {
+		t.Errorf("err = %v; want nil", err)
+	}
+
+	warnRisk(rc.warnf, riskIPForwarding, "IP forwarding is disabled")
+	const wantErr = "1 risk(s) not accepted with --accept-risk:\n\tIP forwarding is disabled (to go ahead anyway, add ip-forwarding to --accept-risk)"
+	if err := rc.err(); err == nil || err.Error() != wantErr {
+		t.Errorf("err = %v; want %q", err, wantErr)
+	}
+	if len(logged) != 1 {
+		t.Errorf("unaccepted risk was also logged: %q", logged)
+	}
+}
+
+func TestSSHOverTailscale(t *testing.T) {
+	self := &ipnstate.PeerStatus{
+		TailscaleIPs: []netaddr.IP{
+			netaddr.MustParseIP("100.64.0.1"),
+			netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+		},
+	}
+	tests := []struct {
+		sshConn string
+		self    *ipnstate.PeerStatus
+		want    bool
+	}{
+		{"100.64.0.2 50000 100.64.0.1 22", self, true},
+		{"fd7a:115c:a1e0::2 50000 fd7a:115c:a1e0::1 22", self, true},
+		{"192.168.1.2 50000 192.168.1.10 22", self, false},
+		{"100.64.0.2 50000 100.64.0.1 22", nil, false},
+		{"", self, false},
+		{"garbage", self, false},
+	}
+	for _, tt := range tests {
+		if got := sshOverTailscale(tt.sshConn, tt.self); got != tt.want {
+			t.Errorf("sshOverTailscale(%q) = %v; want %v", tt.sshConn, got, tt.want)
+		}
+	}
+}
+
+func TestUpInterruptedError(t *testing.T) {
+	var err error = fmt.Errorf("up: %w", upInterruptedError{state: "NeedsLogin"})
+	const want = `up: interrupted; tailscaled was left in state NeedsLogin (run "tailscale up" again to continue, or "tailscale down" to stop)`
+	if err.Error() != want {
+		t.Errorf("Error = %q; want %q", err, want)
+	}
+	var ec interface{ ExitCode() int }
+	if !errors.As(err, &ec) {
+		t.Fatal("error has no ExitCode method")
+	}
+	if got := ec.ExitCode(); got != upInterruptedExitCode {
+		t.Errorf("ExitCode = %d; want %d", got, upInterruptedExitCode)
+	}
+}
+
+func TestUpExitError(t *testing.T) {
+	timeout := fmt.Errorf("timed out waiting for tailscale up; last state was Starting: %w", context.DeadlineExceeded)
+	var err error = upExitError{code: upExitTimeout, err: timeout}
+	if err.Error() != timeout.Error() {
+		t.Errorf("Error = %q; want %q", err, timeout)
+	}
+	if !isTransientUpError(err) {
+		t.Error("timeout isn't transient; want --retry to retry it")
+	}
+	var ec interface{ ExitCode() int }
+	if !errors.As(fmt.Errorf("up: %w", err), &ec) {
+		t.Fatal("wrapped error has no ExitCode method")
+	}
+	if got := ec.ExitCode(); got != upExitTimeout {
+		t.Errorf("ExitCode = %d; want %d", got, upExitTimeout)
+	}
+	if got := upUsageError(errors.New("bad flag")).(upExitError).ExitCode(); got != upExitUsage {
+		t.Errorf("usage ExitCode = %d; want %d", got, upExitUsage)
+	}
+}
+
+func TestUpTimeoutExitCode(t *testing.T) {
+	tests := []struct {
+		state       string
+		timeoutCode int
+		want        int
+	}{
+		{"NoState", upExitTimeout, upExitTimeout},
+		{"Starting", upExitTimeout, upExitTimeout},
+		{"Starting", 75, 75},
+		{"NeedsLogin", upExitTimeout, upExitAuthRequired},
+		{"NeedsLogin", 75, upExitAuthRequired},
+		{"NeedsMachineAuth", 75, upExitAuthRequired},
+	}
+	for _, tt := range tests {
+		if got := upTimeoutExitCode(tt.state, tt.timeoutCode); got != tt.want {
+			t.Errorf("upTimeoutExitCode(%q, %d) = %d; want %d", tt.state, tt.timeoutCode, got, tt.want)
+		}
+	}
+}
+
+func TestForceReauthNeedsConfirm(t *testing.T) {
+	running := ipn.Running.String()
+	tests := []struct {
+		name   string
+		upArgs upArgsT
+		state  string
+		want   bool
+	}{
+		{"running", upArgsT{forceReauth: true}, running, true},
+		{"no_force_reauth", upArgsT{}, running, false},
+		{"yes", upArgsT{forceReauth: true, yes: true}, running, false},
+		{"auth_key", upArgsT{forceReauth: true, authKeyOrFile: "tskey-foo"}, running, false},
+		{"oauth", upArgsT{forceReauth: true, oauthClientID: "k123"}, running, false},
+		{"stopped", upArgsT{forceReauth: true}, ipn.Stopped.String(), false},
+		{"needs_login", upArgsT{forceReauth: true}, ipn.NeedsLogin.String(), false},
+	}
+	for _, tt := range tests {
+		if got := forceReauthNeedsConfirm(tt.upArgs, tt.state); got != tt.want {
+			t.Errorf("%s: forceReauthNeedsConfirm = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOperatorExists(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("no current user: %v", err)
+	}
+	if ok, err := operatorExists(u.Username); !ok || err != nil {
+		t.Errorf("operatorExists(%q) = %v, %v; want true", u.Username, ok, err)
+	}
+	const bogus = "no-such-user-ts-operator"
+	if ok, err := operatorExists(bogus); ok || err != nil {
+		t.Errorf("operatorExists(%q) = %v, %v; want false", bogus, ok, err)
+	}
+}
+
+func TestResolveUpArgsOnHost(t *testing.T) {
+	oldOperatorExists := operatorExists
+	operatorExists = func(name string) (bool, error) {
+		switch name {
+		case "alice":
+			return true, nil
+		case "ldap-down":
+			return false, errors.New("lookup failed")
+		}
+		return false, nil
+	}
+	defer func() { operatorExists = oldOperatorExists }()
+	oldNftablesAvailable := nftablesAvailable
+	nftablesAvailable = func() error { return errors.New("the nft command isn't installed") }
+	defer func() { nftablesAvailable = oldNftablesAvailable }()
+
+	tests := []struct {
+		name     string
+		goos     string // empty means "linux"
+		args     upArgsT
+		want     upArgsT
+		wantErr  string
+		wantWarn string
+	}{
+		{
+			name: "operator",
+			args: upArgsT{opUser: "alice"},
+			want: upArgsT{opUser: "alice"},
+		},
+		{
+			name:    "error_operator_unknown_user",
+			args:    upArgsT{opUser: "alcie"},
+			wantErr: "--operator=alcie isn't a user on this machine",
+		},
+		{
+			name:     "operator_lookup_failed",
+			args:     upArgsT{opUser: "ldap-down"},
+			want:     upArgsT{opUser: "ldap-down"},
+			wantWarn: "can't check that --operator=ldap-down is a user on this machine: lookup failed",
+		},
+		{
+			name: "operator_unchecked_without_peer_creds",
+			goos: "windows",
+			args: upArgsT{opUser: "alcie"},
+			want: upArgsT{opUser: "alcie"},
+		},
+		{
+			name:    "error_nftables_unavailable",
+			args:    upArgsT{netfilterMode: "on/nftables"},
+			wantErr: "--netfilter-mode=on/nftables isn't supported here: the nft command isn't installed",
+		},
+		{
+			name: "iptables_needs_no_check",
+			args: upArgsT{netfilterMode: "on"},
+			want: upArgsT{netfilterMode: "on"},
+		},
+		{
+			// Left for prefsFromUpArgs to reject.
+			name: "bogus_backend_unchecked",
+			args: upArgsT{netfilterMode: "on/ebtables"},
+			want: upArgsT{netfilterMode: "on/ebtables"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var warnBuf tstest.MemLogger
+			goos := tt.goos
+			if goos == "" {
+				goos = "linux"
+			}
+			args := tt.args
+			err := resolveUpArgsOnHost(&args, warnBuf.Logf, goos)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("error = %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(args, tt.want) {
+				t.Errorf("upArgs = %+v; want %+v", args, tt.want)
+			}
+			if gotWarn := strings.TrimSpace(warnBuf.String()); gotWarn != tt.wantWarn {
+				t.Errorf("warning = %q; want %q", gotWarn, tt.wantWarn)
+			}
+		})
+	}
+}
+
+func TestKernelHasNftables(t *testing.T) {
+	mkRoot := func(files map[string]string) string {
+		root := t.TempDir()
+		for name, content := range files {
+			path := filepath.Join(root, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return root
+	}
+	const release = "proc/sys/kernel/osrelease"
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  bool
+	}{
+		{"loaded", map[string]string{"sys/module/nf_tables/refcnt": "3"}, true},
+		{"builtin", map[string]string{
+			release:                              "5.15.0\n",
+			"lib/modules/5.15.0/modules.builtin": "kernel/net/netfilter/nf_tables.ko\n",
+		}, true},
+		{"module", map[string]string{
+			release:                          "5.15.0\n",
+			"lib/modules/5.15.0/modules.dep": "kernel/net/netfilter/nf_tables.ko.xz: kernel/net/netfilter/nfnetlink.ko.xz\n",
+		}, true},
+		{"missing", map[string]string{
+			release:                              "5.15.0\n",
+			"lib/modules/5.15.0/modules.builtin": "kernel/net/ipv4/ip_tables.ko\n",
+			"lib/modules/5.15.0/modules.dep":     "kernel/net/netfilter/x_tables.ko:\n",
+		}, false},
+		{"unknown", map[string]string{release: "5.15.0\n"}, true},
+	}
+	for _, tt := range tests {
+		if got := kernelHasNftables(mkRoot(tt.files)); got != tt.want {
+			t.Errorf("%s: kernelHasNftables = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEditUpPrefs(t *testing.T) {
+	oldGet, oldEdit := getPrefsETag, editPrefsIfMatch
+	defer func() { getPrefsETag, editPrefsIfMatch = oldGet, oldEdit }()
+
+	hostnameEdit := func(name string) *ipn.MaskedPrefs {
+		return &ipn.MaskedPrefs{Prefs: ipn.Prefs{Hostname: name}, HostnameSet: true}
+	}
+	tests := []struct {
+		name        string
+		conflicts   int  // how many edits another client sneaks in first
+		restart     bool // whether recompute finds a restart is needed
+		wantErr     string
+		wantEdits   int
+		wantRetried bool
+	}{
+		{name: "no_conflict", wantEdits: 1},
+		{name: "one_conflict", conflicts: 1, wantEdits: 2, wantRetried: true},
+		{name: "two_conflicts", conflicts: 2, wantErr: "changed by another client again", wantEdits: 2, wantRetried: true},
+		{name: "needs_restart", conflicts: 1, restart: true, wantErr: "need a restart", wantEdits: 1, wantRetried: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cur := ipn.NewPrefs()
+			conflicts := tt.conflicts
+			var edits int
+			getPrefsETag = func(context.Context) (*ipn.Prefs, string, error) {
+				return cur.Clone(), cur.ETag(), nil
+			}
+			editPrefsIfMatch = func(_ context.Context, mp *ipn.MaskedPrefs, etag string) (*ipn.Prefs, error) {
+				edits++
+				if conflicts > 0 {
+					conflicts--
+					cur.ShieldsUp = !cur.ShieldsUp
+				}
+				if etag != cur.ETag() {
+					return nil, ipn.ErrPrefsChanged
+				}
+				cur.ApplyEdits(mp)
+				return cur.Clone(), nil
+			}
+			var retried bool
+			err := editUpPrefs(context.Background(), hostnameEdit("foo"), cur.ETag(), func(curPrefs *ipn.Prefs) (*ipn.MaskedPrefs, error) {
+				retried = true
+				if !curPrefs.Equals(cur) {
+					t.Errorf("recompute got stale prefs")
+				}
+				if tt.restart {
+					return nil, nil
+				}
+				return hostnameEdit("foo"), nil
+			})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("editUpPrefs: %v", err)
+				}
+				if cur.Hostname != "foo" {
+					t.Errorf("Hostname = %q; want %q", cur.Hostname, "foo")
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("editUpPrefs error = %v; want it to contain %q", err, tt.wantErr)
+			}
+			if edits != tt.wantEdits {
+				t.Errorf("edits = %d; want %d", edits, tt.wantEdits)
+			}
+			if retried != tt.wantRetried {
+				t.Errorf("retried = %v; want %v", retried, tt.wantRetried)
+			}
+		})
+	}
+}
+
+func TestUpWatcher(t *testing.T) {
+	state := func(s ipn.State) ipn.Notify { return ipn.Notify{State: &s} }
+	browse := func(url string) ipn.Notify { return ipn.Notify{BrowseToURL: &url} }
+	errMsg := func(msg string) ipn.Notify { return ipn.Notify{ErrMessage: &msg} }
+	const (
+		oldURL = "https://login.example.com/a/old"
+		newURL = "https://login.example.com/a/new"
+	)
+	type step struct {
+		n    ipn.Notify
+		want upActions
+	}
+	tests := []struct {
+		name  string
+		w     upWatcher
+		steps []step
+	}{
+		{
+			name: "interactive_login",
+			steps: []step{
+				{ipn.Notify{Engine: &ipn.EngineStatus{}}, upActions{engineUpdate: true}},
+				{state(ipn.NeedsLogin), upActions{state: "NeedsLogin", startLogin: true}},
+				{browse(newURL), upActions{controlReached: true, authURL: newURL}},
+				{state(ipn.Running), upActions{state: "Running", running: true, controlReached: true, success: true}},
+			},
+		},
+		{
+			name: "already_logged_in",
+			steps: []step{
+				{state(ipn.Starting), upActions{state: "Starting"}},
+				{state(ipn.Running), upActions{state: "Running", running: true, controlReached: true}},
+			},
+		},
+		{
+			name: "json_no_success_line",
+			w:    upWatcher{json: true},
+			steps: []step{
+				{browse(newURL), upActions{controlReached: true, authURL: newURL}},
+				{state(ipn.Running), upActions{state: "Running", running: true, controlReached: true}},
+			},
+		},
+		{
+			name: "machine_auth",
+			steps: []step{
+				{state(ipn.NeedsMachineAuth), upActions{state: "NeedsMachineAuth", machineAuth: true, controlReached: true}},
+				{state(ipn.Running), upActions{state: "Running", running: true, controlReached: true, success: true}},
+			},
+		},
+		{
+			name: "force_reauth_skips_old_url",
+			w:    upWatcher{forceReauth: true, origAuthURL: oldURL},
+			steps: []step{
+				{browse(oldURL), upActions{controlReached: true}},
+				{browse(newURL), upActions{controlReached: true, authURL: newURL}},
+				{state(ipn.Running), upActions{state: "Running", running: true, controlReached: true, success: true}},
+			},
+		},
+		{
+			name: "reauth_without_force_shows_old_url",
+			w:    upWatcher{origAuthURL: oldURL},
+			steps: []step{
+				{browse(oldURL), upActions{controlReached: true, authURL: oldURL}},
+			},
+		},
+		{
+			name: "auth_key_hides_url",
+			w:    upWatcher{authKey: true},
+			steps: []step{
+				{browse(oldURL), upActions{controlReached: true}},
+				{state(ipn.Running), upActions{state: "Running", running: true, controlReached: true}},
+			},
+		},
+		{
+			name: "permission_denied",
+			w:    upWatcher{goos: "linux"},
+			steps: []step{
+				{errMsg(ipn.ErrMsgPermissionDenied), upActions{backendErr: ipn.ErrMsgPermissionDenied + " (try 'sudo tailscale up [...]')"}},
+			},
+		},
+		{
+			name: "permission_denied_windows",
+			w:    upWatcher{goos: "windows"},
+			steps: []step{
+				{errMsg(ipn.ErrMsgPermissionDenied), upActions{backendErr: ipn.ErrMsgPermissionDenied + " (Tailscale service in use by other user?)"}},
+			},
+		},
+		{
+			name: "other_backend_error",
+			steps: []step{
+				{errMsg("boom"), upActions{backendErr: "boom"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := tt.w
+			for i, st := range tt.steps {
+				if got := w.handle(st.n); got != st.want {
+					t.Errorf("step %d (%v): got %+v; want %+v", i, st.n, got, st.want)
+				}
+			}
+		})
+	}
+}
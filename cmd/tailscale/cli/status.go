@@ -14,6 +14,7 @@
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
@@ -143,6 +144,19 @@ func runStatus(ctx context.Context, args []string) error {
 		outln()
 	}
 
+	if statusArgs.self && st.Self != nil && len(st.Self.RouteComments) > 0 {
+		routes := make([]netaddr.IPPrefix, 0, len(st.Self.RouteComments))
+		for r := range st.Self.RouteComments {
+			routes = append(routes, r)
+		}
+		sort.Slice(routes, func(i, j int) bool { return routes[i].String() < routes[j].String() })
+		printf("# Advertised routes:\n")
+		for _, r := range routes {
+			printf("#     - %s: %s\n", r, st.Self.RouteComments[r])
+		}
+		outln()
+	}
+
 	var buf bytes.Buffer
 	f := func(format string, a ...any) { fmt.Fprintf(&buf, format, a...) }
 	printPS := func(ps *ipnstate.PeerStatus) {
@@ -5,20 +5,36 @@
 package cli
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	shellquote "github.com/kballard/go-shellquote"
 	"github.com/peterbourgon/ff/v3/ffcli"
@@ -29,16 +45,18 @@
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/safesocket"
+	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/preftype"
+	"tailscale.com/util/dnsname"
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
 )
 
 var upCmd = &ffcli.Command{
 	Name:       "up",
-	ShortUsage: "up [flags]",
+	ShortUsage: "up [flags] [@flagsfile ...]",
 	ShortHelp:  "Connect to Tailscale, logging in if needed",
 
 	LongHelp: strings.TrimSpace(`
@@ -54,10 +72,77 @@
 result of an unspecified flag's default value, unless the --reset flag
 is also used. (The flags --authkey, --force-reauth, and --qr are not
 considered settings that need to be re-specified when modifying
-settings.)
+settings.) With --reset, the settings that would revert are listed
+first and, on a terminal, confirmation is asked for unless --yes is
+given. Settings listed in --except (such as --except=hostname,operator)
+keep their current values instead of being reset.
+
+An argument of the form @flagsfile is replaced by the flags in that
+file, separated by spaces or newlines, with lines starting with # as
+comments; @- reads them from stdin. They're then parsed along with any
+flags after the file, and count as specified like those on the command
+line.
+
+With --json-prefs, "tailscale up" only prints the settings its other
+flags produce on this OS, as JSON, without contacting tailscaled; it's
+for auditing a set of flags rather than comparing them against the
+current settings like --dry-run does.
+
+Besides 0 for success and 1 for other failures, "tailscale up" exits
+with these statuses so that scripts can tell what went wrong:
+
+  2  authentication (or machine authorization) is still needed when
+     --timeout expires
+  3  tailscaled reported an error
+  4  the flags are invalid or can't be used together
+  5  --timeout expired for another reason (see --timeout-exit-code)
+  130  interrupted by SIGINT or SIGTERM
+
+A flag that can't be parsed at all exits with status 2, as it does for
+every tailscale subcommand.
 `),
 	FlagSet: upFlagSet,
-	Exec:    runUp,
+	Exec: func(ctx context.Context, args []string) error {
+		args, err := parseUpFlagsFiles(upFlagSet, args, os.Stdin)
+		if err != nil {
+			return upUsageError(err)
+		}
+		if upArgs.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, upArgs.timeout)
+			defer cancel()
+		}
+		if err := runUpRetrying(ctx, args); err != nil {
+			return err
+		}
+		if upArgs.waitForPeer != "" {
+			err := waitForPeer(ctx, upArgs.waitForPeer)
+			if errors.Is(err, context.DeadlineExceeded) {
+				return upExitError{code: upArgs.timeoutExitCode, err: err}
+			}
+			return err
+		}
+		return nil
+	},
+}
+
+// parseUpFlagsFiles handles "tailscale up @flagsfile". If args, the
+// non-flag arguments left after fs was parsed, start with an
+// "@flagsfile" argument, it parses into fs the flags from that and any
+// other such files along with the rest of args, and returns the
+// arguments left after that.
+func parseUpFlagsFiles(fs *flag.FlagSet, args []string, stdin io.Reader) ([]string, error) {
+	if len(args) == 0 || !strings.HasPrefix(args[0], "@") {
+		return args, nil
+	}
+	expanded, err := expandArgsFiles(args, stdin)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.Parse(CleanUpArgs(expanded)); err != nil {
+		return nil, err
+	}
+	return fs.Args(), nil
 }
 
 func effectiveGOOS() string {
@@ -91,19 +176,45 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 	upf.BoolVar(&upArgs.json, "json", false, "output in JSON format (WARNING: format subject to change)")
 	upf.BoolVar(&upArgs.forceReauth, "force-reauth", false, "force reauthentication")
 	upf.BoolVar(&upArgs.reset, "reset", false, "reset unspecified settings to their default values")
+	upf.Var(commaListValue{&upArgs.except}, "except", `with --reset, comma-separated settings, by flag name (e.g., "hostname,operator"), to keep at their current values instead of resetting`)
+	upf.BoolVar(&upArgs.yes, "yes", false, "don't ask for confirmation before --reset reverts unspecified settings, or before --force-reauth logs out a running node; needed for the latter when stdin isn't a terminal")
+	upf.StringVar(&upArgs.waitForPeer, "wait-for-peer", "", "after connecting, wait until the named peer (hostname, MagicDNS name or Tailscale IP) is reachable")
+	upf.BoolVar(&upArgs.dryRun, "dry-run", false, "print the settings that would change, and how, without changing them")
+	upf.BoolVar(&upArgs.jsonPrefs, "json-prefs", false, "print the settings the other flags produce on this OS as JSON and exit, without contacting tailscaled")
+	upf.BoolVar(&upArgs.strict, "strict", false, "treat warnings as errors: once done, fail with an error listing any warnings that were printed")
+	upf.Var(commaListValue{&upArgs.acceptRisk}, "accept-risk", fmt.Sprintf("comma-separated risks to go ahead with despite the warning (any of %s); if given, even empty, a risk that isn't listed is an error instead of a warning", strings.Join(knownRisks, ", ")))
+	upf.DurationVar(&upArgs.timeout, "timeout", 0, "maximum time to wait for the Running state (across any --retry attempts) and then for --wait-for-peer; 0 means no limit")
+	upf.IntVar(&upArgs.timeoutExitCode, "timeout-exit-code", upExitTimeout, "exit status to use when --timeout expires before the Running state (or a --retry attempt times out), unless authentication is still needed")
+	upf.IntVar(&upArgs.retry, "retry", 0, fmt.Sprintf("if up fails because the control server is unreachable or too slow, retry it up to this many times with exponential backoff, giving each attempt %v to hear from the control server", upRetryAttemptTimeout))
+	upf.StringVar(&upArgs.role, "role", "", "preset of flags for a common node role (one of client, subnet-router, exit-node, gateway); explicitly specified flags override the preset")
+	upf.Func("profile", `login profile whose settings and identity to use (and save), kept apart from other profiles' on this machine; tailscaled stays on it until another is given, and "" is the default profile`, func(v string) error {
+		if v != "" {
+			if err := ipn.CheckProfileName(v); err != nil {
+				return err
+			}
+		}
+		upArgs.profile, upArgs.profileSet = v, true
+		return nil
+	})
 
 	upf.StringVar(&upArgs.server, "login-server", ipn.DefaultControlURL, "base URL of control server")
 	upf.BoolVar(&upArgs.acceptRoutes, "accept-routes", acceptRouteDefault(goos), "accept routes advertised by other Tailscale nodes")
-	upf.BoolVar(&upArgs.acceptDNS, "accept-dns", true, "accept DNS configuration from the admin panel")
+	upf.StringVar(&upArgs.acceptRoutesFilter, "accept-routes-filter", "", `comma-separated IP prefixes (e.g., "10.20.0.0/16") to limit --accept-routes to: only subnet routes within one of them are accepted ("" accepts all)`)
+	upf.BoolVar(&upArgs.acceptRoutesNoDefault, "accept-routes-no-default", false, "never use default routes (0.0.0.0/0, ::/0) advertised by other Tailscale nodes unless that node is selected with --exit-node")
+	upArgs.acceptDNS = true
+	upf.Var(acceptDNSValue{upArgs}, "accept-dns", `accept DNS configuration from the admin panel, taking over all of the OS's DNS; "split" accepts only MagicDNS and the per-domain (split DNS) resolvers, leaving the OS's default resolver alone; "prefer-magic" accepts only MagicDNS, leaving everything else, split DNS domains included, to the OS's resolver`)
 	upf.BoolVar(&upArgs.singleRoutes, "host-routes", true, "install host routes to other Tailscale nodes")
-	upf.StringVar(&upArgs.exitNodeIP, "exit-node", "", "Tailscale exit node (IP or base name) for internet traffic, or empty string to not use an exit node")
+	upf.StringVar(&upArgs.exitNodeIP, "exit-node", "", "Tailscale exit node (IP, hostname or MagicDNS name, or \"auto\" for the lowest-latency one) for internet traffic, or empty string to not use an exit node")
 	upf.BoolVar(&upArgs.exitNodeAllowLANAccess, "exit-node-allow-lan-access", false, "Allow direct access to the local network when routing traffic via an exit node")
+	upf.BoolVar(&upArgs.noExitNodeThisSession, "no-exit-node-this-session", false, "don't use the configured exit node until the next \"tailscale down\", without forgetting it")
 	upf.BoolVar(&upArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
 	upf.BoolVar(&upArgs.runSSH, "ssh", false, "run an SSH server, permitting access per tailnet admin's declared policy")
-	upf.StringVar(&upArgs.advertiseTags, "advertise-tags", "", "comma-separated ACL tags to request; each must start with \"tag:\" (e.g. \"tag:eng,tag:montreal,tag:ssh\")")
-	upf.StringVar(&upArgs.authKeyOrFile, "auth-key", "", `node authorization key; if it begins with "file:", then it's a path to a file containing the authkey`)
-	upf.StringVar(&upArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
-	upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. \"10.0.0.0/8,192.168.0.0/24\") or empty string to not advertise routes")
+	upf.Var(commaListValue{&upArgs.advertiseTags}, "advertise-tags", "comma-separated ACL tags to request; each must start with \"tag:\" (e.g. \"tag:eng,tag:montreal,tag:ssh\"); may be repeated")
+	upf.StringVar(&upArgs.authKeyOrFile, "auth-key", "", `node authorization key; if it begins with "file:", then it's a path to a file containing the authkey, or if it begins with "env:", the name of an environment variable containing it`)
+	upf.StringVar(&upArgs.oauthClientID, "oauth-client-id", "", "OAuth client ID to mint a single-use ephemeral auth key with, instead of using --auth-key; requires --advertise-tags")
+	upf.StringVar(&upArgs.oauthSecretOrFile, "oauth-client-secret", "", `OAuth client secret for --oauth-client-id; if it begins with "file:", then it's a path to a file containing the secret, or if it begins with "env:", the name of an environment variable containing it`)
+	upf.StringVar(&upArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS; \"@short\" for only the first label of the OS's, \"@fqdn\" for all of it, or \"auto-unique\" for the OS's with a suffix derived from the machine ID, to tell apart clones of a VM image")
+	upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. \"10.0.0.0/8,192.168.0.0/24\", each optionally followed by a \"#comment\"; or \"@/path/to/file\" with one per line) or \"-\" (or an empty string) to not advertise routes")
 	upf.BoolVar(&upArgs.advertiseDefaultRoute, "advertise-exit-node", false, "offer to be an exit node for internet traffic for the tailnet")
 	if safesocket.GOOSUsesPeerCreds(goos) {
 		upf.StringVar(&upArgs.opUser, "operator", "", "Unix username to allow to operate on tailscaled without sudo")
@@ -111,13 +222,106 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 	switch goos {
 	case "linux":
 		upf.BoolVar(&upArgs.snat, "snat-subnet-routes", true, "source NAT traffic to local routes advertised with --advertise-routes")
-		upf.StringVar(&upArgs.netfilterMode, "netfilter-mode", defaultNetfilterMode(), "netfilter mode (one of on, nodivert, off)")
+		upf.BoolVar(&upArgs.snat, "masquerade", true, "alias for --snat-subnet-routes")
+		upf.StringVar(&upArgs.masqueradeTo, "masquerade-to", "", "source IP to SNAT traffic to local routes to, instead of that of the interface it leaves through; can't be used with --snat-subnet-routes=false")
+		upf.StringVar(&upArgs.netfilterMode, "netfilter-mode", defaultNetfilterMode(), "netfilter mode (one of on, nodivert, off), optionally followed by /nftables to program nftables directly instead of using iptables, as in on/nftables")
+		upf.StringVar(&upArgs.dnsBackend, "dns", "", "force how tailscaled manages the OS DNS configuration instead of detecting it (one of systemd-resolved, resolvconf, network-manager, direct); takes effect when tailscaled restarts")
 	case "windows":
 		upf.BoolVar(&upArgs.forceDaemon, "unattended", false, "run in \"Unattended Mode\" where Tailscale keeps running even after the current GUI user logs out (Windows-only)")
 	}
 	return upf
 }
 
+// checkSSHSupported returns an error if --ssh can't be used on goos
+// because the Tailscale SSH server doesn't run there. tailscaled checks
+// this too, but only once asked, and without naming the flag.
+func checkSSHSupported(goos string) error {
+	switch goos {
+	case "linux":
+		return nil
+	case "darwin":
+		if version.IsSandboxedMacOS() {
+			return errors.New("--ssh is not supported by the sandboxed Tailscale GUI app on macOS; use tailscaled instead")
+		}
+		return nil
+	}
+	return fmt.Errorf("--ssh is not supported on %s; the Tailscale SSH server only runs on Linux and macOS", goos)
+}
+
+// checkNetfilterBackend returns an error if backend, as given after a
+// slash in --netfilter-mode=mode/backend, isn't valid. Whether this
+// machine can use it is up to resolveUpArgsOnHost.
+func checkNetfilterBackend(mode, backend string) error {
+	if backend != preftype.NetfilterBackendNftables {
+		return fmt.Errorf("invalid value --netfilter-mode=%s/%s; the only backend is %s", mode, backend, preftype.NetfilterBackendNftables)
+	}
+	if mode == "off" {
+		return fmt.Errorf("--netfilter-mode=off/%s makes no sense; off doesn't use a backend", backend)
+	}
+	return nil
+}
+
+// nftablesAvailable returns an error saying why the nftables netfilter
+// backend can't be used on this machine, if it can't. It's a var for
+// tests.
+var nftablesAvailable = func() error {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return errors.New("the nft command isn't installed")
+	}
+	if !kernelHasNftables("/") {
+		return errors.New("the kernel doesn't have nf_tables, built in or as a module")
+	}
+	return nil
+}
+
+// operatorExists reports whether name is a user on this machine, for
+// --operator. Without cgo, os/user only reads /etc/passwd, so a user it
+// doesn't know, who might come from LDAP or the like, is looked up
+// with getent too where that's installed. It's a var for tests.
+var operatorExists = func(name string) (bool, error) {
+	_, err := user.Lookup(name)
+	if err == nil {
+		return true, nil
+	}
+	var unknown user.UnknownUserError
+	if !errors.As(err, &unknown) {
+		return false, err
+	}
+	if _, err := exec.LookPath("getent"); err == nil {
+		if exec.Command("getent", "passwd", name).Run() == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// kernelHasNftables reports whether the kernel of the system with its
+// root at root has nf_tables loaded, built in, or installed as a
+// module. If it can't tell, as in some containers, it says yes and
+// leaves tailscaled to find out.
+func kernelHasNftables(root string) bool {
+	if _, err := os.Stat(filepath.Join(root, "sys/module/nf_tables")); err == nil {
+		return true
+	}
+	release, err := os.ReadFile(filepath.Join(root, "proc/sys/kernel/osrelease"))
+	if err != nil {
+		return true
+	}
+	dir := filepath.Join(root, "lib/modules", strings.TrimSpace(string(release)))
+	sawList := false
+	for _, name := range []string{"modules.builtin", "modules.dep"} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		sawList = true
+		if bytes.Contains(b, []byte("/nf_tables.ko")) {
+			return true
+		}
+	}
+	return !sawList
+}
+
 func defaultNetfilterMode() string {
 	if distro.Get() == distro.Synology {
 		return "off"
@@ -128,12 +332,19 @@ func defaultNetfilterMode() string {
 type upArgsT struct {
 	qr                     bool
 	reset                  bool
+	except                 string // comma-separated flag names, for --reset
+	yes                    bool   // don't confirm --reset or --force-reauth
 	server                 string
 	acceptRoutes           bool
+	acceptRoutesNoDefault  bool
+	acceptRoutesFilter     string
 	acceptDNS              bool
+	acceptDNSSplit         bool // --accept-dns=split
+	acceptDNSMagic         bool // --accept-dns=prefer-magic
 	singleRoutes           bool
 	exitNodeIP             string
 	exitNodeAllowLANAccess bool
+	noExitNodeThisSession  bool
 	shieldsUp              bool
 	runSSH                 bool
 	forceReauth            bool
@@ -142,15 +353,37 @@ type upArgsT struct {
 	advertiseDefaultRoute  bool
 	advertiseTags          string
 	snat                   bool
+	masqueradeTo           string
 	netfilterMode          string
-	authKeyOrFile          string // "secret" or "file:/path/to/secret"
+	dnsBackend             string
+	authKeyOrFile          string // "secret", "file:/path/to/secret" or "env:VAR"
+	oauthClientID          string
+	oauthSecretOrFile      string // "secret", "file:/path/to/secret" or "env:VAR"
 	hostname               string
 	opUser                 string
 	json                   bool
+	role                   string // key of upRolePresets, or empty
+	waitForPeer            string
+	timeout                time.Duration
+	timeoutExitCode        int
+	strict                 bool
+	acceptRisk             string // comma-separated knownRisks
+	retry                  int
+	dryRun                 bool
+	jsonPrefs              bool
+	profile                string // login profile name; "" for the default one
+	profileSet             bool   // whether --profile was given
 }
 
 func (a upArgsT) getAuthKey() (string, error) {
-	v := a.authKeyOrFile
+	return readSecretOrFile(a.authKeyOrFile)
+}
+
+// readSecretOrFile returns v, or if v begins with "file:", the
+// contents of the named file with surrounding whitespace removed, or if
+// v begins with "env:", the value of the named environment variable,
+// which must be set. Both keep the secret out of the command line.
+func readSecretOrFile(v string) (string, error) {
 	if strings.HasPrefix(v, "file:") {
 		file := strings.TrimPrefix(v, "file:")
 		b, err := os.ReadFile(file)
@@ -159,11 +392,232 @@ func (a upArgsT) getAuthKey() (string, error) {
 		}
 		return strings.TrimSpace(string(b)), nil
 	}
+	if strings.HasPrefix(v, "env:") {
+		name := strings.TrimPrefix(v, "env:")
+		secret := strings.TrimSpace(os.Getenv(name))
+		if secret == "" {
+			return "", fmt.Errorf("environment variable %q named by %q is empty or not set", name, v)
+		}
+		return secret, nil
+	}
 	return v, nil
 }
 
+// mintOAuthAuthKey exchanges OAuth client credentials for an access
+// token from the control server at controlURL, and uses that to
+// create a single-use, preauthorized, ephemeral auth key with the
+// given tags. Neither the token nor the key are stored anywhere.
+func mintOAuthAuthKey(ctx context.Context, controlURL, clientID, clientSecret string, tags []string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	baseURL := strings.TrimSuffix(controlURL, "/")
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", baseURL+"/api/v2/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doOAuthJSON(req, &tok); err != nil {
+		return "", fmt.Errorf("getting OAuth access token: %w", err)
+	}
+	if tok.AccessToken == "" {
+		return "", errors.New("getting OAuth access token: no access_token in response")
+	}
+
+	var keyReq struct {
+		Capabilities struct {
+			Devices struct {
+				Create struct {
+					Reusable      bool     `json:"reusable"`
+					Ephemeral     bool     `json:"ephemeral"`
+					Preauthorized bool     `json:"preauthorized"`
+					Tags          []string `json:"tags"`
+				} `json:"create"`
+			} `json:"devices"`
+		} `json:"capabilities"`
+	}
+	create := &keyReq.Capabilities.Devices.Create
+	create.Ephemeral = true
+	create.Preauthorized = true
+	create.Tags = tags
+	body, err := json.Marshal(keyReq)
+	if err != nil {
+		return "", err
+	}
+	req, err = http.NewRequestWithContext(ctx, "POST", baseURL+"/api/v2/tailnet/-/keys", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+tok.AccessToken)
+	var key struct {
+		Key string `json:"key"`
+	}
+	if err := doOAuthJSON(req, &key); err != nil {
+		return "", fmt.Errorf("creating auth key with OAuth token: %w", err)
+	}
+	if key.Key == "" {
+		return "", errors.New("creating auth key with OAuth token: no key in response")
+	}
+	return key.Key, nil
+}
+
+// doOAuthJSON sends req and decodes its JSON response into v.
+func doOAuthJSON(req *http.Request, v any) error {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("%s: %s: %s", req.URL.Path, res.Status, bytes.TrimSpace(b))
+	}
+	return json.Unmarshal(b, v)
+}
+
 var upArgs upArgsT
 
+// commaListValue is a flag.Value for a comma-separated list flag that
+// may also be repeated: "--advertise-tags=tag:a --advertise-tags=tag:b"
+// is the same as "--advertise-tags=tag:a,tag:b".
+type commaListValue struct {
+	p *string
+}
+
+func (v commaListValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
+}
+
+func (v commaListValue) Set(s string) error {
+	switch {
+	case s == "":
+	case *v.p == "":
+		*v.p = s
+	default:
+		*v.p += "," + s
+	}
+	return nil
+}
+
+// acceptDNSValue is the flag.Value for --accept-dns. It's a bool flag
+// that also accepts "split", which takes the tailnet's DNS settings
+// except for its global resolvers, and "prefer-magic", which takes
+// only MagicDNS.
+type acceptDNSValue struct {
+	upArgs *upArgsT
+}
+
+func (v acceptDNSValue) String() string {
+	switch {
+	case v.upArgs == nil:
+		return ""
+	case v.upArgs.acceptDNSSplit:
+		return "split"
+	case v.upArgs.acceptDNSMagic:
+		return "prefer-magic"
+	}
+	return strconv.FormatBool(v.upArgs.acceptDNS)
+}
+
+func (v acceptDNSValue) Set(s string) error {
+	switch s {
+	case "split":
+		v.upArgs.acceptDNS = true
+		v.upArgs.acceptDNSSplit = true
+		v.upArgs.acceptDNSMagic = false
+		return nil
+	case "prefer-magic":
+		v.upArgs.acceptDNS = true
+		v.upArgs.acceptDNSSplit = false
+		v.upArgs.acceptDNSMagic = true
+		return nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("%q is not one of true, false, split or prefer-magic", s)
+	}
+	v.upArgs.acceptDNS = b
+	v.upArgs.acceptDNSSplit = false
+	v.upArgs.acceptDNSMagic = false
+	return nil
+}
+
+func (v acceptDNSValue) IsBoolFlag() bool { return true }
+
+// upRolePresets maps a --role value to the flags it implies. They're
+// only defaults: flags given explicitly on the command line win.
+var upRolePresets = map[string]map[string]string{
+	"client": {
+		"accept-routes": "true",
+	},
+	"subnet-router": {
+		"accept-dns":         "false",
+		"snat-subnet-routes": "true",
+	},
+	"exit-node": {
+		"accept-dns":          "false",
+		"advertise-exit-node": "true",
+	},
+	"gateway": {
+		"accept-dns":          "false",
+		"advertise-exit-node": "true",
+		"snat-subnet-routes":  "true",
+	},
+}
+
+// expandUpRole sets the flags in fs implied by the --role preset in
+// upArgs, except for those explicitly set on the command line. The
+// expanded flags then count as mentioned, like explicit ones.
+func expandUpRole(fs *flag.FlagSet, upArgs *upArgsT) error {
+	if upArgs.role == "" {
+		return nil
+	}
+	preset, ok := upRolePresets[upArgs.role]
+	if !ok {
+		return fmt.Errorf("invalid value --role=%q; must be one of client, subnet-router, exit-node, gateway", upArgs.role)
+	}
+	switch upArgs.role {
+	case "subnet-router", "gateway":
+		if upArgs.advertiseRoutes == "" || upArgs.advertiseRoutes == "-" {
+			return fmt.Errorf("--role=%s requires --advertise-routes", upArgs.role)
+		}
+	}
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[canonicalFlagName(f.Name)] = true
+	})
+	for name, val := range preset {
+		if explicit[name] || fs.Lookup(name) == nil {
+			// Either overridden, or not applicable to this OS.
+			continue
+		}
+		if err := fs.Set(name, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upJSONVersion is the value of the "version" field in every
+// "tailscale up --json" document. Bump it when a field is removed or
+// changes meaning; adding a field doesn't need a bump.
+const upJSONVersion = 1
+
 // Fields output when `tailscale up --json` is used. Two JSON blocks will be output.
 //
 // When "tailscale up" is run it first outputs a block with AuthURL and QR populated,
@@ -174,17 +628,21 @@ func (a upArgsT) getAuthKey() (string, error) {
 // When the client is authenticated by having someone visit the AuthURL, a second
 // JSON block will be output. The AuthURL and QR fields will not be present, the
 // BackendState and Error fields will give the result of the authentication.
+// Every block also carries the schema version, upJSONVersion.
 // Ex:
 // {
+//    "version": 1,
 //    "AuthURL": "https://login.tailscale.com/a/0123456789abcdef",
 //    "QR": "data:image/png;base64,0123...cdef"
 //    "BackendState": "NeedsLogin"
 // }
 // {
+//    "version": 1,
 //    "BackendState": "Running"
 // }
-//
 type upOutputJSON struct {
+	Version int `json:"version"` // always upJSONVersion
+
 	AuthURL      string `json:",omitempty"` // Authentication URL of the form https://login.tailscale.com/a/0123456789
 	QR           string `json:",omitempty"` // a DataURL (base64) PNG of a QR code AuthURL
 	BackendState string `json:",omitempty"` // name of state like Running or NeedsMachineAuth
@@ -195,11 +653,177 @@ func warnf(format string, args ...any) {
 	printf("Warning: "+format+"\n", args...)
 }
 
+// warnCollector records the warnings passed to its warnf method, for
+// "tailscale up --strict".
+type warnCollector struct {
+	logf logger.Logf // prints each warning as it's recorded
+	msgs []string
+}
+
+func (c *warnCollector) warnf(format string, args ...any) {
+	c.logf(format, args...)
+	c.msgs = append(c.msgs, fmt.Sprintf(format, args...))
+}
+
+// err returns an error listing the recorded warnings, or nil if there
+// weren't any.
+func (c *warnCollector) err() error {
+	if len(c.msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("--strict: %d warning(s):\n\t%s", len(c.msgs), strings.Join(c.msgs, "\n\t"))
+}
+
+// Risks are the warnings that "tailscale up --accept-risk" can
+// acknowledge. Once --accept-risk is given, the ones it doesn't list
+// are errors instead.
+const (
+	riskLoseSSH           = "lose-ssh"           // turning off --ssh from a Tailscale SSH session
+	riskNetfilterOff      = "netfilter-off"      // --netfilter-mode=off
+	riskNetfilterNoDivert = "netfilter-nodivert" // --netfilter-mode=nodivert
+	riskIPForwarding      = "ip-forwarding"      // advertising routes without IP forwarding on
+)
+
+var knownRisks = []string{riskLoseSSH, riskNetfilterOff, riskNetfilterNoDivert, riskIPForwarding}
+
+// riskWarning is a warning about one of the knownRisks. warnRisk passes
+// it to a warnf as the only argument, which prints it like any other
+// warning but lets a riskChecker tell it apart.
+type riskWarning struct {
+	risk string
+	msg  string
+}
+
+func (w riskWarning) String() string { return w.msg }
+
+// warnRisk warns about risk with msg.
+func warnRisk(warnf logger.Logf, risk, msg string) {
+	warnf("%v", riskWarning{risk, msg})
+}
+
+// riskChecker wraps the warnf of "tailscale up --accept-risk". Risks
+// it accepts are printed with acceptedLogf, so they don't count for
+// --strict; the others are recorded for err. Other warnings go to logf.
+type riskChecker struct {
+	logf         logger.Logf
+	acceptedLogf logger.Logf
+	accepted     map[string]bool
+	unaccepted   []riskWarning
+}
+
+// newRiskChecker returns a riskChecker accepting the comma-separated
+// risks in acceptRisk, which must all be knownRisks.
+func newRiskChecker(acceptRisk string, logf, acceptedLogf logger.Logf) (*riskChecker, error) {
+	c := &riskChecker{
+		logf:         logf,
+		acceptedLogf: acceptedLogf,
+		accepted:     map[string]bool{},
+	}
+	for _, risk := range strings.Split(acceptRisk, ",") {
+		risk = strings.TrimSpace(risk)
+		if risk == "" {
+			continue
+		}
+		known := false
+		for _, k := range knownRisks {
+			known = known || k == risk
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown risk %q in --accept-risk; want any of %s", risk, strings.Join(knownRisks, ", "))
+		}
+		c.accepted[risk] = true
+	}
+	return c, nil
+}
+
+func (c *riskChecker) warnf(format string, args ...any) {
+	if len(args) == 1 {
+		if w, ok := args[0].(riskWarning); ok {
+			if c.accepted[w.risk] {
+				c.acceptedLogf("%s (accepted with --accept-risk=%s)", w.msg, w.risk)
+			} else {
+				c.unaccepted = append(c.unaccepted, w)
+			}
+			return
+		}
+	}
+	c.logf(format, args...)
+}
+
+// err returns an error listing the risks warned about that weren't
+// accepted, or nil if there weren't any.
+func (c *riskChecker) err() error {
+	if len(c.unaccepted) == 0 {
+		return nil
+	}
+	var lines []string
+	for _, w := range c.unaccepted {
+		lines = append(lines, fmt.Sprintf("%s (to go ahead anyway, add %s to --accept-risk)", w.msg, w.risk))
+	}
+	return fmt.Errorf("%d risk(s) not accepted with --accept-risk:\n\t%s", len(lines), strings.Join(lines, "\n\t"))
+}
+
+// sshOverTailscale reports whether sshConn, the value of
+// $SSH_CONNECTION, is an SSH session to one of self's Tailscale IPs.
+func sshOverTailscale(sshConn string, self *ipnstate.PeerStatus) bool {
+	f := strings.Fields(sshConn) // client IP, client port, server IP, server port
+	if len(f) != 4 || self == nil {
+		return false
+	}
+	ip, err := netaddr.ParseIP(f[2])
+	if err != nil {
+		return false
+	}
+	for _, tip := range self.TailscaleIPs {
+		if tip == ip {
+			return true
+		}
+	}
+	return false
+}
+
 var (
 	ipv4default = netaddr.MustParseIPPrefix("0.0.0.0/0")
 	ipv6default = netaddr.MustParseIPPrefix("::/0")
 )
 
+// rfc1918Ranges are the IPv4 private address ranges that LANs use.
+var rfc1918Ranges = []netaddr.IPPrefix{
+	netaddr.MustParseIPPrefix("10.0.0.0/8"),
+	netaddr.MustParseIPPrefix("172.16.0.0/12"),
+	netaddr.MustParseIPPrefix("192.168.0.0/16"),
+}
+
+// overlappingPrivateRange returns the RFC 1918 range that r overlaps,
+// if any. Default routes, which overlap everything, are ignored.
+func overlappingPrivateRange(r netaddr.IPPrefix) (netaddr.IPPrefix, bool) {
+	if r.Bits() == 0 {
+		return netaddr.IPPrefix{}, false
+	}
+	for _, lan := range rfc1918Ranges {
+		if r.Overlaps(lan) {
+			return lan, true
+		}
+	}
+	return netaddr.IPPrefix{}, false
+}
+
+// coveringRoute returns the widest of routes that fully contains the
+// narrower route r, if any. Default routes, which contain everything
+// but mean offering an exit node, are ignored.
+func coveringRoute(routes []netaddr.IPPrefix, r netaddr.IPPrefix) (netaddr.IPPrefix, bool) {
+	var wide netaddr.IPPrefix
+	for _, w := range routes {
+		if w.Bits() == 0 || w.Bits() >= r.Bits() || !w.Contains(r.IP()) {
+			continue
+		}
+		if wide.IsZero() || w.Bits() < wide.Bits() {
+			wide = w
+		}
+	}
+	return wide, !wide.IsZero()
+}
+
 func validateViaPrefix(ipp netaddr.IPPrefix) error {
 	if !tsaddr.IsViaPrefix(ipp) {
 		return fmt.Errorf("%v is not a 4-in-6 prefix", ipp)
@@ -220,23 +844,103 @@ func validateViaPrefix(ipp netaddr.IPPrefix) error {
 	return nil
 }
 
+// parseAdvertiseRoute parses and validates one route given to
+// --advertise-routes.
+func parseAdvertiseRoute(s string) (netaddr.IPPrefix, error) {
+	ipp, err := netaddr.ParseIPPrefix(s)
+	if err != nil {
+		return netaddr.IPPrefix{}, fmt.Errorf("%q is not a valid IP address or CIDR prefix", s)
+	}
+	if ipp != ipp.Masked() {
+		return netaddr.IPPrefix{}, fmt.Errorf("%s has non-address bits set; expected %s", ipp, ipp.Masked())
+	}
+	if tsaddr.IsViaPrefix(ipp) {
+		if err := validateViaPrefix(ipp); err != nil {
+			return netaddr.IPPrefix{}, err
+		}
+	}
+	return ipp, nil
+}
+
+// readAdvertiseRoutesFile reads the routes for
+// "--advertise-routes=@file" from file, one per line, each optionally
+// followed by a "#comment" as in the inline form, ignoring blank and
+// comment-only lines. It returns them comma-separated, as they'd be
+// given to --advertise-routes directly, so comments end up as
+// AdvertiseRouteComments either way. Errors name the offending line.
+func readAdvertiseRoutesFile(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	var routes []string
+	for i, line := range strings.Split(string(b), "\n") {
+		route, comment := line, ""
+		if j := strings.IndexByte(line, '#'); j != -1 {
+			route, comment = line[:j], strings.TrimSpace(line[j+1:])
+		}
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		if _, err := parseAdvertiseRoute(route); err != nil {
+			return "", fmt.Errorf("%s:%d: %w", file, i+1, err)
+		}
+		if strings.Contains(comment, ",") {
+			return "", fmt.Errorf("%s:%d: route comments can't contain commas", file, i+1)
+		}
+		if comment != "" {
+			route += "#" + comment
+		}
+		routes = append(routes, route)
+	}
+	return strings.Join(routes, ","), nil
+}
+
+// splitRouteComments strips the optional "#comment" suffix from each
+// comma-separated route in advertiseRoutes, as in
+// "10.0.0.0/8#datacenter". It returns the routes without their
+// comments and the comments keyed by route, or nil if there were none.
+func splitRouteComments(advertiseRoutes string) (string, map[netaddr.IPPrefix]string, error) {
+	if !strings.Contains(advertiseRoutes, "#") {
+		return advertiseRoutes, nil, nil
+	}
+	var comments map[netaddr.IPPrefix]string
+	routes := strings.Split(advertiseRoutes, ",")
+	for i, s := range routes {
+		j := strings.IndexByte(s, '#')
+		if j == -1 {
+			continue
+		}
+		route, comment := s[:j], strings.TrimSpace(s[j+1:])
+		routes[i] = route
+		if comment == "" {
+			continue
+		}
+		ipp, err := parseAdvertiseRoute(route)
+		if err != nil {
+			return "", nil, err
+		}
+		if ipp.Bits() == 0 {
+			return "", nil, fmt.Errorf("%s can't have a comment; use --advertise-exit-node instead", ipp)
+		}
+		if comments == nil {
+			comments = map[netaddr.IPPrefix]string{}
+		}
+		comments[ipp] = comment
+	}
+	return strings.Join(routes, ","), comments, nil
+}
+
 func calcAdvertiseRoutes(advertiseRoutes string, advertiseDefaultRoute bool) ([]netaddr.IPPrefix, error) {
 	routeMap := map[netaddr.IPPrefix]bool{}
 	if advertiseRoutes != "" {
 		var default4, default6 bool
 		advroutes := strings.Split(advertiseRoutes, ",")
 		for _, s := range advroutes {
-			ipp, err := netaddr.ParseIPPrefix(s)
+			ipp, err := parseAdvertiseRoute(s)
 			if err != nil {
-				return nil, fmt.Errorf("%q is not a valid IP address or CIDR prefix", s)
-			}
-			if ipp != ipp.Masked() {
-				return nil, fmt.Errorf("%s has non-address bits set; expected %s", ipp, ipp.Masked())
-			}
-			if tsaddr.IsViaPrefix(ipp) {
-				if err := validateViaPrefix(ipp); err != nil {
-					return nil, err
-				}
+				return nil, err
 			}
 			if ipp == ipv4default {
 				default4 = true
@@ -255,8 +959,32 @@ func calcAdvertiseRoutes(advertiseRoutes string, advertiseDefaultRoute bool) ([]
 		routeMap[netaddr.MustParseIPPrefix("0.0.0.0/0")] = true
 		routeMap[netaddr.MustParseIPPrefix("::/0")] = true
 	}
-	routes := make([]netaddr.IPPrefix, 0, len(routeMap))
-	for r := range routeMap {
+	return sortedPrefixes(routeMap), nil
+}
+
+// canonicalTags returns tags sorted and without duplicates, so that
+// the same set of tags given in any order compares equal. It returns
+// nil if there are none.
+func canonicalTags(tags []string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+	ret := append([]string(nil), tags...)
+	sort.Strings(ret)
+	n := 1
+	for _, tag := range ret[1:] {
+		if tag != ret[n-1] {
+			ret[n] = tag
+			n++
+		}
+	}
+	return ret[:n]
+}
+
+// sortedPrefixes returns the prefixes in set, widest first.
+func sortedPrefixes(set map[netaddr.IPPrefix]bool) []netaddr.IPPrefix {
+	routes := make([]netaddr.IPPrefix, 0, len(set))
+	for r := range set {
 		routes = append(routes, r)
 	}
 	sort.Slice(routes, func(i, j int) bool {
@@ -265,47 +993,195 @@ func calcAdvertiseRoutes(advertiseRoutes string, advertiseDefaultRoute bool) ([]
 		}
 		return routes[i].IP().Less(routes[j].IP())
 	})
-	return routes, nil
+	return routes
 }
 
-// prefsFromUpArgs returns the ipn.Prefs for the provided args.
-//
-// Note that the parameters upArgs and warnf are named intentionally
-// to shadow the globals to prevent accidental misuse of them. This
-// function exists for testing and should have no side effects or
-// outside interactions (e.g. no making Tailscale local API calls).
-func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goos string) (*ipn.Prefs, error) {
-	routes, err := calcAdvertiseRoutes(upArgs.advertiseRoutes, upArgs.advertiseDefaultRoute)
-	if err != nil {
-		return nil, err
+// calcAcceptRoutesFilter parses the comma-separated prefixes given to
+// --accept-routes-filter, which are validated like those given to
+// --advertise-routes.
+func calcAcceptRoutesFilter(filter string) ([]netaddr.IPPrefix, error) {
+	if filter == "" {
+		return nil, nil
 	}
-
-	if upArgs.exitNodeIP == "" && upArgs.exitNodeAllowLANAccess {
-		return nil, fmt.Errorf("--exit-node-allow-lan-access can only be used with --exit-node")
+	set := map[netaddr.IPPrefix]bool{}
+	for _, s := range strings.Split(filter, ",") {
+		ipp, err := parseAdvertiseRoute(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --accept-routes-filter: %w", err)
+		}
+		set[ipp] = true
 	}
+	return sortedPrefixes(set), nil
+}
 
-	var tags []string
-	if upArgs.advertiseTags != "" {
-		tags = strings.Split(upArgs.advertiseTags, ",")
-		for _, tag := range tags {
-			err := tailcfg.CheckTag(tag)
-			if err != nil {
-				return nil, fmt.Errorf("tag: %q: %s", tag, err)
+// resolveUpArgsOnHost does the checks and lookups on this machine that
+// some up flags need, rewriting upArgs with what it finds, so that
+// prefsFromUpArgs doesn't have to. runUp and printPrefsJSON call it
+// before prefsFromUpArgs. Warnings go to warnf.
+func resolveUpArgsOnHost(upArgs *upArgsT, warnf logger.Logf, goos string) error {
+	if strings.HasPrefix(upArgs.advertiseRoutes, "@") {
+		routes, err := readAdvertiseRoutesFile(strings.TrimPrefix(upArgs.advertiseRoutes, "@"))
+		if err != nil {
+			return err
+		}
+		upArgs.advertiseRoutes = routes
+	}
+	if v := upArgs.hostname; strings.HasPrefix(v, "@") {
+		osName, err := derivedHostname(v)
+		if err != nil {
+			return err
+		}
+		hostname, err := checkHostname(osName)
+		if err != nil {
+			return err
+		}
+		// Joining the labels is what @fqdn is for, so only warn
+		// about other changes.
+		if hostname != osName && !(v == "@fqdn" && hostname == strings.ReplaceAll(osName, ".", "-")) {
+			warnf("--hostname=%s: the OS hostname %q isn't a valid DNS label; using %q", v, osName, hostname)
+		}
+		upArgs.hostname = hostname
+	}
+	if upArgs.opUser != "" && safesocket.GOOSUsesPeerCreds(goos) {
+		ok, err := operatorExists(upArgs.opUser)
+		switch {
+		case err != nil:
+			warnf("can't check that --operator=%s is a user on this machine: %v", upArgs.opUser, err)
+		case !ok:
+			return fmt.Errorf("--operator=%s isn't a user on this machine", upArgs.opUser)
+		}
+	}
+	if goos == "linux" {
+		mode, backend, _ := strings.Cut(upArgs.netfilterMode, "/")
+		if backend == preftype.NetfilterBackendNftables {
+			if err := nftablesAvailable(); err != nil {
+				return fmt.Errorf("--netfilter-mode=%s/%s isn't supported here: %v", mode, backend, err)
 			}
 		}
 	}
+	return nil
+}
+
+// prefsFromUpArgs returns the ipn.Prefs for the provided args.
+//
+// Note that the parameters upArgs and warnf are named intentionally
+// to shadow the globals to prevent accidental misuse of them. This
+// function exists for testing and should have no side effects or
+// outside interactions (e.g. no making Tailscale local API calls).
+// Checks that need this machine go in resolveUpArgsOnHost.
+func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goos string) (*ipn.Prefs, error) {
+	advertiseRoutes := upArgs.advertiseRoutes
+	if advertiseRoutes == "-" {
+		// An explicit way to clear the routes that's harder to get
+		// wrong in a shell than an empty --advertise-routes="".
+		advertiseRoutes = ""
+	}
+	advertiseRoutes, routeComments, err := splitRouteComments(advertiseRoutes)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := calcAdvertiseRoutes(advertiseRoutes, upArgs.advertiseDefaultRoute)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		if wide, ok := coveringRoute(routes, r); ok {
+			warnf("--advertise-routes=%v is redundant; it's already covered by %v", r, wide)
+		}
+	}
+
+	if upArgs.exitNodeIP == "" && upArgs.exitNodeAllowLANAccess {
+		return nil, fmt.Errorf("--exit-node-allow-lan-access can only be used with --exit-node")
+	}
+	if upArgs.except != "" {
+		if !upArgs.reset {
+			return nil, fmt.Errorf("--except can only be used with --reset")
+		}
+		if _, err := exceptFlags(goos, upArgs.except); err != nil {
+			return nil, err
+		}
+	}
+	if upArgs.runSSH {
+		if err := checkSSHSupported(goos); err != nil {
+			return nil, err
+		}
+	}
+	if upArgs.exitNodeAllowLANAccess {
+		for _, r := range routes {
+			if lan, ok := overlappingPrivateRange(r); ok {
+				warnf("--advertise-routes=%v overlaps the private range %v; with --exit-node-allow-lan-access, traffic for it may go to your LAN or to the advertised subnet ambiguously", r, lan)
+			}
+		}
+	}
+
+	var tags []string
+	if upArgs.advertiseTags != "" {
+		tags = strings.Split(upArgs.advertiseTags, ",")
+		for _, tag := range tags {
+			err := tailcfg.CheckTag(tag)
+			if err != nil {
+				return nil, fmt.Errorf("tag: %q: %s", tag, err)
+			}
+		}
+		tags = canonicalTags(tags)
+	}
+
+	if upArgs.oauthClientID != "" {
+		if upArgs.authKeyOrFile != "" {
+			return nil, errors.New("--auth-key and --oauth-client-id can't be used together")
+		}
+		if upArgs.oauthSecretOrFile == "" {
+			return nil, errors.New("--oauth-client-id requires --oauth-client-secret")
+		}
+		if len(tags) == 0 {
+			return nil, errors.New("--oauth-client-id requires --advertise-tags; auth keys made with OAuth clients must be tagged")
+		}
+	} else if upArgs.oauthSecretOrFile != "" {
+		return nil, errors.New("--oauth-client-secret requires --oauth-client-id")
+	}
 
 	if len(upArgs.hostname) > 256 {
 		return nil, fmt.Errorf("hostname too long: %d bytes (max 256)", len(upArgs.hostname))
 	}
+	if upArgs.hostname != "" {
+		hostname, err := checkHostname(upArgs.hostname)
+		if err != nil {
+			return nil, err
+		}
+		if hostname != upArgs.hostname {
+			warnf("--hostname=%q isn't a valid DNS label; using %q", upArgs.hostname, hostname)
+			upArgs.hostname = hostname
+		}
+	}
+
+	routeFilter, err := calcAcceptRoutesFilter(upArgs.acceptRoutesFilter)
+	if err != nil {
+		return nil, err
+	}
+	if len(routeFilter) > 0 && !upArgs.acceptRoutes {
+		return nil, errors.New("--accept-routes-filter can only be used with --accept-routes")
+	}
+
+	controlURL, err := normalizeControlURL(upArgs.server)
+	if err != nil {
+		return nil, err
+	}
 
 	prefs := ipn.NewPrefs()
-	prefs.ControlURL = upArgs.server
+	prefs.ControlURL = controlURL
 	prefs.WantRunning = true
 	prefs.RouteAll = upArgs.acceptRoutes
+	prefs.RouteAllNoDefault = upArgs.acceptRoutesNoDefault
+	prefs.RouteAllFilter = routeFilter
 
 	if upArgs.exitNodeIP != "" {
-		if err := prefs.SetExitNodeIP(upArgs.exitNodeIP, st); err != nil {
+		if _, err := netaddr.ParseIP(upArgs.exitNodeIP); err != nil {
+			id, err := exitNodeIDOfName(st, upArgs.exitNodeIP)
+			if err != nil {
+				return nil, err
+			}
+			prefs.ExitNodeID = id
+		} else if err := prefs.SetExitNodeIP(upArgs.exitNodeIP, st); err != nil {
 			var e ipn.ExitNodeLocalIPError
 			if errors.As(err, &e) {
 				return nil, fmt.Errorf("%w; did you mean --advertise-exit-node?", err)
@@ -315,11 +1191,15 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 	}
 
 	prefs.ExitNodeAllowLANAccess = upArgs.exitNodeAllowLANAccess
+	prefs.ExitNodeSuspended = upArgs.noExitNodeThisSession
 	prefs.CorpDNS = upArgs.acceptDNS
+	prefs.CorpDNSSplitOnly = upArgs.acceptDNSSplit
+	prefs.CorpDNSMagicOnly = upArgs.acceptDNSMagic
 	prefs.AllowSingleHosts = upArgs.singleRoutes
 	prefs.ShieldsUp = upArgs.shieldsUp
 	prefs.RunSSH = upArgs.runSSH
 	prefs.AdvertiseRoutes = routes
+	prefs.AdvertiseRouteComments = routeComments
 	prefs.AdvertiseTags = tags
 	prefs.Hostname = upArgs.hostname
 	prefs.ForceDaemon = upArgs.forceDaemon
@@ -328,24 +1208,245 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 	if goos == "linux" {
 		prefs.NoSNAT = !upArgs.snat
 
-		switch upArgs.netfilterMode {
+		if upArgs.masqueradeTo != "" {
+			if !upArgs.snat {
+				return nil, errors.New("--masquerade-to can't be used with --snat-subnet-routes=false")
+			}
+			ip, err := netaddr.ParseIP(upArgs.masqueradeTo)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value --masquerade-to=%q; must be an IP address", upArgs.masqueradeTo)
+			}
+			prefs.MasqueradeTo = ip
+		}
+
+		mode, backend, hasBackend := strings.Cut(upArgs.netfilterMode, "/")
+		if hasBackend {
+			if err := checkNetfilterBackend(mode, backend); err != nil {
+				return nil, err
+			}
+			prefs.NetfilterBackend = backend
+		}
+		switch mode {
 		case "on":
 			prefs.NetfilterMode = preftype.NetfilterOn
 		case "nodivert":
 			prefs.NetfilterMode = preftype.NetfilterNoDivert
-			warnf("netfilter=nodivert; add iptables calls to ts-* chains manually.")
+			warnRisk(warnf, riskNetfilterNoDivert, "netfilter=nodivert; add iptables calls to ts-* chains manually.")
 		case "off":
 			prefs.NetfilterMode = preftype.NetfilterOff
 			if defaultNetfilterMode() != "off" {
-				warnf("netfilter=off; configure iptables yourself.")
+				warnRisk(warnf, riskNetfilterOff, "netfilter=off; configure iptables yourself.")
 			}
 		default:
 			return nil, fmt.Errorf("invalid value --netfilter-mode=%q", upArgs.netfilterMode)
 		}
+
+		switch upArgs.dnsBackend {
+		case "", "systemd-resolved", "resolvconf", "network-manager", "direct":
+			prefs.DNSBackend = upArgs.dnsBackend
+		default:
+			return nil, fmt.Errorf("invalid value --dns=%q; must be one of systemd-resolved, resolvconf, network-manager, direct", upArgs.dnsBackend)
+		}
 	}
 	return prefs, nil
 }
 
+// PrefsFromUpFlags returns the prefs that "tailscale up" run on goos
+// with the given flags (such as []string{"--accept-routes"}) would
+// ask tailscaled for, without talking to tailscaled. The returned
+// MaskedPrefs holds the same prefs, marked as set for each pref one of
+// the flags controls (or for all of them, with --reset), as "tailscale
+// up" uses when editing the prefs of a running tailscaled.
+//
+// st is used to resolve --exit-node names; it may be nil, in which case
+// --exit-node must be an IP address. Warnings about the flags are sent
+// to warnf if it's non-nil.
+//
+// It doesn't look at this machine, which needn't run goos: --hostname
+// values derived from it and --advertise-routes=@file are errors, and
+// --operator and a --netfilter-mode backend aren't checked against it.
+func PrefsFromUpFlags(args []string, goos string, st *ipnstate.Status, warnf logger.Logf) (*ipn.Prefs, *ipn.MaskedPrefs, error) {
+	var upArgs upArgsT
+	fs := newUpFlagSet(goos, &upArgs)
+	fs.Init(fs.Name(), flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(CleanUpArgs(args)); err != nil {
+		return nil, nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, nil, fmt.Errorf("too many non-flag arguments: %q", fs.Args())
+	}
+	if err := expandUpRole(fs, &upArgs); err != nil {
+		return nil, nil, err
+	}
+	if upArgs.hostname == "auto-unique" || strings.HasPrefix(upArgs.hostname, "@") {
+		return nil, nil, fmt.Errorf("--hostname=%s is derived from this machine's, so isn't supported by PrefsFromUpFlags", upArgs.hostname)
+	}
+	if strings.HasPrefix(upArgs.advertiseRoutes, "@") {
+		return nil, nil, errors.New("--advertise-routes=@file isn't supported by PrefsFromUpFlags; give the routes directly")
+	}
+	if st == nil {
+		st = new(ipnstate.Status)
+	}
+	if warnf == nil {
+		warnf = logger.Discard
+	}
+	prefs, err := prefsFromUpArgs(upArgs, warnf, st, goos)
+	if err != nil {
+		return nil, nil, err
+	}
+	mp := &ipn.MaskedPrefs{Prefs: *prefs.Clone(), WantRunningSet: true}
+	visitFlags := fs.Visit
+	if upArgs.reset {
+		visitFlags = fs.VisitAll
+	}
+	visitFlags(func(f *flag.Flag) {
+		updateMaskedPrefsFromUpFlag(mp, f.Name)
+	})
+	mp.ExitNodeSuspendedSet = upArgs.noExitNodeThisSession
+	return prefs, mp, nil
+}
+
+// getPrefsETag and editPrefsIfMatch are tailscale.GetPrefsETag and
+// tailscale.EditPrefsIfMatch. They're vars for tests.
+var (
+	getPrefsETag     = tailscale.GetPrefsETag
+	editPrefsIfMatch = tailscale.EditPrefsIfMatch
+)
+
+// editUpPrefs applies mp, the edit "tailscale up" computed against the
+// prefs with the given ETag, unless another client changed the prefs
+// since. In that case it re-reads them, calls recompute for a fresh edit
+// against the new prefs, and tries once more, so concurrent edits don't
+// clobber each other.
+func editUpPrefs(ctx context.Context, mp *ipn.MaskedPrefs, etag string, recompute func(curPrefs *ipn.Prefs) (*ipn.MaskedPrefs, error)) error {
+	_, err := editPrefsIfMatch(ctx, mp, etag)
+	if err != ipn.ErrPrefsChanged {
+		return err
+	}
+	curPrefs, etag, err := getPrefsETag(ctx)
+	if err != nil {
+		return err
+	}
+	mp, err = recompute(curPrefs)
+	if err != nil {
+		return err
+	}
+	if mp == nil {
+		return errors.New("the prefs were changed by another client and now need a restart to apply; re-run tailscale up")
+	}
+	_, err = editPrefsIfMatch(ctx, mp, etag)
+	if err == ipn.ErrPrefsChanged {
+		return errors.New("the prefs were changed by another client again; re-run tailscale up")
+	}
+	return err
+}
+
+// osHostname returns the OS's hostname. It's a var for tests.
+var osHostname = os.Hostname
+
+// derivedHostname returns the hostname that the --hostname value v,
+// "@short" or "@fqdn", stands for: the first DNS label of the OS
+// hostname, or all of it. Either is then checked like any --hostname.
+func derivedHostname(v string) (string, error) {
+	if v != "@short" && v != "@fqdn" {
+		return "", fmt.Errorf("invalid --hostname=%q: the values starting with @ are @short and @fqdn", v)
+	}
+	hostname, err := osHostname()
+	if err != nil {
+		return "", fmt.Errorf("--hostname=%s: can't get the OS hostname: %v", v, err)
+	}
+	hostname = strings.TrimSuffix(hostname, ".")
+	if v == "@short" {
+		hostname = dnsname.FirstLabel(hostname)
+	}
+	if hostname == "" {
+		return "", fmt.Errorf("--hostname=%s: the OS hostname is empty", v)
+	}
+	return hostname, nil
+}
+
+// machineIDFiles are the files checked, in order, for the machine ID
+// used by --hostname=auto-unique.
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// autoUniqueHostname returns the hostname for --hostname=auto-unique:
+// the OS hostname with a suffix derived from the machine ID. Clones of
+// a VM image get distinct names once each has its own machine ID, as
+// systemd generates on first boot when /etc/machine-id is empty.
+func autoUniqueHostname() (string, error) {
+	hostname, err := osHostname()
+	if err != nil {
+		return "", err
+	}
+	for _, f := range machineIDFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		if id := strings.TrimSpace(string(b)); id != "" {
+			return uniqueHostname(hostname, id), nil
+		}
+	}
+	return "", fmt.Errorf("--hostname=auto-unique: no machine ID found in %s", strings.Join(machineIDFiles, " or "))
+}
+
+// uniqueHostname returns the first label of hostname with a short hash
+// of machineID appended. The machine ID itself is hashed rather than
+// used directly as it's meant to be kept private.
+func uniqueHostname(hostname, machineID string) string {
+	hostname = dnsname.FirstLabel(hostname)
+	sum := sha256.Sum256([]byte("tailscale hostname\x00" + machineID))
+	return hostname + "-" + hex.EncodeToString(sum[:4])
+}
+
+// normalizeControlURL checks that the --login-server value s is a base
+// URL for a control server and returns it without any trailing slash,
+// as the client appends paths like "/key" to it. The URL may have a
+// path, for a control server behind a reverse proxy such as
+// https://corp.example.com/tailscale/. The empty string, for the
+// default server, is returned as is.
+func normalizeControlURL(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid --login-server=%q: %v", s, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid --login-server=%q: must be an http or https URL", s)
+	}
+	if u.RawQuery != "" || u.Fragment != "" || u.ForceQuery {
+		return "", fmt.Errorf("invalid --login-server=%q: can't have a query or fragment", s)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = strings.TrimRight(u.RawPath, "/")
+	return u.String(), nil
+}
+
+// checkHostname checks that hostname is usable as a MagicDNS label. It
+// returns an error for hostnames that start or end with a hyphen or
+// have no usable characters at all. Otherwise it returns hostname with
+// any trailing dot removed and, if hostname has characters MagicDNS
+// doesn't accept (spaces, underscores, dots, ...), sanitized the same
+// way the control server would. Case is preserved when nothing else
+// needs changing, as DNS names are case-insensitive.
+func checkHostname(hostname string) (string, error) {
+	if strings.HasPrefix(hostname, "-") || strings.HasSuffix(hostname, "-") {
+		return "", fmt.Errorf("invalid --hostname=%q: can't start or end with a hyphen", hostname)
+	}
+	trimmed := strings.TrimSuffix(hostname, ".")
+	label := dnsname.SanitizeLabel(trimmed)
+	if label == "" {
+		return "", fmt.Errorf("invalid --hostname=%q: must contain a letter or digit", hostname)
+	}
+	if strings.EqualFold(label, trimmed) {
+		return trimmed, nil
+	}
+	return label, nil
+}
+
 // updatePrefs returns how to edit preferences based on the
 // flag-provided 'prefs' and the currently active 'curPrefs'.
 //
@@ -358,7 +1459,18 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 // transition to running from a previously-logged-in but down state,
 // without changing any settings.
 func updatePrefs(prefs, curPrefs *ipn.Prefs, env upCheckEnv) (simpleUp bool, justEditMP *ipn.MaskedPrefs, err error) {
-	if !env.upArgs.reset {
+	if prefs.ExitNodeSuspended {
+		keepSuspendedExitNode(prefs, curPrefs, env.flagSet)
+	} else {
+		// A suspended exit node stays suspended until the next
+		// "tailscale down", not the next up.
+		prefs.ExitNodeSuspended = curPrefs.ExitNodeSuspended
+	}
+	if env.upArgs.reset {
+		if err := keepExceptedPrefs(prefs, curPrefs, env); err != nil {
+			return false, nil, err
+		}
+	} else {
 		applyImplicitPrefs(prefs, curPrefs, env.user)
 
 		if err := checkForAccidentalSettingReverts(prefs, curPrefs, env); err != nil {
@@ -372,9 +1484,13 @@ func updatePrefs(prefs, curPrefs *ipn.Prefs, env upCheckEnv) (simpleUp bool, jus
 		return false, nil, fmt.Errorf("can't change --login-server without --force-reauth")
 	}
 
-	tagsChanged := !reflect.DeepEqual(curPrefs.AdvertiseTags, prefs.AdvertiseTags)
+	tagsChanged := !reflect.DeepEqual(canonicalTags(curPrefs.AdvertiseTags), canonicalTags(prefs.AdvertiseTags))
 
-	simpleUp = env.flagSet.NFlag() == 0 &&
+	nflag := env.flagSet.NFlag()
+	if env.upArgs.profileSet {
+		nflag-- // --profile alone brings up that profile as it was
+	}
+	simpleUp = nflag == 0 &&
 		curPrefs.Persist != nil &&
 		curPrefs.Persist.LoginName != "" &&
 		env.backendState != ipn.NeedsLogin.String()
@@ -382,6 +1498,7 @@ func updatePrefs(prefs, curPrefs *ipn.Prefs, env upCheckEnv) (simpleUp bool, jus
 	justEdit := env.backendState == ipn.Running.String() &&
 		!env.upArgs.forceReauth &&
 		env.upArgs.authKeyOrFile == "" &&
+		env.upArgs.oauthClientID == "" &&
 		!controlURLChanged &&
 		!tagsChanged
 
@@ -396,14 +1513,81 @@ func updatePrefs(prefs, curPrefs *ipn.Prefs, env upCheckEnv) (simpleUp bool, jus
 		visitFlags(func(f *flag.Flag) {
 			updateMaskedPrefsFromUpFlag(justEditMP, f.Name)
 		})
+		justEditMP.ExitNodeSuspendedSet = env.upArgs.noExitNodeThisSession
 	}
 
 	return simpleUp, justEditMP, nil
 }
 
-func runUp(ctx context.Context, args []string) error {
+// upLoginProfile returns the StateKey of the login profile for up to
+// start. If that's another profile than the one tailscaled is using,
+// it also returns the profile's saved prefs (new ones if it has none),
+// for up to use in place of the current prefs.
+func upLoginProfile(ctx context.Context, upArgs upArgsT) (key ipn.StateKey, switchPrefs *ipn.Prefs, err error) {
+	if upArgs.profileSet && effectiveGOOS() == "windows" {
+		return "", nil, errors.New("--profile isn't supported on Windows")
+	}
+	cur, err := tailscale.CurrentLoginProfile(ctx)
+	if err != nil {
+		if upArgs.profileSet {
+			return "", nil, fmt.Errorf("getting current login profile: %w", err)
+		}
+		// An older tailscaled only has the default profile.
+		return ipn.GlobalDaemonStateKey, nil, nil
+	}
+	if !upArgs.profileSet || upArgs.profile == cur.Name {
+		return ipn.ProfileStateKey(cur.Name), nil, nil
+	}
+	lp, err := tailscale.LoginProfile(ctx, upArgs.profile)
+	if err != nil {
+		return "", nil, fmt.Errorf("getting login profile %q: %w", upArgs.profile, err)
+	}
+	if lp.Prefs == nil {
+		return ipn.ProfileStateKey(lp.Name), ipn.NewPrefs(), nil
+	}
+	return ipn.ProfileStateKey(lp.Name), lp.Prefs, nil
+}
+
+func runUp(ctx context.Context, args []string) (retErr error) {
 	if len(args) > 0 {
-		fatalf("too many non-flag arguments: %q", args)
+		return upUsageError(fmt.Errorf("too many non-flag arguments: %q", args))
+	}
+
+	// With --strict, warnings are still printed as they happen, but
+	// also make up fail once it's otherwise done.
+	warnf := logger.Logf(warnf)
+	printWarnf := warnf
+	if upArgs.strict {
+		wc := &warnCollector{logf: warnf}
+		warnf = wc.warnf
+		defer func() {
+			if retErr == nil {
+				retErr = wc.err()
+			}
+		}()
+	}
+	// With --accept-risk, the risks it doesn't list make up fail
+	// before any settings are changed.
+	var (
+		rc    *riskChecker
+		rcErr error
+	)
+	upFlagSet.Visit(func(f *flag.Flag) {
+		if f.Name == "accept-risk" {
+			rc, rcErr = newRiskChecker(upArgs.acceptRisk, warnf, printWarnf)
+		}
+	})
+	if rcErr != nil {
+		return upUsageError(rcErr)
+	}
+	if rc != nil {
+		warnf = rc.warnf
+	}
+	if upArgs.jsonPrefs {
+		if err := expandUpRole(upFlagSet, &upArgs); err != nil {
+			return upUsageError(err)
+		}
+		return printPrefsJSON(upArgs, warnf, effectiveGOOS())
 	}
 
 	st, err := tailscale.Status(ctx)
@@ -412,22 +1596,6 @@ func runUp(ctx context.Context, args []string) error {
 	}
 	origAuthURL := st.AuthURL
 
-	// printAuthURL reports whether we should print out the
-	// provided auth URL from an IPN notify.
-	printAuthURL := func(url string) bool {
-		if upArgs.authKeyOrFile != "" {
-			// Issue 1755: when using an authkey, don't
-			// show an authURL that might still be pending
-			// from a previous non-completed interactive
-			// login.
-			return false
-		}
-		if upArgs.forceReauth && url == origAuthURL {
-			return false
-		}
-		return true
-	}
-
 	if distro.Get() == distro.Synology {
 		notSupported := "not supported on Synology; see https://github.com/tailscale/tailscale/issues/1995"
 		if upArgs.acceptRoutes {
@@ -441,21 +1609,66 @@ func runUp(ctx context.Context, args []string) error {
 		}
 	}
 
+	if err := expandUpRole(upFlagSet, &upArgs); err != nil {
+		return upUsageError(err)
+	}
+
+	if upArgs.hostname == "auto-unique" {
+		hostname, err := autoUniqueHostname()
+		if err != nil {
+			return err
+		}
+		upArgs.hostname = hostname
+	}
+	if err := resolveUpArgsOnHost(&upArgs, warnf, effectiveGOOS()); err != nil {
+		return upUsageError(err)
+	}
+
+	if upArgs.exitNodeIP == "auto" {
+		ps, latency, err := autoExitNode(ctx, st)
+		if err != nil {
+			return err
+		}
+		if len(ps.TailscaleIPs) == 0 {
+			return fmt.Errorf("--exit-node=auto: exit node %q has no Tailscale IPs", ps.HostName)
+		}
+		name := strings.TrimSuffix(ps.DNSName, ".")
+		if name == "" {
+			name = ps.HostName
+		}
+		fmt.Fprintf(Stderr, "Using exit node %s (%v away)\n", name, latency.Round(time.Millisecond))
+		upArgs.exitNodeIP = ps.TailscaleIPs[0].String()
+	}
+
 	prefs, err := prefsFromUpArgs(upArgs, warnf, st, effectiveGOOS())
 	if err != nil {
-		fatalf("%s", err)
+		return upUsageError(err)
 	}
 
+
 	if len(prefs.AdvertiseRoutes) > 0 {
 		if err := tailscale.CheckIPForwarding(context.Background()); err != nil {
-			warnf("%v", err)
+			warnRisk(warnf, riskIPForwarding, err.Error())
 		}
 	}
 
-	curPrefs, err := tailscale.GetPrefs(ctx)
+	curPrefs, prefsETag, err := getPrefsETag(ctx)
 	if err != nil {
 		return err
 	}
+	backendState := st.BackendState
+	stateKey, switchPrefs, err := upLoginProfile(ctx, upArgs)
+	if err != nil {
+		return err
+	}
+	if switchPrefs != nil {
+		// Switching to another login profile: settings that differ
+		// from the profile being left aren't reverts, so compare
+		// against the saved ones of the profile being switched to,
+		// which isn't running yet.
+		curPrefs = switchPrefs
+		backendState = ipn.Stopped.String()
+	}
 
 	env := upCheckEnv{
 		goos:          effectiveGOOS(),
@@ -463,16 +1676,64 @@ func runUp(ctx context.Context, args []string) error {
 		user:          os.Getenv("USER"),
 		flagSet:       upFlagSet,
 		upArgs:        upArgs,
-		backendState:  st.BackendState,
+		backendState:  backendState,
 		curExitNodeIP: exitNodeIP(curPrefs, st),
+		st:            st,
 	}
 	simpleUp, justEditMP, err := updatePrefs(prefs, curPrefs, env)
 	if err != nil {
-		fatalf("%s", err)
+		return upUsageError(err)
+	}
+	newPrefs := prefs
+	switch {
+	case justEditMP != nil:
+		newPrefs = curPrefs.Clone()
+		newPrefs.ApplyEdits(justEditMP)
+	case simpleUp:
+		newPrefs = curPrefs.Clone()
+		newPrefs.WantRunning = true
+	}
+	if curPrefs.RunSSH && !newPrefs.RunSSH && sshOverTailscale(os.Getenv("SSH_CONNECTION"), st.Self) {
+		warnRisk(warnf, riskLoseSSH, "this turns off Tailscale SSH, which this session is connected over; it will be disconnected")
+	}
+	if rc != nil {
+		if err := rc.err(); err != nil {
+			return err
+		}
+	}
+	if upArgs.dryRun {
+		printUpDryRun(env, curPrefs, newPrefs)
+		return nil
+	}
+	if upArgs.reset && curPrefs.ControlURL != "" {
+		if printResetReverts(env, curPrefs, prefs) && !upArgs.yes && stdinIsTerminal() && !confirm("Continue?") {
+			return errors.New("aborted; no settings were changed")
+		}
+	}
+	if forceReauthNeedsConfirm(upArgs, backendState) {
+		if !stdinIsTerminal() {
+			return errors.New(forceReauthNoTTYMsg)
+		}
+		fmt.Fprintln(Stderr, "--force-reauth will log this node out of the tailnet until someone logs in again interactively.")
+		if !confirm("Continue?") {
+			return errors.New("aborted; still logged in")
+		}
 	}
 	if justEditMP != nil {
-		_, err := tailscale.EditPrefs(ctx, justEditMP)
-		return err
+		return editUpPrefs(ctx, justEditMP, prefsETag, func(curPrefs *ipn.Prefs) (*ipn.MaskedPrefs, error) {
+			// Start over from the flags: updatePrefs fills in prefs
+			// from the current ones, which are what changed.
+			prefs, err := prefsFromUpArgs(upArgs, logger.Discard, st, effectiveGOOS())
+			if err != nil {
+				return nil, upUsageError(err)
+			}
+			env.curExitNodeIP = exitNodeIP(curPrefs, st)
+			_, mp, err := updatePrefs(prefs, curPrefs, env)
+			if err != nil {
+				return nil, upUsageError(err)
+			}
+			return mp, nil
+		})
 	}
 
 	// At this point we need to subscribe to the IPN bus to watch
@@ -484,183 +1745,928 @@ func runUp(ctx context.Context, args []string) error {
 	gotEngineUpdate := make(chan bool, 1) // gets value upon an engine update
 	pumpErr := make(chan error, 1)
 	go func() { pumpErr <- pump(pumpCtx, bc, c) }()
+	backendErr := make(chan error, 1) // gets tailscaled's first ErrMessage
+
+	var stateMu sync.Mutex
+	lastState := st.BackendState // guarded by stateMu; updated from notifications
+	lastStateOf := func() string {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		return lastState
+	}
+
+	// timedOutErr returns the error for giving up on reaching Running
+	// because of cause, a deadline, saying how far we got.
+	timedOutErr := func(cause error) error {
+		state := lastStateOf()
+		err := fmt.Errorf("timed out waiting for tailscale up; last state was %s: %w", state, cause)
+		if upArgs.json {
+			printUpJSON(&upOutputJSON{BackendState: state, Error: err.Error()})
+		}
+		return upExitError{code: upTimeoutExitCode(state, upArgs.timeoutExitCode), err: err}
+	}
+
+	// pumpDoneErr returns the error for pumpCtx being done before
+	// we reached Running, saying how far we got if ctx (that is,
+	// --timeout) expired.
+	pumpDoneErr := func() error {
+		if gotSignal.Get() {
+			err := upInterruptedError{state: interruptedBackendState(lastStateOf())}
+			if upArgs.json {
+				printUpJSON(&upOutputJSON{BackendState: err.state, Error: err.Error()})
+			}
+			return err
+		}
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return pumpCtx.Err()
+		}
+		return timedOutErr(ctx.Err())
+	}
+	var loginOnce sync.Once
+	startLoginInteractive := func() {
+		loginOnce.Do(func() {
+			// Once interrupted, don't start a login nobody will finish.
+			if pumpCtx.Err() == nil {
+				bc.StartLoginInteractive()
+			}
+		})
+	}
+
+	w := &upWatcher{
+		goos:        effectiveGOOS(),
+		json:        upArgs.json,
+		authKey:     upArgs.authKeyOrFile != "" || upArgs.oauthClientID != "",
+		forceReauth: upArgs.forceReauth,
+		origAuthURL: origAuthURL,
+	}
+	var controlReached syncs.AtomicBool // whether we've seen signs of the control server answering
+	bc.SetNotifyCallback(func(n ipn.Notify) {
+		a := w.handle(n)
+		if a.controlReached {
+			controlReached.Set(true)
+		}
+		if a.engineUpdate {
+			select {
+			case gotEngineUpdate <- true:
+			default:
+			}
+		}
+		if a.backendErr != "" {
+			select {
+			case backendErr <- upExitError{code: upExitBackendError, err: fmt.Errorf("backend error: %v", a.backendErr)}:
+			default:
+			}
+		}
+		if a.state != "" {
+			stateMu.Lock()
+			lastState = a.state
+			stateMu.Unlock()
+		}
+		if a.startLogin {
+			startLoginInteractive()
+		}
+		if a.machineAuth {
+			if upArgs.json {
+				printUpDoneJSON(ipn.NeedsMachineAuth, "")
+			} else {
+				fmt.Fprintf(Stderr, "\nTo authorize your machine, visit (as admin):\n\n\t%s\n\n", prefs.AdminPageURL())
+			}
+		}
+		if a.running {
+			if upArgs.json {
+				printUpDoneJSON(ipn.Running, "")
+			} else if a.success {
+				fmt.Fprintf(Stderr, "Success.\n")
+			}
+			select {
+			case running <- true:
+			default:
+			}
+			cancel()
+		}
+		if url := a.authURL; url != "" {
+			if upArgs.json {
+				printUpJSON(upAuthURLJSON(url, st.BackendState))
+			} else {
+				fmt.Fprintf(Stderr, "\nTo authenticate, visit:\n\n\t%s\n\n", url)
+				if upArgs.qr {
+					if q, err := authURLQR(url, stderrWidth()); err != nil {
+						fmt.Fprintf(Stderr, "Not showing QR code: %v\n\n", err)
+					} else {
+						fmt.Fprintf(Stderr, "%s\n", q)
+					}
+				}
+			}
+		}
+	})
+	// Wait for backend client to be connected so we know
+	// we're subscribed to updates. Otherwise we can miss
+	// an update upon its transition to running. Do so by causing some traffic
+	// back to the bus that we then wait on.
+	bc.RequestEngineStatus()
+	select {
+	case <-gotEngineUpdate:
+	case err := <-backendErr:
+		return err
+	case <-pumpCtx.Done():
+		return pumpDoneErr()
+	case err := <-pumpErr:
+		if ctx.Err() != nil || gotSignal.Get() {
+			return pumpDoneErr()
+		}
+		return err
+	}
+
+	// Special case: bare "tailscale up" means to just start
+	// running, if there's ever been a login.
+	if simpleUp && switchPrefs == nil {
+		_, err := tailscale.EditPrefs(ctx, &ipn.MaskedPrefs{
+			Prefs: ipn.Prefs{
+				WantRunning: true,
+			},
+			WantRunningSet: true,
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		// newPrefs are prefs, or for a bare switch to another
+		// login profile, that profile's saved ones.
+		prefs := newPrefs
+		if err := tailscale.CheckPrefs(ctx, prefs); err != nil {
+			return err
+		}
+
+		authKey, err := upArgs.getAuthKey()
+		if err != nil {
+			return err
+		}
+		if upArgs.oauthClientID != "" {
+			secret, err := readSecretOrFile(upArgs.oauthSecretOrFile)
+			if err != nil {
+				return err
+			}
+			authKey, err = mintOAuthAuthKey(ctx, prefs.ControlURLOrDefault(), upArgs.oauthClientID, secret, prefs.AdvertiseTags)
+			if err != nil {
+				return err
+			}
+		}
+		opts := ipn.Options{
+			StateKey:    stateKey,
+			AuthKey:     authKey,
+			UpdatePrefs: prefs,
+		}
+		// On Windows, we still run in mostly the "legacy" way that
+		// predated the server's StateStore. That is, we send an empty
+		// StateKey and send the prefs directly. Although the Windows
+		// supports server mode, though, the transition to StateStore
+		// is only half complete. Only server mode uses it, and the
+		// Windows service (~tailscaled) is the one that computes the
+		// StateKey based on the connection identity. So for now, just
+		// do as the Windows GUI's always done:
+		if effectiveGOOS() == "windows" {
+			// The Windows service will set this as needed based
+			// on our connection's identity.
+			opts.StateKey = ""
+			opts.Prefs = prefs
+		}
+
+		bc.Start(opts)
+		if upArgs.forceReauth {
+			startLoginInteractive()
+		}
+	}
+
+	// If we still haven't heard back from the control server after a
+	// while, it might be because a captive portal is eating our
+	// connections to it. Check once and tell the user, as otherwise it
+	// just looks like we're hung. The check runs in the background so
+	// as not to hold up the loop below.
+	captiveTimer := time.NewTimer(captivePortalCheckDelay)
+	defer captiveTimer.Stop()
+	captiveResult := make(chan bool, 1)
+
+	// With --retry, give up on an attempt that hasn't heard from the
+	// control server in upRetryAttemptTimeout, so it can be tried
+	// again. Once control has answered, with a login URL or
+	// otherwise, we're waiting on a person instead, for as long as
+	// they take (or --timeout allows).
+	var attemptTimeout <-chan time.Time
+	if upArgs.retry > 0 {
+		t := time.NewTimer(upRetryAttemptTimeout)
+		defer t.Stop()
+		attemptTimeout = t.C
+	}
+
+	// This whole 'up' mechanism is too complicated and results in
+	// hairy stuff like this select. We're ultimately waiting for
+	// 'running' to be done, but even in the case where
+	// it succeeds, other parts may shut down concurrently so we
+	// need to prioritize reads from 'running' if it's
+	// readable; its send does happen before the pump mechanism
+	// shuts down. (Issue 2333)
+	for {
+		select {
+		case <-running:
+			return nil
+		case err := <-backendErr:
+			return err
+		case <-captiveTimer.C:
+			if !controlReached.Get() {
+				go func() { captiveResult <- detectCaptivePortal(pumpCtx, newPrefs.ControlURLOrDefault()) }()
+			}
+		case portal := <-captiveResult:
+			if portal && !controlReached.Get() {
+				fmt.Fprintf(Stderr, "\npossible captive portal detected; complete the portal login and retry.\n\n")
+			}
+		case <-attemptTimeout:
+			if !controlReached.Get() {
+				return timedOutErr(fmt.Errorf("no answer from the control server in %v: %w", upRetryAttemptTimeout, context.DeadlineExceeded))
+			}
+		case <-pumpCtx.Done():
+			select {
+			case <-running:
+				return nil
+			default:
+			}
+			return pumpDoneErr()
+		case err := <-pumpErr:
+			select {
+			case <-running:
+				return nil
+			default:
+			}
+			if ctx.Err() != nil || gotSignal.Get() {
+				return pumpDoneErr()
+			}
+			return err
+		}
+	}
+}
+
+// upWatcher decides what "tailscale up" does about each IPN
+// notification while it waits for the backend to be running: what to
+// print, when to start an interactive login, and when it's done. It
+// does no I/O itself; runUp's notify callback carries out the
+// upActions it returns.
+type upWatcher struct {
+	goos        string // effectiveGOOS, for the permission-denied hint
+	json        bool   // --json
+	authKey     bool   // whether logging in with an auth key or OAuth client
+	forceReauth bool   // --force-reauth
+	origAuthURL string // the auth URL already pending before up started
+
+	printed bool // whether an auth URL or machine auth message was printed
+}
+
+// upActions are what upWatcher.handle decided to do about a
+// notification, in the order runUp carries them out.
+type upActions struct {
+	engineUpdate   bool   // an engine update arrived
+	backendErr     string // if non-empty, fail with this backend error
+	state          string // if non-empty, the backend's new state
+	startLogin     bool   // start an interactive login
+	machineAuth    bool   // tell the user to have an admin authorize the machine
+	running        bool   // the backend is running, so up is done
+	controlReached bool   // the control server has answered: it sent an auth URL, or got us past login
+	success        bool   // with running, print "Success." (only without --json)
+	authURL        string // if non-empty, the auth URL to show the user
+}
+
+func (w *upWatcher) handle(n ipn.Notify) upActions {
+	var a upActions
+	a.engineUpdate = n.Engine != nil
+	if n.ErrMessage != nil {
+		msg := *n.ErrMessage
+		if msg == ipn.ErrMsgPermissionDenied {
+			switch w.goos {
+			case "windows":
+				msg += " (Tailscale service in use by other user?)"
+			default:
+				msg += " (try 'sudo tailscale up [...]')"
+			}
+		}
+		a.backendErr = msg
+	}
+	if s := n.State; s != nil {
+		a.state = s.String()
+		switch *s {
+		case ipn.NeedsLogin:
+			a.startLogin = true
+		case ipn.NeedsMachineAuth:
+			w.printed = true
+			a.machineAuth = true
+			a.controlReached = true
+		case ipn.Running:
+			// Done full authentication process. Only need to print an
+			// update if we printed the "please click" message earlier.
+			a.running = true
+			a.success = w.printed && !w.json
+			a.controlReached = true
+		}
+	}
+	if url := n.BrowseToURL; url != nil {
+		a.controlReached = true
+		if w.showAuthURL(*url) {
+			w.printed = true
+			a.authURL = *url
+		}
+	}
+	return a
+}
+
+// showAuthURL reports whether to show the user url, an auth URL from
+// an IPN notification.
+func (w *upWatcher) showAuthURL(url string) bool {
+	if w.authKey {
+		// Issue 1755: when using an authkey, don't
+		// show an authURL that might still be pending
+		// from a previous non-completed interactive
+		// login.
+		return false
+	}
+	if w.forceReauth && url == w.origAuthURL {
+		return false
+	}
+	return true
+}
+
+// Exit statuses of "tailscale up" besides 0 and 1, as documented in
+// its LongHelp.
+const (
+	upExitAuthRequired = 2 // --timeout expired while authentication was still needed
+	upExitBackendError = 3 // tailscaled sent an ErrMessage
+	upExitUsage        = 4 // invalid flags, caught before any settings were changed
+	upExitTimeout      = 5 // --timeout expired otherwise; the default for --timeout-exit-code
+)
+
+// upExitError is an error from "tailscale up" that gives the exit
+// status it should have.
+type upExitError struct {
+	code int
+	err  error
+}
+
+func (e upExitError) Error() string { return e.err.Error() }
+func (e upExitError) Unwrap() error { return e.err }
+
+// ExitCode implements the interface that main uses to pick its exit status.
+func (e upExitError) ExitCode() int { return e.code }
+
+// upUsageError returns err, an error about the flags given to
+// "tailscale up", with the exit status for that.
+func upUsageError(err error) error {
+	return upExitError{code: upExitUsage, err: err}
+}
+
+// upTimeoutExitCode returns the exit status for a timeout waiting for
+// the Running state when tailscaled was last in backend state state.
+// timeoutCode, from --timeout-exit-code, is used unless it was still
+// waiting for the user (or an admin) to authenticate.
+func upTimeoutExitCode(state string, timeoutCode int) int {
+	switch state {
+	case ipn.NeedsLogin.String(), ipn.NeedsMachineAuth.String():
+		return upExitAuthRequired
+	}
+	return timeoutCode
+}
+
+// upInterruptedExitCode is the exit status of "tailscale up" when
+// SIGINT or SIGTERM stops it before tailscaled is running, so that
+// scripts can tell that apart from a failure. It's what shells use for
+// SIGINT.
+const upInterruptedExitCode = 130
+
+// upInterruptedError is the error from runUp when it's interrupted
+// while waiting for tailscaled to reach the Running state.
+type upInterruptedError struct {
+	state string // tailscaled's backend state when interrupted
+}
+
+func (e upInterruptedError) Error() string {
+	return fmt.Sprintf("interrupted; tailscaled was left in state %s (run \"tailscale up\" again to continue, or \"tailscale down\" to stop)", e.state)
+}
+
+// ExitCode implements the interface that main uses to pick its exit status.
+func (e upInterruptedError) ExitCode() int { return upInterruptedExitCode }
+
+// interruptedBackendState returns tailscaled's current backend state,
+// or last, the last one runUp was told about, if it can't be fetched
+// quickly.
+func interruptedBackendState(last string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	st, err := tailscale.StatusWithoutPeers(ctx)
+	if err != nil {
+		return last
+	}
+	return st.BackendState
+}
+
+// printPrefsJSON prints, for --json-prefs, the prefs that upArgs
+// produce on goos as JSON, without contacting tailscaled. So settings
+// that need the node's state, like an --exit-node given by name, fail.
+func printPrefsJSON(upArgs upArgsT, warnf logger.Logf, goos string) error {
+	if upArgs.dryRun {
+		return upUsageError(errors.New("--json-prefs can't be used with --dry-run"))
+	}
+	if upArgs.exitNodeIP == "auto" {
+		return upUsageError(errors.New("--exit-node=auto needs tailscaled, so can't be used with --json-prefs"))
+	}
+	if upArgs.hostname == "auto-unique" {
+		hostname, err := autoUniqueHostname()
+		if err != nil {
+			return err
+		}
+		upArgs.hostname = hostname
+	}
+	if err := resolveUpArgsOnHost(&upArgs, warnf, goos); err != nil {
+		return upUsageError(err)
+	}
+	prefs, err := prefsFromUpArgs(upArgs, warnf, new(ipnstate.Status), goos)
+	if err != nil {
+		return upUsageError(err)
+	}
+	data, err := json.MarshalIndent(prefs, "", "  ")
+	if err != nil {
+		return err
+	}
+	outln(string(data))
+	return nil
+}
+
+// printUpDryRun prints, for --dry-run, the flags whose values differ
+// between curPrefs and newPrefs (per prefsToFlags), with the current
+// and new values.
+func printUpDryRun(env upCheckEnv, curPrefs, newPrefs *ipn.Prefs) {
+	flagsCur := prefsToFlags(env, curPrefs)
+	flagsNew := prefsToFlags(env, newPrefs)
+	var changes []string
+	for flagName, valNew := range flagsNew {
+		valCur := flagsCur[flagName]
+		if reflect.DeepEqual(valCur, valNew) {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("--%s: %s -> %s", flagName, fmtDryRunValue(valCur), fmtDryRunValue(valNew)))
+	}
+	sort.Strings(changes)
+	if curPrefs.WantRunning != newPrefs.WantRunning {
+		changes = append(changes, fmt.Sprintf("WantRunning: %v -> %v", curPrefs.WantRunning, newPrefs.WantRunning))
+	}
+	if len(changes) == 0 {
+		outln("Dry run; tailscale up would change nothing.")
+		return
+	}
+	outln("Dry run; tailscale up would change:")
+	for _, c := range changes {
+		printf("\t%s\n", c)
+	}
+}
+
+// printResetReverts prints to Stderr, for --reset, the settings that
+// weren't given on the command line and so will revert from their
+// values in curPrefs to their defaults in newPrefs. It reports whether
+// there were any.
+func printResetReverts(env upCheckEnv, curPrefs, newPrefs *ipn.Prefs) bool {
+	flagIsSet := map[string]bool{}
+	env.flagSet.Visit(func(f *flag.Flag) {
+		flagIsSet[canonicalFlagName(f.Name)] = true
+	})
+	flagsCur := prefsToFlags(env, curPrefs)
+	flagsNew := prefsToFlags(env, newPrefs)
+	names := revertedFlags(flagsCur, flagsNew, flagIsSet, env)
+	if len(names) == 0 {
+		return false
+	}
+	sort.Strings(names)
+	fmt.Fprintln(Stderr, "--reset will revert these settings to their defaults:")
+	for _, name := range names {
+		fmt.Fprintf(Stderr, "\t--%s: %s -> %s\n", name, fmtDryRunValue(flagsCur[name]), fmtDryRunValue(flagsNew[name]))
+	}
+	return true
+}
+
+// authURLQR returns authURL as a QR code drawn with text, for --qr.
+// It returns an error if the code is wider than width columns, as a
+// wrapped one can't be scanned. A width of 0 means it's unknown.
+func authURLQR(authURL string, width int) (string, error) {
+	q, err := qrcode.New(authURL, qrcode.Medium)
+	if err != nil {
+		return "", err
+	}
+	s := q.ToString(false)
+	line := s
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		line = s[:i]
+	}
+	if need := utf8.RuneCountInString(line); width > 0 && need > width {
+		return "", fmt.Errorf("terminal is %d columns wide; need %d to show it", width, need)
+	}
+	return s, nil
+}
+
+// forceReauthNoTTYMsg is the error for --force-reauth on a running node
+// with no way to confirm it.
+const forceReauthNoTTYMsg = "--force-reauth would log this running node out until someone logs in again interactively, " +
+	"and stdin isn't a terminal to confirm that on; add --yes to do it anyway, or use --auth-key to reauthenticate without an interactive login"
+
+// forceReauthNeedsConfirm reports whether "tailscale up --force-reauth"
+// should be confirmed first: the node is running, and with no auth key
+// to log back in with it'd be dropped from the tailnet until someone
+// logs in interactively, which on a headless server can be hard to do.
+func forceReauthNeedsConfirm(upArgs upArgsT, backendState string) bool {
+	return upArgs.forceReauth && !upArgs.yes &&
+		backendState == ipn.Running.String() &&
+		upArgs.authKeyOrFile == "" && upArgs.oauthClientID == ""
+}
+
+// stdinIsTerminal reports whether os.Stdin is a terminal, so a
+// confirmation can be asked for.
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// confirm asks question on Stderr and reports whether the user answered
+// yes on os.Stdin.
+func confirm(question string) bool {
+	fmt.Fprintf(Stderr, "%s [y/N] ", question)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+func fmtDryRunValue(v any) string {
+	if s, ok := v.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(v)
+}
+
+// findPeer returns the peer in st named by name, which may be its
+// hostname, its MagicDNS name (with or without the tailnet suffix and
+// trailing dot) or one of its Tailscale IPs.
+func findPeer(st *ipnstate.Status, name string) (*ipnstate.PeerStatus, error) {
+	if ip, err := netaddr.ParseIP(name); err == nil {
+		for _, ps := range st.Peer {
+			for _, pip := range ps.TailscaleIPs {
+				if pip == ip {
+					return ps, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("no peer with Tailscale IP %v", ip)
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	var match *ipnstate.PeerStatus
+	for _, ps := range st.Peer {
+		if peerHasName(ps, name) {
+			if match != nil && match != ps {
+				return nil, fmt.Errorf("peer name %q is ambiguous; use its MagicDNS name or Tailscale IP", name)
+			}
+			match = ps
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("no peer named %q", name)
+	}
+	return match, nil
+}
+
+// peerHasName reports whether name is ps's hostname or its MagicDNS
+// name, with or without the tailnet suffix and trailing dot. The
+// comparison is case-insensitive.
+func peerHasName(ps *ipnstate.PeerStatus, name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	dnsName := strings.TrimSuffix(strings.ToLower(ps.DNSName), ".")
+	return dnsName == name || dnsname.FirstLabel(dnsName) == name || strings.EqualFold(ps.HostName, name)
+}
+
+// exitNodeIDOfName returns the ID of the peer in st that name refers
+// to, for a non-IP --exit-node value. It fails if name matches no peer
+// or more than one, listing the candidates, or if the peer isn't
+// offering to be an exit node.
+func exitNodeIDOfName(st *ipnstate.Status, name string) (tailcfg.StableNodeID, error) {
+	var matches, exitNodes []*ipnstate.PeerStatus
+	for _, ps := range st.Peer {
+		if peerHasName(ps, name) {
+			matches = append(matches, ps)
+		}
+		if ps.ExitNodeOption {
+			exitNodes = append(exitNodes, ps)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		if st.Self != nil && peerHasName(st.Self, name) {
+			return "", fmt.Errorf("cannot use %s as an exit node as it is this machine; did you mean --advertise-exit-node?", name)
+		}
+		if len(exitNodes) == 0 {
+			return "", fmt.Errorf("invalid value %q for --exit-node; must be IP or unique node name", name)
+		}
+		return "", fmt.Errorf("invalid value %q for --exit-node; must be IP or unique node name; exit nodes available: %s", name, peerList(exitNodes))
+	case 1:
+		ps := matches[0]
+		if !ps.ExitNodeOption {
+			return "", fmt.Errorf("node %q is not advertising an exit node", name)
+		}
+		return ps.ID, nil
+	default:
+		return "", fmt.Errorf("exit node name %q is ambiguous; it matches %s; use its MagicDNS name or Tailscale IP", name, peerList(matches))
+	}
+}
+
+// peerList formats peers for an error message, sorted, as their
+// MagicDNS names and first Tailscale IPs.
+func peerList(peers []*ipnstate.PeerStatus) string {
+	ipnstate.SortPeers(peers)
+	var sb strings.Builder
+	for i, ps := range peers {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%s (%s)", strings.TrimSuffix(ps.DNSName, "."), firstIPString(ps.TailscaleIPs))
+	}
+	return sb.String()
+}
+
+// peerReachable reports whether ps looks reachable: we've completed a
+// WireGuard handshake with it, or have a direct path to it.
+func peerReachable(ps *ipnstate.PeerStatus) bool {
+	return ps.CurAddr != "" || !ps.LastHandshake.IsZero()
+}
+
+// waitForPeer waits for the peer named by name to be reachable, pinging
+// it to nudge a connection along, until ctx is done.
+func waitForPeer(ctx context.Context, name string) error {
+	c, bc, ctx, cancel := connect(ctx)
+	defer cancel()
+	pongs := make(chan *ipnstate.PingResult, 1)
+	bc.SetNotifyCallback(func(n ipn.Notify) {
+		if pr := n.PingResult; pr != nil && pr.Err == "" {
+			select {
+			case pongs <- pr:
+			default:
+			}
+		}
+	})
+	go pump(ctx, bc, c)
 
-	var printed bool // whether we've yet printed anything to stdout or stderr
-	var loginOnce sync.Once
-	startLoginInteractive := func() { loginOnce.Do(func() { bc.StartLoginInteractive() }) }
+	ping := func(ip netaddr.IP) bool {
+		bc.Ping(ip.String(), false)
+		t := time.NewTimer(5 * time.Second)
+		defer t.Stop()
+		select {
+		case pr := <-pongs:
+			return pr.IP == ip.String()
+		case <-t.C:
+		case <-ctx.Done():
+		}
+		return false
+	}
+	return pollForPeer(ctx, name, tailscale.Status, ping, time.Second)
+}
 
+// autoExitNode picks the exit node for --exit-node=auto by pinging
+// each candidate in st once. See pickExitNode.
+func autoExitNode(ctx context.Context, st *ipnstate.Status) (*ipnstate.PeerStatus, time.Duration, error) {
+	c, bc, ctx, cancel := connect(ctx)
+	defer cancel()
+	pongs := make(chan *ipnstate.PingResult, 1)
 	bc.SetNotifyCallback(func(n ipn.Notify) {
-		if n.Engine != nil {
+		if pr := n.PingResult; pr != nil && pr.Err == "" {
 			select {
-			case gotEngineUpdate <- true:
+			case pongs <- pr:
 			default:
 			}
 		}
-		if n.ErrMessage != nil {
-			msg := *n.ErrMessage
-			if msg == ipn.ErrMsgPermissionDenied {
-				switch effectiveGOOS() {
-				case "windows":
-					msg += " (Tailscale service in use by other user?)"
-				default:
-					msg += " (try 'sudo tailscale up [...]')"
-				}
-			}
-			fatalf("backend error: %v\n", msg)
-		}
-		if s := n.State; s != nil {
-			switch *s {
-			case ipn.NeedsLogin:
-				startLoginInteractive()
-			case ipn.NeedsMachineAuth:
-				printed = true
-				if env.upArgs.json {
-					printUpDoneJSON(ipn.NeedsMachineAuth, "")
-				} else {
-					fmt.Fprintf(Stderr, "\nTo authorize your machine, visit (as admin):\n\n\t%s\n\n", prefs.AdminPageURL())
-				}
-			case ipn.Running:
-				// Done full authentication process
-				if env.upArgs.json {
-					printUpDoneJSON(ipn.Running, "")
-				} else if printed {
-					// Only need to print an update if we printed the "please click" message earlier.
-					fmt.Fprintf(Stderr, "Success.\n")
-				}
-				select {
-				case running <- true:
-				default:
+	})
+	go pump(ctx, bc, c)
+
+	latency := func(ip netaddr.IP) (time.Duration, bool) {
+		bc.Ping(ip.String(), false)
+		t := time.NewTimer(2 * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case pr := <-pongs:
+				if pr.IP == ip.String() {
+					return time.Duration(pr.LatencySeconds * float64(time.Second)), true
 				}
-				cancel()
+			case <-t.C:
+				return 0, false
+			case <-ctx.Done():
+				return 0, false
 			}
 		}
-		if url := n.BrowseToURL; url != nil && printAuthURL(*url) {
-			printed = true
-			if upArgs.json {
-				js := &upOutputJSON{AuthURL: *url, BackendState: st.BackendState}
+	}
+	return pickExitNode(st, latency)
+}
 
-				q, err := qrcode.New(*url, qrcode.Medium)
-				if err == nil {
-					png, err := q.PNG(128)
-					if err == nil {
-						js.QR = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
-					}
-				}
+// pickExitNode returns the online peer in st offering to be an exit
+// node with the lowest latency, along with that latency. Peers for
+// which latency reports false are skipped. It fails if there are no
+// such peers, rather than leaving traffic going direct.
+func pickExitNode(st *ipnstate.Status, latency func(netaddr.IP) (time.Duration, bool)) (*ipnstate.PeerStatus, time.Duration, error) {
+	var candidates []*ipnstate.PeerStatus
+	for _, ps := range st.Peer {
+		if ps.ExitNodeOption && ps.Online && len(ps.TailscaleIPs) > 0 {
+			candidates = append(candidates, ps)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, 0, errors.New("--exit-node=auto: no online peers are offering to be an exit node")
+	}
+	ipnstate.SortPeers(candidates)
+	var best *ipnstate.PeerStatus
+	var bestLatency time.Duration
+	for _, ps := range candidates {
+		d, ok := latency(ps.TailscaleIPs[0])
+		if ok && (best == nil || d < bestLatency) {
+			best, bestLatency = ps, d
+		}
+	}
+	if best == nil {
+		return nil, 0, fmt.Errorf("--exit-node=auto: none of the exit nodes answered a ping: %s", peerList(candidates))
+	}
+	return best, bestLatency, nil
+}
 
-				data, err := json.MarshalIndent(js, "", "\t")
-				if err != nil {
-					log.Printf("upOutputJSON marshalling error: %v", err)
-				} else {
-					fmt.Println(string(data))
-				}
-			} else {
-				fmt.Fprintf(Stderr, "\nTo authenticate, visit:\n\n\t%s\n\n", *url)
-				if upArgs.qr {
-					q, err := qrcode.New(*url, qrcode.Medium)
-					if err != nil {
-						log.Printf("QR code error: %v", err)
-					} else {
-						fmt.Fprintf(Stderr, "%s\n", q.ToString(false))
-					}
+// pollForPeer polls getStatus every interval until the peer named by
+// name is reachable according to peerReachable or to ping, or ctx is
+// done.
+func pollForPeer(ctx context.Context, name string, getStatus func(context.Context) (*ipnstate.Status, error), ping func(netaddr.IP) bool, interval time.Duration) error {
+	var lastErr error
+	for {
+		st, err := getStatus(ctx)
+		if err == nil {
+			var ps *ipnstate.PeerStatus
+			ps, err = findPeer(st, name)
+			if err == nil {
+				if peerReachable(ps) || len(ps.TailscaleIPs) > 0 && ping(ps.TailscaleIPs[0]) {
+					return nil
 				}
+				err = fmt.Errorf("peer %q not reachable yet", name)
 			}
 		}
-	})
-	// Wait for backend client to be connected so we know
-	// we're subscribed to updates. Otherwise we can miss
-	// an update upon its transition to running. Do so by causing some traffic
-	// back to the bus that we then wait on.
-	bc.RequestEngineStatus()
-	select {
-	case <-gotEngineUpdate:
-	case <-pumpCtx.Done():
-		return pumpCtx.Err()
-	case err := <-pumpErr:
-		return err
+		lastErr = err
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for peer %q: %w (last: %v)", name, ctx.Err(), lastErr)
+		case <-time.After(interval):
+		}
 	}
+}
 
-	// Special case: bare "tailscale up" means to just start
-	// running, if there's ever been a login.
-	if simpleUp {
-		_, err := tailscale.EditPrefs(ctx, &ipn.MaskedPrefs{
-			Prefs: ipn.Prefs{
-				WantRunning: true,
-			},
-			WantRunningSet: true,
-		})
-		if err != nil {
+var (
+	// captivePortalCheckDelay is how long runUp waits to hear from
+	// the control server before checking for a captive portal.
+	captivePortalCheckDelay = 20 * time.Second
+
+	// upRetryAttemptTimeout is how long each attempt at up gets to
+	// hear from the control server with --retry.
+	upRetryAttemptTimeout = 2 * time.Minute
+
+	// upRetryBackoff is how long --retry waits before its first
+	// retry. It doubles for each retry after that.
+	upRetryBackoff = 5 * time.Second
+)
+
+// runUpAttempt is runUp, as called by runUpRetrying.
+// It's a var for tests.
+var runUpAttempt = runUp
+
+// runUpRetrying runs runUp, retrying it up to --retry times if it fails
+// with a transient error. runUp itself limits how long each attempt
+// waits for the control server.
+func runUpRetrying(ctx context.Context, args []string) error {
+	if upArgs.retry <= 0 {
+		return runUpAttempt(ctx, args)
+	}
+	// runUp resolves some flags, such as --exit-node=auto, by
+	// rewriting upArgs, so each attempt starts over from a copy. The
+	// --role presets go in first: once applied, their flags count as
+	// given on the command line, and later attempts wouldn't apply
+	// them again.
+	if err := expandUpRole(upFlagSet, &upArgs); err != nil {
+		return upUsageError(err)
+	}
+	orig := upArgs
+	return retryUp(ctx, upArgs.retry, upRetryBackoff, func(ctx context.Context) error {
+		upArgs = orig
+		return runUpAttempt(ctx, args)
+	})
+}
+
+// retryUp calls run until it succeeds, fails with an error that
+// isTransientUpError says isn't transient, or has been retried retries
+// times. It sleeps for backoff before the first retry, doubling that
+// each time.
+func retryUp(ctx context.Context, retries int, backoff time.Duration, run func(context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		err := run(ctx)
+		if err == nil || attempt == retries || !isTransientUpError(err) || ctx.Err() != nil {
 			return err
 		}
-	} else {
-		if err := tailscale.CheckPrefs(ctx, prefs); err != nil {
+		fmt.Fprintf(Stderr, "up failed (attempt %d of %d): %v; retrying in %v\n", attempt+1, retries+1, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
 			return err
 		}
+		backoff *= 2
+	}
+}
 
-		authKey, err := upArgs.getAuthKey()
-		if err != nil {
-			return err
-		}
-		opts := ipn.Options{
-			StateKey:    ipn.GlobalDaemonStateKey,
-			AuthKey:     authKey,
-			UpdatePrefs: prefs,
-		}
-		// On Windows, we still run in mostly the "legacy" way that
-		// predated the server's StateStore. That is, we send an empty
-		// StateKey and send the prefs directly. Although the Windows
-		// supports server mode, though, the transition to StateStore
-		// is only half complete. Only server mode uses it, and the
-		// Windows service (~tailscaled) is the one that computes the
-		// StateKey based on the connection identity. So for now, just
-		// do as the Windows GUI's always done:
-		if effectiveGOOS() == "windows" {
-			// The Windows service will set this as needed based
-			// on our connection's identity.
-			opts.StateKey = ""
-			opts.Prefs = prefs
+// isTransientUpError reports whether err, from runUp, might go away if
+// up is tried again: the control server or network was unreachable or
+// too slow. Errors where control (or tailscaled) rejected the request,
+// such as a bad auth key or conflicting prefs, aren't transient.
+func isTransientUpError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EHOSTUNREACH, syscall.ENETUNREACH} {
+		if errors.Is(err, errno) {
+			return true
 		}
+	}
+	return false
+}
 
-		bc.Start(opts)
-		if upArgs.forceReauth {
-			startLoginInteractive()
-		}
+// detectCaptivePortal reports whether fetching the public key of the
+// control server at controlURL looks like it was intercepted by a
+// captive portal: a redirect, a certificate that doesn't check out, or
+// anything other than the JSON the /key endpoint serves. If the server
+// can't be reached at all, it returns false, as that's
+// indistinguishable from just being offline.
+func detectCaptivePortal(ctx context.Context, controlURL string) bool {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	keyURL := fmt.Sprintf("%s/key?v=%d", strings.TrimSuffix(controlURL, "/"), tailcfg.CurrentCapabilityVersion)
+	req, err := http.NewRequestWithContext(ctx, "GET", keyURL, nil)
+	if err != nil {
+		return false
+	}
+	hc := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		var (
+			unknownAuthority x509.UnknownAuthorityError
+			badHostname      x509.HostnameError
+			badCert          x509.CertificateInvalidError
+		)
+		// A portal answering for the control server can't have its
+		// certificate.
+		return errors.As(err, &unknownAuthority) || errors.As(err, &badHostname) || errors.As(err, &badCert)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return true
 	}
+	var v any
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&v) != nil
+}
 
-	// This whole 'up' mechanism is too complicated and results in
-	// hairy stuff like this select. We're ultimately waiting for
-	// 'running' to be done, but even in the case where
-	// it succeeds, other parts may shut down concurrently so we
-	// need to prioritize reads from 'running' if it's
-	// readable; its send does happen before the pump mechanism
-	// shuts down. (Issue 2333)
-	select {
-	case <-running:
-		return nil
-	case <-pumpCtx.Done():
-		select {
-		case <-running:
-			return nil
-		default:
-		}
-		return pumpCtx.Err()
-	case err := <-pumpErr:
-		select {
-		case <-running:
-			return nil
-		default:
+// upAuthURLJSON returns the "tailscale up --json" document asking the
+// user to visit authURL, with a QR code for it.
+func upAuthURLJSON(authURL, backendState string) *upOutputJSON {
+	js := &upOutputJSON{AuthURL: authURL, BackendState: backendState}
+	q, err := qrcode.New(authURL, qrcode.Medium)
+	if err == nil {
+		png, err := q.PNG(128)
+		if err == nil {
+			js.QR = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
 		}
-		return err
 	}
+	return js
 }
 
 func printUpDoneJSON(state ipn.State, errorString string) {
-	js := &upOutputJSON{BackendState: state.String(), Error: errorString}
+	printUpJSON(&upOutputJSON{BackendState: state.String(), Error: errorString})
+}
+
+// printUpJSON prints js, stamped with upJSONVersion, to Stdout. Every
+// JSON document "tailscale up --json" prints goes through here.
+func printUpJSON(js *upOutputJSON) {
+	js.Version = upJSONVersion
 	data, err := json.MarshalIndent(js, "", "  ")
 	if err != nil {
-		log.Printf("printUpDoneJSON marshalling error: %v", err)
-	} else {
-		fmt.Println(string(data))
+		log.Printf("upOutputJSON marshalling error: %v", err)
+		return
 	}
+	outln(string(data))
 }
 
 var (
@@ -670,21 +2676,26 @@ func printUpDoneJSON(state ipn.State, errorString string) {
 func init() {
 	// Both these have the same ipn.Pref:
 	addPrefFlagMapping("advertise-exit-node", "AdvertiseRoutes")
-	addPrefFlagMapping("advertise-routes", "AdvertiseRoutes")
+	addPrefFlagMapping("advertise-routes", "AdvertiseRoutes", "AdvertiseRouteComments")
 
 	// And this flag has two ipn.Prefs:
 	addPrefFlagMapping("exit-node", "ExitNodeIP", "ExitNodeID")
 
 	// The rest are 1:1:
-	addPrefFlagMapping("accept-dns", "CorpDNS")
+	addPrefFlagMapping("accept-dns", "CorpDNS", "CorpDNSSplitOnly", "CorpDNSMagicOnly")
 	addPrefFlagMapping("accept-routes", "RouteAll")
+	addPrefFlagMapping("accept-routes-no-default", "RouteAllNoDefault")
+	addPrefFlagMapping("accept-routes-filter", "RouteAllFilter")
 	addPrefFlagMapping("advertise-tags", "AdvertiseTags")
 	addPrefFlagMapping("host-routes", "AllowSingleHosts")
 	addPrefFlagMapping("hostname", "Hostname")
 	addPrefFlagMapping("login-server", "ControlURL")
-	addPrefFlagMapping("netfilter-mode", "NetfilterMode")
+	addPrefFlagMapping("netfilter-mode", "NetfilterMode", "NetfilterBackend")
+	addPrefFlagMapping("dns", "DNSBackend")
 	addPrefFlagMapping("shields-up", "ShieldsUp")
 	addPrefFlagMapping("snat-subnet-routes", "NoSNAT")
+	addPrefFlagMapping("masquerade", "NoSNAT")
+	addPrefFlagMapping("masquerade-to", "MasqueradeTo")
 	addPrefFlagMapping("exit-node-allow-lan-access", "ExitNodeAllowLANAccess")
 	addPrefFlagMapping("unattended", "ForceDaemon")
 	addPrefFlagMapping("operator", "OperatorUser")
@@ -702,11 +2713,115 @@ func addPrefFlagMapping(flagName string, prefNames ...string) {
 	}
 }
 
+// prefsWithoutFlag are the ipn.Prefs fields that deliberately have no
+// up flag, with the reason why.
+var prefsWithoutFlag = map[string]string{
+	"WantRunning": "handled (ignored) by checkForAccidentalSettingReverts",
+	"Persist":     "handled (ignored) by checkForAccidentalSettingReverts",
+	"LoggedOut":   "handled (ignored) by checkForAccidentalSettingReverts",
+	"NotepadURLs": "TODO(bradfitz): https://github.com/tailscale/tailscale/issues/1830",
+
+	"ExitNodeSuspended": "session-only; set by the prefless --no-exit-node-this-session",
+}
+
+// checkPrefFlagMapping reports whether the up flags and ipn.Prefs
+// fields are still in sync, so that checkForAccidentalSettingReverts
+// guards every setting. It returns an error describing each up flag
+// (on any OS) that's neither prefless nor mapped to a pref with
+// addPrefFlagMapping, each mapping whose flag no longer exists or whose
+// pref has no MaskedPrefs field, and each pref that no flag sets and
+// isn't listed in prefsWithoutFlag.
+//
+// It's for use by tests.
+func checkPrefFlagMapping() error {
+	var errs []string
+	addErr := func(format string, args ...any) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	allFlags := map[string]bool{}
+	for _, goos := range []string{"linux", "darwin", "windows", "freebsd"} {
+		var upArgs upArgsT
+		newUpFlagSet(goos, &upArgs).VisitAll(func(f *flag.Flag) {
+			allFlags[f.Name] = true
+		})
+	}
+	for _, name := range sortedKeys(allFlags) {
+		if _, ok := prefsOfFlag[name]; !ok && !preflessFlag(name) {
+			addErr("up flag --%s has no ipn.Prefs mapping; add one with addPrefFlagMapping, or list it in preflessFlag", name)
+		}
+	}
+
+	prefHasFlag := map[string]bool{}
+	maskedType := reflect.TypeOf(ipn.MaskedPrefs{})
+	for _, name := range sortedKeys(prefsOfFlag) {
+		if !allFlags[name] {
+			addErr("addPrefFlagMapping has a mapping for --%s, which isn't an up flag", name)
+		}
+		for _, pref := range prefsOfFlag[name] {
+			prefHasFlag[pref] = true
+			if _, ok := maskedType.FieldByName(pref + "Set"); !ok {
+				addErr("ipn.MaskedPrefs has no %sSet field for --%s", pref, name)
+			}
+		}
+	}
+
+	prefType := reflect.TypeOf(ipn.Prefs{})
+	for i := 0; i < prefType.NumField(); i++ {
+		prefName := prefType.Field(i).Name
+		_, exempt := prefsWithoutFlag[prefName]
+		switch {
+		case prefHasFlag[prefName] && exempt:
+			addErr("ipn.Prefs field %q is set by an up flag but listed in prefsWithoutFlag", prefName)
+		case !prefHasFlag[prefName] && !exempt:
+			addErr("unexpected new ipn.Pref field %q is not handled by up.go (see addPrefFlagMapping and checkForAccidentalSettingReverts)", prefName)
+		}
+	}
+	for _, name := range sortedKeys(prefsWithoutFlag) {
+		if _, ok := prefType.FieldByName(name); !ok {
+			addErr("prefsWithoutFlag lists %q, which isn't an ipn.Prefs field", name)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flagAliases maps alternate flag names to the canonical flag they're
+// equivalent to. Only the canonical name is used when suggesting flags
+// in checkForAccidentalSettingReverts.
+var flagAliases = map[string]string{
+	"masquerade": "snat-subnet-routes",
+}
+
+// canonicalFlagName returns the flag that flagName is an alias of, or
+// flagName itself if it's not an alias.
+func canonicalFlagName(flagName string) string {
+	if canon, ok := flagAliases[flagName]; ok {
+		return canon
+	}
+	return flagName
+}
+
 // preflessFlag reports whether flagName is a flag that doesn't
 // correspond to an ipn.Pref.
 func preflessFlag(flagName string) bool {
 	switch flagName {
-	case "auth-key", "force-reauth", "reset", "qr", "json":
+	case "auth-key", "force-reauth", "reset", "except", "qr", "json", "role", "strict",
+		"oauth-client-id", "oauth-client-secret", "wait-for-peer", "timeout", "timeout-exit-code", "retry", "dry-run",
+		"json-prefs", "yes", "accept-risk", "profile", "no-exit-node-this-session":
 		return true
 	}
 	return false
@@ -741,6 +2856,38 @@ type upCheckEnv struct {
 	backendState  string
 	curExitNodeIP netaddr.IP
 	distro        distro.Distro
+
+	// st, if non-nil, is used to find the IP of the exit node
+	// selected by ID in whichever prefs are being rendered as
+	// flags. Without it, curExitNodeIP is used.
+	st *ipnstate.Status
+}
+
+// revertedFlags returns, in no particular order, the flags not in
+// flagIsSet whose values differ between flagsCur and flagsNew (as
+// returned by prefsToFlags), ignoring differences that don't matter.
+// Without --reset, these are the settings the user forgot to mention;
+// with it, they're the ones that will revert to their defaults.
+func revertedFlags(flagsCur, flagsNew map[string]any, flagIsSet map[string]bool, env upCheckEnv) []string {
+	var names []string
+	for flagName := range flagsCur {
+		valCur, valNew := flagsCur[flagName], flagsNew[flagName]
+		if flagIsSet[flagName] {
+			continue
+		}
+		if reflect.DeepEqual(valCur, valNew) {
+			continue
+		}
+		if flagName == "login-server" && ipn.IsLoginServerSynonym(valCur) && ipn.IsLoginServerSynonym(valNew) {
+			continue
+		}
+		if flagName == "accept-routes" && valNew == false && env.goos == "linux" && env.distro == distro.Synology {
+			// Issue 3176. Old prefs had 'RouteAll: true' on disk, so ignore that.
+			continue
+		}
+		names = append(names, flagName)
+	}
+	return names
 }
 
 // checkForAccidentalSettingReverts (the "up checker") checks for
@@ -765,8 +2912,10 @@ func checkForAccidentalSettingReverts(newPrefs, curPrefs *ipn.Prefs, env upCheck
 
 	flagIsSet := map[string]bool{}
 	env.flagSet.Visit(func(f *flag.Flag) {
-		flagIsSet[f.Name] = true
+		flagIsSet[canonicalFlagName(f.Name)] = true
 	})
+	// --profile only says whose settings curPrefs are.
+	delete(flagIsSet, "profile")
 
 	if len(flagIsSet) == 0 {
 		// A bare "tailscale up" is a special case to just
@@ -780,22 +2929,8 @@ func checkForAccidentalSettingReverts(newPrefs, curPrefs *ipn.Prefs, env upCheck
 	flagsNew := prefsToFlags(env, newPrefs)
 
 	var missing []string
-	for flagName := range flagsCur {
-		valCur, valNew := flagsCur[flagName], flagsNew[flagName]
-		if flagIsSet[flagName] {
-			continue
-		}
-		if reflect.DeepEqual(valCur, valNew) {
-			continue
-		}
-		if flagName == "login-server" && ipn.IsLoginServerSynonym(valCur) && ipn.IsLoginServerSynonym(valNew) {
-			continue
-		}
-		if flagName == "accept-routes" && valNew == false && env.goos == "linux" && env.distro == distro.Synology {
-			// Issue 3176. Old prefs had 'RouteAll: true' on disk, so ignore that.
-			continue
-		}
-		missing = append(missing, fmtFlagValueArg(flagName, valCur))
+	for _, flagName := range revertedFlags(flagsCur, flagsNew, flagIsSet, env) {
+		missing = append(missing, fmtFlagValueArg(env.goos, flagName, flagsCur[flagName]))
 	}
 	if len(missing) == 0 {
 		return nil
@@ -809,14 +2944,16 @@ func checkForAccidentalSettingReverts(newPrefs, curPrefs *ipn.Prefs, env upCheck
 		type isBool interface {
 			IsBoolFlag() bool
 		}
-		if ib, ok := f.Value.(isBool); ok && ib.IsBoolFlag() {
+		// Bool flags that also take a mode, like --accept-dns,
+		// are written out with their value when given one.
+		if ib, ok := f.Value.(isBool); ok && ib.IsBoolFlag() && (f.Value.String() == "true" || f.Value.String() == "false") {
 			if f.Value.String() == "false" {
 				explicit = append(explicit, "--"+f.Name+"=false")
 			} else {
 				explicit = append(explicit, "--"+f.Name)
 			}
 		} else {
-			explicit = append(explicit, fmtFlagValueArg(f.Name, f.Value.String()))
+			explicit = append(explicit, fmtFlagValueArg(env.goos, f.Name, f.Value.String()))
 		}
 	})
 
@@ -841,9 +2978,78 @@ func applyImplicitPrefs(prefs, oldPrefs *ipn.Prefs, curUser string) {
 	}
 }
 
+// keepSuspendedExitNode copies the current exit node settings into
+// prefs for "tailscale up --no-exit-node-this-session", so that
+// suspending the exit node doesn't also forget it. Settings whose flags
+// were given explicitly are left alone.
+func keepSuspendedExitNode(prefs, curPrefs *ipn.Prefs, fs *flag.FlagSet) {
+	flagIsSet := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		flagIsSet[f.Name] = true
+	})
+	if !flagIsSet["exit-node"] {
+		prefs.ExitNodeID = curPrefs.ExitNodeID
+		prefs.ExitNodeIP = curPrefs.ExitNodeIP
+	}
+	if !flagIsSet["exit-node-allow-lan-access"] {
+		prefs.ExitNodeAllowLANAccess = curPrefs.ExitNodeAllowLANAccess
+	}
+}
+
+// exceptFlags returns the canonical names of the flags in the
+// comma-separated list except, for --except. Each must be an up flag
+// on goos that controls a setting.
+func exceptFlags(goos, except string) ([]string, error) {
+	fs := newUpFlagSet(goos, new(upArgsT))
+	var names []string
+	for _, name := range strings.Split(except, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown flag %q in --except", name)
+		}
+		name = canonicalFlagName(name)
+		if _, ok := prefsOfFlag[name]; !ok {
+			return nil, fmt.Errorf("--%s in --except isn't a setting that --reset changes", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// keepExceptedPrefs copies into prefs, for "tailscale up --reset
+// --except=...", the current values of the settings controlled by the
+// flags listed in --except. Flags that were also given explicitly are
+// left alone.
+func keepExceptedPrefs(prefs, curPrefs *ipn.Prefs, env upCheckEnv) error {
+	if env.upArgs.except == "" {
+		return nil
+	}
+	names, err := exceptFlags(env.goos, env.upArgs.except)
+	if err != nil {
+		return err
+	}
+	flagIsSet := map[string]bool{}
+	env.flagSet.Visit(func(f *flag.Flag) {
+		flagIsSet[canonicalFlagName(f.Name)] = true
+	})
+	dst, src := reflect.ValueOf(prefs).Elem(), reflect.ValueOf(curPrefs).Elem()
+	for _, name := range names {
+		if flagIsSet[name] {
+			continue
+		}
+		for _, pref := range prefsOfFlag[name] {
+			dst.FieldByName(pref).Set(src.FieldByName(pref))
+		}
+	}
+	return nil
+}
+
 func flagAppliesToOS(flag, goos string) bool {
 	switch flag {
-	case "netfilter-mode", "snat-subnet-routes":
+	case "netfilter-mode", "snat-subnet-routes", "masquerade", "masquerade-to", "dns":
 		return goos == "linux"
 	case "unattended":
 		return goos == "windows"
@@ -858,15 +3064,24 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]any) {
 		if !prefs.ExitNodeIP.IsZero() {
 			return prefs.ExitNodeIP.String()
 		}
-		if prefs.ExitNodeID.IsZero() || env.curExitNodeIP.IsZero() {
+		if prefs.ExitNodeID.IsZero() {
 			return ""
 		}
-		return env.curExitNodeIP.String()
+		ip := env.curExitNodeIP
+		if env.st != nil {
+			// prefs may select a different exit node than the
+			// current one, as with --exit-node=<name>.
+			ip = exitNodeIP(prefs, env.st)
+		}
+		if ip.IsZero() {
+			return ""
+		}
+		return ip.String()
 	}
 
 	fs := newUpFlagSet(env.goos, new(upArgsT) /* dummy */)
 	fs.VisitAll(func(f *flag.Flag) {
-		if preflessFlag(f.Name) {
+		if preflessFlag(f.Name) || canonicalFlagName(f.Name) != f.Name {
 			return
 		}
 		set := func(v any) {
@@ -885,10 +3100,25 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]any) {
 			set(prefs.ControlURL)
 		case "accept-routes":
 			set(prefs.RouteAll)
+		case "accept-routes-no-default":
+			set(prefs.RouteAllNoDefault)
+		case "accept-routes-filter":
+			var filter []string
+			for _, r := range prefs.RouteAllFilter {
+				filter = append(filter, r.String())
+			}
+			set(strings.Join(filter, ","))
 		case "host-routes":
 			set(prefs.AllowSingleHosts)
 		case "accept-dns":
-			set(prefs.CorpDNS)
+			switch {
+			case prefs.CorpDNS && prefs.CorpDNSMagicOnly:
+				set("prefer-magic")
+			case prefs.CorpDNS && prefs.CorpDNSSplitOnly:
+				set("split")
+			default:
+				set(prefs.CorpDNS)
+			}
 		case "shields-up":
 			set(prefs.ShieldsUp)
 		case "exit-node":
@@ -896,7 +3126,7 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]any) {
 		case "exit-node-allow-lan-access":
 			set(prefs.ExitNodeAllowLANAccess)
 		case "advertise-tags":
-			set(strings.Join(prefs.AdvertiseTags, ","))
+			set(strings.Join(canonicalTags(prefs.AdvertiseTags), ","))
 		case "hostname":
 			set(prefs.Hostname)
 		case "operator":
@@ -908,14 +3138,30 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]any) {
 					sb.WriteByte(',')
 				}
 				sb.WriteString(r.String())
+				if c, ok := prefs.AdvertiseRouteComments[r]; ok {
+					sb.WriteByte('#')
+					sb.WriteString(c)
+				}
 			}
 			set(sb.String())
 		case "advertise-exit-node":
 			set(hasExitNodeRoutes(prefs.AdvertiseRoutes))
 		case "snat-subnet-routes":
 			set(!prefs.NoSNAT)
+		case "masquerade-to":
+			if prefs.MasqueradeTo.IsZero() {
+				set("")
+			} else {
+				set(prefs.MasqueradeTo.String())
+			}
 		case "netfilter-mode":
-			set(prefs.NetfilterMode.String())
+			if prefs.NetfilterBackend != "" {
+				set(prefs.NetfilterMode.String() + "/" + prefs.NetfilterBackend)
+			} else {
+				set(prefs.NetfilterMode.String())
+			}
+		case "dns":
+			set(prefs.DNSBackend)
 		case "unattended":
 			set(prefs.ForceDaemon)
 		}
@@ -923,16 +3169,52 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]any) {
 	return ret
 }
 
-func fmtFlagValueArg(flagName string, val any) string {
+// fmtFlagValueArg formats a flag and its value as an argument that can
+// be pasted into the usual shell on goos: PowerShell on Windows, and a
+// POSIX shell everywhere else.
+func fmtFlagValueArg(goos, flagName string, val any) string {
 	if val == true {
 		return "--" + flagName
 	}
 	if val == "" {
 		return "--" + flagName + "="
 	}
+	if goos == "windows" {
+		return fmt.Sprintf("--%s=%s", flagName, powershellQuote(fmt.Sprint(val)))
+	}
 	return fmt.Sprintf("--%s=%v", flagName, shellquote.Join(fmt.Sprint(val)))
 }
 
+// powershellQuote returns s quoted, if it needs to be, so that
+// PowerShell passes it to a native command as a single argument. Commas
+// need quoting too, as PowerShell would otherwise make an array of the
+// comma-separated parts.
+func powershellQuote(s string) string {
+	needsQuote := strings.IndexFunc(s, func(r rune) bool {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return false
+		}
+		return !strings.ContainsRune(`-_./:=+@\`, r)
+	}) >= 0
+	if !needsQuote {
+		return s
+	}
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '`', '$':
+			// Backtick is PowerShell's escape character inside
+			// double quotes.
+			sb.WriteByte('`')
+		}
+		sb.WriteRune(r)
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
 func hasExitNodeRoutes(rr []netaddr.IPPrefix) bool {
 	var v4, v6 bool
 	for _, r := range rr {
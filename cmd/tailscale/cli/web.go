@@ -469,8 +469,13 @@ func tailscaleUp(ctx context.Context, prefs *ipn.Prefs, forceReauth bool) (authU
 
 	bc.SetPrefs(prefs)
 
+	// Stay on the login profile that "tailscale up --profile" picked.
+	stateKey := ipn.GlobalDaemonStateKey
+	if lp, err := tailscale.CurrentLoginProfile(ctx); err == nil {
+		stateKey = ipn.ProfileStateKey(lp.Name)
+	}
 	bc.Start(ipn.Options{
-		StateKey: ipn.GlobalDaemonStateKey,
+		StateKey: stateKey,
 	})
 	if forceReauth {
 		bc.StartLoginInteractive()
@@ -7,6 +7,7 @@
 package main // import "tailscale.com/cmd/tailscale"
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -23,6 +24,10 @@ func main() {
 	}
 	if err := cli.Run(args); err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		var ec interface{ ExitCode() int }
+		if errors.As(err, &ec) {
+			os.Exit(ec.ExitCode())
+		}
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,39 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.18 && (linux || darwin || freebsd || openbsd)
+// +build go1.18
+// +build linux darwin freebsd openbsd
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// stateLockFile is the open lock file for the state, kept referenced so
+// it's not closed (releasing the lock) until the process exits.
+var stateLockFile *os.File
+
+// lockStateFile takes an exclusive lock on path+".lock", so that a
+// second tailscaled started with the same state file fails fast instead
+// of both fighting over it. The lock is held until the process exits.
+func lockStateFile(path string) error {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return fmt.Errorf("state %s is locked; is tailscaled already running with it?", path)
+		}
+		return fmt.Errorf("locking state %s: %w", path, err)
+	}
+	stateLockFile = f
+	return nil
+}
@@ -0,0 +1,11 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.18 && !linux && !darwin && !freebsd && !openbsd
+// +build go1.18,!linux,!darwin,!freebsd,!openbsd
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+// lockStateFile is a no-op on platforms without flock.
+func lockStateFile(path string) error { return nil }
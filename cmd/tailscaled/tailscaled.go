@@ -317,6 +317,11 @@ func run() error {
 	if err := trySynologyMigration(statePathOrDefault()); err != nil {
 		log.Printf("error in synology migration: %v", err)
 	}
+	if statePath := statePathOrDefault(); store.IsFileStorePath(statePath) {
+		if err := lockStateFile(statePath); err != nil {
+			return err
+		}
+	}
 
 	var debugMux *http.ServeMux
 	if args.debug != "" {
@@ -331,6 +336,14 @@ func run() error {
 
 	socksListener, httpProxyListener := mustStartProxyListeners(args.socksAddr, args.httpProxyAddr)
 
+	store, err := store.New(logf, statePathOrDefault())
+	if err != nil {
+		return fmt.Errorf("store.New: %w", err)
+	}
+	if runtime.GOOS == "linux" {
+		setDNSBackendFromPrefs(logf, store)
+	}
+
 	dialer := new(tsdial.Dialer) // mutated below (before used)
 	e, useNetstack, err := createEngine(logf, linkMon, dialer)
 	if err != nil {
@@ -363,6 +376,9 @@ func run() error {
 		dialer.NetstackDialTCP = func(ctx context.Context, dst netaddr.IPPort) (net.Conn, error) {
 			return ns.DialContextTCP(ctx, dst)
 		}
+		dialer.NetstackDialUDP = func(ctx context.Context, dst netaddr.IPPort) (net.Conn, error) {
+			return ns.DialContextUDP(ctx, dst)
+		}
 	}
 	if socksListener != nil || httpProxyListener != nil {
 		if httpProxyListener != nil {
@@ -404,11 +420,17 @@ func run() error {
 	}()
 
 	opts := ipnServerOpts()
-
-	store, err := store.New(logf, statePathOrDefault())
-	if err != nil {
-		return fmt.Errorf("store.New: %w", err)
+	if opts.AutostartStateKey == ipn.GlobalDaemonStateKey {
+		// Start with the login profile last selected by
+		// "tailscale up --profile", if any.
+		key, err := ipn.CurrentDaemonStateKey(store)
+		if err != nil {
+			logf("reading current login profile: %v; using the default profile", err)
+		} else {
+			opts.AutostartStateKey = key
+		}
 	}
+
 	srv, err := ipnserver.New(logf, pol.PublicID.String(), store, e, dialer, nil, opts)
 	if err != nil {
 		return fmt.Errorf("ipnserver.New: %w", err)
@@ -436,6 +458,31 @@ func run() error {
 	return nil
 }
 
+// setDNSBackendFromPrefs forces the DNS management mode to the
+// DNSBackend pref saved in store for the current login profile, if
+// any. The OS DNS configurator is made along with the engine, before
+// the LocalBackend loads its prefs, so this peeks at them early.
+func setDNSBackendFromPrefs(logf logger.Logf, store ipn.StateStore) {
+	key, err := ipn.CurrentDaemonStateKey(store)
+	if err != nil {
+		return
+	}
+	bs, err := store.ReadState(key)
+	if err != nil {
+		// Most likely ipn.ErrStateNotExist on first run; either
+		// way, the backend will report problems reading state.
+		return
+	}
+	prefs, err := ipn.PrefsFromBytes(bs, false)
+	if err != nil {
+		logf("can't read prefs for DNS backend: %v", err)
+		return
+	}
+	if prefs.DNSBackend != "" {
+		dns.SetForcedMode(prefs.DNSBackend)
+	}
+}
+
 func createEngine(logf logger.Logf, linkMon *monitor.Mon, dialer *tsdial.Dialer) (e wgengine.Engine, useNetstack bool, err error) {
 	if args.tunname == "" {
 		return nil, false, errors.New("no --tun value specified")
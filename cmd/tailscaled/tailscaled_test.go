@@ -4,10 +4,40 @@
 
 package main // import "tailscale.com/cmd/tailscaled"
 
-import "testing"
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
 
 func TestNothing(t *testing.T) {
 	// This test does nothing on purpose, so we can run
 	// GODEBUG=memprofilerate=1 go test -v -run=Nothing -memprofile=prof.mem
 	// without any errors about no matching tests.
 }
+
+func TestLockStateFile(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("flock semantics only checked on Linux")
+	}
+	path := filepath.Join(t.TempDir(), "tailscaled.state")
+	if err := lockStateFile(path); err != nil {
+		t.Fatal(err)
+	}
+	f := stateLockFile
+	defer f.Close()
+
+	// flock locks belong to the open file, so a second lock attempt
+	// fails even from the same process.
+	err := lockStateFile(path)
+	if err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Fatalf("second lock: got %v; want already running error", err)
+	}
+
+	f.Close()
+	if err := lockStateFile(path); err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	stateLockFile.Close()
+}
@@ -5,6 +5,7 @@
 package controlclient
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -85,6 +86,44 @@ func TestNewDirect(t *testing.T) {
 	}
 }
 
+func TestServerURLPathPrefix(t *testing.T) {
+	var gotPath string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		json.NewEncoder(w).Encode(&tailcfg.OverTLSPublicKeyResponse{
+			LegacyPublicKey: key.NewMachine().Public(),
+		})
+	}))
+	defer ts.Close()
+
+	c, err := NewDirect(Options{
+		ServerURL: ts.URL + "/tailscale/",
+		GetMachinePrivateKey: func() (key.MachinePrivate, error) {
+			return key.NewMachine(), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ts.URL + "/tailscale"; c.serverURL != want {
+		t.Errorf("c.serverURL = %q; want %q", c.serverURL, want)
+	}
+	if _, err := loadServerPubKeys(context.Background(), ts.Client(), c.serverURL); err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != "/tailscale/key" {
+		t.Errorf("key fetched from %q; want /tailscale/key", gotPath)
+	}
+
+	nc, err := newNoiseClient(key.NewMachine(), key.NewMachine().Public(), c.serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nc.serverPath != "/tailscale" {
+		t.Errorf("noise client serverPath = %q; want /tailscale", nc.serverPath)
+	}
+}
+
 func fakeEndpoints(ports ...uint16) (ret []tailcfg.Endpoint) {
 	for _, port := range ports {
 		ret = append(ret, tailcfg.Endpoint{
@@ -66,6 +66,14 @@
 // The provided ctx is only used for the initial connection, until
 // Dial returns. It does not affect the connection once established.
 func Dial(ctx context.Context, addr string, machineKey key.MachinePrivate, controlKey key.MachinePublic, protocolVersion uint16) (*controlbase.Conn, error) {
+	return DialWithPathPrefix(ctx, addr, "", machineKey, controlKey, protocolVersion)
+}
+
+// DialWithPathPrefix is like Dial, but for a control server whose URLs
+// all start with pathPrefix (such as "/tailscale"), as when it's behind
+// a reverse proxy that routes on the path. pathPrefix must not end in
+// a slash.
+func DialWithPathPrefix(ctx context.Context, addr, pathPrefix string, machineKey key.MachinePrivate, controlKey key.MachinePublic, protocolVersion uint16) (*controlbase.Conn, error) {
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
@@ -73,6 +81,7 @@ func Dial(ctx context.Context, addr string, machineKey key.MachinePrivate, contr
 	a := &dialParams{
 		ctx:        ctx,
 		host:       host,
+		pathPrefix: pathPrefix,
 		httpPort:   port,
 		httpsPort:  "443",
 		machineKey: machineKey,
@@ -86,6 +95,7 @@ func Dial(ctx context.Context, addr string, machineKey key.MachinePrivate, contr
 type dialParams struct {
 	ctx        context.Context
 	host       string
+	pathPrefix string // prepended to serverUpgradePath
 	httpPort   string
 	httpsPort  string
 	machineKey key.MachinePrivate
@@ -106,7 +116,7 @@ func (a *dialParams) dial() (*controlbase.Conn, error) {
 	u := &url.URL{
 		Scheme: "http",
 		Host:   net.JoinHostPort(a.host, a.httpPort),
-		Path:   serverUpgradePath,
+		Path:   a.pathPrefix + serverUpgradePath,
 	}
 	conn, httpErr := a.tryURL(u, init)
 	if httpErr == nil {
@@ -25,14 +25,22 @@
 
 func TestControlHTTP(t *testing.T) {
 	tests := []struct {
-		name  string
-		proxy proxy
+		name       string
+		proxy      proxy
+		pathPrefix string
 	}{
 		// direct connection
 		{
 			name:  "no_proxy",
 			proxy: nil,
 		},
+		// direct connection to a server behind a path-routing
+		// reverse proxy
+		{
+			name:       "no_proxy_path_prefix",
+			proxy:      nil,
+			pathPrefix: "/tailscale",
+		},
 		// SOCKS5
 		{
 			name:  "socks5",
@@ -96,17 +104,23 @@ func TestControlHTTP(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			testControlHTTP(t, test.proxy)
+			testControlHTTP(t, test.proxy, test.pathPrefix)
 		})
 	}
 }
 
-func testControlHTTP(t *testing.T, proxy proxy) {
+func testControlHTTP(t *testing.T, proxy proxy, pathPrefix string) {
 	client, server := key.NewMachine(), key.NewMachine()
 
 	const testProtocolVersion = 1
 	sch := make(chan serverResult, 1)
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if want := pathPrefix + serverUpgradePath; r.URL.Path != want {
+			err := fmt.Errorf("upgrade request for %q; want %q", r.URL.Path, want)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			sch <- serverResult{err: err}
+			return
+		}
 		conn, err := AcceptHTTP(context.Background(), w, r, server)
 		if err != nil {
 			log.Print(err)
@@ -149,6 +163,7 @@ func testControlHTTP(t *testing.T, proxy proxy) {
 	a := dialParams{
 		ctx:         context.Background(), //ctx,
 		host:        "localhost",
+		pathPrefix:  pathPrefix,
 		httpPort:    strconv.Itoa(httpLn.Addr().(*net.TCPAddr).Port),
 		httpsPort:   strconv.Itoa(httpsLn.Addr().(*net.TCPAddr).Port),
 		machineKey:  client,
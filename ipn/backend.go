@@ -171,9 +171,25 @@ type PartialFile struct {
 // * on Windows, it's the empty string (in client mode) or, via
 //   LocalBackend.userID, a string like "user-$USER_ID" (used in
 //   server mode).
-// * on Linux/etc, it's always "_daemon" (ipn.GlobalDaemonStateKey)
+// * on Linux/etc, it's "_daemon" (ipn.GlobalDaemonStateKey), or
+//   the ipn.ProfileStateKey of the login profile selected with
+//   "tailscale up --profile"
 type StateKey string
 
+// LoginProfile is a login profile, as selected with "tailscale up
+// --profile", and its saved prefs.
+type LoginProfile struct {
+	// Name is the profile's name, or empty for the default profile.
+	Name string
+
+	// Current is whether tailscaled is using the profile.
+	Current bool
+
+	// Prefs are the profile's prefs, with any private keys removed,
+	// or nil if the profile has never been used.
+	Prefs *Prefs `json:",omitempty"`
+}
+
 type Options struct {
 	// FrontendLogID is the public logtail id used by the frontend.
 	FrontendLogID string
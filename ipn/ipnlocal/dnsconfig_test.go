@@ -287,6 +287,63 @@ func TestDNSConfigForNetmap(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "split_only",
+			nm: &netmap.NetworkMap{
+				DNS: tailcfg.DNSConfig{
+					Resolvers: []dnstype.Resolver{
+						{Addr: "8.8.8.8"},
+					},
+					FallbackResolvers: []dnstype.Resolver{
+						{Addr: "8.8.4.4"},
+					},
+					Routes: map[string][]dnstype.Resolver{
+						"foo.com.": {{Addr: "1.2.3.4"}},
+					},
+					Domains: []string{"foo.com"},
+				},
+			},
+			prefs: &ipn.Prefs{
+				CorpDNS:          true,
+				CorpDNSSplitOnly: true,
+				ExitNodeID:       "some-id",
+			},
+			want: &dns.Config{
+				Hosts: map[dnsname.FQDN][]netaddr.IP{},
+				Routes: map[dnsname.FQDN][]dnstype.Resolver{
+					"foo.com.": {{Addr: "1.2.3.4"}},
+				},
+				SearchDomains: []dnsname.FQDN{"foo.com."},
+			},
+		},
+		{
+			name: "magic_only",
+			nm: &netmap.NetworkMap{
+				DNS: tailcfg.DNSConfig{
+					Resolvers: []dnstype.Resolver{
+						{Addr: "8.8.8.8"},
+					},
+					FallbackResolvers: []dnstype.Resolver{
+						{Addr: "8.8.4.4"},
+					},
+					Routes: map[string][]dnstype.Resolver{
+						"foo.com.": {{Addr: "1.2.3.4"}},
+					},
+					Domains: []string{"tailnet.ts.net"},
+				},
+			},
+			prefs: &ipn.Prefs{
+				CorpDNS:          true,
+				CorpDNSSplitOnly: true,
+				CorpDNSMagicOnly: true,
+				ExitNodeID:       "some-id",
+			},
+			want: &dns.Config{
+				Hosts:         map[dnsname.FQDN][]netaddr.IP{},
+				Routes:        map[dnsname.FQDN][]dnstype.Resolver{},
+				SearchDomains: []dnsname.FQDN{"tailnet.ts.net."},
+			},
+		},
 		{
 			name: "not_exit_node_NOT_need_fallbacks",
 			nm: &netmap.NetworkMap{
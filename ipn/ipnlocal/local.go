@@ -50,6 +50,7 @@
 	"tailscale.com/types/views"
 	"tailscale.com/util/deephash"
 	"tailscale.com/util/dnsname"
+	"tailscale.com/util/mak"
 	"tailscale.com/util/multierr"
 	"tailscale.com/util/osshare"
 	"tailscale.com/util/systemd"
@@ -361,7 +362,12 @@ func (b *LocalBackend) Shutdown() {
 func (b *LocalBackend) Prefs() *ipn.Prefs {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	p := b.prefs.Clone()
+	return withoutPrivateKeys(b.prefs.Clone())
+}
+
+// withoutPrivateKeys removes any private keys from p, which may be nil,
+// and returns it.
+func withoutPrivateKeys(p *ipn.Prefs) *ipn.Prefs {
 	if p != nil && p.Persist != nil {
 		p.Persist.LegacyFrontendPrivateMachineKey = key.MachinePrivate{}
 		p.Persist.PrivateNodeKey = key.NodePrivate{}
@@ -370,6 +376,48 @@ func (b *LocalBackend) Prefs() *ipn.Prefs {
 	return p
 }
 
+// LoginProfile returns the named login profile, with its saved prefs.
+// If current is true, it returns the profile b is using instead, which
+// is the default profile if b's state isn't a login profile's.
+func (b *LocalBackend) LoginProfile(name string, current bool) (*ipn.LoginProfile, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	curName, isProfile := ipn.ProfileOfStateKey(b.stateKey)
+	if current {
+		return &ipn.LoginProfile{
+			Name:    curName,
+			Current: true,
+			Prefs:   withoutPrivateKeys(b.prefs.Clone()),
+		}, nil
+	}
+	if name != "" {
+		if err := ipn.CheckProfileName(name); err != nil {
+			return nil, err
+		}
+	}
+	lp := &ipn.LoginProfile{
+		Name:    name,
+		Current: isProfile && name == curName,
+	}
+	if lp.Current {
+		lp.Prefs = withoutPrivateKeys(b.prefs.Clone())
+		return lp, nil
+	}
+	bs, err := b.store.ReadState(ipn.ProfileStateKey(name))
+	switch {
+	case errors.Is(err, ipn.ErrStateNotExist):
+		return lp, nil
+	case err != nil:
+		return nil, err
+	}
+	p, err := ipn.PrefsFromBytes(bs, false)
+	if err != nil {
+		return nil, fmt.Errorf("prefs of login profile %q: %w", name, err)
+	}
+	lp.Prefs = withoutPrivateKeys(p)
+	return lp, nil
+}
+
 // Status returns the latest status of the backend and its
 // sub-components.
 func (b *LocalBackend) Status() *ipnstate.Status {
@@ -442,6 +490,13 @@ func (b *LocalBackend) updateStatus(sb *ipnstate.StatusBuilder, extraLocked func
 		for _, pln := range b.peerAPIListeners {
 			ss.PeerAPIURL = append(ss.PeerAPIURL, pln.urlStr)
 		}
+		if b.prefs != nil {
+			for _, r := range b.prefs.AdvertiseRoutes {
+				if c, ok := b.prefs.AdvertiseRouteComments[r]; ok {
+					mak.Set(&ss.RouteComments, r, c)
+				}
+			}
+		}
 	})
 	// TODO: hostinfo, and its networkinfo
 	// TODO: EngineStatus copy (and deprecate it?)
@@ -497,7 +552,7 @@ func (b *LocalBackend) populatePeerStatusLocked(sb *ipnstate.StatusBuilder) {
 			LastSeen:       lastSeen,
 			Online:         p.Online != nil && *p.Online,
 			ShareeNode:     p.Hostinfo.ShareeNode(),
-			ExitNode:       p.StableID != "" && p.StableID == b.prefs.ExitNodeID,
+			ExitNode:       p.StableID != "" && p.StableID == b.prefs.ExitNodeID && !b.prefs.ExitNodeSuspended,
 			ExitNodeOption: exitNodeOption,
 			SSH_HostKeys:   p.Hostinfo.SSH_HostKeys().AsSlice(),
 		})
@@ -943,6 +998,12 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		b.mu.Unlock()
 		return fmt.Errorf("loading requested state: %v", err)
 	}
+	if profile, ok := ipn.ProfileOfStateKey(opts.StateKey); ok {
+		// Come back to this login profile if tailscaled restarts.
+		if err := b.store.WriteState(ipn.CurrentProfileKey, []byte(profile)); err != nil {
+			b.logf("failed to save current login profile: %v", err)
+		}
+	}
 
 	if opts.UpdatePrefs != nil {
 		newPrefs := opts.UpdatePrefs
@@ -1818,7 +1879,19 @@ func (b *LocalBackend) checkPrefsLocked(p *ipn.Prefs) error {
 }
 
 func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	return b.EditPrefsIfMatch(mp, "")
+}
+
+// EditPrefsIfMatch is like EditPrefs, but if etag is non-empty, it
+// only applies mp if the current prefs (as returned by Prefs) still
+// have that ETag. Otherwise it returns ipn.ErrPrefsChanged and leaves
+// the prefs alone.
+func (b *LocalBackend) EditPrefsIfMatch(mp *ipn.MaskedPrefs, etag string) (*ipn.Prefs, error) {
 	b.mu.Lock()
+	if etag != "" && withoutPrivateKeys(b.prefs.Clone()).ETag() != etag {
+		b.mu.Unlock()
+		return nil, ipn.ErrPrefsChanged
+	}
 	p0 := b.prefs.Clone()
 	p1 := b.prefs.Clone()
 	p1.ApplyEdits(mp)
@@ -1865,6 +1938,11 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 
 	oldp := b.prefs
 	newp.Persist = oldp.Persist // caller isn't allowed to override this
+	if !newp.WantRunning {
+		// A suspended exit node only stays suspended until the
+		// session ends.
+		newp.ExitNodeSuspended = false
+	}
 	b.prefs = newp
 	// findExitNodeIDLocked returns whether it updated b.prefs, but
 	// everything in this function treats b.prefs as completely new
@@ -2074,6 +2152,13 @@ func (b *LocalBackend) authReconfig() {
 		b.logf("[v1] authReconfig: skipping because !WantRunning.")
 		return
 	}
+	if prefs.ExitNodeSuspended {
+		// Configure everything as if no exit node were selected,
+		// without touching the selection in b.prefs.
+		prefs = prefs.Clone()
+		prefs.ExitNodeID = ""
+		prefs.ExitNodeIP = netaddr.IP{}
+	}
 
 	var flags netmap.WGConfigFlags
 	if prefs.RouteAll {
@@ -2082,6 +2167,9 @@ func (b *LocalBackend) authReconfig() {
 	if prefs.AllowSingleHosts {
 		flags |= netmap.AllowSingleHosts
 	}
+	if prefs.RouteAllNoDefault {
+		flags |= netmap.NoUnselectedDefaultRoutes
+	}
 	if hasPAC && disableSubnetsIfPAC {
 		if flags&netmap.AllowSubnetRoutes != 0 {
 			b.logf("authReconfig: have PAC; disabling subnet routes")
@@ -2098,7 +2186,7 @@ func (b *LocalBackend) authReconfig() {
 		b.dialer.SetExitDNSDoH("")
 	}
 
-	cfg, err := nmcfg.WGCfg(nm, b.logf, flags, prefs.ExitNodeID)
+	cfg, err := nmcfg.WGCfg(nm, b.logf, flags, prefs.ExitNodeID, prefs.RouteAllFilter)
 	if err != nil {
 		b.logf("wgcfg: %v", err)
 		return
@@ -2209,6 +2297,11 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, prefs *ipn.Prefs, logf logger.Log
 			dcfg.Routes[dom] = nil // resolve internally with dcfg.Hosts
 		}
 	}
+	if prefs.CorpDNSMagicOnly {
+		// Only MagicDNS; the OS's resolver keeps everything else,
+		// including the tailnet's split DNS domains.
+		return dcfg
+	}
 
 	addDefault := func(resolvers []dnstype.Resolver) {
 		for _, r := range resolvers {
@@ -2216,14 +2309,20 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, prefs *ipn.Prefs, logf logger.Log
 		}
 	}
 
+	// With CorpDNSSplitOnly, none of the default resolvers below are
+	// used, only the routes.
+	splitOnly := prefs.CorpDNSSplitOnly
+
 	// If we're using an exit node and that exit node is new enough (1.19.x+)
 	// to run a DoH DNS proxy, then send all our DNS traffic through it.
-	if dohURL, ok := exitNodeCanProxyDNS(nm, prefs.ExitNodeID); ok {
+	if dohURL, ok := exitNodeCanProxyDNS(nm, prefs.ExitNodeID); ok && !splitOnly {
 		addDefault([]dnstype.Resolver{{Addr: dohURL}})
 		return dcfg
 	}
 
-	addDefault(nm.DNS.Resolvers)
+	if !splitOnly {
+		addDefault(nm.DNS.Resolvers)
+	}
 	for suffix, resolvers := range nm.DNS.Routes {
 		fqdn, err := dnsname.ToFQDN(suffix)
 		if err != nil {
@@ -2250,6 +2349,8 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, prefs *ipn.Prefs, logf logger.Log
 	// https://github.com/tailscale/tailscale/issues/1743 for
 	// details.
 	switch {
+	case splitOnly:
+		// The user asked for a purely split-DNS config.
 	case len(dcfg.DefaultResolvers) != 0:
 		// Default resolvers already set.
 	case !prefs.ExitNodeID.IsZero():
@@ -2514,7 +2615,9 @@ func (b *LocalBackend) routerConfig(cfg *wgcfg.Config, prefs *ipn.Prefs, oneCGNA
 		LocalAddrs:       unmapIPPrefixes(cfg.Addresses),
 		SubnetRoutes:     unmapIPPrefixes(prefs.AdvertiseRoutes),
 		SNATSubnetRoutes: !prefs.NoSNAT,
+		SNATSource:       prefs.MasqueradeTo,
 		NetfilterMode:    prefs.NetfilterMode,
+		NetfilterBackend: prefs.NetfilterBackend,
 		Routes:           peerRoutes(cfg.Peers, singleRouteThreshold),
 	}
 
@@ -475,6 +475,116 @@ func (panicOnUseTransport) RoundTrip(*http.Request) (*http.Response, error) {
 	panic("unexpected HTTP request")
 }
 
+func TestLoginProfile(t *testing.T) {
+	var logf logger.Logf = logger.Discard
+	store := new(mem.Store)
+	eng, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	lb, err := NewLocalBackend(logf, "logid", store, nil, eng, 0)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	lb.SetHTTPTestClient(&http.Client{
+		Transport: panicOnUseTransport{}, // not running, so no HTTP requests
+	})
+
+	defaultPrefs := ipn.NewPrefs()
+	defaultPrefs.WantRunning = false
+	store.WriteState(ipn.GlobalDaemonStateKey, defaultPrefs.ToBytes())
+
+	workPrefs := ipn.NewPrefs()
+	workPrefs.ControlURL = "https://ctl.example.com"
+	workPrefs.WantRunning = false
+	if err := lb.Start(ipn.Options{
+		StateKey:    ipn.ProfileStateKey("work"),
+		UpdatePrefs: workPrefs,
+	}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	if key, err := ipn.CurrentDaemonStateKey(store); err != nil || key != ipn.ProfileStateKey("work") {
+		t.Errorf("CurrentDaemonStateKey = %q, %v; want %q", key, err, ipn.ProfileStateKey("work"))
+	}
+
+	check := func(name string, current bool, wantName string, wantCurrent bool, wantControlURL string) {
+		t.Helper()
+		lp, err := lb.LoginProfile(name, current)
+		if err != nil {
+			t.Fatalf("LoginProfile(%q, %v): %v", name, current, err)
+		}
+		if lp.Name != wantName || lp.Current != wantCurrent {
+			t.Errorf("LoginProfile(%q, %v) = name %q, current %v; want %q, %v", name, current, lp.Name, lp.Current, wantName, wantCurrent)
+		}
+		gotControlURL := "<nil prefs>"
+		if lp.Prefs != nil {
+			gotControlURL = lp.Prefs.ControlURL
+		}
+		if gotControlURL != wantControlURL {
+			t.Errorf("LoginProfile(%q, %v) ControlURL = %q; want %q", name, current, gotControlURL, wantControlURL)
+		}
+	}
+	check("", true, "work", true, "https://ctl.example.com")
+	check("work", false, "work", true, "https://ctl.example.com")
+	check("", false, "", false, "")
+	check("home", false, "home", false, "<nil prefs>")
+
+	if _, err := lb.LoginProfile("Not Valid", false); err == nil {
+		t.Error("LoginProfile with an invalid name succeeded")
+	}
+}
+
+func TestEditPrefsIfMatch(t *testing.T) {
+	var logf logger.Logf = logger.Discard
+	store := new(mem.Store)
+	eng, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	lb, err := NewLocalBackend(logf, "logid", store, nil, eng, 0)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	lb.SetHTTPTestClient(&http.Client{
+		Transport: panicOnUseTransport{}, // not running, so no HTTP requests
+	})
+	prefs := ipn.NewPrefs()
+	prefs.WantRunning = false
+	if err := lb.Start(ipn.Options{
+		StateKey:    ipn.GlobalDaemonStateKey,
+		UpdatePrefs: prefs,
+	}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	etag := lb.Prefs().ETag()
+	p, err := lb.EditPrefsIfMatch(&ipn.MaskedPrefs{
+		Prefs:       ipn.Prefs{Hostname: "first"},
+		HostnameSet: true,
+	}, etag)
+	if err != nil {
+		t.Fatalf("EditPrefsIfMatch with current ETag: %v", err)
+	}
+	if p.Hostname != "first" {
+		t.Errorf("Hostname = %q; want %q", p.Hostname, "first")
+	}
+
+	// A second edit made with the now-stale ETag must not clobber the first.
+	_, err = lb.EditPrefsIfMatch(&ipn.MaskedPrefs{
+		Prefs:       ipn.Prefs{Hostname: "second"},
+		HostnameSet: true,
+	}, etag)
+	if err != ipn.ErrPrefsChanged {
+		t.Fatalf("EditPrefsIfMatch with stale ETag = %v; want %v", err, ipn.ErrPrefsChanged)
+	}
+	if got := lb.Prefs().Hostname; got != "first" {
+		t.Errorf("after rejected edit, Hostname = %q; want %q", got, "first")
+	}
+}
+
 // Issue 1573: don't generate a machine key if we don't want to be running.
 func TestLazyMachineKeyGeneration(t *testing.T) {
 	defer func(old bool) { panicOnMachineKeyGeneration = old }(panicOnMachineKeyGeneration)
@@ -119,6 +119,10 @@ type PeerStatus struct {
 	// not include the IPs in TailscaleIPs.
 	PrimaryRoutes *views.IPPrefixSlice `json:",omitempty"`
 
+	// RouteComments are the user's notes on the routes this node
+	// advertises, keyed by route. It is only populated for Self.
+	RouteComments map[netaddr.IPPrefix]string `json:",omitempty"`
+
 	// Endpoints:
 	Addrs   []string
 	CurAddr string // one of Addrs, or unique if roaming
@@ -284,6 +288,9 @@ func (sb *StatusBuilder) AddPeer(peer key.NodePublic, st *PeerStatus) {
 	if v := st.Tags; v != nil && !v.IsNil() {
 		e.Tags = v
 	}
+	if v := st.RouteComments; v != nil {
+		e.RouteComments = v
+	}
 	if v := st.OS; v != "" {
 		e.OS = st.OS
 	}
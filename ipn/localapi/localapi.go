@@ -111,6 +111,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveLogout(w, r)
 	case "/localapi/v0/prefs":
 		h.servePrefs(w, r)
+	case "/localapi/v0/login-profile":
+		h.serveLoginProfile(w, r)
 	case "/localapi/v0/check-prefs":
 		h.serveCheckPrefs(w, r)
 	case "/localapi/v0/check-ip-forwarding":
@@ -376,10 +378,14 @@ func (h *Handler) servePrefs(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		var err error
-		prefs, err = h.b.EditPrefs(mp)
+		prefs, err = h.b.EditPrefsIfMatch(mp, strings.Trim(r.Header.Get("If-Match"), `"`))
 		if err != nil {
 			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
+			if err == ipn.ErrPrefsChanged {
+				w.WriteHeader(http.StatusPreconditionFailed)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
 			json.NewEncoder(w).Encode(resJSON{Error: err.Error()})
 			return
 		}
@@ -390,6 +396,7 @@ func (h *Handler) servePrefs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", `"`+prefs.ETag()+`"`)
 	e := json.NewEncoder(w)
 	e.SetIndent("", "\t")
 	e.Encode(prefs)
@@ -399,6 +406,29 @@ type resJSON struct {
 	Error string `json:",omitempty"`
 }
 
+// serveLoginProfile returns the login profile named by the "name"
+// query parameter, or the current one if there's no such parameter.
+func (h *Handler) serveLoginProfile(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "login profile access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	_, named := r.URL.Query()["name"]
+	lp, err := h.b.LoginProfile(r.FormValue("name"), !named)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(lp)
+}
+
 func (h *Handler) serveCheckPrefs(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "checkprefs access denied", http.StatusForbidden)
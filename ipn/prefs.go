@@ -6,6 +6,8 @@
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -38,6 +40,11 @@
 	// ErrExitNodeIDAlreadySet is returned from (*Prefs).SetExitNodeIP when the
 	// Prefs.ExitNodeID field is already set.
 	ErrExitNodeIDAlreadySet = errors.New("cannot set ExitNodeIP when ExitNodeID is already set")
+
+	// ErrPrefsChanged is returned from a conditional prefs edit when the
+	// prefs no longer have the ETag the caller last saw, meaning another
+	// client changed them in the meantime.
+	ErrPrefsChanged = errors.New("prefs were changed concurrently")
 )
 
 // IsLoginServerSynonym reports whether a URL is a drop-in replacement
@@ -70,6 +77,20 @@ type Prefs struct {
 	// controlled by ExitNodeID/IP below.
 	RouteAll bool
 
+	// RouteAllNoDefault specifies that default routes (0.0.0.0/0 and
+	// ::/0) advertised by other nodes are never used unless the node
+	// advertising them is explicitly selected with ExitNodeID/IP,
+	// even for peers whose identity can't be matched against the
+	// exit node (such as those without a StableID).
+	RouteAllNoDefault bool `json:",omitempty"`
+
+	// RouteAllFilter, if non-empty, limits the subnets accepted with
+	// RouteAll to those within one of these prefixes. A subnet that
+	// is wider than all of them, and so only partly inside one, is
+	// not accepted. Default routes aren't subnets, so it doesn't
+	// affect them.
+	RouteAllFilter []netaddr.IPPrefix `json:",omitempty"`
+
 	// AllowSingleHosts specifies whether to install routes for each
 	// node IP on the tailscale network, in addition to a route for
 	// the whole network.
@@ -104,10 +125,30 @@ type Prefs struct {
 	// routed directly or via the exit node.
 	ExitNodeAllowLANAccess bool
 
+	// ExitNodeSuspended specifies that the exit node selected by
+	// ExitNodeID or ExitNodeIP is kept but not used, so traffic
+	// goes out directly. It only lasts for the current session:
+	// LocalBackend clears it when WantRunning next becomes false.
+	ExitNodeSuspended bool `json:",omitempty"`
+
 	// CorpDNS specifies whether to install the Tailscale network's
 	// DNS configuration, if it exists.
 	CorpDNS bool
 
+	// CorpDNSSplitOnly, if CorpDNS is also set, limits the installed
+	// DNS configuration to MagicDNS and the per-domain (split DNS)
+	// resolvers. The OS's default resolver is left alone, so the
+	// tailnet's global resolvers, a DNS-proxying exit node and the
+	// fallback resolvers are all not used.
+	CorpDNSSplitOnly bool `json:",omitempty"`
+
+	// CorpDNSMagicOnly, if CorpDNS is also set, limits the installed
+	// DNS configuration to MagicDNS alone: only names under the
+	// MagicDNS domains are answered locally, and every other query goes
+	// to the OS's resolver, as without CorpDNS. It's narrower than
+	// CorpDNSSplitOnly, and wins if both are set.
+	CorpDNSMagicOnly bool `json:",omitempty"`
+
 	// RunSSH bool is whether this node should run an SSH
 	// server, permitting access to peers according to the
 	// policies as configured by the Tailnet's admin(s).
@@ -169,6 +210,12 @@ type Prefs struct {
 	// node.
 	AdvertiseRoutes []netaddr.IPPrefix
 
+	// AdvertiseRouteComments optionally annotates entries of
+	// AdvertiseRoutes with a free-form note describing the route,
+	// such as "datacenter". It is informational only; comments for
+	// routes not in AdvertiseRoutes are ignored.
+	AdvertiseRouteComments map[netaddr.IPPrefix]string `json:",omitempty"`
+
 	// NoSNAT specifies whether to source NAT traffic going to
 	// destinations in AdvertiseRoutes. The default is to apply source
 	// NAT, which makes the traffic appear to come from the router
@@ -181,10 +228,36 @@ type Prefs struct {
 	// Linux-only.
 	NoSNAT bool
 
+	// MasqueradeTo, if non-zero, is the source address that traffic
+	// to destinations in AdvertiseRoutes is rewritten to, instead of
+	// the address of whichever interface it leaves through. It's for
+	// multi-homed subnet routers that need a stable source address,
+	// and has no effect if NoSNAT is set.
+	//
+	// Linux-only.
+	MasqueradeTo netaddr.IP
+
 	// NetfilterMode specifies how much to manage netfilter rules for
 	// Tailscale, if at all.
 	NetfilterMode preftype.NetfilterMode
 
+	// NetfilterBackend is how tailscaled programs the rules that
+	// NetfilterMode asks for: empty for iptables, or
+	// preftype.NetfilterBackendNftables to use nftables directly, for
+	// systems without iptables.
+	//
+	// Linux-only.
+	NetfilterBackend string `json:",omitempty"`
+
+	// DNSBackend, if non-empty, forces the mechanism tailscaled uses
+	// to manage the OS DNS configuration instead of detecting one.
+	// Valid values are "systemd-resolved", "resolvconf",
+	// "network-manager" and "direct". It takes effect the next time
+	// tailscaled starts.
+	//
+	// Linux-only.
+	DNSBackend string `json:",omitempty"`
+
 	// OperatorUser is the local machine user name who is allowed to
 	// operate tailscaled without being root or using sudo.
 	OperatorUser string `json:",omitempty"`
@@ -203,11 +276,16 @@ type MaskedPrefs struct {
 
 	ControlURLSet             bool `json:",omitempty"`
 	RouteAllSet               bool `json:",omitempty"`
+	RouteAllNoDefaultSet      bool `json:",omitempty"`
+	RouteAllFilterSet         bool `json:",omitempty"`
 	AllowSingleHostsSet       bool `json:",omitempty"`
 	ExitNodeIDSet             bool `json:",omitempty"`
 	ExitNodeIPSet             bool `json:",omitempty"`
 	ExitNodeAllowLANAccessSet bool `json:",omitempty"`
+	ExitNodeSuspendedSet      bool `json:",omitempty"`
 	CorpDNSSet                bool `json:",omitempty"`
+	CorpDNSSplitOnlySet       bool `json:",omitempty"`
+	CorpDNSMagicOnlySet       bool `json:",omitempty"`
 	RunSSHSet                 bool `json:",omitempty"`
 	WantRunningSet            bool `json:",omitempty"`
 	LoggedOutSet              bool `json:",omitempty"`
@@ -217,8 +295,12 @@ type MaskedPrefs struct {
 	NotepadURLsSet            bool `json:",omitempty"`
 	ForceDaemonSet            bool `json:",omitempty"`
 	AdvertiseRoutesSet        bool `json:",omitempty"`
+	AdvertiseRouteCommentsSet bool `json:",omitempty"`
 	NoSNATSet                 bool `json:",omitempty"`
+	MasqueradeToSet           bool `json:",omitempty"`
 	NetfilterModeSet          bool `json:",omitempty"`
+	NetfilterBackendSet       bool `json:",omitempty"`
+	DNSBackendSet             bool `json:",omitempty"`
 	OperatorUserSet           bool `json:",omitempty"`
 }
 
@@ -289,10 +371,22 @@ func (p *Prefs) pretty(goos string) string {
 	var sb strings.Builder
 	sb.WriteString("Prefs{")
 	fmt.Fprintf(&sb, "ra=%v ", p.RouteAll)
+	if p.RouteAllNoDefault {
+		sb.WriteString("ra-nodefault=true ")
+	}
+	if len(p.RouteAllFilter) > 0 {
+		fmt.Fprintf(&sb, "ra-filter=%v ", p.RouteAllFilter)
+	}
 	if !p.AllowSingleHosts {
 		sb.WriteString("mesh=false ")
 	}
-	fmt.Fprintf(&sb, "dns=%v want=%v ", p.CorpDNS, p.WantRunning)
+	if p.CorpDNS && p.CorpDNSMagicOnly {
+		fmt.Fprintf(&sb, "dns=magic want=%v ", p.WantRunning)
+	} else if p.CorpDNS && p.CorpDNSSplitOnly {
+		fmt.Fprintf(&sb, "dns=split want=%v ", p.WantRunning)
+	} else {
+		fmt.Fprintf(&sb, "dns=%v want=%v ", p.CorpDNS, p.WantRunning)
+	}
 	if p.RunSSH {
 		sb.WriteString("ssh=true ")
 	}
@@ -313,17 +407,29 @@ func (p *Prefs) pretty(goos string) string {
 	} else if !p.ExitNodeID.IsZero() {
 		fmt.Fprintf(&sb, "exit=%v lan=%t ", p.ExitNodeID, p.ExitNodeAllowLANAccess)
 	}
+	if p.ExitNodeSuspended {
+		sb.WriteString("exit-suspended=true ")
+	}
 	if len(p.AdvertiseRoutes) > 0 || goos == "linux" {
 		fmt.Fprintf(&sb, "routes=%v ", p.AdvertiseRoutes)
 	}
 	if len(p.AdvertiseRoutes) > 0 || p.NoSNAT {
 		fmt.Fprintf(&sb, "snat=%v ", !p.NoSNAT)
 	}
+	if !p.MasqueradeTo.IsZero() {
+		fmt.Fprintf(&sb, "snat-to=%v ", p.MasqueradeTo)
+	}
 	if len(p.AdvertiseTags) > 0 {
 		fmt.Fprintf(&sb, "tags=%s ", strings.Join(p.AdvertiseTags, ","))
 	}
 	if goos == "linux" {
 		fmt.Fprintf(&sb, "nf=%v ", p.NetfilterMode)
+		if p.NetfilterBackend != "" {
+			fmt.Fprintf(&sb, "nfbackend=%s ", p.NetfilterBackend)
+		}
+	}
+	if p.DNSBackend != "" {
+		fmt.Fprintf(&sb, "dnsbackend=%s ", p.DNSBackend)
 	}
 	if p.ControlURL != "" && p.ControlURL != DefaultControlURL {
 		fmt.Fprintf(&sb, "url=%q ", p.ControlURL)
@@ -351,6 +457,14 @@ func (p *Prefs) ToBytes() []byte {
 	return data
 }
 
+// ETag returns an opaque string identifying the contents of p, for
+// conditional edits with the LocalAPI's If-Match header. Any change
+// to p changes its ETag.
+func (p *Prefs) ETag() string {
+	sum := sha256.Sum256(p.ToBytes())
+	return hex.EncodeToString(sum[:16])
+}
+
 func (p *Prefs) Equals(p2 *Prefs) bool {
 	if p == nil && p2 == nil {
 		return true
@@ -362,22 +476,31 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 	return p != nil && p2 != nil &&
 		p.ControlURL == p2.ControlURL &&
 		p.RouteAll == p2.RouteAll &&
+		p.RouteAllNoDefault == p2.RouteAllNoDefault &&
+		compareIPNets(p.RouteAllFilter, p2.RouteAllFilter) &&
 		p.AllowSingleHosts == p2.AllowSingleHosts &&
 		p.ExitNodeID == p2.ExitNodeID &&
 		p.ExitNodeIP == p2.ExitNodeIP &&
 		p.ExitNodeAllowLANAccess == p2.ExitNodeAllowLANAccess &&
+		p.ExitNodeSuspended == p2.ExitNodeSuspended &&
 		p.CorpDNS == p2.CorpDNS &&
+		p.CorpDNSSplitOnly == p2.CorpDNSSplitOnly &&
+		p.CorpDNSMagicOnly == p2.CorpDNSMagicOnly &&
 		p.RunSSH == p2.RunSSH &&
 		p.WantRunning == p2.WantRunning &&
 		p.LoggedOut == p2.LoggedOut &&
 		p.NotepadURLs == p2.NotepadURLs &&
 		p.ShieldsUp == p2.ShieldsUp &&
 		p.NoSNAT == p2.NoSNAT &&
+		p.MasqueradeTo == p2.MasqueradeTo &&
 		p.NetfilterMode == p2.NetfilterMode &&
+		p.NetfilterBackend == p2.NetfilterBackend &&
+		p.DNSBackend == p2.DNSBackend &&
 		p.OperatorUser == p2.OperatorUser &&
 		p.Hostname == p2.Hostname &&
 		p.ForceDaemon == p2.ForceDaemon &&
 		compareIPNets(p.AdvertiseRoutes, p2.AdvertiseRoutes) &&
+		compareRouteComments(p.AdvertiseRouteComments, p2.AdvertiseRouteComments) &&
 		compareStrings(p.AdvertiseTags, p2.AdvertiseTags) &&
 		p.Persist.Equals(p2.Persist)
 }
@@ -394,6 +517,18 @@ func compareIPNets(a, b []netaddr.IPPrefix) bool {
 	return true
 }
 
+func compareRouteComments(a, b map[netaddr.IPPrefix]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if v2, ok := b[k]; !ok || v != v2 {
+			return false
+		}
+	}
+	return true
+}
+
 func compareStrings(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -437,8 +572,9 @@ func (p *Prefs) ControlURLOrDefault() string {
 }
 
 // AdminPageURL returns the admin web site URL for the current ControlURL.
+// A ControlURL with a path, for a server behind a reverse proxy, keeps it.
 func (p *Prefs) AdminPageURL() string {
-	url := p.ControlURLOrDefault()
+	url := strings.TrimSuffix(p.ControlURLOrDefault(), "/")
 	if IsLoginServerSynonym(url) {
 		// TODO(crawshaw): In future release, make this https://console.tailscale.com
 		url = "https://login.tailscale.com"
@@ -22,8 +22,15 @@ func (src *Prefs) Clone() *Prefs {
 	}
 	dst := new(Prefs)
 	*dst = *src
+	dst.RouteAllFilter = append(src.RouteAllFilter[:0:0], src.RouteAllFilter...)
 	dst.AdvertiseTags = append(src.AdvertiseTags[:0:0], src.AdvertiseTags...)
 	dst.AdvertiseRoutes = append(src.AdvertiseRoutes[:0:0], src.AdvertiseRoutes...)
+	if dst.AdvertiseRouteComments != nil {
+		dst.AdvertiseRouteComments = map[netaddr.IPPrefix]string{}
+		for k, v := range src.AdvertiseRouteComments {
+			dst.AdvertiseRouteComments[k] = v
+		}
+	}
 	if dst.Persist != nil {
 		dst.Persist = new(persist.Persist)
 		*dst.Persist = *src.Persist
@@ -35,11 +42,16 @@ func (src *Prefs) Clone() *Prefs {
 var _PrefsCloneNeedsRegeneration = Prefs(struct {
 	ControlURL             string
 	RouteAll               bool
+	RouteAllNoDefault      bool
+	RouteAllFilter         []netaddr.IPPrefix
 	AllowSingleHosts       bool
 	ExitNodeID             tailcfg.StableNodeID
 	ExitNodeIP             netaddr.IP
 	ExitNodeAllowLANAccess bool
+	ExitNodeSuspended      bool
 	CorpDNS                bool
+	CorpDNSSplitOnly       bool
+	CorpDNSMagicOnly       bool
 	RunSSH                 bool
 	WantRunning            bool
 	LoggedOut              bool
@@ -49,8 +61,12 @@ func (src *Prefs) Clone() *Prefs {
 	NotepadURLs            bool
 	ForceDaemon            bool
 	AdvertiseRoutes        []netaddr.IPPrefix
+	AdvertiseRouteComments map[netaddr.IPPrefix]string
 	NoSNAT                 bool
+	MasqueradeTo           netaddr.IP
 	NetfilterMode          preftype.NetfilterMode
+	NetfilterBackend       string
+	DNSBackend             string
 	OperatorUser           string
 	Persist                *persist.Persist
 }{})
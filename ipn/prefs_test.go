@@ -38,11 +38,16 @@ func TestPrefsEqual(t *testing.T) {
 	prefsHandles := []string{
 		"ControlURL",
 		"RouteAll",
+		"RouteAllNoDefault",
+		"RouteAllFilter",
 		"AllowSingleHosts",
 		"ExitNodeID",
 		"ExitNodeIP",
 		"ExitNodeAllowLANAccess",
+		"ExitNodeSuspended",
 		"CorpDNS",
+		"CorpDNSSplitOnly",
+		"CorpDNSMagicOnly",
 		"RunSSH",
 		"WantRunning",
 		"LoggedOut",
@@ -52,8 +57,12 @@ func TestPrefsEqual(t *testing.T) {
 		"NotepadURLs",
 		"ForceDaemon",
 		"AdvertiseRoutes",
+		"AdvertiseRouteComments",
 		"NoSNAT",
+		"MasqueradeTo",
 		"NetfilterMode",
+		"NetfilterBackend",
+		"DNSBackend",
 		"OperatorUser",
 		"Persist",
 	}
@@ -157,6 +166,16 @@ func TestPrefsEqual(t *testing.T) {
 			&Prefs{ExitNodeAllowLANAccess: true},
 			true,
 		},
+		{
+			&Prefs{ExitNodeSuspended: true},
+			&Prefs{ExitNodeSuspended: false},
+			false,
+		},
+		{
+			&Prefs{ExitNodeSuspended: true},
+			&Prefs{ExitNodeSuspended: true},
+			true,
+		},
 
 		{
 			&Prefs{CorpDNS: true},
@@ -180,6 +199,16 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{CorpDNS: true, CorpDNSSplitOnly: true},
+			&Prefs{CorpDNS: true},
+			false,
+		},
+		{
+			&Prefs{CorpDNS: true, CorpDNSMagicOnly: true},
+			&Prefs{CorpDNS: true},
+			false,
+		},
 		{
 			&Prefs{NoSNAT: true},
 			&Prefs{NoSNAT: false},
@@ -190,6 +219,16 @@ func TestPrefsEqual(t *testing.T) {
 			&Prefs{NoSNAT: true},
 			true,
 		},
+		{
+			&Prefs{MasqueradeTo: netaddr.MustParseIP("192.168.1.2")},
+			&Prefs{},
+			false,
+		},
+		{
+			&Prefs{MasqueradeTo: netaddr.MustParseIP("192.168.1.2")},
+			&Prefs{MasqueradeTo: netaddr.MustParseIP("192.168.1.2")},
+			true,
+		},
 
 		{
 			&Prefs{Hostname: "android-host01"},
@@ -249,6 +288,21 @@ func TestPrefsEqual(t *testing.T) {
 			&Prefs{AdvertiseRoutes: nets("192.168.0.0/24", "10.1.0.0/16")},
 			true,
 		},
+		{
+			&Prefs{AdvertiseRouteComments: map[netaddr.IPPrefix]string{netaddr.MustParseIPPrefix("10.1.0.0/16"): "lab"}},
+			&Prefs{AdvertiseRouteComments: map[netaddr.IPPrefix]string{netaddr.MustParseIPPrefix("10.1.0.0/16"): "office"}},
+			false,
+		},
+		{
+			&Prefs{AdvertiseRouteComments: map[netaddr.IPPrefix]string{netaddr.MustParseIPPrefix("10.1.0.0/16"): "lab"}},
+			&Prefs{AdvertiseRouteComments: map[netaddr.IPPrefix]string{netaddr.MustParseIPPrefix("10.2.0.0/16"): "lab"}},
+			false,
+		},
+		{
+			&Prefs{AdvertiseRouteComments: map[netaddr.IPPrefix]string{netaddr.MustParseIPPrefix("10.1.0.0/16"): "lab"}},
+			&Prefs{AdvertiseRouteComments: map[netaddr.IPPrefix]string{netaddr.MustParseIPPrefix("10.1.0.0/16"): "lab"}},
+			true,
+		},
 
 		{
 			&Prefs{NetfilterMode: preftype.NetfilterOff},
@@ -261,6 +315,55 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{NetfilterBackend: preftype.NetfilterBackendNftables},
+			&Prefs{NetfilterBackend: ""},
+			false,
+		},
+		{
+			&Prefs{NetfilterBackend: preftype.NetfilterBackendNftables},
+			&Prefs{NetfilterBackend: preftype.NetfilterBackendNftables},
+			true,
+		},
+
+		{
+			&Prefs{RouteAllNoDefault: true},
+			&Prefs{RouteAllNoDefault: false},
+			false,
+		},
+		{
+			&Prefs{RouteAllNoDefault: true},
+			&Prefs{RouteAllNoDefault: true},
+			true,
+		},
+
+		{
+			&Prefs{RouteAllFilter: nets("10.20.0.0/16")},
+			&Prefs{RouteAllFilter: nil},
+			false,
+		},
+		{
+			&Prefs{RouteAllFilter: nets("10.20.0.0/16")},
+			&Prefs{RouteAllFilter: nets("10.21.0.0/16")},
+			false,
+		},
+		{
+			&Prefs{RouteAllFilter: nets("10.20.0.0/16", "fd00::/8")},
+			&Prefs{RouteAllFilter: nets("10.20.0.0/16", "fd00::/8")},
+			true,
+		},
+
+		{
+			&Prefs{DNSBackend: "direct"},
+			&Prefs{DNSBackend: ""},
+			false,
+		},
+		{
+			&Prefs{DNSBackend: "systemd-resolved"},
+			&Prefs{DNSBackend: "systemd-resolved"},
+			true,
+		},
+
 		{
 			&Prefs{Persist: &persist.Persist{}},
 			&Prefs{Persist: &persist.Persist{LoginName: "dave"}},
@@ -330,6 +433,25 @@ func TestBasicPrefs(t *testing.T) {
 	checkPrefs(t, p)
 }
 
+func TestAdminPageURL(t *testing.T) {
+	tests := []struct {
+		controlURL string
+		want       string
+	}{
+		{"", "https://login.tailscale.com/admin/machines"},
+		{"https://controlplane.tailscale.com", "https://login.tailscale.com/admin/machines"},
+		{"https://corp.example.com", "https://corp.example.com/admin/machines"},
+		{"https://corp.example.com/tailscale", "https://corp.example.com/tailscale/admin/machines"},
+		{"https://corp.example.com/tailscale/", "https://corp.example.com/tailscale/admin/machines"},
+	}
+	for _, tt := range tests {
+		p := &Prefs{ControlURL: tt.controlURL}
+		if got := p.AdminPageURL(); got != tt.want {
+			t.Errorf("AdminPageURL with ControlURL %q = %q; want %q", tt.controlURL, got, tt.want)
+		}
+	}
+}
+
 func TestPrefsPersist(t *testing.T) {
 	tstest.PanicOnLog()
 
@@ -344,6 +466,18 @@ func TestPrefsPersist(t *testing.T) {
 	checkPrefs(t, p)
 }
 
+func TestPrefsETag(t *testing.T) {
+	p := NewPrefs()
+	etag := p.ETag()
+	if got := p.Clone().ETag(); got != etag {
+		t.Errorf("clone ETag = %q; want %q", got, etag)
+	}
+	p.WantRunning = !p.WantRunning
+	if got := p.ETag(); got == etag {
+		t.Errorf("ETag unchanged after changing WantRunning")
+	}
+}
+
 func TestPrefsPretty(t *testing.T) {
 	tests := []struct {
 		p    Prefs
@@ -355,6 +489,29 @@ func TestPrefsPretty(t *testing.T) {
 			"linux",
 			"Prefs{ra=false mesh=false dns=false want=false routes=[] nf=off Persist=nil}",
 		},
+		{
+			Prefs{CorpDNS: true, CorpDNSSplitOnly: true},
+			"windows",
+			"Prefs{ra=false mesh=false dns=split want=false Persist=nil}",
+		},
+		{
+			Prefs{CorpDNS: true, CorpDNSSplitOnly: true, CorpDNSMagicOnly: true},
+			"windows",
+			"Prefs{ra=false mesh=false dns=magic want=false Persist=nil}",
+		},
+		{
+			Prefs{DNSBackend: "systemd-resolved"},
+			"linux",
+			"Prefs{ra=false mesh=false dns=false want=false routes=[] nf=off dnsbackend=systemd-resolved Persist=nil}",
+		},
+		{
+			Prefs{
+				AdvertiseRoutes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/8")},
+				MasqueradeTo:    netaddr.MustParseIP("192.168.1.2"),
+			},
+			"linux",
+			"Prefs{ra=false mesh=false dns=false want=false routes=[10.0.0.0/8] snat=true snat-to=192.168.1.2 nf=off Persist=nil}",
+		},
 		{
 			Prefs{},
 			"windows",
@@ -435,6 +592,14 @@ func TestPrefsPretty(t *testing.T) {
 			"linux",
 			`Prefs{ra=false mesh=false dns=false want=false exit=myNodeABC lan=true routes=[] nf=off Persist=nil}`,
 		},
+		{
+			Prefs{
+				ExitNodeID:        tailcfg.StableNodeID("myNodeABC"),
+				ExitNodeSuspended: true,
+			},
+			"linux",
+			`Prefs{ra=false mesh=false dns=false want=false exit=myNodeABC lan=false exit-suspended=true routes=[] nf=off Persist=nil}`,
+		},
 		{
 			Prefs{
 				ExitNodeAllowLANAccess: true,
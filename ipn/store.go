@@ -6,6 +6,8 @@
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 )
 
 // ErrStateNotExist is returned by StateStore.ReadState when the
@@ -34,8 +36,74 @@
 	// the server should start with the Prefs JSON loaded from
 	// StateKey "user-1234".
 	ServerModeStartKey = StateKey("server-mode-start-key")
+
+	// CurrentProfileKey's value is the name of the login profile, as
+	// selected with "tailscale up --profile", that tailscaled last
+	// started with and so loads on startup. It's absent or empty for
+	// the default profile, whose state is at GlobalDaemonStateKey.
+	CurrentProfileKey = StateKey("_current-profile")
 )
 
+// profileStateKeyPrefix prefixes the StateKey of each named login
+// profile, keeping them alongside GlobalDaemonStateKey.
+const profileStateKeyPrefix = string(GlobalDaemonStateKey) + "-profile-"
+
+// ProfileStateKey returns the StateKey that holds the prefs of the
+// named login profile. The default profile, "", uses
+// GlobalDaemonStateKey.
+func ProfileStateKey(profile string) StateKey {
+	if profile == "" {
+		return GlobalDaemonStateKey
+	}
+	return StateKey(profileStateKeyPrefix + profile)
+}
+
+// ProfileOfStateKey returns the name of the login profile whose prefs
+// are at k, and whether k is a login profile's StateKey at all.
+func ProfileOfStateKey(k StateKey) (profile string, ok bool) {
+	if k == GlobalDaemonStateKey {
+		return "", true
+	}
+	profile = strings.TrimPrefix(string(k), profileStateKeyPrefix)
+	if profile == string(k) || profile == "" {
+		return "", false
+	}
+	return profile, true
+}
+
+// CheckProfileName reports whether profile is a valid login profile
+// name: up to 64 lowercase letters, digits, '-' and '_'.
+func CheckProfileName(profile string) error {
+	if profile == "" {
+		return errors.New("login profile name must not be empty")
+	}
+	if len(profile) > 64 {
+		return fmt.Errorf("login profile name %q is too long; the limit is 64 characters", profile)
+	}
+	for _, r := range profile {
+		if !('a' <= r && r <= 'z' || '0' <= r && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("invalid login profile name %q; use only lowercase letters, digits, '-' and '_'", profile)
+		}
+	}
+	return nil
+}
+
+// CurrentDaemonStateKey returns the StateKey of the login profile that
+// tailscaled last started with, per CurrentProfileKey in store.
+func CurrentDaemonStateKey(store StateStore) (StateKey, error) {
+	bs, err := store.ReadState(CurrentProfileKey)
+	if err != nil && !errors.Is(err, ErrStateNotExist) {
+		return "", err
+	}
+	profile := string(bs)
+	if profile != "" {
+		if err := CheckProfileName(profile); err != nil {
+			return "", fmt.Errorf("bad %s: %w", CurrentProfileKey, err)
+		}
+	}
+	return ProfileStateKey(profile), nil
+}
+
 // StateStore persists state, and produces it back on request.
 type StateStore interface {
 	// ReadState returns the bytes associated with ID. Returns (nil,
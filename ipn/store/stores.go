@@ -71,6 +71,18 @@ func New(logf logger.Logf, path string) (ipn.StateStore, error) {
 	return NewFileStore(logf, path)
 }
 
+// IsFileStorePath reports whether New would use a file store for path,
+// rather than a store registered with Register.
+func IsFileStorePath(path string) bool {
+	regOnce.Do(registerDefaultStores)
+	for prefix := range knownStores {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
 // Register registers a prefix to be used for
 // NewStore. It panics if the prefix is empty, or if the
 // prefix is already registered.
@@ -69,6 +69,18 @@ type store2 struct {
 	} else if _, ok := s.(*FileStore); !ok {
 		t.Fatalf("%q: got: %T, want: %T", path, s, new(FileStore))
 	}
+
+	for path, want := range map[string]bool{
+		"mem:abcd":                            false,
+		"arn:foo":                             false,
+		"kube:abcd":                           false,
+		"/var/lib/tailscale/tailscaled.state": true,
+		"tailscaled.state":                    true,
+	} {
+		if got := IsFileStorePath(path); got != want {
+			t.Errorf("IsFileStorePath(%q) = %v; want %v", path, got, want)
+		}
+	}
 }
 
 func testStoreSemantics(t *testing.T, store ipn.StateStore) {
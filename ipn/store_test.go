@@ -0,0 +1,41 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProfileStateKey(t *testing.T) {
+	for _, profile := range []string{"", "work", "home-2_b"} {
+		k := ProfileStateKey(profile)
+		got, ok := ProfileOfStateKey(k)
+		if !ok || got != profile {
+			t.Errorf("ProfileOfStateKey(ProfileStateKey(%q) = %q) = %q, %v", profile, k, got, ok)
+		}
+	}
+	if k := ProfileStateKey(""); k != GlobalDaemonStateKey {
+		t.Errorf("default profile's key = %q; want %q", k, GlobalDaemonStateKey)
+	}
+	for _, k := range []StateKey{"", "user-1234", MachineKeyStateKey, CurrentProfileKey, "_daemon-profile-"} {
+		if profile, ok := ProfileOfStateKey(k); ok {
+			t.Errorf("ProfileOfStateKey(%q) = %q, true; want not a profile", k, profile)
+		}
+	}
+}
+
+func TestCheckProfileName(t *testing.T) {
+	for _, name := range []string{"work", "a", "home-2_b", strings.Repeat("a", 64)} {
+		if err := CheckProfileName(name); err != nil {
+			t.Errorf("CheckProfileName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "Work", "a b", "a/b", "../x", strings.Repeat("a", 65)} {
+		if err := CheckProfileName(name); err == nil {
+			t.Errorf("CheckProfileName(%q) succeeded; want error", name)
+		}
+	}
+}
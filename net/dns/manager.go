@@ -31,6 +31,19 @@
 // Such operations should be wrapped in a timeout context.
 const reconfigTimeout = time.Second
 
+// forcedMode, if non-empty, is the DNS management mode that
+// NewOSConfigurator uses instead of detecting one. See SetForcedMode.
+var forcedMode string
+
+// SetForcedMode makes later calls to NewOSConfigurator use the named
+// DNS management mode ("systemd-resolved", "resolvconf",
+// "network-manager" or "direct") instead of detecting one. An empty
+// mode restores detection. It only has an effect on Linux, and must be
+// called before NewOSConfigurator.
+func SetForcedMode(mode string) {
+	forcedMode = mode
+}
+
 // Manager manages system DNS settings.
 type Manager struct {
 	logf logger.Logf
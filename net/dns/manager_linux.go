@@ -35,9 +35,24 @@ func NewOSConfigurator(logf logger.Logf, interfaceName string) (ret OSConfigurat
 		nmVersionBetween:  nmVersionBetween,
 		resolvconfStyle:   resolvconfStyle,
 	}
-	mode, err := dnsMode(logf, env)
-	if err != nil {
-		return nil, err
+	mode := forcedMode
+	if mode == "" {
+		mode, err = dnsMode(logf, env)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		logf("dns: using forced mode %q", mode)
+	}
+	if mode == "resolvconf" {
+		switch env.resolvconfStyle() {
+		case "debian":
+			mode = "debian-resolvconf"
+		case "openresolv":
+			mode = "openresolv"
+		default:
+			return nil, errors.New("DNS mode resolvconf requested, but no resolvconf binary found")
+		}
 	}
 	switch mode {
 	case "direct":
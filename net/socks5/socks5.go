@@ -14,6 +14,7 @@
 package socks5
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
@@ -21,6 +22,7 @@
 	"log"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"tailscale.com/types/logger"
@@ -152,13 +154,17 @@ func (c *Conn) handleRequest() error {
 		c.clientConn.Write(buf)
 		return err
 	}
-	if req.command != connect {
+	c.request = req
+	switch req.command {
+	case connect:
+	case udpAssociate:
+		return c.handleUDPAssociate()
+	default:
 		res := &response{reply: commandNotSupported}
 		buf, _ := res.marshal()
 		c.clientConn.Write(buf)
 		return fmt.Errorf("unsupported command %v", req.command)
 	}
-	c.request = req
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -180,19 +186,9 @@ func (c *Conn) handleRequest() error {
 	}
 	serverPort, _ := strconv.Atoi(serverPortStr)
 
-	var bindAddrType addrType
-	if ip := net.ParseIP(serverAddr); ip != nil {
-		if ip.To4() != nil {
-			bindAddrType = ipv4
-		} else {
-			bindAddrType = ipv6
-		}
-	} else {
-		bindAddrType = domainName
-	}
 	res := &response{
 		reply:        success,
-		bindAddrType: bindAddrType,
+		bindAddrType: addrTypeOf(serverAddr),
 		bindAddr:     serverAddr,
 		bindPort:     uint16(serverPort),
 	}
@@ -221,6 +217,185 @@ func (c *Conn) handleRequest() error {
 	return <-errc
 }
 
+// handleUDPAssociate serves a UDP ASSOCIATE request: it relays
+// datagrams between the client and whatever destinations the client
+// addresses them to, until the client closes its TCP connection.
+func (c *Conn) handleUDPAssociate() error {
+	clientIP, _, err := net.SplitHostPort(c.clientConn.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+	localIP, _, err := net.SplitHostPort(c.clientConn.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	relay, err := net.ListenPacket("udp", net.JoinHostPort(localIP, "0"))
+	if err != nil {
+		res := &response{reply: generalFailure}
+		buf, _ := res.marshal()
+		c.clientConn.Write(buf)
+		return err
+	}
+	defer relay.Close()
+
+	relayAddr := relay.LocalAddr().(*net.UDPAddr)
+	res := &response{
+		reply:        success,
+		bindAddrType: addrTypeOf(relayAddr.IP.String()),
+		bindAddr:     relayAddr.IP.String(),
+		bindPort:     uint16(relayAddr.Port),
+	}
+	buf, err := res.marshal()
+	if err != nil {
+		res = &response{reply: generalFailure}
+		buf, _ = res.marshal()
+	}
+	c.clientConn.Write(buf)
+
+	u := &udpAssociation{
+		srv:      c.srv,
+		relay:    relay,
+		clientIP: clientIP,
+		backends: map[string]net.Conn{},
+	}
+	go u.serve()
+	defer u.close()
+
+	// The association lasts as long as the TCP connection, which
+	// otherwise carries nothing.
+	_, err = io.Copy(io.Discard, c.clientConn)
+	return err
+}
+
+// udpAssociation is the state of a UDP ASSOCIATE request.
+type udpAssociation struct {
+	srv      *Server
+	relay    net.PacketConn
+	clientIP string // only datagrams from here are relayed
+
+	mu         sync.Mutex
+	clientAddr net.Addr            // where the client sends from, once known
+	backends   map[string]net.Conn // by destination host:port
+	closed     bool
+}
+
+// serve relays datagrams from the client to their destinations.
+func (u *udpAssociation) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := u.relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		host, _, _ := net.SplitHostPort(addr.String())
+		if host != u.clientIP {
+			continue
+		}
+		req, data, err := parseUDPRequest(buf[:n])
+		if err != nil {
+			u.srv.logf("bad UDP datagram from client: %v", err)
+			continue
+		}
+		dst := net.JoinHostPort(req.destination, strconv.Itoa(int(req.port)))
+		backend, err := u.backend(addr, dst)
+		if err != nil {
+			u.srv.logf("can't dial %s over UDP: %v", dst, err)
+			continue
+		}
+		backend.Write(data)
+	}
+}
+
+// backend returns the connection to dst, dialing it if needed.
+func (u *udpAssociation) backend(clientAddr net.Addr, dst string) (net.Conn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		return nil, net.ErrClosed
+	}
+	u.clientAddr = clientAddr
+	if c, ok := u.backends[dst]; ok {
+		return c, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := u.srv.dial(ctx, "udp", dst)
+	if err != nil {
+		return nil, err
+	}
+	u.backends[dst] = c
+	go u.relayReplies(c, dst)
+	return c, nil
+}
+
+// relayReplies sends datagrams received on backend back to the client,
+// as coming from dst.
+func (u *udpAssociation) relayReplies(backend net.Conn, dst string) {
+	host, portStr, _ := net.SplitHostPort(dst)
+	port, _ := strconv.Atoi(portStr)
+	t := addrTypeOf(host)
+	addr, err := marshalAddr(t, host, uint16(port))
+	if err != nil {
+		return
+	}
+	hdr := append([]byte{0, 0, 0, byte(t)}, addr...) // RSV, RSV, FRAG, ATYP
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := backend.Read(buf)
+		if err != nil {
+			return
+		}
+		u.mu.Lock()
+		clientAddr := u.clientAddr
+		u.mu.Unlock()
+		u.relay.WriteTo(append(hdr[:len(hdr):len(hdr)], buf[:n]...), clientAddr)
+	}
+}
+
+func (u *udpAssociation) close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	for _, c := range u.backends {
+		c.Close()
+	}
+}
+
+// parseUDPRequest parses the header the client puts on each datagram
+// it sends to the relay, returning the destination and the payload.
+// Fragmented datagrams aren't supported.
+func parseUDPRequest(pkt []byte) (*request, []byte, error) {
+	if len(pkt) < 4 {
+		return nil, nil, fmt.Errorf("short datagram")
+	}
+	if pkt[2] != 0 {
+		return nil, nil, fmt.Errorf("fragmented datagrams are not supported")
+	}
+	r := bytes.NewReader(pkt[4:])
+	dst, port, err := parseAddr(r, addrType(pkt[3]))
+	if err != nil {
+		return nil, nil, err
+	}
+	req := &request{
+		destination:  dst,
+		port:         port,
+		destAddrType: addrType(pkt[3]),
+	}
+	return req, pkt[len(pkt)-r.Len():], nil
+}
+
+// addrTypeOf returns the address type to use for host.
+func addrTypeOf(host string) addrType {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return ipv4
+		}
+		return ipv6
+	}
+	return domainName
+}
+
 // parseClientGreeting parses a request initiation packet
 // and returns a slice that contains the acceptable auth methods
 // for the client.
@@ -267,52 +442,57 @@ func parseClientRequest(r io.Reader) (*request, error) {
 	cmd := hdr[1]
 	destAddrType := addrType(hdr[3])
 
-	var destination string
-	var port uint16
+	destination, port, err := parseAddr(r, destAddrType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &request{
+		command:      commandType(cmd),
+		destination:  destination,
+		port:         port,
+		destAddrType: destAddrType,
+	}, nil
+}
 
-	if destAddrType == ipv4 {
+// parseAddr reads an address of type t, followed by a port, from r.
+func parseAddr(r io.Reader, t addrType) (destination string, port uint16, err error) {
+	if t == ipv4 {
 		var ip [4]byte
 		_, err = io.ReadFull(r, ip[:])
 		if err != nil {
-			return nil, fmt.Errorf("could not read IPv4 address")
+			return "", 0, fmt.Errorf("could not read IPv4 address")
 		}
 		destination = net.IP(ip[:]).String()
-	} else if destAddrType == domainName {
+	} else if t == domainName {
 		var dstSizeByte [1]byte
 		_, err = io.ReadFull(r, dstSizeByte[:])
 		if err != nil {
-			return nil, fmt.Errorf("could not read domain name size")
+			return "", 0, fmt.Errorf("could not read domain name size")
 		}
 		dstSize := int(dstSizeByte[0])
 		domainName := make([]byte, dstSize)
 		_, err = io.ReadFull(r, domainName)
 		if err != nil {
-			return nil, fmt.Errorf("could not read domain name")
+			return "", 0, fmt.Errorf("could not read domain name")
 		}
 		destination = string(domainName)
-	} else if destAddrType == ipv6 {
+	} else if t == ipv6 {
 		var ip [16]byte
 		_, err = io.ReadFull(r, ip[:])
 		if err != nil {
-			return nil, fmt.Errorf("could not read IPv6 address")
+			return "", 0, fmt.Errorf("could not read IPv6 address")
 		}
 		destination = net.IP(ip[:]).String()
 	} else {
-		return nil, fmt.Errorf("unsupported address type")
+		return "", 0, fmt.Errorf("unsupported address type")
 	}
 	var portBytes [2]byte
 	_, err = io.ReadFull(r, portBytes[:])
 	if err != nil {
-		return nil, fmt.Errorf("could not read port")
+		return "", 0, fmt.Errorf("could not read port")
 	}
-	port = binary.BigEndian.Uint16(portBytes[:])
-
-	return &request{
-		command:      commandType(cmd),
-		destination:  destination,
-		port:         port,
-		destAddrType: destAddrType,
-	}, nil
+	return destination, binary.BigEndian.Uint16(portBytes[:]), nil
 }
 
 // response contains the contents of
@@ -339,22 +519,32 @@ func (res *response) marshal() ([]byte, error) {
 		return pkt, nil
 	}
 
+	addr, err := marshalAddr(res.bindAddrType, res.bindAddr, res.bindPort)
+	if err != nil {
+		return nil, err
+	}
+	return append(pkt, addr...), nil
+}
+
+// marshalAddr returns the wire form of an address of type t followed
+// by port.
+func marshalAddr(t addrType, host string, port uint16) ([]byte, error) {
 	var addr []byte
-	switch res.bindAddrType {
+	switch t {
 	case ipv4:
-		addr = net.ParseIP(res.bindAddr).To4()
+		addr = net.ParseIP(host).To4()
 		if addr == nil {
 			return nil, fmt.Errorf("invalid IPv4 address for binding")
 		}
 	case domainName:
-		if len(res.bindAddr) > 255 {
+		if len(host) > 255 {
 			return nil, fmt.Errorf("invalid domain name for binding")
 		}
-		addr = make([]byte, 0, len(res.bindAddr)+1)
-		addr = append(addr, byte(len(res.bindAddr)))
-		addr = append(addr, []byte(res.bindAddr)...)
+		addr = make([]byte, 0, len(host)+1)
+		addr = append(addr, byte(len(host)))
+		addr = append(addr, []byte(host)...)
 	case ipv6:
-		addr = net.ParseIP(res.bindAddr).To16()
+		addr = net.ParseIP(host).To16()
 		if addr == nil {
 			return nil, fmt.Errorf("invalid IPv6 address for binding")
 		}
@@ -362,10 +552,7 @@ func (res *response) marshal() ([]byte, error) {
 		return nil, fmt.Errorf("unsupported address type")
 	}
 
-	pkt = append(pkt, addr...)
-	port := make([]byte, 2)
-	binary.BigEndian.PutUint16(port, uint16(res.bindPort))
-	pkt = append(pkt, port...)
-
-	return pkt, nil
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, port)
+	return append(addr, portBytes...), nil
 }
@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUDPAssociate(t *testing.T) {
+	// An echo server for the client to reach through the proxy.
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Logf: t.Logf}
+	go srv.Serve(ln)
+
+	ctrl, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := ctrl.Write([]byte{socks5Version, 1, noAuthRequired}); err != nil {
+		t.Fatal(err)
+	}
+	var greeting [2]byte
+	if _, err := io.ReadFull(ctrl, greeting[:]); err != nil {
+		t.Fatal(err)
+	}
+	if greeting != [2]byte{socks5Version, noAuthRequired} {
+		t.Fatalf("greeting reply = %v", greeting)
+	}
+	// The client's address isn't known yet, so it sends zeros.
+	if _, err := ctrl.Write([]byte{socks5Version, byte(udpAssociate), 0, byte(ipv4), 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(ctrl, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if replyCode(hdr[1]) != success {
+		t.Fatalf("UDP ASSOCIATE reply = %v", hdr[1])
+	}
+	relayHost, relayPort, err := parseAddr(ctrl, addrType(hdr[3]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay, err := net.Dial("udp", net.JoinHostPort(relayHost, strconv.Itoa(int(relayPort))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	relay.SetDeadline(time.Now().Add(5 * time.Second))
+
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	dstHdr, err := marshalAddr(ipv4, echoAddr.IP.String(), uint16(echoAddr.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstHdr = append([]byte{0, 0, 0, byte(ipv4)}, dstHdr...)
+
+	payload := []byte("hello over udp")
+	if _, err := relay.Write(append(dstHdr, payload...)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := relay.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, data, err := parseUDPRequest(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.destination != echoAddr.IP.String() || int(req.port) != echoAddr.Port {
+		t.Errorf("reply came from %s:%d; want %v", req.destination, req.port, echoAddr)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Errorf("reply = %q; want %q", data, payload)
+	}
+}
+
+func TestParseUDPRequestFragmented(t *testing.T) {
+	if _, _, err := parseUDPRequest([]byte{0, 0, 1, byte(ipv4), 127, 0, 0, 1, 0, 53, 'x'}); err == nil {
+		t.Error("fragmented datagram parsed without error")
+	}
+}
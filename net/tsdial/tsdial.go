@@ -38,6 +38,9 @@ type Dialer struct {
 	// If nil, it's not used.
 	NetstackDialTCP func(context.Context, netaddr.IPPort) (net.Conn, error)
 
+	// NetstackDialUDP is like NetstackDialTCP, but for UDP.
+	NetstackDialUDP func(context.Context, netaddr.IPPort) (net.Conn, error)
+
 	peerDialControlFuncAtomic atomic.Value // of func() func(network, address string, c syscall.RawConn) error
 
 	peerClientOnce sync.Once
@@ -205,10 +208,14 @@ func (d *Dialer) UserDial(ctx context.Context, network, addr string) (net.Conn,
 		return nil, err
 	}
 	if d.UseNetstackForIP != nil && d.UseNetstackForIP(ipp.IP()) {
-		if d.NetstackDialTCP == nil {
+		dial := d.NetstackDialTCP
+		if strings.HasPrefix(network, "udp") {
+			dial = d.NetstackDialUDP
+		}
+		if dial == nil {
 			return nil, errors.New("Dialer not initialized correctly")
 		}
-		return d.NetstackDialTCP(ctx, ipp)
+		return dial(ctx, ipp)
 	}
 	// TODO(bradfitz): netns, etc
 	var stdDialer net.Dialer
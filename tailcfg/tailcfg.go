@@ -1784,6 +1784,7 @@ type OverTLSPublicKeyResponse struct {
 	// Noise-based control plane protocol. (see packages
 	// control/controlbase and control/controlhttp)
 	PublicKey key.MachinePublic `json:"publicKey"`
+
 }
 
 // TokenRequest is a request to get an OIDC ID token for an audience.
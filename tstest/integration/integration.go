@@ -10,7 +10,9 @@
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -47,9 +49,72 @@
 // It should be called from TestMain after all tests have completed.
 func CleanupBinaries() {
 	buildOnce.Do(func() {})
-	if binDir != "" {
+	if binDir != "" && !inBinaryCache(binDir) {
 		os.RemoveAll(binDir)
 	}
+	archBins.Lock()
+	defer archBins.Unlock()
+	for _, dir := range archBins.dirs {
+		if !inBinaryCache(dir) {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+// binCache is the configuration set by UseBinaryCache.
+var binCache struct {
+	dir   string
+	force bool
+}
+
+// UseBinaryCache makes BinaryDir and BinaryDirForArch keep the
+// binaries they build in dir, and reuse them in later runs when the
+// source and build settings haven't changed. The binaries are keyed
+// on the git revision and any uncommitted changes, so the cache is
+// only used when building from a git checkout. If rebuild is true,
+// cached binaries are replaced rather than reused.
+//
+// It must be called, typically from TestMain, before any binaries are
+// built.
+func UseBinaryCache(dir string, rebuild bool) {
+	binCache.dir = dir
+	binCache.force = rebuild
+}
+
+// TestGoFlags returns the extra flags that test binaries are built
+// with, from the space-separated $TS_TEST_GOFLAGS, such as "-race" or
+// "-cover" to chase a problem that only shows up in an integration
+// test. The race detector needs cgo, so -race is ignored when
+// cross-compiling.
+func TestGoFlags() []string {
+	return strings.Fields(os.Getenv("TS_TEST_GOFLAGS"))
+}
+
+// buildFlags returns the flags to pass to go build or go install for
+// binaries built for goos and goarch.
+func buildFlags(goos, goarch string) []string {
+	cross := goos != runtime.GOOS || goarch != runtime.GOARCH
+	var flags []string
+	if version.IsRace() && !cross {
+		// The race detector needs cgo, which doesn't cross-compile.
+		flags = append(flags, "-race")
+	}
+	for _, f := range TestGoFlags() {
+		if f == "-race" {
+			if cross {
+				log.Printf("not building %s/%s test binaries with -race from TS_TEST_GOFLAGS: it needs cgo, which doesn't cross-compile", goos, goarch)
+			}
+			if cross || version.IsRace() {
+				continue
+			}
+		}
+		flags = append(flags, f)
+	}
+	return flags
+}
+
+func inBinaryCache(dir string) bool {
+	return binCache.dir != "" && strings.HasPrefix(dir, binCache.dir+string(filepath.Separator))
 }
 
 // BinaryDir returns a directory containing test tailscale and tailscaled binaries.
@@ -79,20 +144,75 @@ func TailscaledBinary(tb testing.TB) string {
 	return filepath.Join(BinaryDir(tb), "tailscaled"+exe())
 }
 
+// BinaryDirForArch is like BinaryDir, but the binaries are built for
+// Linux on goarch, for running in a VM guest. If goarch is the host's
+// architecture, it returns BinaryDir.
+// If any test calls BinaryDirForArch, there must be a TestMain function
+// that calls CleanupBinaries after all tests are complete.
+func BinaryDirForArch(tb testing.TB, goarch string) string {
+	return BinaryDirFor(tb, "linux", goarch)
+}
+
+// BinaryDirFor is like BinaryDirForArch, but for goos as well, such as
+// for a Windows VM guest. If goos and goarch are the host's, it returns
+// BinaryDir.
+// If any test calls BinaryDirFor, there must be a TestMain function
+// that calls CleanupBinaries after all tests are complete.
+func BinaryDirFor(tb testing.TB, goos, goarch string) string {
+	if goos == runtime.GOOS && goarch == runtime.GOARCH {
+		return BinaryDir(tb)
+	}
+	archBins.Lock()
+	defer archBins.Unlock()
+	key := goos + "/" + goarch
+	if dir, ok := archBins.dirs[key]; ok {
+		return dir
+	}
+	dir, err := buildTestBinariesFor(goos, goarch)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if archBins.dirs == nil {
+		archBins.dirs = map[string]string{}
+	}
+	archBins.dirs[key] = dir
+	return dir
+}
+
 var (
 	buildOnce sync.Once
 	buildErr  error
 	binDir    string
 )
 
+// archBins holds the directories of binaries built by BinaryDirFor,
+// keyed by "GOOS/GOARCH".
+var archBins struct {
+	sync.Mutex
+	dirs map[string]string
+}
+
 // buildTestBinaries builds tailscale and tailscaled.
 // It returns the dir containing the binaries.
 func buildTestBinaries() (string, error) {
+	return buildTestBinariesFor(runtime.GOOS, runtime.GOARCH)
+}
+
+// buildTestBinariesFor builds tailscale and tailscaled for goos and
+// goarch. It returns the dir containing the binaries.
+func buildTestBinariesFor(goos, goarch string) (string, error) {
+	if binCache.dir != "" {
+		key, err := binaryCacheKey(goos, goarch)
+		if err == nil {
+			return buildCachedTestBinaries(filepath.Join(binCache.dir, key), goos, goarch)
+		}
+		log.Printf("not caching test binaries: %v", err)
+	}
 	bindir, err := ioutil.TempDir("", "")
 	if err != nil {
 		return "", err
 	}
-	err = build(bindir, "tailscale.com/cmd/tailscaled", "tailscale.com/cmd/tailscale")
+	err = build(bindir, goos, goarch, "tailscale.com/cmd/tailscaled", "tailscale.com/cmd/tailscale")
 	if err != nil {
 		os.RemoveAll(bindir)
 		return "", err
@@ -100,17 +220,114 @@ func buildTestBinaries() (string, error) {
 	return bindir, nil
 }
 
-func build(outDir string, targets ...string) error {
+// buildCachedTestBinaries is like buildTestBinariesFor, but returns
+// dir if it already holds the binaries, or builds them into dir.
+func buildCachedTestBinaries(dir, goos, goarch string) (string, error) {
+	if !binCache.force && hasTestBinaries(dir, goos) {
+		return dir, nil
+	}
+	if err := os.MkdirAll(binCache.dir, 0755); err != nil {
+		return "", err
+	}
+	// Build next to dir and move it into place when done, so an
+	// interrupted build never leaves a partial entry behind.
+	tmp, err := ioutil.TempDir(binCache.dir, "tmp-")
+	if err != nil {
+		return "", err
+	}
+	if err := build(tmp, goos, goarch, "tailscale.com/cmd/tailscaled", "tailscale.com/cmd/tailscale"); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	os.RemoveAll(dir)
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		if hasTestBinaries(dir, goos) {
+			// Another test process cached the same binaries first.
+			return dir, nil
+		}
+		return "", err
+	}
+	return dir, nil
+}
+
+func hasTestBinaries(dir, goos string) bool {
+	ext := ""
+	if goos == "windows" {
+		ext = ".exe"
+	}
+	for _, name := range []string{"tailscale", "tailscaled"} {
+		fi, err := os.Stat(filepath.Join(dir, name+ext))
+		if err != nil || !fi.Mode().IsRegular() {
+			return false
+		}
+	}
+	return true
+}
+
+// binaryCacheKey returns the name of the binary cache entry for the
+// tailscale and tailscaled binaries for goos and goarch built from the
+// current source tree. It hashes the git revision, the diff of the
+// working tree against it, the contents of untracked files and the
+// settings build uses, so any change to the source gives a new key.
+func binaryCacheKey(goos, goarch string) (string, error) {
+	git := func(args ...string) ([]byte, error) {
+		out, err := exec.Command("git", args...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("git %s: %w", strings.Join(args, " "), err)
+		}
+		return out, nil
+	}
+	top, err := git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", err
+	}
+	root := strings.TrimSpace(string(top))
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s/%s flags=%q\n", runtime.Version(), goos, goarch, buildFlags(goos, goarch))
+	for _, args := range [][]string{
+		{"rev-parse", "HEAD"},
+		{"diff", "--binary", "HEAD"},
+	} {
+		out, err := git(args...)
+		if err != nil {
+			return "", err
+		}
+		h.Write(out)
+	}
+	untracked, err := git("-C", root, "ls-files", "-z", "--others", "--exclude-standard")
+	if err != nil {
+		return "", err
+	}
+	for _, name := range strings.Split(string(untracked), "\x00") {
+		if name == "" {
+			continue
+		}
+		f, err := os.Open(filepath.Join(root, name))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00", name)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func build(outDir, goos, goarch string, targets ...string) error {
 	goBin, err := findGo()
 	if err != nil {
 		return err
 	}
+	flags := buildFlags(goos, goarch)
 	cmd := exec.Command(goBin, "install")
-	if version.IsRace() {
-		cmd.Args = append(cmd.Args, "-race")
-	}
+	cmd.Args = append(cmd.Args, flags...)
 	cmd.Args = append(cmd.Args, targets...)
-	cmd.Env = append(os.Environ(), "GOARCH="+runtime.GOARCH, "GOBIN="+outDir)
+	cmd.Env = append(os.Environ(), "GOOS="+goos, "GOARCH="+goarch, "GOBIN="+outDir)
 	errOut, err := cmd.CombinedOutput()
 	if err == nil {
 		return nil
@@ -118,9 +335,14 @@ func build(outDir string, targets ...string) error {
 	if strings.Contains(string(errOut), "when GOBIN is set") {
 		// Fallback slow path for cross-compiled binaries.
 		for _, target := range targets {
-			outFile := filepath.Join(outDir, path.Base(target)+exe())
-			cmd := exec.Command(goBin, "build", "-o", outFile, target)
-			cmd.Env = append(os.Environ(), "GOARCH="+runtime.GOARCH)
+			outFile := filepath.Join(outDir, path.Base(target))
+			if goos == "windows" {
+				outFile += ".exe"
+			}
+			cmd := exec.Command(goBin, "build", "-o", outFile)
+			cmd.Args = append(cmd.Args, flags...)
+			cmd.Args = append(cmd.Args, target)
+			cmd.Env = append(os.Environ(), "GOOS="+goos, "GOARCH="+goarch)
 			if errOut, err := cmd.CombinedOutput(); err != nil {
 				return fmt.Errorf("failed to build %v with %v: %v, %s", target, goBin, err, errOut)
 			}
@@ -231,24 +453,41 @@ func (lc *LogCatcher) StoreRawJSON() {
 	lc.raw = true
 }
 
-func (lc *LogCatcher) logsContains(sub mem.RO) bool {
+// LogsContains reports whether sub appears anywhere in the logs lc has
+// received.
+func (lc *LogCatcher) LogsContains(sub mem.RO) bool {
 	lc.mu.Lock()
 	defer lc.mu.Unlock()
 	return mem.Contains(mem.B(lc.buf.Bytes()), sub)
 }
 
-func (lc *LogCatcher) numRequests() int {
+// NumRequests returns the number of log upload requests lc has received.
+func (lc *LogCatcher) NumRequests() int {
 	lc.mu.Lock()
 	defer lc.mu.Unlock()
 	return lc.reqs
 }
 
-func (lc *LogCatcher) logsString() string {
+// LogsString returns all the logs lc has received, for printing when a
+// test fails.
+func (lc *LogCatcher) LogsString() string {
 	lc.mu.Lock()
 	defer lc.mu.Unlock()
 	return lc.buf.String()
 }
 
+// Lines returns the log lines lc has received, oldest first. It's not
+// useful after StoreRawJSON, as the raw uploads aren't split into lines.
+func (lc *LogCatcher) Lines() []string {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	s := strings.TrimSuffix(lc.buf.String(), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
 // Reset clears the buffered logs from memory.
 func (lc *LogCatcher) Reset() {
 	lc.mu.Lock()
@@ -21,6 +21,7 @@
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
 	"strings"
@@ -34,6 +35,7 @@
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/store"
+	"tailscale.com/logtail"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
@@ -64,6 +66,30 @@ func TestMain(m *testing.M) {
 	os.Exit(0)
 }
 
+func TestLogCatcherLines(t *testing.T) {
+	lc := &LogCatcher{}
+	if got := lc.Lines(); got != nil {
+		t.Errorf("Lines before any uploads = %q; want nil", got)
+	}
+	id, err := logtail.NewPrivateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{`[{"text":"one\n"},{"text":"two"}]`, `{"text":"three"}`} {
+		rec := httptest.NewRecorder()
+		lc.ServeHTTP(rec, httptest.NewRequest("POST", "/c/tailnode.log.tailscale.io/"+id.String(), strings.NewReader(body)))
+		if rec.Code != 200 {
+			t.Fatalf("upload of %s: got status %d", body, rec.Code)
+		}
+	}
+	if got, want := lc.Lines(), []string{"one", "two", "three"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Lines = %q; want %q", got, want)
+	}
+	if !lc.LogsContains(mem.S("two")) {
+		t.Error("LogsContains didn't find an uploaded line")
+	}
+}
+
 func TestOneNodeUpNoAuth(t *testing.T) {
 	t.Parallel()
 	env := newTestEnv(t)
@@ -78,7 +104,7 @@ func TestOneNodeUpNoAuth(t *testing.T) {
 
 	d1.MustCleanShutdown(t)
 
-	t.Logf("number of HTTP logcatcher requests: %v", env.LogCatcher.numRequests())
+	t.Logf("number of HTTP logcatcher requests: %v", env.LogCatcher.NumRequests())
 }
 
 func TestOneNodeExpiredKey(t *testing.T) {
@@ -138,8 +164,8 @@ func TestCollectPanic(t *testing.T) {
 	}
 	if err := tstest.WaitFor(20*time.Second, func() error {
 		const sub = `panic`
-		if !n.env.LogCatcher.logsContains(mem.S(sub)) {
-			return fmt.Errorf("log catcher didn't see %#q; got %s", sub, n.env.LogCatcher.logsString())
+		if !n.env.LogCatcher.LogsContains(mem.S(sub)) {
+			return fmt.Errorf("log catcher didn't see %#q; got %s", sub, n.env.LogCatcher.LogsString())
 		}
 		return nil
 	}); err != nil {
@@ -160,8 +186,8 @@ func TestControlTimeLogLine(t *testing.T) {
 
 	if err := tstest.WaitFor(20*time.Second, func() error {
 		const sub = `"controltime":"2020-08-03T00:00:00.000000001Z"`
-		if !n.env.LogCatcher.logsContains(mem.S(sub)) {
-			return fmt.Errorf("log catcher didn't see %#q; got %s", sub, n.env.LogCatcher.logsString())
+		if !n.env.LogCatcher.LogsContains(mem.S(sub)) {
+			return fmt.Errorf("log catcher didn't see %#q; got %s", sub, n.env.LogCatcher.LogsString())
 		}
 		return nil
 	}); err != nil {
@@ -373,6 +399,49 @@ func TestAddPingRequest(t *testing.T) {
 	t.Error("all ping attempts failed")
 }
 
+func TestSetNodeDERPMap(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t)
+	n1 := newTestNode(t, env)
+	d1 := n1.StartDaemon()
+
+	n1.AwaitListening()
+	n1.MustUp()
+	n1.AwaitRunning()
+
+	awaitRelay := func(want string) {
+		t.Helper()
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			if got := n1.MustStatus().Self.Relay; got != want {
+				return fmt.Errorf("home DERP region = %q; want %q", got, want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	awaitRelay("test")
+
+	// A second DERP server, as the only region in the node's own map.
+	dm := RunDERPAndSTUN(t, logger.Discard, "127.0.0.1")
+	r := dm.Regions[1]
+	delete(dm.Regions, 1)
+	r.RegionID, r.RegionCode = 2, "test2"
+	r.Nodes[0].RegionID, r.Nodes[0].Name = 2, "t2"
+	dm.Regions[2] = r
+
+	nodeKey := env.Control.AllNodes()[0].Key
+	if !env.Control.SetNodeDERPMap(nodeKey, dm) {
+		t.Fatal("SetNodeDERPMap didn't find the node")
+	}
+	awaitRelay("test2")
+
+	env.Control.SetNodeDERPMap(nodeKey, nil)
+	awaitRelay("test")
+
+	d1.MustCleanShutdown(t)
+}
+
 // Issue 2434: when "down" (WantRunning false), tailscaled shouldn't
 // be connected to control.
 func TestNoControlConnWhenDown(t *testing.T) {
@@ -482,6 +551,63 @@ func TestLogoutRemovesAllPeers(t *testing.T) {
 	wantNode0PeerCount(len(nodes) - 1) // all other nodes are peers again
 }
 
+func TestBinaryCache(t *testing.T) {
+	t.Setenv("TS_TEST_GOFLAGS", "") // ignore the caller's, which change the key
+	key, err := binaryCacheKey(runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		t.Skipf("not in a git checkout: %v", err)
+	}
+	if key2, err := binaryCacheKey(runtime.GOOS, runtime.GOARCH); err != nil || key2 != key {
+		t.Errorf("key not stable: %q, %q, %v", key, key2, err)
+	}
+	if other, err := binaryCacheKey(runtime.GOOS, "mips"); err != nil || other == key {
+		t.Errorf("GOARCH not part of key: %q, %v", other, err)
+	}
+	t.Setenv("TS_TEST_GOFLAGS", "-cover")
+	if other, err := binaryCacheKey(runtime.GOOS, runtime.GOARCH); err != nil || other == key {
+		t.Errorf("TS_TEST_GOFLAGS not part of key: %q, %v", other, err)
+	}
+	t.Setenv("TS_TEST_GOFLAGS", "")
+
+	old := binCache
+	defer func() { binCache = old }()
+	UseBinaryCache(t.TempDir(), false)
+
+	// An entry already in the cache is returned without building.
+	dir := filepath.Join(binCache.dir, key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"tailscale", "tailscaled"} {
+		if err := os.WriteFile(filepath.Join(dir, name+exe()), nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := buildTestBinariesFor(runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != dir {
+		t.Errorf("got %q; want cached %q", got, dir)
+	}
+	if !inBinaryCache(got) {
+		t.Errorf("%q not considered in the cache", got)
+	}
+}
+
+func TestBuildFlags(t *testing.T) {
+	t.Setenv("TS_TEST_GOFLAGS", " -race  -cover -tags=foo ")
+	if got, want := TestGoFlags(), []string{"-race", "-cover", "-tags=foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("TestGoFlags() = %q; want %q", got, want)
+	}
+	if got, want := buildFlags(runtime.GOOS, runtime.GOARCH), []string{"-race", "-cover", "-tags=foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("native buildFlags = %q; want %q", got, want)
+	}
+	if got, want := buildFlags(runtime.GOOS, "mips"), []string{"-cover", "-tags=foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cross buildFlags = %q; want %q, without -race", got, want)
+	}
+}
+
 // testEnv contains the test environment (set of servers) used by one
 // or more nodes.
 type testEnv struct {
@@ -541,7 +667,7 @@ func newTestEnv(t testing.TB, opts ...testEnvOpt) *testEnv {
 		// Shut down e.
 		if err := e.TrafficTrap.Err(); err != nil {
 			e.t.Errorf("traffic trap: %v", err)
-			e.t.Logf("logs: %s", e.LogCatcher.logsString())
+			e.t.Logf("logs: %s", e.LogCatcher.LogsString())
 		}
 		e.LogCatcherServer.Close()
 		e.TrafficTrapServer.Close()
@@ -614,8 +740,8 @@ func (n *testNode) AwaitResponding() {
 
 	if err := tstest.WaitFor(20*time.Second, func() error {
 		const sub = `Program starting: `
-		if !n.env.LogCatcher.logsContains(mem.S(sub)) {
-			return fmt.Errorf("log catcher didn't see %#q; got %s", sub, n.env.LogCatcher.logsString())
+		if !n.env.LogCatcher.LogsContains(mem.S(sub)) {
+			return fmt.Errorf("log catcher didn't see %#q; got %s", sub, n.env.LogCatcher.LogsString())
 		}
 		return nil
 	}); err != nil {
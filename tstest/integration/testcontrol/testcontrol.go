@@ -33,6 +33,7 @@
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/dnsname"
 )
 
 const msgLimit = 1 << 20 // encrypted message length limit
@@ -46,6 +47,17 @@ type Server struct {
 	Verbose     bool
 	DNSConfig   *tailcfg.DNSConfig // nil means no DNS config
 
+	// MagicDNSDomain, if non-empty, is the domain that nodes are
+	// named under, as "<hostname>.<MagicDNSDomain>.", like the
+	// control server names them for MagicDNS. Empty means nodes
+	// have no name.
+	MagicDNSDomain string
+
+	// EphemeralTimeout is how long an ephemeral node (see AddAuthKey)
+	// may go without a streaming map request before it's removed.
+	// Zero means 30 seconds.
+	EphemeralTimeout time.Duration
+
 	// ExplicitBaseURL or HTTPTestServer must be set.
 	ExplicitBaseURL string           // e.g. "http://127.0.0.1:1234" with no trailing URL
 	HTTPTestServer  *httptest.Server // if non-nil, used to get BaseURL
@@ -66,10 +78,56 @@ type Server struct {
 	users         map[key.NodePublic]*tailcfg.User
 	logins        map[key.NodePublic]*tailcfg.Login
 	updates       map[tailcfg.NodeID]chan updateType
+	online        map[tailcfg.NodeID]bool // node ID => true while it has a streaming map request
 	authPath      map[string]*AuthPath
 	nodeKeyAuthed map[key.NodePublic]bool // key => true once authenticated
 	pingReqsToAdd map[key.NodePublic]*tailcfg.PingRequest
-	allExpired    bool // All nodes will be told their node key is expired.
+	authKeys      map[string]bool         // auth key => whether nodes registered with it are ephemeral
+	ephemeral     map[key.NodePublic]bool // node key => true if registered with an ephemeral auth key
+	allExpired    bool                    // All nodes will be told their node key is expired.
+	policy        Policy
+	policyGen     int                    // incremented by UpdatePolicy
+	policyGenSent map[key.NodePublic]int // node key => policyGen of its last map response
+
+	nodeDERPMaps map[key.NodePublic]*tailcfg.DERPMap // node key => DERP map to send it instead of DERPMap
+}
+
+// Policy is the tailnet-wide configuration the server sends to every
+// node. Its zero value allows all traffic, has no SSH policy, uses the
+// Server's DNSConfig and approves no subnet routes.
+type Policy struct {
+	PacketFilter []tailcfg.FilterRule // nil means tailcfg.FilterAllowAll
+	SSHPolicy    *tailcfg.SSHPolicy   // nil means no SSH policy
+	DNSConfig    *tailcfg.DNSConfig   // nil means Server.DNSConfig
+
+	// AutoApproveRoutes are the prefixes within which routes a node
+	// advertises in Hostinfo.RoutableIPs are approved and sent to its
+	// peers as subnet routes.
+	AutoApproveRoutes []netaddr.IPPrefix
+}
+
+func (p Policy) clone() Policy {
+	p.PacketFilter = append([]tailcfg.FilterRule(nil), p.PacketFilter...)
+	p.AutoApproveRoutes = append([]netaddr.IPPrefix(nil), p.AutoApproveRoutes...)
+	return p
+}
+
+// approvedRoutes returns the routes advertised by n that p approves.
+func (p Policy) approvedRoutes(n *tailcfg.Node) (routes []netaddr.IPPrefix) {
+	if !n.Hostinfo.Valid() {
+		return nil
+	}
+	advertised := n.Hostinfo.RoutableIPs()
+	for i := 0; i < advertised.Len(); i++ {
+		r := advertised.At(i)
+		for _, ap := range p.AutoApproveRoutes {
+			if ap.Bits() <= r.Bits() && ap.Contains(r.IP()) {
+				routes = append(routes, r)
+				break
+			}
+		}
+	}
+	return routes
 }
 
 // BaseURL returns the server's base URL, without trailing slash.
@@ -158,6 +216,38 @@ func (s *Server) AddPingRequest(nodeKeyDst key.NodePublic, pr *tailcfg.PingReque
 	return sendUpdate(oldUpdatesCh, updateDebugInjection)
 }
 
+// SetNodeDERPMap sets the DERP map sent to the node with key nk, in
+// place of s.DERPMap; a nil dm goes back to s.DERPMap. It reports
+// whether nk is a known node.
+func (s *Server) SetNodeDERPMap(nk key.NodePublic, dm *tailcfg.DERPMap) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node := s.nodeLocked(nk)
+	if node == nil {
+		return false
+	}
+	if dm == nil {
+		delete(s.nodeDERPMaps, nk)
+	} else {
+		if s.nodeDERPMaps == nil {
+			s.nodeDERPMaps = map[key.NodePublic]*tailcfg.DERPMap{}
+		}
+		s.nodeDERPMaps[nk] = dm
+	}
+	sendUpdate(s.updates[node.ID], updateSelfChanged)
+	return true
+}
+
+// derpMap returns the DERP map to send to the node with key nk.
+func (s *Server) derpMap(nk key.NodePublic) *tailcfg.DERPMap {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if dm, ok := s.nodeDERPMaps[nk]; ok {
+		return dm
+	}
+	return s.DERPMap
+}
+
 // Mark the Node key of every node as expired
 func (s *Server) SetExpireAllNodes(expired bool) {
 	s.mu.Lock()
@@ -170,6 +260,75 @@ func (s *Server) SetExpireAllNodes(expired bool) {
 	}
 }
 
+// Policy returns a copy of the server's current policy.
+func (s *Server) Policy() Policy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.policy.clone()
+}
+
+// UpdatePolicy calls fn to modify the server's policy and sends the
+// result to all connected nodes. It returns the new policy generation,
+// for use with AwaitNodePolicy.
+func (s *Server) UpdatePolicy(fn func(*Policy)) (gen int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.policy.clone()
+	fn(&p)
+	s.policy = p
+	s.policyGen++
+	for _, node := range s.nodes {
+		sendUpdate(s.updates[node.ID], updateSelfChanged)
+	}
+	return s.policyGen
+}
+
+// AwaitNodePolicy waits for node k to have been sent a map response
+// reflecting at least policy generation gen, as returned by
+// UpdatePolicy. It returns an error if the node is unknown or the
+// context is done first.
+func (s *Server) AwaitNodePolicy(ctx context.Context, k key.NodePublic, gen int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cond := s.condLocked()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			cond.Broadcast()
+		}
+	}()
+
+	for {
+		if s.nodes[k] == nil {
+			return errors.New("unknown node key")
+		}
+		if s.policyGenSent[k] >= gen {
+			return nil
+		}
+		cond.Wait()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// AddAuthKey makes nodes registering with authKey ephemeral if
+// ephemeral is true: they're removed once they've been disconnected
+// for EphemeralTimeout. Auth keys that were never added are accepted
+// too, as before, for regular nodes.
+func (s *Server) AddAuthKey(authKey string, ephemeral bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.authKeys == nil {
+		s.authKeys = map[string]bool{}
+	}
+	s.authKeys[authKey] = ephemeral
+}
+
 type AuthPath struct {
 	nodeKey key.NodePublic
 
@@ -492,6 +651,13 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 		Addresses:         allowedIPs,
 		AllowedIPs:        allowedIPs,
 		Hostinfo:          req.Hostinfo.View(),
+		Name:              s.nodeName(req.Hostinfo.View()),
+	}
+	if req.Auth.AuthKey != "" && s.authKeys[req.Auth.AuthKey] {
+		if s.ephemeral == nil {
+			s.ephemeral = map[key.NodePublic]bool{}
+		}
+		s.ephemeral[nk] = true
 	}
 	requireAuth := s.RequireAuth
 	if requireAuth && s.nodeKeyAuthed[nk] {
@@ -578,6 +744,49 @@ func (s *Server) UpdateNode(n *tailcfg.Node) (peersToUpdate []tailcfg.NodeID) {
 	return peersToUpdate
 }
 
+// nodeName returns the MagicDNS name of a node with Hostinfo hi,
+// or the empty string if s.MagicDNSDomain is empty.
+func (s *Server) nodeName(hi tailcfg.HostinfoView) string {
+	if s.MagicDNSDomain == "" {
+		return ""
+	}
+	host := "node"
+	if hi.Valid() {
+		if h := dnsname.SanitizeHostname(hi.Hostname()); h != "" {
+			host = h
+		}
+	}
+	return host + "." + strings.Trim(s.MagicDNSDomain, ".") + "."
+}
+
+// scheduleEphemeralCleanup removes the ephemeral node nk once
+// EphemeralTimeout passes, unless it's started a new map stream
+// (replacing updatesCh) by then.
+func (s *Server) scheduleEphemeralCleanup(nk key.NodePublic, nodeID tailcfg.NodeID, updatesCh chan updateType) {
+	timeout := s.EphemeralTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.updates[nodeID] != updatesCh {
+			return
+		}
+		s.logf("removing disconnected ephemeral node %v", nk.ShortString())
+		delete(s.nodes, nk)
+		delete(s.updates, nodeID)
+		delete(s.ephemeral, nk)
+		delete(s.policyGenSent, nk)
+		var peers []tailcfg.NodeID
+		for _, n := range s.nodes {
+			peers = append(peers, n.ID)
+		}
+		s.updateLocked("ephemeralCleanup", peers)
+		s.condLocked().Broadcast()
+	})
+}
+
 func (s *Server) incrInServeMap(delta int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -629,6 +838,7 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 		node.DiscoKey = req.DiscoKey
 		if req.Hostinfo != nil {
 			node.Hostinfo = req.Hostinfo.View()
+			node.Name = s.nodeName(node.Hostinfo)
 			if ni := node.Hostinfo.NetInfo(); ni.Valid() {
 				if ni.PreferredDERP() != 0 {
 					node.DERP = fmt.Sprintf("127.3.3.40:%d", ni.PreferredDERP())
@@ -656,15 +866,27 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 	}
 	s.updateLocked("serveMap", peersToUpdate)
 	s.condLocked().Broadcast()
+	isEphemeral := s.ephemeral[node.Key]
 	s.mu.Unlock()
 
 	// ReadOnly implies no streaming, as it doesn't
 	// register an updatesCh to get updates.
 	streaming := req.Stream && !req.ReadOnly
 	compress := req.Compress != ""
+	if streaming && isEphemeral {
+		defer s.scheduleEphemeralCleanup(node.Key, nodeID, updatesCh)
+	}
+	if streaming && breakSameNodeMapResponseStreams(req) {
+		s.setOnline(nodeID, true, nil)
+		defer s.setOnline(nodeID, false, updatesCh)
+	}
 
 	w.WriteHeader(200)
 	for {
+		s.mu.Lock()
+		policyGen := s.policyGen
+		s.mu.Unlock()
+
 		res, err := s.MapResponse(req)
 		if err != nil {
 			// TODO: log
@@ -689,6 +911,7 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 		if err := s.sendMapMsg(w, mkey, compress, resBytes); err != nil {
 			return
 		}
+		s.markPolicySent(req.NodeKey, policyGen)
 		if !streaming {
 			return
 		}
@@ -721,6 +944,57 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 	}
 }
 
+// setOnline records whether nodeID has a streaming map request and
+// tells its peers if that changed. If updatesCh is non-nil, it's only
+// done if updatesCh is still nodeID's current stream, so a stream
+// replaced by a newer one doesn't mark the node offline as it ends.
+func (s *Server) setOnline(nodeID tailcfg.NodeID, online bool, updatesCh chan updateType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if updatesCh != nil && s.updates[nodeID] != updatesCh {
+		return
+	}
+	if s.online[nodeID] == online {
+		return
+	}
+	if online {
+		if s.online == nil {
+			s.online = map[tailcfg.NodeID]bool{}
+		}
+		s.online[nodeID] = true
+	} else {
+		delete(s.online, nodeID)
+	}
+	var peers []tailcfg.NodeID
+	for _, n := range s.nodes {
+		if n.ID != nodeID {
+			peers = append(peers, n.ID)
+		}
+	}
+	s.updateLocked("setOnline", peers)
+}
+
+// isOnline reports whether nodeID currently has a streaming map request.
+func (s *Server) isOnline(nodeID tailcfg.NodeID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.online[nodeID]
+}
+
+// markPolicySent records that nk was sent a map response reflecting
+// policy generation gen.
+func (s *Server) markPolicySent(nk key.NodePublic, gen int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.policyGenSent == nil {
+		s.policyGenSent = map[key.NodePublic]int{}
+	}
+	if gen > s.policyGenSent[nk] {
+		s.policyGenSent[nk] = gen
+	}
+	s.condLocked().Broadcast()
+}
+
 var keepAliveMsg = &struct {
 	KeepAlive bool
 }{
@@ -738,10 +1012,11 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 		return nil, nil
 	}
 	user, _ := s.getUser(nk)
+	policy := s.Policy()
 	t := time.Date(2020, 8, 3, 0, 0, 0, 1, time.UTC)
 	res = &tailcfg.MapResponse{
 		Node:            node,
-		DERPMap:         s.DERPMap,
+		DERPMap:         s.derpMap(nk),
 		Domain:          string(user.Domain),
 		CollectServices: "true",
 		PacketFilter:    tailcfg.FilterAllowAll,
@@ -749,10 +1024,23 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 			DisableUPnP: "true",
 		},
 		DNSConfig:   s.DNSConfig,
+		SSHPolicy:   policy.SSHPolicy,
 		ControlTime: &t,
 	}
+	if policy.PacketFilter != nil {
+		res.PacketFilter = policy.PacketFilter
+	}
+	if policy.DNSConfig != nil {
+		res.DNSConfig = policy.DNSConfig
+	}
 	for _, p := range s.AllNodes() {
 		if p.StableID != node.StableID {
+			online := s.isOnline(p.ID)
+			p.Online = &online
+			if routes := policy.approvedRoutes(p); len(routes) > 0 {
+				p.AllowedIPs = append(p.AllowedIPs, routes...)
+				p.PrimaryRoutes = routes
+			}
 			res.Peers = append(res.Peers, p)
 		}
 	}
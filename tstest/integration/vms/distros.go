@@ -7,6 +7,7 @@
 import (
 	_ "embed"
 	"log"
+	"time"
 
 	"github.com/tailscale/hujson"
 )
@@ -16,17 +17,62 @@
 type Distro struct {
 	Name           string // amazon-linux
 	URL            string // URL to a qcow2 image
-	SHA256Sum      string // hex-encoded sha256 sum of contents of URL
+	SHA256Sum      string // hex-encoded sha256 sum of the qcow2 image, after undoing any Compression
 	MemoryMegs     int    // VM memory in megabytes
-	PackageManager string // yum/apt/dnf/zypper
+	PackageManager string // yum/apt/dnf/zypper/ostree/transactional-update, or empty if none (Flatcar)
 	InitSystem     string // systemd/openrc
 	HostGenerated  bool   // generated image rather than downloaded
+	Ignition       bool   // configured with Ignition rather than cloud-init
+	Arch           string // GOARCH of the guest, amd64 if empty
+	OS             string // GOOS of the guest, linux if empty
+	Compression    string // "xz", "zstd" or "gzip" if URL is compressed, else empty
+
+	// ExtraDaemonArgs are added to the guest's tailscaled command
+	// line, such as "--tun=userspace-networking", to test a
+	// distro with a different daemon configuration. They go in
+	// FLAGS in /etc/default/tailscaled, which the init scripts
+	// split on spaces, so they can't contain spaces or quotes.
+	ExtraDaemonArgs []string `json:",omitempty"`
+
+	// ExpectedFailures maps the names of testDistro's subtests that
+	// always fail on this distro, for reasons outside tailscale (such
+	// as an old kernel missing a module), to why. Those subtests still
+	// run, but failing only skips them with that note, and passing
+	// fails them, so the entry gets removed once it's fixed.
+	ExpectedFailures map[string]string `json:",omitempty"`
 }
 
+// GoArch returns the GOARCH of d's guest.
+func (d *Distro) GoArch() string {
+	if d.Arch == "" {
+		return "amd64"
+	}
+	return d.Arch
+}
+
+// GoOS returns the GOOS of d's guest.
+func (d *Distro) GoOS() string {
+	if d.OS == "" {
+		return "linux"
+	}
+	return d.OS
+}
+
+// SSHUser returns the administrator account the harness logs in as.
+func (d *Distro) SSHUser() string {
+	if d.GoOS() == "windows" {
+		return "Administrator"
+	}
+	return "root"
+}
+
+// InstallPre returns the cloud-init runcmd entries that install what
+// the tests need on d's guest. The guest only reports its address to
+// the harness once they've all succeeded, so none may prompt.
 func (d *Distro) InstallPre() string {
 	switch d.PackageManager {
 	case "yum":
-		return ` - [ yum, update, gnupg2 ]
+		return ` - [ yum, "-y", update, gnupg2 ]
  - [ yum, "-y", install, iptables ]
  - [ sh, "-c", "printf '\n\nUseDNS no\n\n' | tee -a /etc/ssh/sshd_config" ]
  - [ systemctl, restart, "sshd.service" ]`
@@ -43,11 +89,69 @@ func (d *Distro) InstallPre() string {
 	case "apk":
 		return ` - [ apk, "-U", add, curl, "ca-certificates", iptables, ip6tables ]
  - [ modprobe, tun ]`
+
+	// The packages installed on immutable distros only show up after a
+	// reboot into the new deployment or snapshot, which the harness does
+	// once it can SSH in.
+	case "ostree":
+		return ` - [ "rpm-ostree", install, "--idempotent", "--allow-inactive", iptables ]`
+
+	case "transactional-update":
+		return ` - [ "transactional-update", "--non-interactive", pkg, install, iptables ]`
 	}
 
 	return ""
 }
 
+// Immutable reports whether d has a read-only /usr and installs
+// packages into a new deployment or snapshot that needs a reboot.
+func (d *Distro) Immutable() bool {
+	return d.PackageManager == "ostree" || d.PackageManager == "transactional-update"
+}
+
+// UserspaceNetworking reports whether d's guest runs tailscaled with
+// --tun=userspace-networking, and so has no TUN device, routes or
+// netfilter rules of its own.
+func (d *Distro) UserspaceNetworking() bool {
+	for _, a := range d.ExtraDaemonArgs {
+		if a == "--tun=userspace-networking" || a == "-tun=userspace-networking" {
+			return true
+		}
+	}
+	return false
+}
+
+// SSHTimeout returns how long to keep trying to SSH into d's guest
+// once it has an IP address, going by how slowly it boots: CentOS and
+// Amazon Linux run a yum update and then restart sshd from cloud-init,
+// and immutable distros reboot into a new deployment and then boot
+// again. Windows is slowest of all: it finishes sysprep, then reboots
+// once cloudbase-init has set its hostname.
+func (d *Distro) SSHTimeout() time.Duration {
+	switch {
+	case d.GoOS() == "windows":
+		return 10 * time.Minute
+	case d.PackageManager == "yum":
+		return 6 * time.Minute
+	case d.Immutable():
+		return 4 * time.Minute
+	}
+	return 2 * time.Minute
+}
+
+// InstallDirs returns the directories the tailscale and tailscaled
+// binaries under test are installed to. Immutable distros keep
+// /usr/local writable; on ostree it lives at /var/usrlocal.
+func (d *Distro) InstallDirs() (cliDir, daemonDir string) {
+	switch d.PackageManager {
+	case "ostree":
+		return "/var/usrlocal/bin", "/var/usrlocal/bin"
+	case "transactional-update":
+		return "/usr/local/bin", "/usr/local/bin"
+	}
+	return "/usr/bin", "/usr/sbin"
+}
+
 //go:embed distros.hujson
 var distroData string
 
@@ -6,6 +6,7 @@
 
 import (
 	"testing"
+	"time"
 )
 
 func TestDistrosGotLoaded(t *testing.T) {
@@ -13,3 +14,43 @@ func TestDistrosGotLoaded(t *testing.T) {
 		t.Fatal("no distros were loaded")
 	}
 }
+
+func TestExpectedFailures(t *testing.T) {
+	for _, d := range Distros {
+		for name, why := range d.ExpectedFailures {
+			if why == "" {
+				t.Errorf("%s: ExpectedFailures[%q] needs a reason", d.Name, name)
+			}
+		}
+	}
+}
+
+func TestUserspaceNetworking(t *testing.T) {
+	if !(&Distro{ExtraDaemonArgs: []string{"--verbose=1", "--tun=userspace-networking"}}).UserspaceNetworking() {
+		t.Error("--tun=userspace-networking not detected")
+	}
+	if (&Distro{ExtraDaemonArgs: []string{"--tun=tailscale1"}}).UserspaceNetworking() {
+		t.Error("--tun=tailscale1 detected as userspace networking")
+	}
+	if (&Distro{}).UserspaceNetworking() {
+		t.Error("default detected as userspace networking")
+	}
+}
+
+func TestSSHTimeout(t *testing.T) {
+	for _, d := range Distros {
+		if got := d.SSHTimeout(); got < time.Minute {
+			t.Errorf("%s: SSHTimeout() = %v; want at least a minute", d.Name, got)
+		}
+	}
+	fast := Distro{PackageManager: "apt"}
+	for _, slow := range []Distro{
+		{Name: "centos", PackageManager: "yum"},
+		{Name: "fedora-coreos", PackageManager: "ostree"},
+		{Name: "windows", OS: "windows"},
+	} {
+		if slow.SSHTimeout() <= fast.SSHTimeout() {
+			t.Errorf("%s's SSHTimeout() = %v; want more than apt's %v", slow.Name, slow.SSHTimeout(), fast.SSHTimeout())
+		}
+	}
+}
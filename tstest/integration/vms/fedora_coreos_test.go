@@ -0,0 +1,180 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vms
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+   Fedora CoreOS doesn't ship cloud-init; it is configured on first boot by
+   Ignition[1], which QEMU guests read from the opt/com.coreos/config fw_cfg
+   entry. This writes an Ignition config that does what the cloud-init
+   user-data does for every other distro: authorize our SSH key for root
+   and the ts user, install iptables if the distro lacks it and report in
+   to the harness. Ignition only takes password hashes, so unlike with
+   cloud-init, ts can only log in with the key.
+
+   [1]: https://coreos.github.io/ignition/
+*/
+
+type ignitionConfig struct {
+	Ignition struct {
+		Version string `json:"version"`
+	} `json:"ignition"`
+	Passwd struct {
+		Users []ignitionUser `json:"users"`
+	} `json:"passwd"`
+	Storage struct {
+		Files []ignitionFile `json:"files"`
+	} `json:"storage"`
+	Systemd struct {
+		Units []ignitionUnit `json:"units"`
+	} `json:"systemd"`
+}
+
+type ignitionUser struct {
+	Name              string   `json:"name"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys"`
+	Groups            []string `json:"groups,omitempty"`
+}
+
+type ignitionFile struct {
+	Path     string `json:"path"`
+	Mode     int    `json:"mode"`
+	Contents struct {
+		Source string `json:"source"`
+	} `json:"contents"`
+}
+
+type ignitionUnit struct {
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Contents string `json:"contents"`
+}
+
+// ignitionSetupUnit stands in for the cloud-init runcmd on Ignition
+// distros. It only runs on the first boot so that the harness's reboot
+// into the deployment with iptables layered doesn't report in twice.
+const ignitionSetupUnit = `[Unit]
+Description=Prepare for Tailscale VM tests
+Wants=network-online.target
+After=network-online.target
+ConditionPathExists=!/var/lib/ts-vm-setup.done
+
+[Service]
+Type=oneshot
+%sExecStart=/usr/bin/curl %s -H "User-Agent: %s"
+ExecStartPost=/usr/bin/touch /var/lib/ts-vm-setup.done
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// ignitionInstallPre is the Ignition counterpart of InstallPre: the
+// ExecStart lines of ignitionSetupUnit that install what the tests
+// need. Flatcar, which has no package manager, already ships iptables.
+func (d *Distro) ignitionInstallPre() string {
+	if d.PackageManager == "ostree" {
+		return "ExecStart=/usr/bin/rpm-ostree install --idempotent --allow-inactive iptables\n"
+	}
+	return ""
+}
+
+// mkIgnitionConfig writes the Ignition config for d to
+// tdir/<name>/config.ign.
+func mkIgnitionConfig(t *testing.T, d Distro, sshKey, hostURL, tdir string, port int) {
+	t.Helper()
+
+	var cfg ignitionConfig
+	cfg.Ignition.Version = "3.3.0"
+
+	key := strings.TrimSpace(sshKey)
+	for _, name := range []string{"root", "core"} {
+		cfg.Passwd.Users = append(cfg.Passwd.Users, ignitionUser{
+			Name:              name,
+			SSHAuthorizedKeys: []string{key},
+		})
+	}
+	// The sudo group has passwordless sudo on both Fedora CoreOS and
+	// Flatcar, like the wheel group that cloud-init puts ts in.
+	cfg.Passwd.Users = append(cfg.Passwd.Users, ignitionUser{
+		Name:              "ts",
+		SSHAuthorizedKeys: []string{key},
+		Groups:            []string{"sudo"},
+	})
+
+	hostname := ignitionFile{Path: "/etc/hostname", Mode: 0644}
+	hostname.Contents.Source = "data:," + url.PathEscape(d.Name)
+	cfg.Storage.Files = append(cfg.Storage.Files, hostname)
+
+	cfg.Systemd.Units = append(cfg.Systemd.Units, ignitionUnit{
+		Name:     "ts-vm-setup.service",
+		Enabled:  true,
+		Contents: fmt.Sprintf(ignitionSetupUnit, d.ignitionInstallPre(), fmt.Sprintf("%s/myip/%d", hostURL, port), d.Name),
+	})
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(tdir, d.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.ign"), data, 0644); err != nil {
+		t.Fatalf("can't write ignition config: %v", err)
+	}
+}
+
+func TestMkIgnitionConfig(t *testing.T) {
+	for _, d := range []Distro{
+		{Name: "fedora-coreos-35", PackageManager: "ostree", Ignition: true},
+		{Name: "flatcar-stable", Ignition: true},
+	} {
+		t.Run(d.Name, func(t *testing.T) {
+			tdir := t.TempDir()
+			mkIgnitionConfig(t, d, "ssh-ed25519 AAAA test\n", "http://52.52.0.2:8081", tdir, 2222)
+
+			data, err := os.ReadFile(filepath.Join(tdir, d.Name, "config.ign"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var cfg ignitionConfig
+			if err := json.Unmarshal(data, &cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			var users []string
+			for _, u := range cfg.Passwd.Users {
+				users = append(users, u.Name)
+				if len(u.SSHAuthorizedKeys) != 1 || u.SSHAuthorizedKeys[0] != "ssh-ed25519 AAAA test" {
+					t.Errorf("user %s has keys %q", u.Name, u.SSHAuthorizedKeys)
+				}
+			}
+			if got, want := strings.Join(users, ","), "root,core,ts"; got != want {
+				t.Errorf("users = %s; want %s", got, want)
+			}
+
+			if len(cfg.Systemd.Units) != 1 {
+				t.Fatalf("got %d units; want 1", len(cfg.Systemd.Units))
+			}
+			unit := cfg.Systemd.Units[0].Contents
+			if want := `ExecStart=/usr/bin/curl http://52.52.0.2:8081/myip/2222 -H "User-Agent: ` + d.Name + `"`; !strings.Contains(unit, want) {
+				t.Errorf("unit lacks %q:\n%s", want, unit)
+			}
+			if got, want := strings.Contains(unit, "rpm-ostree"), d.PackageManager == "ostree"; got != want {
+				t.Errorf("unit installs with rpm-ostree = %v; want %v", got, want)
+			}
+		})
+	}
+}
@@ -10,7 +10,11 @@
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -18,7 +22,9 @@
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -30,24 +36,55 @@
 	"tailscale.com/tstest/integration"
 	"tailscale.com/tstest/integration/testcontrol"
 	"tailscale.com/types/dnstype"
+	"tailscale.com/types/key"
 )
 
 type Harness struct {
 	testerDialer   proxy.Dialer
+	testerSOCKS    string // host:port of the tester node's SOCKS5 server
 	testerDir      string
 	binaryDir      string
 	cli            string
 	daemon         string
 	pubKey         string
 	signer         ssh.Signer
-	cs             *testcontrol.Server
+	cs             *testcontrol.Server     // nil with --control-url
+	lc             *integration.LogCatcher // logs uploaded by the guest VM; nil with --control-url
+	testerLC       *integration.LogCatcher // logs uploaded by the tester node; nil with --control-url
 	loginServerURL string
+	hostURL        string // the harness's own HTTP server, for /myip
+	logTarget      string // TS_LOG_TARGET for the guest and tester; empty for the default
 	testerV4       netaddr.IP
+	testerV6       netaddr.IP
+	testerNodeKey  key.NodePublic // zero with --control-url
+	testerDERPOnly bool           // whether the tester only talks to peers over DERP
 	ipMu           *sync.Mutex
 	ipMap          map[string]ipMapping
+	result         *distroResult     // for the summary of the run; nil outside testOneDistribution
+	accel          string            // qemu accelerator for the guest, "kvm" or "tcg"; empty until mkVM
+	xfail          map[string]string // the guest's Distro.ExpectedFailures
+	smoke          bool              // with --smoke, only start tailscaled and log in
 }
 
-func newHarness(t *testing.T) *Harness {
+// testerOpts are extra settings for the tester node's tailscaled, for
+// tests that need it to report something to control that it doesn't by
+// default, or to reach the guest some other way.
+type testerOpts struct {
+	DaemonArgs []string // extra tailscaled flags
+	Env        []string // extra KEY=value environment variables
+
+	// DERPMap, if non-nil, is the DERP map control gives the tester
+	// instead of the harness's own, such as to put it on a region
+	// the guest doesn't prefer. Its regions are added to the guest's
+	// map. It needs the embedded control server.
+	DERPMap *tailcfg.DERPMap
+
+	// DERPOnly makes the tester never talk to peers directly, so
+	// that all its traffic with the guest is relayed over DERP.
+	DERPOnly bool
+}
+
+func newHarness(t *testing.T, tester testerOpts) *Harness {
 	dir := t.TempDir()
 	bindHost := deriveBindhost(t)
 	ln, err := net.Listen("tcp", net.JoinHostPort(bindHost, "0"))
@@ -59,42 +96,76 @@ func newHarness(t *testing.T) *Harness {
 	})
 	t.Logf("host:port: %s", ln.Addr())
 
-	cs := &testcontrol.Server{
-		DNSConfig: &tailcfg.DNSConfig{
-			// TODO: this is wrong.
-			// It is also only one of many configurations.
-			// Figure out how to scale it up.
-			Resolvers:    []dnstype.Resolver{{Addr: "100.100.100.100"}, {Addr: "8.8.8.8"}},
-			Domains:      []string{"record"},
-			Proxied:      true,
-			ExtraRecords: []tailcfg.DNSRecord{{Name: "extratest.record", Type: "A", Value: "1.2.3.4"}},
-		},
-	}
-
-	derpMap := integration.RunDERPAndSTUN(t, t.Logf, bindHost)
-	cs.DERPMap = derpMap
-
 	var (
 		ipMu  sync.Mutex
 		ipMap = map[string]ipMapping{}
 	)
 
 	mux := http.NewServeMux()
-	mux.Handle("/", cs)
+	hostURL := fmt.Sprintf("http://%s", ln.Addr())
 
-	lc := &integration.LogCatcher{}
-	if *verboseLogcatcher {
-		lc.UseLogf(t.Logf)
-		t.Cleanup(func() {
-			lc.UseLogf(nil) // do not log after test is complete
-		})
+	// With --control-url, the guest and tester register with that
+	// server instead, which brings its own DERP map, and their logs go
+	// wherever they would normally.
+	var (
+		cs          *testcontrol.Server
+		lc          *integration.LogCatcher
+		testerLC    *integration.LogCatcher
+		loginServer = *controlURL
+		logTarget   string
+	)
+	if loginServer == "" {
+		cs = &testcontrol.Server{
+			DNSConfig: &tailcfg.DNSConfig{
+				// TODO: this is wrong.
+				// It is also only one of many configurations.
+				// Figure out how to scale it up.
+				Resolvers:    []dnstype.Resolver{{Addr: "100.100.100.100"}, {Addr: "8.8.8.8"}},
+				Domains:      []string{"record"},
+				Proxied:      true,
+				ExtraRecords: []tailcfg.DNSRecord{{Name: "extratest.record", Type: "A", Value: "1.2.3.4"}},
+			},
+			MagicDNSDomain: "vms.tailnet.test",
+		}
+
+		derpMap := integration.RunDERPAndSTUN(t, t.Logf, bindHost)
+		if tester.DERPMap != nil {
+			// The guest has to know the tester's regions too to
+			// reach it over DERP.
+			for id, r := range tester.DERPMap.Regions {
+				derpMap.Regions[id] = r
+			}
+		}
+		cs.DERPMap = derpMap
+
+		mux.Handle("/", cs)
+
+		lc = &integration.LogCatcher{}
+		testerLC = &integration.LogCatcher{}
+		if *verboseLogcatcher {
+			lc.UseLogf(t.Logf)
+			testerLC.UseLogf(t.Logf)
+			t.Cleanup(func() {
+				// do not log after test is complete
+				lc.UseLogf(nil)
+				testerLC.UseLogf(nil)
+			})
+		}
+		mux.Handle("/c/", lc)
+
+		// The tester node uploads its logs separately so that lc only
+		// sees logs from the guest.
+		mux.Handle("/tester/c/", http.StripPrefix("/tester", testerLC))
+
+		loginServer = hostURL
+		logTarget = hostURL
 	}
-	mux.Handle("/c/", lc)
 
 	// This handler will let the virtual machines tell the host information about that VM.
 	// This is used to maintain a list of port->IP address mappings that are known to be
 	// working. This allows later steps to connect over SSH. This returns no response to
-	// clients because no response is needed.
+	// clients because no response is needed. With --vm-network=tap, the request comes
+	// straight from the guest's address on the bridge, which is where SSH goes too.
 	mux.HandleFunc("/myip/", func(w http.ResponseWriter, r *http.Request) {
 		ipMu.Lock()
 		defer ipMu.Unlock()
@@ -106,7 +177,7 @@ func newHarness(t *testing.T) *Harness {
 			log.Panicf("bad port: %v", port)
 		}
 		distro := r.UserAgent()
-		ipMap[distro] = ipMapping{distro, port, host}
+		ipMap[distro] = ipMapping{distro, port, host, *vmNetwork == "tap"}
 		t.Logf("%s: %v", name, host)
 	})
 
@@ -133,7 +204,6 @@ func newHarness(t *testing.T) *Harness {
 		t.Fatalf("can't parse private key: %v", err)
 	}
 
-	loginServer := fmt.Sprintf("http://%s", ln.Addr())
 	t.Logf("loginServer: %s", loginServer)
 
 	h := &Harness{
@@ -143,12 +213,16 @@ func newHarness(t *testing.T) *Harness {
 		daemon:         integration.TailscaledBinary(t),
 		signer:         signer,
 		loginServerURL: loginServer,
+		hostURL:        hostURL,
+		logTarget:      logTarget,
 		cs:             cs,
+		lc:             lc,
+		testerLC:       testerLC,
 		ipMu:           &ipMu,
 		ipMap:          ipMap,
 	}
 
-	h.makeTestNode(t, loginServer)
+	h.makeTestNode(t, loginServer, tester)
 
 	return h
 }
@@ -171,29 +245,43 @@ func (h *Harness) Tailscale(t *testing.T, args ...string) []byte {
 // enables us to make connections to and from the tailscale network being
 // tested. This mutates the Harness to allow tests to dial into the tailscale
 // network as well as control the tester's tailscaled.
-func (h *Harness) makeTestNode(t *testing.T, controlURL string) {
+func (h *Harness) makeTestNode(t *testing.T, controlURL string, opts testerOpts) {
 	dir := t.TempDir()
 	h.testerDir = dir
 
-	port, err := getProbablyFreePortNumber()
+	for _, kv := range opts.Env {
+		if !strings.Contains(kv, "=") {
+			t.Fatalf("tester environment variable %q isn't of the form KEY=value", kv)
+		}
+	}
+
+	port, ln, err := reservePort()
 	if err != nil {
 		t.Fatalf("can't get free port: %v", err)
 	}
 
-	cmd := exec.Command(
-		h.daemon,
+	args := []string{
 		"--tun=userspace-networking",
-		"--state="+filepath.Join(dir, "state.json"),
-		"--socket="+filepath.Join(dir, "sock"),
+		"--state=" + filepath.Join(dir, "state.json"),
+		"--socket=" + filepath.Join(dir, "sock"),
 		fmt.Sprintf("--socks5-server=localhost:%d", port),
-	)
+	}
+	cmd := exec.Command(h.daemon, append(args, opts.DaemonArgs...)...)
 
 	cmd.Env = append(
 		os.Environ(),
 		"NOTIFY_SOCKET="+filepath.Join(dir, "notify_socket"),
-		"TS_LOG_TARGET="+h.loginServerURL,
 	)
+	if h.logTarget != "" {
+		cmd.Env = append(cmd.Env, "TS_LOG_TARGET="+h.logTarget+"/tester")
+	}
+	if opts.DERPOnly {
+		cmd.Env = append(cmd.Env, "TS_DEBUG_ALWAYS_USE_DERP=true")
+		h.testerDERPOnly = true
+	}
+	cmd.Env = append(cmd.Env, opts.Env...)
 
+	ln.Close()
 	err = cmd.Start()
 	if err != nil {
 		t.Fatalf("can't start tailscaled: %v", err)
@@ -229,16 +317,403 @@ func (h *Harness) makeTestNode(t *testing.T, controlURL string) {
 		"up",
 		"--login-server="+controlURL,
 		"--hostname=tester",
+		"--accept-routes",
 	)
 
-	dialer, err := proxy.SOCKS5("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)), nil, &net.Dialer{})
+	h.testerSOCKS = net.JoinHostPort("127.0.0.1", fmt.Sprint(port))
+	dialer, err := proxy.SOCKS5("tcp", h.testerSOCKS, nil, &net.Dialer{})
 	if err != nil {
 		t.Fatalf("can't make netstack proxy dialer: %v", err)
 	}
 	h.testerDialer = dialer
 	h.testerV4 = bytes2Netaddr(h.Tailscale(t, "ip", "-4"))
+	h.testerV6 = bytes2Netaddr(h.Tailscale(t, "ip", "-6"))
+	if h.cs != nil {
+		nk, err := selfNodeKey(h.Tailscale(t, "status", "--json"))
+		if err != nil {
+			t.Fatalf("can't get the tester's node key: %v", err)
+		}
+		if ip, ok := h.assignedIP(nk, false); !ok || ip != h.testerV4 {
+			t.Fatalf("tester says its IPv4 address is %v, but control assigned it %v", h.testerV4, ip)
+		}
+		if ip, ok := h.assignedIP(nk, true); !ok || ip != h.testerV6 {
+			t.Fatalf("tester says its IPv6 address is %v, but control assigned it %v", h.testerV6, ip)
+		}
+		h.testerNodeKey = nk
+	}
+	if opts.DERPMap != nil {
+		h.needEmbeddedControl(t)
+		h.cs.SetNodeDERPMap(h.testerNodeKey, opts.DERPMap)
+		h.awaitTesterDERPRegion(t, opts.DERPMap)
+	}
+}
+
+// awaitTesterDERPRegion waits for the tester node's home DERP region
+// to be one in dm, once control has sent it dm.
+func (h *Harness) awaitTesterDERPRegion(t *testing.T, dm *tailcfg.DERPMap) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		var st struct {
+			Self struct{ Relay string }
+		}
+		if err := json.Unmarshal(h.Tailscale(t, "status", "--json"), &st); err != nil {
+			t.Fatalf("can't parse the tester's status: %v", err)
+		}
+		for _, r := range dm.Regions {
+			if r.RegionCode == st.Self.Relay {
+				t.Logf("tester's home DERP region is %s", st.Self.Relay)
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tester's home DERP region is still %q, not one in its DERP map", st.Self.Relay)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// dialTesterUDP dials addr (an ip:port) over UDP from the tester node,
+// using a SOCKS5 UDP ASSOCIATE with its SOCKS5 server, which
+// golang.org/x/net/proxy doesn't support. Reads and writes on the
+// returned conn carry one datagram each.
+func (h *Harness) dialTesterUDP(addr string) (net.Conn, error) {
+	dst, err := netaddr.ParseIPPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctrl, err := net.Dial("tcp", h.testerSOCKS)
+	if err != nil {
+		return nil, err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			ctrl.Close()
+		}
+	}()
+	ctrl.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// Greeting: version 5, one auth method, no auth.
+	if _, err := ctrl.Write([]byte{5, 1, 0}); err != nil {
+		return nil, err
+	}
+	var greeting [2]byte
+	if _, err := io.ReadFull(ctrl, greeting[:]); err != nil {
+		return nil, err
+	}
+	if greeting != [2]byte{5, 0} {
+		return nil, fmt.Errorf("SOCKS5 server rejected greeting: %v", greeting)
+	}
+	// UDP ASSOCIATE, without saying where we'll send from.
+	if _, err := ctrl.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	var reply [4]byte
+	if _, err := io.ReadFull(ctrl, reply[:]); err != nil {
+		return nil, err
+	}
+	if reply[1] != 0 {
+		return nil, fmt.Errorf("SOCKS5 UDP ASSOCIATE failed with reply code %d", reply[1])
+	}
+	var relayIP []byte
+	switch reply[3] {
+	case 1:
+		relayIP = make([]byte, 4)
+	case 4:
+		relayIP = make([]byte, 16)
+	default:
+		return nil, fmt.Errorf("unexpected SOCKS5 relay address type %d", reply[3])
+	}
+	var relayPort [2]byte
+	if _, err := io.ReadFull(ctrl, relayIP); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(ctrl, relayPort[:]); err != nil {
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	relayAddr := &net.UDPAddr{IP: relayIP, Port: int(binary.BigEndian.Uint16(relayPort[:]))}
+	relay, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := []byte{0, 0, 0} // RSV, RSV, FRAG
+	if dst.IP().Is4() {
+		hdr = append(hdr, 1)
+	} else {
+		hdr = append(hdr, 4)
+	}
+	hdr = append(hdr, dst.IP().IPAddr().IP...)
+	hdr = append(hdr, byte(dst.Port()>>8), byte(dst.Port()))
+
+	ok = true
+	return &socksUDPConn{Conn: relay, ctrl: ctrl, hdr: hdr}, nil
+}
+
+// socksUDPConn is a UDP conn through a SOCKS5 UDP relay. It adds and
+// strips the relay's per-datagram headers.
+type socksUDPConn struct {
+	net.Conn          // to the relay
+	ctrl     net.Conn // the association lasts while this is open
+	hdr      []byte   // header for datagrams to the destination
+}
+
+func (c *socksUDPConn) Write(b []byte) (int, error) {
+	if _, err := c.Conn.Write(append(c.hdr[:len(c.hdr):len(c.hdr)], b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socksUDPConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+len(c.hdr)+16)
+	n, err := c.Conn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	if n < 4 {
+		return 0, errors.New("short datagram from SOCKS5 relay")
+	}
+	skip := 4 + 2
+	switch buf[3] {
+	case 1:
+		skip += 4
+	case 4:
+		skip += 16
+	case 3:
+		skip += 1 + int(buf[4])
+	}
+	if n < skip {
+		return 0, errors.New("short datagram from SOCKS5 relay")
+	}
+	return copy(b, buf[skip:n]), nil
+}
+
+func (c *socksUDPConn) Close() error {
+	c.ctrl.Close()
+	return c.Conn.Close()
 }
 
 func bytes2Netaddr(inp []byte) netaddr.IP {
 	return netaddr.MustParseIP(string(bytes.TrimSpace(inp)))
 }
+
+// needGuestIPv6 skips t, saying why, if the guest has no working IPv6
+// stack for tailscaled to put its IPv6 address on.
+func needGuestIPv6(t *testing.T, cli *ssh.Client) {
+	t.Helper()
+	outp, err := getSession(t, cli).CombinedOutput("test -e /proc/net/if_inet6 && cat /proc/sys/net/ipv6/conf/all/disable_ipv6")
+	if err != nil {
+		t.Skipf("guest has no IPv6 stack (no /proc/net/if_inet6): %v, output: %s", err, outp)
+	}
+	if strings.TrimSpace(string(outp)) != "0" {
+		t.Skip("guest has IPv6 turned off with net.ipv6.conf.all.disable_ipv6")
+	}
+}
+
+// needEmbeddedControl skips t when the harness is running against an
+// external control server (--control-url), as t inspects or
+// reconfigures the embedded one.
+func (h *Harness) needEmbeddedControl(t *testing.T) {
+	t.Helper()
+	if h.cs == nil {
+		t.Skipf("needs the embedded control server, but --control-url=%s", h.loginServerURL)
+	}
+}
+
+// startExtraControl starts another control server sharing the
+// harness's DERP map and DNS config, for tests that move the guest
+// between control servers. It returns the server and its URL.
+func (h *Harness) startExtraControl(t *testing.T) (*testcontrol.Server, string) {
+	h.needEmbeddedControl(t)
+	cs := h.newExtraControl()
+	hs := serveControl(t, cs, net.JoinHostPort(deriveBindhost(t), "0"))
+	return cs, fmt.Sprintf("http://%s", hs.Addr)
+}
+
+// newExtraControl returns a control server sharing the harness's DERP
+// map and DNS config, without serving it.
+func (h *Harness) newExtraControl() *testcontrol.Server {
+	return &testcontrol.Server{
+		DERPMap:   h.cs.DERPMap,
+		DNSConfig: h.cs.DNSConfig,
+	}
+}
+
+// serveControl serves cs over HTTP on addr until hs is closed or t
+// finishes. The returned server's Addr is the address actually
+// listened on, so cs can be served again there after hs is closed.
+func serveControl(t *testing.T, cs *testcontrol.Server, addr string) (hs *http.Server) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("can't make TCP listener: %v", err)
+	}
+	hs = &http.Server{Addr: ln.Addr().String(), Handler: cs}
+	go hs.Serve(ln)
+	t.Cleanup(func() {
+		hs.Close()
+	})
+	return hs
+}
+
+// A controlScenario configures the control server's policy for one
+// test scenario: its packet filter, SSH policy, DNS config or which
+// subnet routes are approved.
+type controlScenario func(*testcontrol.Policy)
+
+// applyControlScenario applies scenario to h.cs for the rest of t,
+// restoring the previous policy when t finishes. If the guest is
+// already registered, it waits for the guest to be sent the new
+// policy; otherwise the guest gets it when it comes up.
+func (h *Harness) applyControlScenario(t *testing.T, cli *ssh.Client, scenario controlScenario) {
+	t.Helper()
+	h.needEmbeddedControl(t)
+	prev := h.cs.Policy()
+	gen := h.cs.UpdatePolicy(scenario)
+	t.Cleanup(func() {
+		gen := h.cs.UpdatePolicy(func(p *testcontrol.Policy) { *p = prev })
+		h.awaitGuestPolicy(t, cli, gen)
+	})
+	h.awaitGuestPolicy(t, cli, gen)
+}
+
+// awaitGuestPolicy waits for the guest, if it's registered with h.cs,
+// to be sent policy generation gen.
+func (h *Harness) awaitGuestPolicy(t *testing.T, cli *ssh.Client, gen int) {
+	t.Helper()
+	nk, ok := h.guestNodeKey(t, cli)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := h.cs.AwaitNodePolicy(ctx, nk, gen); err != nil {
+		t.Fatalf("guest didn't get control policy %d: %v", gen, err)
+	}
+}
+
+// guestNodeKey returns the guest's node key, per its "tailscale status
+// --json". It reports false if tailscaled on the guest can't say or
+// h.cs doesn't know the key.
+func (h *Harness) guestNodeKey(t *testing.T, cli *ssh.Client) (key.NodePublic, bool) {
+	t.Helper()
+	h.needEmbeddedControl(t)
+	sess, err := cli.NewSession()
+	if err != nil {
+		t.Fatalf("can't make SSH session with VM: %v", err)
+	}
+	defer sess.Close()
+	outp, err := sess.Output("tailscale status --json")
+	if err != nil {
+		return key.NodePublic{}, false
+	}
+	nk, err := selfNodeKey(outp)
+	if err != nil || h.cs.Node(nk) == nil {
+		return key.NodePublic{}, false
+	}
+	return nk, true
+}
+
+// selfNodeKey returns the node's own key from the output of "tailscale
+// status --json".
+func selfNodeKey(statusJSON []byte) (key.NodePublic, error) {
+	var st struct {
+		Self struct{ PublicKey key.NodePublic }
+	}
+	if err := json.Unmarshal(statusJSON, &st); err != nil {
+		return key.NodePublic{}, err
+	}
+	if st.Self.PublicKey.IsZero() {
+		return key.NodePublic{}, errors.New("no node key in tailscale status")
+	}
+	return st.Self.PublicKey, nil
+}
+
+// peerDNSName returns the MagicDNS name of the peer with Tailscale IP
+// ip from the output of "tailscale status --json", without its
+// trailing dot. It's empty if the peer has no name.
+func peerDNSName(statusJSON []byte, ip netaddr.IP) (string, error) {
+	var st struct {
+		Peer map[string]struct {
+			DNSName      string
+			TailscaleIPs []netaddr.IP
+		}
+	}
+	if err := json.Unmarshal(statusJSON, &st); err != nil {
+		return "", err
+	}
+	for _, p := range st.Peer {
+		for _, pip := range p.TailscaleIPs {
+			if pip == ip {
+				return strings.TrimSuffix(p.DNSName, "."), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no peer with IP %v in tailscale status", ip)
+}
+
+// nodeLogs returns the log lines that tailscaled on node, "guest" or
+// "tester", has uploaded so far.
+func (h *Harness) nodeLogs(t *testing.T, node string) []string {
+	t.Helper()
+	h.needEmbeddedControl(t)
+	switch node {
+	case "guest":
+		return h.lc.Lines()
+	case "tester":
+		return h.testerLC.Lines()
+	}
+	t.Fatalf("unknown node %q", node)
+	return nil
+}
+
+// awaitLogLine waits for tailscaled on node to upload a log line
+// matching re, and fails the test with what it did log if that doesn't
+// happen within timeout.
+func (h *Harness) awaitLogLine(t *testing.T, node string, re *regexp.Regexp, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		lines := h.nodeLogs(t, node)
+		for _, line := range lines {
+			if re.MatchString(line) {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s didn't log anything matching %#q in %v; its logs:\n%s", node, re, timeout, strings.Join(lines, "\n"))
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// controlHostinfo returns the Hostinfo that the embedded control server
+// last received from the node with key nk, or an invalid view if it
+// doesn't know of the node or hasn't had a Hostinfo from it.
+func (h *Harness) controlHostinfo(nk key.NodePublic) tailcfg.HostinfoView {
+	n := h.cs.Node(nk)
+	if n == nil {
+		return tailcfg.HostinfoView{}
+	}
+	return n.Hostinfo
+}
+
+// assignedIP returns the Tailscale IPv4 address, or IPv6 if v6, that
+// h.cs assigned to the node with key nk, so that tests don't depend on
+// the order nodes registered in. It reports false if h.cs doesn't know
+// nk.
+func (h *Harness) assignedIP(nk key.NodePublic, v6 bool) (netaddr.IP, bool) {
+	n := h.cs.Node(nk)
+	if n == nil {
+		return netaddr.IP{}, false
+	}
+	for _, a := range n.Addresses {
+		if a.IP().Is6() == v6 {
+			return a.IP(), true
+		}
+	}
+	return netaddr.IP{}, false
+}
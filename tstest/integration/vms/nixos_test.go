@@ -148,7 +148,7 @@
     package = testTailscale;
   };
 
-  # Override TS_LOG_TARGET to our private logcatcher.
+  # Override TS_LOG_TARGET to our private logcatcher, if there is one.
   systemd.services.tailscaled.environment."TS_LOG_TARGET" = "{{.LogTarget}}";
 }`
 
@@ -185,7 +185,7 @@ func (h *Harness) makeNixOSImage(t *testing.T, d Distro, cdir string) string {
 		LogTarget string
 	}{
 		BinPath:   h.binaryDir,
-		LogTarget: h.loginServerURL,
+		LogTarget: h.logTarget,
 	})
 	if err != nil {
 		t.Fatal(err)
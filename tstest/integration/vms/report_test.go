@@ -0,0 +1,375 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package vms
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"text/tabwriter"
+	"time"
+
+	"tailscale.com/net/netcheck"
+	"tailscale.com/types/opt"
+)
+
+// distroResult is how one distro fared in the VM tests, for the
+// summary written at the end of the run.
+type distroResult struct {
+	Name      string          `json:"name"`
+	Result    string          `json:"result"` // "pass", "fail" or "skip"
+	BootTime  reportDuration  `json:"bootTime"`
+	LoginTime reportDuration  `json:"loginTime"`
+	Subtests  []subtestResult `json:"subtests"`
+
+	// Netcheck is what "tailscale netcheck" found on the guest, for
+	// telling connectivity failures caused by its network apart from
+	// those caused by tailscaled. It's nil if the netcheck step
+	// didn't get that far.
+	Netcheck *guestNetcheck `json:"netcheck,omitempty"`
+}
+
+// guestNetcheck is the part of a guest's netcheck report that's worth
+// keeping in the summary of the run.
+type guestNetcheck struct {
+	PreferredDERP int      `json:"preferredDERP"` // or 0 for unknown
+	NAT           string   `json:"nat"`           // "easy", "hard" or "" if unknown
+	UDP           bool     `json:"udp"`
+	IPv4          bool     `json:"ipv4"`
+	IPv6          bool     `json:"ipv6"`
+	PortMapping   []string `json:"portMapping,omitempty"` // protocols found on the LAN: "upnp", "pmp", "pcp"
+}
+
+// parseGuestNetcheck parses the output of "tailscale netcheck
+// --format=json" into a guestNetcheck. The NAT is "hard" if the
+// guest's mapped address varied by STUN server, as it does behind a
+// symmetric NAT.
+func parseGuestNetcheck(out []byte) (*guestNetcheck, error) {
+	var r netcheck.Report
+	if err := json.Unmarshal(out, &r); err != nil {
+		return nil, fmt.Errorf("can't parse netcheck report: %v", err)
+	}
+	nc := &guestNetcheck{
+		PreferredDERP: r.PreferredDERP,
+		UDP:           r.UDP,
+		IPv4:          r.IPv4,
+		IPv6:          r.IPv6,
+	}
+	if hard, ok := r.MappingVariesByDestIP.Get(); ok {
+		nc.NAT = "easy"
+		if hard {
+			nc.NAT = "hard"
+		}
+	}
+	for _, pm := range []struct {
+		name  string
+		found opt.Bool
+	}{
+		{"upnp", r.UPnP},
+		{"pmp", r.PMP},
+		{"pcp", r.PCP},
+	} {
+		if v, ok := pm.found.Get(); ok && v {
+			nc.PortMapping = append(nc.PortMapping, pm.name)
+		}
+	}
+	return nc, nil
+}
+
+type subtestResult struct {
+	Name     string         `json:"name"`
+	Result   string         `json:"result"` // as distroResult.Result, or "xfail" for an expected failure
+	Duration reportDuration `json:"duration"`
+}
+
+// reportDuration is a time.Duration that marshals as a string like
+// "1m4.2s" rather than a count of nanoseconds.
+type reportDuration time.Duration
+
+func (d reportDuration) String() string {
+	return time.Duration(d).Round(100 * time.Millisecond).String()
+}
+
+func (d reportDuration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func testResult(t *testing.T) string {
+	switch {
+	case t.Failed():
+		return "fail"
+	case t.Skipped():
+		return "skip"
+	}
+	return "pass"
+}
+
+// results collects the distroResult of each distro tested, from the
+// cleanup of testOneDistribution.
+var results struct {
+	sync.Mutex
+	distros []*distroResult
+}
+
+func addResult(r *distroResult) {
+	results.Lock()
+	defer results.Unlock()
+	results.distros = append(results.distros, r)
+}
+
+// run is t.Run for the subtests of testDistro, recording each one's
+// result and duration in h.result. A subtest in h.xfail is run with
+// runExpectingFailure instead: failing skips it, and passing fails it.
+func (h *Harness) run(t *testing.T, name string, f func(t *testing.T)) bool {
+	start := time.Now()
+	var (
+		result  string
+		xfailed bool
+	)
+	ok := t.Run(name, func(t *testing.T) {
+		defer func() { result = testResult(t) }()
+		why, xfail := h.xfail[name]
+		if !xfail {
+			f(t)
+			return
+		}
+		failed, skipped := runExpectingFailure(t, f)
+		switch {
+		case failed:
+			xfailed = true
+			t.Skipf("failed as expected: %s", why)
+		case skipped:
+			t.Skip("skipped; it's listed in ExpectedFailures")
+		default:
+			t.Errorf("%s passed, but it's listed in the distro's ExpectedFailures (%q); remove it from there", name, why)
+		}
+	})
+	if xfailed {
+		result = "xfail"
+	}
+	if h.result != nil {
+		h.result.Subtests = append(h.result.Subtests, subtestResult{
+			Name:     name,
+			Result:   result,
+			Duration: reportDuration(time.Since(start)),
+		})
+	}
+	return ok
+}
+
+// runUnlessSmoke is h.run, except that with --smoke it leaves out the
+// subtest altogether, for the steps before login that a smoke test
+// doesn't need.
+func (h *Harness) runUnlessSmoke(t *testing.T, name string, f func(t *testing.T)) bool {
+	if h.smoke {
+		return true
+	}
+	return h.run(t, name, f)
+}
+
+// runExpectingFailure runs f as a test of its own, named after t with
+// "/xfail" added, that doesn't fail t if it fails, and reports whether it failed or
+// was skipped. The testing package can't take back a subtest's failure,
+// which would fail t too, so this goes through testing.RunTests.
+func runExpectingFailure(t *testing.T, f func(t *testing.T)) (failed, skipped bool) {
+	matchAll := func(pat, str string) (bool, error) { return true, nil }
+	testing.RunTests(matchAll, []testing.InternalTest{{
+		Name: t.Name() + "/xfail",
+		F: func(t *testing.T) {
+			defer func() { failed, skipped = t.Failed(), t.Skipped() }()
+			f(t)
+		},
+	}})
+	return failed, skipped
+}
+
+// writeReport writes a table summarizing rr to w, with a line for
+// each distro listing the subtests that failed, if any.
+func writeReport(w io.Writer, rr []*distroResult) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "DISTRO\tRESULT\tBOOT\tLOGIN\tFAILED")
+	for _, r := range rr {
+		var failed []string
+		for _, st := range r.Subtests {
+			if st.Result == "fail" {
+				failed = append(failed, st.Name)
+			}
+		}
+		if len(failed) == 0 {
+			failed = []string{"-"}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%v\t%s\n", r.Name, r.Result, r.BootTime, r.LoginTime, strings.Join(failed, ","))
+	}
+	return tw.Flush()
+}
+
+// reportResults writes the results of the distros tested in this run
+// as JSON to a new temporary directory, and as a table to stdout. It
+// does nothing if no distros were tested.
+func reportResults() error {
+	results.Lock()
+	defer results.Unlock()
+	if len(results.distros) == 0 {
+		return nil
+	}
+	rr := results.distros
+	sort.Slice(rr, func(i, j int) bool { return rr[i].Name < rr[j].Name })
+
+	dir, err := os.MkdirTemp("", "tailscale-vm-tests-")
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(rr, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "report.json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("\nVM test results (also in %s):\n", path)
+	return writeReport(os.Stdout, rr)
+}
+
+func TestWriteReport(t *testing.T) {
+	rr := []*distroResult{
+		{
+			Name:      "ubuntu-20-04",
+			Result:    "fail",
+			BootTime:  reportDuration(42 * time.Second),
+			LoginTime: reportDuration(1500 * time.Millisecond),
+			Subtests: []subtestResult{
+				{Name: "login", Result: "pass"},
+				{Name: "ping-ipv4", Result: "fail"},
+				{Name: "outgoing-udp-ipv4", Result: "fail"},
+			},
+		},
+		{
+			Name:     "nixos-21-11",
+			Result:   "pass",
+			BootTime: reportDuration(time.Minute),
+		},
+	}
+	var buf strings.Builder
+	if err := writeReport(&buf, rr); err != nil {
+		t.Fatal(err)
+	}
+	const want = `DISTRO        RESULT  BOOT  LOGIN  FAILED
+ubuntu-20-04  fail    42s   1.5s   ping-ipv4,outgoing-udp-ipv4
+nixos-21-11   pass    1m0s  0s     -
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	data, err := json.Marshal(rr[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"name":"nixos-21-11","result":"pass","bootTime":"1m0s","loginTime":"0s","subtests":null}`; string(data) != want {
+		t.Errorf("JSON = %s; want %s", data, want)
+	}
+}
+
+func TestParseGuestNetcheck(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want guestNetcheck
+	}{
+		{
+			name: "easy",
+			in:   `{"UDP":true,"IPv4":true,"MappingVariesByDestIP":false,"UPnP":false,"PMP":true,"PCP":null,"PreferredDERP":1,"GlobalV4":"1.2.3.4:41641"}`,
+			want: guestNetcheck{PreferredDERP: 1, NAT: "easy", UDP: true, IPv4: true, PortMapping: []string{"pmp"}},
+		},
+		{
+			name: "hard",
+			in:   `{"UDP":true,"IPv4":true,"IPv6":true,"MappingVariesByDestIP":true,"PreferredDERP":2}`,
+			want: guestNetcheck{PreferredDERP: 2, NAT: "hard", UDP: true, IPv4: true, IPv6: true},
+		},
+		{
+			name: "no-udp",
+			in:   `{"UDP":false,"MappingVariesByDestIP":null}`,
+			want: guestNetcheck{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGuestNetcheck([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v; want %+v", *got, tt.want)
+			}
+		})
+	}
+	if _, err := parseGuestNetcheck([]byte("# Warning: not JSON")); err == nil {
+		t.Error("parsed non-JSON output without error")
+	}
+}
+
+func TestRunExpectingFailure(t *testing.T) {
+	tests := []struct {
+		name        string
+		f           func(t *testing.T)
+		wantFailed  bool
+		wantSkipped bool
+	}{
+		{"fails", func(t *testing.T) { t.Fatal("known failure") }, true, false},
+		{"skips", func(t *testing.T) { t.Skip("not applicable") }, false, true},
+		{"passes", func(t *testing.T) {}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failed, skipped := runExpectingFailure(t, tt.f)
+			if failed != tt.wantFailed || skipped != tt.wantSkipped {
+				t.Errorf("runExpectingFailure = failed %v, skipped %v; want %v, %v", failed, skipped, tt.wantFailed, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestRunXFail(t *testing.T) {
+	h := &Harness{
+		xfail:  map[string]string{"broken": "no such kernel module"},
+		result: &distroResult{},
+	}
+	if !h.run(t, "broken", func(t *testing.T) { t.Error("known failure") }) {
+		t.Error("expected failure failed its parent")
+	}
+	h.run(t, "fine", func(t *testing.T) {})
+	var got []string
+	for _, st := range h.result.Subtests {
+		got = append(got, st.Name+"="+st.Result)
+	}
+	if want := []string{"broken=xfail", "fine=pass"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subtest results = %q; want %q", got, want)
+	}
+}
+
+func TestRunUnlessSmoke(t *testing.T) {
+	for _, smoke := range []bool{false, true} {
+		h := &Harness{smoke: smoke, result: &distroResult{}}
+		var ran bool
+		h.runUnlessSmoke(t, "step", func(t *testing.T) { ran = true })
+		if ran == smoke {
+			t.Errorf("smoke=%v: ran = %v", smoke, ran)
+		}
+		if ran != (len(h.result.Subtests) == 1) {
+			t.Errorf("smoke=%v: ran = %v, but recorded subtests %v", smoke, ran, h.result.Subtests)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build ignore
+// +build ignore
+
+// Command tcp_tester serves a fixed amount of data to every TCP
+// connection it accepts. The distros being tested don't have a
+// consistent tool for this, and it's needed to push full-sized
+// segments through a subnet router.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+)
+
+var (
+	server = flag.String("server", "", "host:port to bind to for serving TCP")
+	size   = flag.Int64("bytes", 4<<20, "number of bytes to send to each connection")
+)
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func main() {
+	flag.Parse()
+
+	if *server == "" {
+		log.Fatal("specify -server")
+	}
+
+	ln, err := net.Listen("tcp", *server)
+	if err != nil {
+		log.Fatalf("can't listen %s: %v", *server, err)
+	}
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			defer conn.Close()
+			n, err := io.Copy(conn, io.LimitReader(zeroReader{}, *size))
+			log.Printf("sent %d bytes to %s: %v", n, conn.RemoteAddr(), err)
+		}()
+	}
+}
@@ -52,7 +52,7 @@ func TestMITMProxy(t *testing.T) {
 	ctx, done := context.WithCancel(context.Background())
 	t.Cleanup(done)
 
-	h := newHarness(t)
+	h := newHarness(t, testerOpts{})
 
 	err := ramsem.sem.Acquire(ctx, int64(distro.MemoryMegs))
 	if err != nil {
@@ -60,7 +60,7 @@ func TestMITMProxy(t *testing.T) {
 	}
 	t.Cleanup(func() { ramsem.sem.Release(int64(distro.MemoryMegs)) })
 
-	vm := h.mkVM(t, 2, distro, h.pubKey, h.loginServerURL, t.TempDir())
+	vm := h.mkVM(t, 2, distro, h.pubKey, h.hostURL, t.TempDir())
 	vm.waitStartup(t)
 
 	ipm := h.waitForIPMap(t, vm, distro)
@@ -9,19 +9,24 @@
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"flag"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -29,8 +34,11 @@
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/semaphore"
+	"tailscale.com/tstest/integration"
 	"tailscale.com/types/logger"
 )
 
@@ -70,12 +78,21 @@ func (h *Harness) makeImage(t *testing.T, d Distro, cdir string) string {
 	return h.makeNixOSImage(t, d, cdir)
 }
 
-// mkVM makes a KVM-accelerated virtual machine and prepares it for introduction
-// to the testcontrol server. The function it returns is for killing the virtual
-// machine when it is time for it to die.
+// mkVM makes a virtual machine, KVM-accelerated if the host allows (see
+// guestAccel), and prepares it for introduction to the testcontrol
+// server. The function it returns is for killing the virtual machine
+// when it is time for it to die.
 func (h *Harness) mkVM(t *testing.T, n int, d Distro, sshKey, hostURL, tdir string) *vmInstance {
 	t.Helper()
 
+	if h.accel == "" {
+		accel, err := guestAccel(t.Logf, d, *requireKVM)
+		if err != nil {
+			t.Skipf("can't run %s: %v", d.Name, err)
+		}
+		h.accel = accel
+	}
+
 	cdir, err := os.UserCacheDir()
 	if err != nil {
 		t.Fatalf("can't find cache dir: %v", err)
@@ -83,10 +100,11 @@ func (h *Harness) mkVM(t *testing.T, n int, d Distro, sshKey, hostURL, tdir stri
 	cdir = filepath.Join(cdir, "tailscale", "vm-test")
 	os.MkdirAll(filepath.Join(cdir, "qcow2"), 0755)
 
-	port, err := getProbablyFreePortNumber()
+	port, ln, err := reservePort()
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer ln.Close() // in case of early t.Fatal; closed again below
 
 	var qcowPath string
 	if d.HostGenerated {
@@ -96,41 +114,68 @@ func (h *Harness) mkVM(t *testing.T, n int, d Distro, sshKey, hostURL, tdir stri
 	}
 
 	mkLayeredQcow(t, tdir, d, qcowPath)
-	mkSeed(t, d, sshKey, hostURL, tdir, port)
+	switch {
+	case d.Ignition:
+		mkIgnitionConfig(t, d, sshKey, hostURL, tdir, port)
+	case d.GoOS() == "windows":
+		mkWindowsSeed(t, d, sshKey, hostURL, tdir, port)
+	default:
+		mkSeed(t, d, sshKey, hostURL, tdir, port)
+	}
 
 	driveArg := fmt.Sprintf("file=%s,if=virtio", filepath.Join(tdir, d.Name+".qcow2"))
 
-	args := []string{
-		"-machine", "q35,accel=kvm,usb=off,vmport=off,dump-guest-core=off",
-		"-netdev", fmt.Sprintf("user,hostfwd=::%d-:22,id=net0", port),
-		"-device", "virtio-net-pci,netdev=net0,id=net0,mac=8a:28:5c:30:1f:25",
+	var tap, mac string
+	if *vmNetwork == "tap" {
+		tap, mac = newTapName()
+		mkTap(t, tap)
+	}
+	netArgs, err := qemuNetArgs(*vmNetwork, port, tap, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qemu, args := qemuMachine(t, d, h.accel)
+	args = append(args, netArgs...)
+	args = append(args,
 		"-m", fmt.Sprint(d.MemoryMegs),
-		"-cpu", "host",
 		"-smp", "4",
 		"-boot", "c",
 		"-drive", driveArg,
-		"-cdrom", filepath.Join(tdir, d.Name, "seed", "seed.iso"),
-		"-smbios", "type=1,serial=ds=nocloud;h=" + d.Name,
 		"-nographic",
+	)
+	if d.GoOS() == "windows" {
+		// Windows expects the hardware clock in local time.
+		args = append(args, "-rtc", "base=localtime")
+	}
+
+	if d.Ignition {
+		args = append(args, "-fw_cfg", "name=opt/com.coreos/config,file="+filepath.Join(tdir, d.Name, "config.ign"))
+	} else {
+		args = append(args,
+			"-cdrom", filepath.Join(tdir, d.Name, "seed", "seed.iso"),
+			"-smbios", "type=1,serial=ds=nocloud;h="+d.Name,
+		)
 	}
 
 	if *useVNC {
 		// test listening on VNC port
-		ln, err := net.Listen("tcp", net.JoinHostPort("0.0.0.0", strconv.Itoa(5900+n)))
+		vncLn, err := net.Listen("tcp", net.JoinHostPort("0.0.0.0", strconv.Itoa(5900+n)))
 		if err != nil {
 			t.Fatalf("would not be able to listen on the VNC port for the VM: %v", err)
 		}
-		ln.Close()
+		vncLn.Close()
 		args = append(args, "-vnc", fmt.Sprintf(":%d", n))
 	} else {
 		args = append(args, "-display", "none")
 	}
 
-	t.Logf("running: qemu-system-x86_64 %s", strings.Join(args, " "))
+	t.Logf("running: %s %s", qemu, strings.Join(args, " "))
 
-	cmd := exec.Command("qemu-system-x86_64", args...)
+	cmd := exec.Command(qemu, args...)
 	cmd.Stdout = &qemuLog{f: t.Logf}
 	cmd.Stderr = &qemuLog{f: t.Logf}
+	ln.Close()
 	if err := cmd.Start(); err != nil {
 		t.Fatal(err)
 	}
@@ -156,6 +201,65 @@ func (h *Harness) mkVM(t *testing.T, n int, d Distro, sshKey, hostURL, tdir stri
 	return vm
 }
 
+var (
+	vmNetwork = flag.String("vm-network", "user", `how guests are networked: "user" puts each behind its own qemu user-mode NAT, with SSH reached through a forwarded port; "tap" puts each directly on the --vm-bridge L2 bridge through a tap device, for testing direct connections without that NAT in the way (making the tap device needs CAP_NET_ADMIN)`)
+	vmBridge  = flag.String("vm-bridge", "virbr0", "with --vm-network=tap, the existing bridge to attach guests to; something on it must hand out addresses over DHCP and route to the internet, as libvirt's default network does")
+)
+
+// qemuNetArgs returns the qemu arguments that give a guest its network
+// interface for the given --vm-network mode. port is the host port to
+// forward to the guest's SSH port in user mode, and tap and mac are
+// the tap device and MAC address to use in tap mode.
+func qemuNetArgs(mode string, port int, tap, mac string) ([]string, error) {
+	switch mode {
+	case "user":
+		return []string{
+			"-netdev", fmt.Sprintf("user,hostfwd=::%d-:22,id=net0", port),
+			"-device", "virtio-net-pci,netdev=net0,id=net0,mac=8a:28:5c:30:1f:25",
+		}, nil
+	case "tap":
+		return []string{
+			"-netdev", fmt.Sprintf("tap,ifname=%s,script=no,downscript=no,id=net0", tap),
+			"-device", "virtio-net-pci,netdev=net0,id=net0,mac=" + mac,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown --vm-network=%q; want user or tap", mode)
+}
+
+// newTapName returns a random name for a guest's tap device, and a
+// MAC address for the guest to match. Guests share the bridge, maybe
+// with those of other test processes, so both need to be unique.
+func newTapName() (tap, mac string) {
+	var b [3]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("tsvm%x", b), fmt.Sprintf("8a:28:5c:%02x:%02x:%02x", b[0], b[1], b[2])
+}
+
+// mkTap makes the tap device tap, owned by the current user so qemu
+// can open it, attached to --vm-bridge. It's removed when t is done.
+func mkTap(t *testing.T, tap string) {
+	t.Helper()
+	if _, err := net.InterfaceByName(*vmBridge); err != nil {
+		t.Fatalf("--vm-network=tap needs the bridge --vm-bridge=%s: %v", *vmBridge, err)
+	}
+	t.Cleanup(func() {
+		if out, err := exec.Command("ip", "link", "del", tap).CombinedOutput(); err != nil {
+			t.Logf("removing tap device %s: %v, %s", tap, err, out)
+		}
+	})
+	for _, args := range [][]string{
+		{"tuntap", "add", "dev", tap, "mode", "tap", "user", strconv.Itoa(os.Getuid())},
+		{"link", "set", tap, "master", *vmBridge},
+		{"link", "set", tap, "up"},
+	} {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Fatalf("ip %s: %v, %s (--vm-network=tap needs CAP_NET_ADMIN)", strings.Join(args, " "), err, out)
+		}
+	}
+}
+
 type qemuLog struct {
 	buf []byte
 	f   logger.Logf
@@ -192,7 +296,7 @@ func (w *qemuLog) Write(p []byte) (int, error) {
 //
 // This function writes the distribution image to fout. It is always closed. Do
 // not expect fout to remain writable.
-func fetchFromS3(t *testing.T, fout *os.File, d Distro) bool {
+func fetchFromS3(t *testing.T, path string, d Distro) bool {
 	t.Helper()
 
 	if *noS3 {
@@ -211,6 +315,10 @@ func fetchFromS3(t *testing.T, fout *os.File, d Distro) bool {
 	})
 
 	t.Logf("fetching s3://%s/%s", bucketName, d.SHA256Sum)
+	fout, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	_, err = dler.Download(context.TODO(), fout, &s3.GetObjectInput{
 		Bucket: aws.String(bucketName),
@@ -229,6 +337,77 @@ func fetchFromS3(t *testing.T, fout *os.File, d Distro) bool {
 	return true
 }
 
+// qemuSystem maps a GOARCH to the qemu system emulator for it.
+var qemuSystem = map[string]string{
+	"amd64": "qemu-system-x86_64",
+	"arm64": "qemu-system-aarch64",
+}
+
+// qemuMachine returns the qemu system emulator for d's guest
+// architecture along with the arguments that pick its machine type and
+// CPU, accelerated with accel ("kvm" or "tcg").
+func qemuMachine(t *testing.T, d Distro, accel string) (qemu string, args []string) {
+	t.Helper()
+
+	// TCG has no host CPU or interrupt controller to pass through, so
+	// it emulates the most capable ones it can instead.
+	cpu, gic := "host", "host"
+	if accel == "tcg" {
+		cpu, gic = "max", "max"
+	}
+	qemu = qemuSystem[d.GoArch()]
+	switch d.GoArch() {
+	case "amd64":
+		return qemu, []string{
+			"-machine", "q35,accel=" + accel + ",usb=off,vmport=off,dump-guest-core=off",
+			"-cpu", cpu,
+		}
+	case "arm64":
+		// The virt machine has no built-in firmware, so point it at
+		// UEFI to boot the cloud images.
+		return qemu, []string{
+			"-machine", "virt,accel=" + accel + ",gic-version=" + gic + ",dump-guest-core=off",
+			"-cpu", cpu,
+			"-bios", aarch64Firmware(t),
+		}
+	}
+	t.Fatalf("don't know how to run %s guests", d.GoArch())
+	return "", nil
+}
+
+var aarch64FirmwareFlag = flag.String("aarch64-firmware", "", "path to the UEFI firmware for aarch64 guests; if empty, the usual install locations are searched")
+
+// aarch64FirmwarePaths are where distros and nixpkgs put the UEFI
+// firmware for qemu-system-aarch64.
+var aarch64FirmwarePaths = []string{
+	"/usr/share/qemu-efi-aarch64/QEMU_EFI.fd",
+	"/usr/share/AAVMF/AAVMF_CODE.fd",
+	"/usr/share/edk2/aarch64/QEMU_EFI.fd",
+	"/usr/share/qemu/edk2-aarch64-code.fd",
+}
+
+func aarch64Firmware(t *testing.T) string {
+	t.Helper()
+
+	if *aarch64FirmwareFlag != "" {
+		return *aarch64FirmwareFlag
+	}
+	paths := aarch64FirmwarePaths
+	if qemu, err := exec.LookPath("qemu-system-aarch64"); err == nil {
+		// nixpkgs ships the firmware next to qemu instead.
+		if qemu, err := filepath.EvalSymlinks(qemu); err == nil {
+			paths = append(paths, filepath.Join(filepath.Dir(qemu), "..", "share", "qemu", "edk2-aarch64-code.fd"))
+		}
+	}
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	t.Fatalf("can't find UEFI firmware for aarch64 guests in %v; set --aarch64-firmware", paths)
+	return ""
+}
+
 // fetchDistro fetches a distribution from the internet if it doesn't already exist locally. It
 // also validates the sha256 sum from a known good hash.
 func fetchDistro(t *testing.T, resultDistro Distro) string {
@@ -253,53 +432,254 @@ func fetchDistro(t *testing.T, resultDistro Distro) string {
 		}
 	}
 
-	t.Logf("downloading distro image %s to %s", resultDistro.URL, qcowPath)
+	// Downloads go to a .partial file that is only renamed into place
+	// once its hash checks out, so that an interrupted download can be
+	// picked up where it left off next time.
+	partialPath := qcowPath + ".partial"
+	t.Logf("downloading distro image %s to %s", resultDistro.URL, partialPath)
 	if err := os.MkdirAll(filepath.Dir(qcowPath), 0777); err != nil {
 		t.Fatal(err)
 	}
-	fout, err := os.Create(qcowPath)
+
+	var compression string
+	handled := func() bool {
+		release := acquireDownload(t)
+		defer release()
+		for _, src := range imageSources {
+			if ok, compressed := src.FetchImage(t, resultDistro, partialPath); ok {
+				if compressed {
+					compression = resultDistro.Compression
+				}
+				return true
+			}
+		}
+		return false
+	}()
+	if !handled {
+		t.Fatalf("none of the image sources has %s", resultDistro.Name)
+	}
+
+	if compression == "" {
+		if hash := hashFile(t, partialPath); hash != resultDistro.SHA256Sum {
+			// Whatever went wrong, resuming this file won't fix it.
+			os.Remove(partialPath)
+			t.Fatalf("hash mismatch for %s, want: %s, got: %s", resultDistro.URL, resultDistro.SHA256Sum, hash)
+		}
+		if err := os.Rename(partialPath, qcowPath); err != nil {
+			t.Fatal(err)
+		}
+		return qcowPath
+	}
+
+	t.Logf("decompressing %s (%s)", partialPath, compression)
+	tmpPath := qcowPath + ".tmp"
+	hash, err := decompressImage(compression, partialPath, tmpPath)
 	if err != nil {
+		os.Remove(tmpPath)
+		t.Fatalf("can't decompress %s: %v", resultDistro.URL, err)
+	}
+	if hash != resultDistro.SHA256Sum {
+		os.Remove(tmpPath)
+		os.Remove(partialPath)
+		t.Fatalf("hash mismatch for decompressed %s, want: %s, got: %s", resultDistro.URL, resultDistro.SHA256Sum, hash)
+	}
+	if err := os.Rename(tmpPath, qcowPath); err != nil {
 		t.Fatal(err)
 	}
+	os.Remove(partialPath)
+	return qcowPath
+}
 
-	if !fetchFromS3(t, fout, resultDistro) {
-		resp, err := http.Get(resultDistro.URL)
-		if err != nil {
-			t.Fatalf("can't fetch qcow2 for %s (%s): %v", resultDistro.Name, resultDistro.URL, err)
-		}
+// An ImageSource is somewhere fetchDistro can get a distro's image from.
+type ImageSource interface {
+	// FetchImage writes d's image to path and reports whether it did.
+	// If it doesn't have the image, it returns false without touching
+	// path, and the next source is tried. compressed reports whether
+	// the image is compressed as d.Compression says, rather than
+	// already being plain qcow2. Errors fail t.
+	//
+	// path may hold the start of the image from an earlier, interrupted
+	// attempt, which a source may resume from.
+	FetchImage(t *testing.T, d Distro, path string) (ok, compressed bool)
+}
 
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			t.Fatalf("%s replied %s", resultDistro.URL, resp.Status)
-		}
+// imageSources are the sources fetchDistro tries, in order, until one
+// has the image. The HTTP source always does, so a source added to be
+// tried first, such as a local mirror, goes ahead of it.
+var imageSources = []ImageSource{s3ImageSource{}, httpImageSource{}}
+
+// s3ImageSource fetches plain qcow2 images, keyed by their sum, from
+// the S3 bucket.
+type s3ImageSource struct{}
+
+func (s3ImageSource) FetchImage(t *testing.T, d Distro, path string) (ok, compressed bool) {
+	return fetchFromS3(t, path, d), false
+}
+
+// httpImageSource downloads images from Distro.URL, as published there.
+type httpImageSource struct{}
+
+func (httpImageSource) FetchImage(t *testing.T, d Distro, path string) (ok, compressed bool) {
+	if err := resumeDownload(d.URL, path); err != nil {
+		t.Fatalf("can't fetch qcow2 for %s: %v", d.Name, err)
+	}
+	return true, true
+}
 
-		if n, err := io.Copy(fout, resp.Body); err != nil {
-			t.Fatalf("download of %s failed: %v", resultDistro.URL, err)
-		} else if n == 0 {
-			t.Fatalf("download of %s got zero-length file", resultDistro.URL)
+// dlsem limits how many distro images are downloaded at once, so that
+// parallel tests don't all compete for the network and disk. It's
+// separate from ramsem, which limits the VMs running at once, and
+// doesn't cover hashing the downloads.
+var dlsem struct {
+	once sync.Once
+	sem  *semaphore.Weighted
+}
+
+// acquireDownload waits for one of the --download-limit download slots
+// and returns a func that releases it.
+func acquireDownload(t *testing.T) (release func()) {
+	t.Helper()
+	dlsem.once.Do(func() {
+		n := *downloadLimit
+		if n < 1 {
+			n = 1
 		}
+		dlsem.sem = semaphore.NewWeighted(int64(n))
+	})
+	if err := dlsem.sem.Acquire(context.Background(), 1); err != nil {
+		t.Fatalf("can't acquire download slot: %v", err)
+	}
+	return func() { dlsem.sem.Release(1) }
+}
+
+// decompressImage decompresses src, an image compressed with
+// compression (one of the Distro.Compression values), to dst. It
+// returns the hex SHA-256 sum of the decompressed image, hashed as it's
+// written.
+func decompressImage(compression, src, dst string) (hash string, err error) {
+	fin, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer fin.Close()
 
-		resp.Body.Close()
-		if err = fout.Close(); err != nil {
-			t.Fatalf("can't close fout: %v", err)
+	var r io.Reader
+	switch compression {
+	case "gzip":
+		zr, err := gzip.NewReader(fin)
+		if err != nil {
+			return "", err
+		}
+		r = zr
+	case "zstd":
+		zr, err := zstd.NewReader(fin)
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+		r = zr
+	case "xz":
+		// There's no xz decoder in the tree, so use the xz tool.
+		cmd := exec.Command("xz", "--decompress", "--stdout")
+		cmd.Stdin = fin
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return "", err
 		}
+		if err := cmd.Start(); err != nil {
+			return "", err
+		}
+		defer func() {
+			if err != nil {
+				// Don't leave xz blocked writing to the pipe.
+				cmd.Process.Kill()
+			}
+			if werr := cmd.Wait(); werr != nil && err == nil {
+				err = fmt.Errorf("xz: %v, %s", werr, bytes.TrimSpace(stderr.Bytes()))
+			}
+		}()
+		r = out
+	default:
+		return "", fmt.Errorf("unknown compression %q", compression)
+	}
 
-		hash := checkCachedImageHash(t, resultDistro, cdir)
+	fout, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(fout, hasher), r); err != nil {
+		fout.Close()
+		return "", err
+	}
+	if err := fout.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
 
-		if hash != resultDistro.SHA256Sum {
-			t.Fatalf("hash mismatch for %s, want: %s, got: %s", resultDistro.URL, resultDistro.SHA256Sum, hash)
+// resumeDownload downloads url to path. If path already holds the start
+// of the file from an earlier attempt, only the rest is requested.
+func resumeDownload(url, path string) error {
+	fout, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	have, err := fout.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if have > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", have))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Appending to what we have.
+	case http.StatusOK:
+		// Either a fresh download or the server doesn't do ranges.
+		if err := fout.Truncate(0); err != nil {
+			return err
 		}
+		if _, err := fout.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		have = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		// We already have all of it; the hash check decides if it's
+		// any good.
+		return fout.Close()
+	default:
+		return fmt.Errorf("%s replied %s", url, resp.Status)
 	}
 
-	return qcowPath
+	n, err := io.Copy(fout, resp.Body)
+	if err != nil {
+		return fmt.Errorf("download of %s failed after %d bytes: %w", url, have+n, err)
+	}
+	if have+n == 0 {
+		return fmt.Errorf("download of %s got zero-length file", url)
+	}
+	return fout.Close()
 }
 
-func checkCachedImageHash(t *testing.T, d Distro, cacheDir string) string {
+func hashFile(t *testing.T, path string) string {
 	t.Helper()
 
-	qcowPath := filepath.Join(cacheDir, "qcow2", d.SHA256Sum)
-
-	fin, err := os.Open(qcowPath)
+	fin, err := os.Open(path)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -309,7 +689,13 @@ func checkCachedImageHash(t *testing.T, d Distro, cacheDir string) string {
 	if _, err := io.Copy(hasher, fin); err != nil {
 		t.Fatal(err)
 	}
-	hash := hex.EncodeToString(hasher.Sum(nil))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func checkCachedImageHash(t *testing.T, d Distro, cacheDir string) string {
+	t.Helper()
+
+	hash := hashFile(t, filepath.Join(cacheDir, "qcow2", d.SHA256Sum))
 
 	if hash != d.SHA256Sum {
 		t.Fatalf("hash mismatch, got: %q, want: %q", hash, d.SHA256Sum)
@@ -327,13 +713,17 @@ func (h *Harness) copyBinaries(t *testing.T, d Distro, conn *ssh.Client) {
 		t.Fatalf("can't connect over sftp to copy binaries: %v", err)
 	}
 
-	mkdir(t, cli, "/usr/bin")
-	mkdir(t, cli, "/usr/sbin")
+	cliDir, daemonDir := d.InstallDirs()
+	mkdir(t, cli, cliDir)
+	mkdir(t, cli, daemonDir)
 	mkdir(t, cli, "/etc/default")
 	mkdir(t, cli, "/var/lib/tailscale")
 
-	copyFile(t, cli, h.daemon, "/usr/sbin/tailscaled")
-	copyFile(t, cli, h.cli, "/usr/bin/tailscale")
+	// h.daemon and h.cli are built for the host, which runs the tester
+	// node; the guest may not share its architecture.
+	binDir := integration.BinaryDirForArch(t, d.GoArch())
+	copyFile(t, cli, filepath.Join(binDir, "tailscaled"), path.Join(daemonDir, "tailscaled"))
+	copyFile(t, cli, filepath.Join(binDir, "tailscale"), path.Join(cliDir, "tailscale"))
 
 	// TODO(Xe): revisit this assumption before it breaks the test.
 	copyFile(t, cli, "../../../cmd/tailscaled/tailscaled.defaults", "/etc/default/tailscaled")
@@ -344,19 +734,63 @@ func (h *Harness) copyBinaries(t *testing.T, d Distro, conn *ssh.Client) {
 		copyFile(t, cli, "../../../cmd/tailscaled/tailscaled.openrc", "/etc/init.d/tailscaled")
 	case "systemd":
 		mkdir(t, cli, "/etc/systemd/system")
-		copyFile(t, cli, "../../../cmd/tailscaled/tailscaled.service", "/etc/systemd/system/tailscaled.service")
+		unit, err := os.ReadFile("../../../cmd/tailscaled/tailscaled.service")
+		if err != nil {
+			t.Fatal(err)
+		}
+		unit = bytes.ReplaceAll(unit, []byte("/usr/sbin/tailscaled"), []byte(path.Join(daemonDir, "tailscaled")))
+		writeFile(t, cli, "/etc/systemd/system/tailscaled.service", unit)
 	}
 
 	fout, err := cli.OpenFile("/etc/default/tailscaled", os.O_WRONLY|os.O_APPEND)
 	if err != nil {
 		t.Fatalf("can't append to defaults for tailscaled: %v", err)
 	}
-	fmt.Fprintf(fout, "\n\nTS_LOG_TARGET=%s\n", h.loginServerURL)
+	fmt.Fprintf(fout, "\n\nTS_LOG_TARGET=%s\n", h.logTarget)
+	if coverageBuild() {
+		// tailscaled only writes coverage data into a directory
+		// that already exists.
+		mkdir(t, cli, guestCoverDir)
+		fmt.Fprintf(fout, "GOCOVERDIR=%s\n", guestCoverDir)
+	}
+	if len(d.ExtraDaemonArgs) > 0 {
+		flags, err := daemonFlags(d.ExtraDaemonArgs)
+		if err != nil {
+			fout.Close()
+			t.Fatalf("%s: %v", d.Name, err)
+		}
+		// This overrides the empty FLAGS from tailscaled.defaults.
+		fmt.Fprintf(fout, "FLAGS=%q\n", flags)
+	}
 	fout.Close()
 
+	if coverageBuild() {
+		// So the CLI run over SSH writes its coverage data there too,
+		// rather than warning that GOCOVERDIR isn't set. This relies
+		// on sshd reading /etc/environment through PAM.
+		env, err := cli.OpenFile("/etc/environment", os.O_WRONLY|os.O_APPEND|os.O_CREATE)
+		if err != nil {
+			t.Fatalf("can't append to /etc/environment: %v", err)
+		}
+		fmt.Fprintf(env, "\nGOCOVERDIR=%s\n", guestCoverDir)
+		env.Close()
+	}
+
 	t.Log("tailscale installed!")
 }
 
+// daemonFlags returns args as the value of FLAGS in
+// /etc/default/tailscaled, or an error if one of them wouldn't survive
+// the init scripts' unquoted expansion of $FLAGS.
+func daemonFlags(args []string) (string, error) {
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\$`") {
+			return "", fmt.Errorf("ExtraDaemonArgs entry %q can't be passed through FLAGS", arg)
+		}
+	}
+	return strings.Join(args, " "), nil
+}
+
 func mkdir(t *testing.T, cli *sftp.Client, name string) {
 	t.Helper()
 
@@ -366,6 +800,22 @@ func mkdir(t *testing.T, cli *sftp.Client, name string) {
 	}
 }
 
+func writeFile(t *testing.T, cli *sftp.Client, remoteDest string, data []byte) {
+	t.Helper()
+
+	fout, err := cli.Create(remoteDest)
+	if err != nil {
+		t.Fatalf("can't create output file: %v", err)
+	}
+	if _, err := fout.Write(data); err != nil {
+		fout.Close()
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := fout.Close(); err != nil {
+		t.Fatalf("can't close fout on remote host: %v", err)
+	}
+}
+
 func copyFile(t *testing.T, cli *sftp.Client, localSrc, remoteDest string) {
 	t.Helper()
 
@@ -440,6 +890,16 @@ func copyFile(t *testing.T, cli *sftp.Client, localSrc, remoteDest string) {
         config: disabled
 
 runcmd:
+ - set -e
 {{.InstallPre}}
- - [ curl, "{{.HostURL}}/myip/{{.Port}}", "-H", "User-Agent: {{.Hostname}}" ]
+ - 'n=1; until curl -fsS --max-time 10 "{{.HostURL}}/myip/{{.Port}}" -H "User-Agent: {{.Hostname}}"; do [ $n -lt {{.MyIPAttempts}} ] || exit 1; n=$((n+1)); sleep {{.MyIPRetrySeconds}}; done'
 `
+
+// myIPAttempts and myIPRetrySeconds are how many times, and how far
+// apart, a guest tries to report its address to the harness's /myip
+// handler before giving up. Until one of them gets through, the guest
+// isn't in ipMap and can't be tested.
+const (
+	myIPAttempts     = 30
+	myIPRetrySeconds = 5
+)
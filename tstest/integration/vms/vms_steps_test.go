@@ -10,15 +10,29 @@
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tstest/integration"
+	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/preftype"
 )
 
 const timeout = 15 * time.Second
@@ -72,6 +86,519 @@ func (h *Harness) testPing(t *testing.T, ipAddr netaddr.IP, cli *ssh.Client) {
 	})
 }
 
+// testPingPaths checks that tailscale ping uses the disco path by
+// default and TSMP with --tsmp, and that both get a pong.
+func (h *Harness) testPingPaths(t *testing.T, ipAddr netaddr.IP, cli *ssh.Client) {
+	for _, tt := range []struct {
+		flags    string
+		wantTSMP bool
+	}{
+		{"", false},
+		{"--tsmp", true},
+	} {
+		retry(t, func() error {
+			sess := getSession(t, cli)
+			cmd := fmt.Sprintf("tailscale ping -c 1 %s %s", tt.flags, ipAddr)
+			outp, err := sess.CombinedOutput(cmd)
+			if err != nil {
+				return fmt.Errorf("%s: %v, output: %s", cmd, err, outp)
+			}
+			if !bytes.Contains(outp, []byte("pong")) {
+				return fmt.Errorf("%s: no pong, output: %s", cmd, outp)
+			}
+			if gotTSMP := bytes.Contains(outp, []byte("via TSMP")); gotTSMP != tt.wantTSMP {
+				return fmt.Errorf("%s: pong via TSMP = %v; want %v, output: %s", cmd, gotTSMP, tt.wantTSMP, outp)
+			}
+			if h.testerDERPOnly && !tt.wantTSMP && !bytes.Contains(outp, []byte("via DERP(")) {
+				return fmt.Errorf("%s: pong wasn't relayed over DERP, though the tester only uses DERP; output: %s", cmd, outp)
+			}
+			t.Logf("%s", outp)
+			return nil
+		})
+	}
+}
+
+// testControlURLMigration moves the guest to a freshly started control
+// server with "tailscale up --login-server=... --force-reauth", checks
+// that it registers and comes up there, and then moves it back to the
+// harness's control server the same way.
+func (h *Harness) testControlURLMigration(t *testing.T, cli *ssh.Client) {
+	csB, urlB := h.startExtraControl(t)
+
+	up := func(loginServer string) {
+		t.Helper()
+		cmd := fmt.Sprintf("tailscale up --login-server=%s --force-reauth --yes", loginServer)
+		outp, err := getSession(t, cli).CombinedOutput(cmd)
+		if err != nil {
+			t.Fatalf("%s: %v, output: %s", cmd, err, outp)
+		}
+	}
+
+	up(urlB)
+	nodes := csB.AllNodes()
+	if len(nodes) != 1 {
+		t.Fatalf("new control server has %d nodes; want just the guest", len(nodes))
+	}
+	ipBytes, err := getSession(t, cli).Output("tailscale ip -4")
+	if err != nil {
+		t.Fatalf("can't get IP after moving to %s: %v", urlB, err)
+	}
+	ip := netaddr.MustParseIP(string(bytes.TrimSpace(ipBytes)))
+	var found bool
+	for _, a := range nodes[0].Addresses {
+		found = found || a.IP() == ip
+	}
+	if !found {
+		t.Fatalf("guest has IP %v; want one of %v from the new control server", ip, nodes[0].Addresses)
+	}
+
+	up(h.loginServerURL)
+	retry(t, func() error {
+		outp, err := getSession(t, cli).CombinedOutput("tailscale status")
+		if err != nil {
+			return fmt.Errorf("tailscale status: %v, output: %s", err, outp)
+		}
+		if !bytes.Contains(outp, []byte(h.testerV4.String())) {
+			return fmt.Errorf("can't find tester IP after moving back to %s: %s", h.loginServerURL, outp)
+		}
+		return nil
+	})
+}
+
+// waitForTester waits for "tailscale status" on the guest to work and
+// list the tester node. Like in the "tailscale status" step, tailscaled
+// may take a moment to be ready after starting.
+func (h *Harness) waitForTester(cli *ssh.Client) error {
+	var outp []byte
+	var err error
+	dur := 100 * time.Millisecond
+	for count := 0; count < 10; count++ {
+		var sess *ssh.Session
+		sess, err = cli.NewSession()
+		if err != nil {
+			return err
+		}
+		outp, err = sess.CombinedOutput("tailscale status")
+		sess.Close()
+		if err == nil && bytes.Contains(outp, []byte(h.testerV4.String())) {
+			return nil
+		}
+		time.Sleep(dur)
+		dur *= 2
+	}
+	if err != nil {
+		return fmt.Errorf("tailscale status: %v, output: %s", err, outp)
+	}
+	return fmt.Errorf("can't find tester IP %v in tailscale status: %s", h.testerV4, outp)
+}
+
+// hardenedUnitDropIn is a systemd drop-in for tailscaled.service
+// following the usual hardening recommendations: no privilege
+// escalation, only the capabilities tailscaled needs, and a read-only
+// view of the OS apart from its state and DNS config.
+const hardenedUnitDropIn = `[Service]
+NoNewPrivileges=yes
+CapabilityBoundingSet=CAP_NET_ADMIN CAP_NET_RAW CAP_NET_BIND_SERVICE CAP_SYS_MODULE
+ProtectSystem=full
+ProtectHome=yes
+PrivateTmp=yes
+ReadWritePaths=/var/lib/tailscale -/etc/resolv.conf
+`
+
+// testHardenedService restarts tailscaled under hardenedUnitDropIn and
+// checks that it still comes up and can reach the tester, showing the
+// unit's recent logs otherwise so capability errors are easy to spot.
+// The drop-in is removed again afterwards.
+func (h *Harness) testHardenedService(t *testing.T, d Distro, cli *ssh.Client) {
+	if d.InitSystem != "systemd" {
+		t.Skipf("hardening drop-ins need systemd, not %q", d.InitSystem)
+	}
+
+	const dropInDir = "/etc/systemd/system/tailscaled.service.d"
+	run := func(cmd string) {
+		t.Helper()
+		outp, err := getSession(t, cli).CombinedOutput(cmd)
+		if err != nil {
+			t.Fatalf("%s: %v, output: %s", cmd, err, outp)
+		}
+	}
+	restart := func() {
+		t.Helper()
+		run("systemctl daemon-reload && systemctl restart tailscaled.service")
+		if err := h.waitForTester(cli); err != nil {
+			logs, _ := getSession(t, cli).CombinedOutput("journalctl -u tailscaled.service -n 50 --no-pager")
+			t.Fatalf("%v\n\ntailscaled logs:\n%s", err, logs)
+		}
+	}
+
+	run(fmt.Sprintf("mkdir -p %[1]s && cat > %[1]s/hardening.conf <<'EOF'\n%[2]sEOF", dropInDir, hardenedUnitDropIn))
+	t.Cleanup(func() {
+		run("rm -f " + dropInDir + "/hardening.conf")
+		restart()
+	})
+
+	restart()
+	h.testPing(t, h.testerV4, cli)
+	h.testOutgoingTCP(t, h.testerV4, cli)
+}
+
+// guestBackendState returns the BackendState the guest's "tailscale
+// status --json" reports. If that fails, as it does when tailscaled
+// isn't running, it returns "" and the error with the command's
+// output.
+func guestBackendState(t *testing.T, cli *ssh.Client) (string, error) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	sess := getSession(t, cli)
+	sess.Stdout = &stdout
+	sess.Stderr = &stderr
+	if err := sess.Run("tailscale status --json"); err != nil {
+		return "", fmt.Errorf("tailscale status --json: %v, output: %s%s", err, stdout.Bytes(), stderr.Bytes())
+	}
+	var st struct{ BackendState string }
+	if err := json.Unmarshal(stdout.Bytes(), &st); err != nil {
+		t.Fatalf("can't parse tailscale status --json: %v, output: %s", err, stdout.Bytes())
+	}
+	return st.BackendState, nil
+}
+
+// awaitTailscaledReady waits for the guest's tailscaled to come up
+// after its service is started, which is when "tailscale status" gets
+// an answer with a BackendState other than NoState or Stopped. The
+// failure says what it saw last, to tell a tailscaled that never
+// started from one that's up but stuck.
+func awaitTailscaledReady(t *testing.T, cli *ssh.Client, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		st, err := guestBackendState(t, cli)
+		switch st {
+		case "", "NoState", "Stopped":
+		default:
+			t.Logf("tailscaled is up, in state %s", st)
+			return
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				t.Fatalf("tailscaled not responding %v after start: %v", timeout, err)
+			}
+			t.Fatalf("tailscaled still in state %q %v after start", st, timeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// testNetcheck runs "tailscale netcheck" on the guest and records what
+// it found in h.result. It only fails if netcheck itself does.
+func (h *Harness) testNetcheck(t *testing.T, cli *ssh.Client) {
+	var stdout, stderr bytes.Buffer
+	sess := getSession(t, cli)
+	sess.Stdout = &stdout
+	sess.Stderr = &stderr
+	if err := sess.Run("tailscale netcheck --format=json"); err != nil {
+		t.Fatalf("tailscale netcheck: %v, output: %s%s", err, stdout.Bytes(), stderr.Bytes())
+	}
+	nc, err := parseGuestNetcheck(stdout.Bytes())
+	if err != nil {
+		t.Fatalf("%v, output: %s", err, stdout.Bytes())
+	}
+	t.Logf("guest netcheck: preferred DERP %d, NAT %q, UDP %v, IPv4 %v, IPv6 %v, port mapping %v",
+		nc.PreferredDERP, nc.NAT, nc.UDP, nc.IPv4, nc.IPv6, nc.PortMapping)
+	if h.result != nil {
+		h.result.Netcheck = nc
+	}
+}
+
+// testMagicDNS checks that the guest resolves the tester's MagicDNS
+// name to the tester's Tailscale IP with the system resolver. It's
+// skipped if the guest doesn't accept DNS config from control.
+func (h *Harness) testMagicDNS(t *testing.T, cli *ssh.Client) {
+	prefsJSON, err := getSession(t, cli).Output("tailscale debug prefs")
+	if err != nil {
+		t.Fatalf("tailscale debug prefs: %v", err)
+	}
+	var prefs struct{ CorpDNS bool }
+	if err := json.Unmarshal(prefsJSON, &prefs); err != nil {
+		t.Fatalf("can't parse guest prefs %q: %v", prefsJSON, err)
+	}
+	if !prefs.CorpDNS {
+		t.Skip("guest doesn't accept DNS config")
+	}
+
+	statusJSON, err := getSession(t, cli).Output("tailscale status --json")
+	if err != nil {
+		t.Fatalf("tailscale status: %v", err)
+	}
+	name, err := peerDNSName(statusJSON, h.testerV4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name == "" {
+		t.Skip("control didn't give the tester a MagicDNS name")
+	}
+
+	// The guest's DNS config can lag its netmap a little, so retry.
+	cmd := magicDNSLookupCmd(name)
+	var outp []byte
+	for deadline := time.Now().Add(30 * time.Second); ; {
+		outp, _ = getSession(t, cli).CombinedOutput(cmd)
+		for _, ip := range resolvedIPs(outp) {
+			if ip == h.testerV4 {
+				t.Logf("guest resolved %s to %v", name, ip)
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	t.Fatalf("guest didn't resolve %s to the tester's IP %v; %s: %s", name, h.testerV4, cmd, outp)
+}
+
+// magicDNSLookupCmd returns the guest shell command that resolves name.
+// It prefers getent, which goes through the same NSS and resolver
+// config as other programs (systemd-resolved, resolvconf or a plain
+// /etc/resolv.conf), and falls back to nslookup on images without it.
+func magicDNSLookupCmd(name string) string {
+	return fmt.Sprintf("if command -v getent >/dev/null 2>&1; then getent hosts %[1]s; else nslookup %[1]s; fi", name)
+}
+
+// resolvedIPs returns the IP addresses in the output of getent hosts or
+// nslookup. For nslookup, that includes the resolver's own address.
+func resolvedIPs(outp []byte) []netaddr.IP {
+	var ips []netaddr.IP
+	for _, f := range strings.Fields(string(outp)) {
+		if ip, err := netaddr.ParseIP(f); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// testDown runs "tailscale down" on the guest and checks that it undid
+// what "tailscale up" set up: tailscaled is Stopped and, unless it uses
+// userspace networking, tailscale0 has no Tailscale addresses, its
+// route table is empty and the ts-* netfilter chains are gone, which
+// they are whatever the netfilter mode was. tailscaled keeps the TUN
+// device itself open while it runs, so tailscale0 stays. The guest is
+// brought back up afterwards.
+func (h *Harness) testDown(t *testing.T, d Distro, cli *ssh.Client) {
+	t.Cleanup(func() {
+		getSession(t, cli).Run(fmt.Sprintf("tailscale up --login-server=%s", h.loginServerURL))
+	})
+
+	prefsJSON, err := getSession(t, cli).Output("tailscale debug prefs")
+	if err != nil {
+		t.Fatalf("tailscale debug prefs: %v", err)
+	}
+	var prefs struct{ NetfilterMode preftype.NetfilterMode }
+	if err := json.Unmarshal(prefsJSON, &prefs); err != nil {
+		t.Fatalf("can't parse guest prefs %q: %v", prefsJSON, err)
+	}
+	hasIPTables := !d.UserspaceNetworking() && getSession(t, cli).Run("command -v iptables") == nil
+	if hasIPTables && prefs.NetfilterMode != preftype.NetfilterOff {
+		// Make sure the check below is checking something.
+		outp, _ := getSession(t, cli).CombinedOutput(netfilterRulesCmd)
+		if len(tailscaleNetfilterRules(outp)) == 0 {
+			t.Fatalf("no ts-* netfilter rules with --netfilter-mode=%v before tailscale down:\n%s", prefs.NetfilterMode, outp)
+		}
+	}
+
+	if outp, err := getSession(t, cli).CombinedOutput("tailscale down"); err != nil {
+		t.Fatalf("tailscale down: %v, output: %s", err, outp)
+	}
+
+	var st string
+	for deadline := time.Now().Add(timeout); ; {
+		st, err = guestBackendState(t, cli)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st == "Stopped" || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if st != "Stopped" {
+		t.Fatalf("state after tailscale down = %q; want Stopped", st)
+	}
+
+	if d.UserspaceNetworking() {
+		return
+	}
+	outp, err := getSession(t, cli).CombinedOutput("ip -o addr show dev tailscale0")
+	if err != nil {
+		t.Fatalf("can't list tailscale0's addresses: %v, output: %s", err, outp)
+	}
+	if ips := tailscaleAddrs(outp); len(ips) > 0 {
+		t.Errorf("tailscale0 still has Tailscale addresses %v after tailscale down:\n%s", ips, outp)
+	}
+	for _, cmd := range []string{"ip route show table 52", "ip -6 route show table 52"} {
+		outp, _ := getSession(t, cli).CombinedOutput(cmd)
+		if routes := bytes.TrimSpace(outp); len(routes) > 0 && !bytes.Contains(routes, []byte("FIB table does not exist")) {
+			t.Errorf("%s after tailscale down:\n%s", cmd, routes)
+		}
+	}
+	if hasIPTables {
+		outp, _ := getSession(t, cli).CombinedOutput(netfilterRulesCmd)
+		if left := tailscaleNetfilterRules(outp); len(left) > 0 {
+			t.Errorf("ts-* netfilter rules left after tailscale down:\n%s", strings.Join(left, "\n"))
+		}
+	}
+}
+
+// netfilterRulesCmd lists the guest's iptables and ip6tables rules in
+// the tables tailscaled uses.
+const netfilterRulesCmd = "for t in filter nat; do iptables -t $t -S; ip6tables -t $t -S; done 2>&1"
+
+// tailscaleNetfilterRules returns the lines of iptables -S output that
+// create, jump to or are in one of tailscaled's ts-* chains.
+func tailscaleNetfilterRules(outp []byte) []string {
+	var rules []string
+	for _, line := range strings.Split(string(outp), "\n") {
+		if strings.Contains(line, " ts-") {
+			rules = append(rules, line)
+		}
+	}
+	return rules
+}
+
+// kernelLogCmd prints the guest's kernel log, from journald if dmesg
+// isn't allowed to read it.
+const kernelLogCmd = "dmesg 2>/dev/null || journalctl -k --no-pager 2>/dev/null"
+
+// oomKillRx matches the kernel's OOM killer reports, "Killed process
+// 1234 (tailscaled) ..." and, from older kernels, "Out of memory: Kill
+// process 1234 (tailscaled) score ...".
+var oomKillRx = regexp.MustCompile(`Kill(?:ed)? process \d+ \(([^)]+)\)`)
+
+// oomKilledProcs returns the names of the processes the OOM killer
+// killed according to kernelLog, without duplicates, in the order of
+// their first kill.
+func oomKilledProcs(kernelLog []byte) []string {
+	var procs []string
+	seen := map[string]bool{}
+	for _, m := range oomKillRx.FindAllSubmatch(kernelLog, -1) {
+		if p := string(m[1]); !seen[p] {
+			seen[p] = true
+			procs = append(procs, p)
+		}
+	}
+	return procs
+}
+
+// guestOOMNote returns a note for a failure message if the guest's
+// OOM killer has killed anything, as that would otherwise only show up
+// as a confusing timeout. It returns "" if it hasn't, or if the kernel
+// log can't be read.
+func guestOOMNote(cli *ssh.Client) string {
+	sess, err := cli.NewSession()
+	if err != nil {
+		return ""
+	}
+	defer sess.Close()
+	outp, _ := sess.Output(kernelLogCmd)
+	procs := oomKilledProcs(outp)
+	if len(procs) == 0 {
+		return ""
+	}
+	for _, p := range procs {
+		if p == "tailscaled" {
+			return "; tailscaled was OOM-killed in the guest, which needs more MemoryMegs in distros.hujson"
+		}
+	}
+	return fmt.Sprintf("; the guest ran out of memory and the OOM killer killed %s, so it may need more MemoryMegs in distros.hujson", strings.Join(procs, ", "))
+}
+
+// tailscaleAddrs returns the Tailscale IPs in the output of "ip -o addr".
+func tailscaleAddrs(outp []byte) []netaddr.IP {
+	var ips []netaddr.IP
+	f := strings.Fields(string(outp))
+	for i := 0; i+1 < len(f); i++ {
+		if f[i] != "inet" && f[i] != "inet6" {
+			continue
+		}
+		if p, err := netaddr.ParseIPPrefix(f[i+1]); err == nil && tsaddr.IsTailscaleIP(p.IP()) {
+			ips = append(ips, p.IP())
+		}
+	}
+	return ips
+}
+
+// maxClockSkew is how far the guest's clock may be from the host's
+// before checkGuestClock sets it. A cold-booted image can be off by
+// far more, which breaks TLS to the control server in confusing ways.
+const maxClockSkew = time.Minute
+
+// guestClockSkew returns how far ahead of the host's clock the guest's
+// is, given the output of "date -u +%s" on the guest and the host's
+// times just before and after running it.
+func guestClockSkew(dateOut []byte, before, after time.Time) (time.Duration, error) {
+	secs, err := strconv.ParseInt(strings.TrimSpace(string(dateOut)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("can't parse guest date %q: %v", dateOut, err)
+	}
+	mid := before.Add(after.Sub(before) / 2)
+	return time.Unix(secs, 0).Sub(mid.Truncate(time.Second)), nil
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// guestClockCmds returns the commands that print d's guest's clock in
+// Unix seconds, like "date -u +%s", and that set it to now.
+func guestClockCmds(d Distro, now time.Time) (read, set string) {
+	if d.GoOS() == "windows" {
+		return powerShellCommand("[DateTimeOffset]::UtcNow.ToUnixTimeSeconds()"),
+			powerShellCommand(fmt.Sprintf("Set-Date -Date ([DateTimeOffset]::FromUnixTimeSeconds(%d).LocalDateTime) | Out-Null", now.Unix()))
+	}
+	// Both GNU and busybox date take this format.
+	return "date -u +%s", fmt.Sprintf("date -u -s '%s'", now.UTC().Format("2006-01-02 15:04:05"))
+}
+
+// readGuestClockSkew returns how far ahead of the host's clock the
+// guest's is.
+func readGuestClockSkew(t *testing.T, d Distro, cli *ssh.Client) time.Duration {
+	t.Helper()
+	cmd, _ := guestClockCmds(d, time.Now())
+	before := time.Now()
+	outp, err := getSession(t, cli).CombinedOutput(cmd)
+	after := time.Now()
+	if err != nil {
+		t.Fatalf("reading guest clock: %v, output: %s", err, outp)
+	}
+	skew, err := guestClockSkew(outp, before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return skew
+}
+
+// checkGuestClock makes sure the guest's clock is within maxClockSkew
+// of the host's, setting it from the host's if not, and fails with a
+// clock skew diagnosis if that doesn't work.
+func checkGuestClock(t *testing.T, d Distro, cli *ssh.Client) {
+	t.Helper()
+	skew := readGuestClockSkew(t, d, cli)
+	if absDuration(skew) <= maxClockSkew {
+		t.Logf("guest clock is %v off the host's", skew)
+		return
+	}
+	t.Logf("guest clock is %v off the host's; setting it", skew)
+	_, cmd := guestClockCmds(d, time.Now())
+	if outp, err := getSession(t, cli).CombinedOutput(cmd); err != nil {
+		t.Fatalf("clock skew: guest clock is %v off the host's, and %s failed: %v, output: %s", skew, cmd, err, outp)
+	}
+	if after := readGuestClockSkew(t, d, cli); absDuration(after) > maxClockSkew {
+		t.Fatalf("clock skew: guest clock is still %v off the host's after setting it (was %v); TLS to the control server will likely fail", after, skew)
+	}
+}
+
 func getSession(t *testing.T, cli *ssh.Client) *ssh.Session {
 	sess, err := cli.NewSession()
 	if err != nil {
@@ -133,3 +660,636 @@ func (h *Harness) testOutgoingTCP(t *testing.T, ipAddr netaddr.IP, cli *ssh.Clie
 
 	<-ctx.Done()
 }
+
+// tailscaledServiceCmds returns the shell commands to stop and start
+// tailscaled on d, skipping the test for init systems it doesn't know.
+func tailscaledServiceCmds(t *testing.T, d Distro) (stop, start string) {
+	switch d.InitSystem {
+	case "openrc":
+		return "rc-service tailscaled stop", "rc-service tailscaled start"
+	case "systemd":
+		return "systemctl stop tailscaled.service", "systemctl start tailscaled.service"
+	}
+	t.Skipf("don't know how to restart tailscaled with init system %q", d.InitSystem)
+	return "", ""
+}
+
+// guestCoverDir is where tailscaled and tailscale on the guest write
+// coverage data when TS_TEST_GOFLAGS builds them with -cover.
+const guestCoverDir = "/var/lib/tailscale/cover"
+
+// coverageBuild reports whether TS_TEST_GOFLAGS builds the test
+// binaries with coverage instrumentation.
+func coverageBuild() bool {
+	for _, f := range integration.TestGoFlags() {
+		if strings.HasPrefix(f, "-cover") {
+			return true
+		}
+	}
+	return false
+}
+
+// collectCoverage copies the coverage data that the guest's binaries
+// wrote to guestCoverDir into the host's $GOCOVERDIR, where it can be
+// merged with the tester's by "go tool covdata". A binary built with
+// -cover only writes its counters when it exits, so tailscaled is
+// stopped first, and started again afterwards.
+func (h *Harness) collectCoverage(t *testing.T, d Distro, cli *ssh.Client) {
+	if !coverageBuild() {
+		t.Skip("TS_TEST_GOFLAGS doesn't build the test binaries with -cover")
+	}
+	hostDir := os.Getenv("GOCOVERDIR")
+	if hostDir == "" {
+		t.Skip("GOCOVERDIR isn't set, so there's nowhere to put the guest's coverage data")
+	}
+	stop, start := tailscaledServiceCmds(t, d)
+	if out, err := getSession(t, cli).CombinedOutput(stop); err != nil {
+		t.Fatalf("%s: %v, %s", stop, err, out)
+	}
+	defer func() {
+		if out, err := getSession(t, cli).CombinedOutput(start); err != nil {
+			t.Fatalf("%s: %v, %s", start, err, out)
+		}
+		awaitTailscaledReady(t, cli, timeout)
+	}()
+
+	sc, err := sftp.NewClient(cli)
+	if err != nil {
+		t.Fatalf("can't connect over sftp to copy coverage data: %v", err)
+	}
+	defer sc.Close()
+	fis, err := sc.ReadDir(guestCoverDir)
+	if errors.Is(err, os.ErrNotExist) {
+		t.Skipf("%s has no %s; its binaries weren't copied from the host", d.Name, guestCoverDir)
+	}
+	if err != nil {
+		t.Fatalf("can't list %s: %v", guestCoverDir, err)
+	}
+	var n int
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		dst := filepath.Join(hostDir, fi.Name())
+		if _, err := os.Stat(dst); err == nil {
+			// Metadata files are named by their hash, so one that's
+			// already there from another guest is the same.
+			continue
+		}
+		if err := copyFromGuest(sc, path.Join(guestCoverDir, fi.Name()), dst); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	t.Logf("copied %d coverage files from %s to %s", n, d.Name, hostDir)
+}
+
+// copyFromGuest copies the file at src on the guest to dst on the host.
+func copyFromGuest(sc *sftp.Client, src, dst string) error {
+	fin, err := sc.Open(src)
+	if err != nil {
+		return fmt.Errorf("can't open %s on the guest: %v", src, err)
+	}
+	defer fin.Close()
+	fout, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fout, fin); err != nil {
+		fout.Close()
+		return fmt.Errorf("can't copy %s from the guest: %v", src, err)
+	}
+	return fout.Close()
+}
+
+// testEphemeralCleanup registers the guest as an ephemeral node with a
+// separate control server, stops tailscaled, and checks that control
+// removes the node soon after. The guest is moved back to the
+// harness's control server afterwards.
+func (h *Harness) testEphemeralCleanup(t *testing.T, d Distro, cli *ssh.Client) {
+	stop, start := tailscaledServiceCmds(t, d)
+
+	const ephemeralTimeout = 5 * time.Second
+	csB, urlB := h.startExtraControl(t)
+	csB.EphemeralTimeout = ephemeralTimeout
+	const authKey = "tskey-vms-ephemeral"
+	csB.AddAuthKey(authKey, true)
+
+	run := func(cmd string) {
+		t.Helper()
+		outp, err := getSession(t, cli).CombinedOutput(cmd)
+		if err != nil {
+			t.Fatalf("%s: %v, output: %s", cmd, err, outp)
+		}
+	}
+
+	run(fmt.Sprintf("tailscale up --login-server=%s --auth-key=%s --force-reauth", urlB, authKey))
+	if n := csB.NumNodes(); n != 1 {
+		t.Fatalf("control server has %d nodes after ephemeral login; want 1", n)
+	}
+
+	run(stop)
+	deadline := time.Now().Add(ephemeralTimeout + time.Minute)
+	for csB.NumNodes() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ephemeral node still registered %v after tailscaled stopped", time.Minute+ephemeralTimeout)
+		}
+		time.Sleep(time.Second)
+	}
+
+	run(start)
+	run(fmt.Sprintf("tailscale up --login-server=%s --force-reauth --yes", h.loginServerURL))
+	if err := h.waitForTester(cli); err != nil {
+		t.Fatalf("after moving back from ephemeral control server: %v", err)
+	}
+}
+
+// testControlDownAtBoot registers the guest with a separate control
+// server, then restarts tailscaled through the init system while that
+// server is down, as if the machine booted before control (or the
+// network in front of it) was reachable. Once the server is back on
+// the same address, tailscaled must reconnect and reach Running on its
+// own. The guest is moved back to the harness's control server
+// afterwards.
+func (h *Harness) testControlDownAtBoot(t *testing.T, d Distro, cli *ssh.Client) {
+	h.needEmbeddedControl(t)
+	stop, start := tailscaledServiceCmds(t, d)
+
+	csB := h.newExtraControl()
+	hs := serveControl(t, csB, net.JoinHostPort(deriveBindhost(t), "0"))
+	urlB := fmt.Sprintf("http://%s", hs.Addr)
+
+	run := func(cmd string) {
+		t.Helper()
+		outp, err := getSession(t, cli).CombinedOutput(cmd)
+		if err != nil {
+			t.Fatalf("%s: %v, output: %s", cmd, err, outp)
+		}
+	}
+	backendState := func() string {
+		t.Helper()
+		st, _ := guestBackendState(t, cli)
+		return st
+	}
+
+	run(fmt.Sprintf("tailscale up --login-server=%s --force-reauth --yes", urlB))
+	if n := csB.NumNodes(); n != 1 {
+		t.Fatalf("control server has %d nodes after login; want 1", n)
+	}
+
+	run(stop)
+	hs.Close()
+	run(start)
+
+	// Give tailscaled time to try control and fail a few times.
+	time.Sleep(10 * time.Second)
+	if st := backendState(); st == "Running" {
+		t.Fatalf("tailscaled is Running with its control server down")
+	}
+
+	serveControl(t, csB, hs.Addr)
+	// controlclient backs off for at most 30 seconds between attempts.
+	deadline := time.Now().Add(2 * time.Minute)
+	for {
+		st := backendState()
+		if st == "Running" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tailscaled still %q 2m after its control server came back", st)
+		}
+		time.Sleep(time.Second)
+	}
+	for _, n := range csB.AllNodes() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := csB.AwaitNodeInMapRequest(ctx, n.Key)
+		cancel()
+		if err != nil {
+			t.Fatalf("guest didn't resume its map poll: %v", err)
+		}
+	}
+
+	run(fmt.Sprintf("tailscale up --login-server=%s --force-reauth --yes", h.loginServerURL))
+	if err := h.waitForTester(cli); err != nil {
+		t.Fatalf("after moving back from restarted control server: %v", err)
+	}
+}
+
+// testSecondInstance starts a second tailscaled by hand against the
+// same state file and socket as the running service, as an operator
+// might by mistake, and checks that it exits promptly with a clear
+// error while the service carries on unaffected.
+func (h *Harness) testSecondInstance(t *testing.T, d Distro, cli *ssh.Client) {
+	if strings.HasPrefix(d.Name, "nixos") {
+		t.Skip("NixOS runs its own tailscaled build, not the one under test")
+	}
+
+	// Userspace networking keeps the second instance away from the
+	// service's TUN device and routes should it get that far.
+	_, daemonDir := d.InstallDirs()
+	cmd := "timeout 30 " + path.Join(daemonDir, "tailscaled") +
+		" --state=/var/lib/tailscale/tailscaled.state" +
+		" --socket=/run/tailscale/tailscaled.sock" +
+		" --tun=userspace-networking --port=0"
+	start := time.Now()
+	outp, err := getSession(t, cli).CombinedOutput(cmd)
+	elapsed := time.Since(start)
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		t.Fatalf("second tailscaled exited successfully; output: %s", outp)
+	case errors.As(err, &exitErr) && exitErr.ExitStatus() == 124:
+		t.Fatalf("second tailscaled was still running after 30s; output: %s", outp)
+	case !bytes.Contains(outp, []byte("already running")):
+		t.Fatalf("second tailscaled failed without saying tailscaled is already running: %v, output: %s", err, outp)
+	}
+	if elapsed > 10*time.Second {
+		t.Errorf("second tailscaled took %v to fail; want it to fail fast", elapsed)
+	}
+
+	if err := h.waitForTester(cli); err != nil {
+		t.Fatalf("after starting a second tailscaled: %v", err)
+	}
+	h.testPing(t, h.testerV4, cli)
+}
+
+// testSubnetLargeTransfer advertises a subnet route from the guest to
+// a network namespace behind a veth pair with the default 1500 byte
+// MTU, and pulls a few megabytes over TCP from a server in that
+// namespace through the subnet router. The server negotiates its MSS
+// for the veth's MTU, not tailscale0's, so this catches full-sized
+// segments getting lost on the way into the tunnel and the transfer
+// stalling. The namespace and route are removed afterwards.
+func (h *Harness) testSubnetLargeTransfer(t *testing.T, cli *ssh.Client) {
+	const (
+		netns      = "tsmss"
+		route      = "10.123.0.0/24"
+		serverAddr = "10.123.0.2:8123"
+		size       = 4 << 20
+	)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("can't get working directory: %v", err)
+	}
+	dir := t.TempDir()
+	run(t, cwd, "go", "build", "-o", filepath.Join(dir, "tcp_tester"), "./tcp_tester.go")
+
+	sftpCli, err := sftp.NewClient(cli)
+	if err != nil {
+		t.Fatalf("can't connect over sftp to copy binaries: %v", err)
+	}
+	defer sftpCli.Close()
+
+	copyFile(t, sftpCli, filepath.Join(dir, "tcp_tester"), "/tcp_tester")
+
+	runCmd := func(cmd string) {
+		t.Helper()
+		outp, err := getSession(t, cli).CombinedOutput(cmd)
+		if err != nil {
+			t.Fatalf("%s: %v, output: %s", cmd, err, outp)
+		}
+	}
+
+	t.Cleanup(func() {
+		for _, cmd := range []string{
+			"pkill tcp_tester",
+			"ip netns delete " + netns,
+			"ip link delete tsmss0",
+			fmt.Sprintf("tailscale up --login-server=%s --reset", h.loginServerURL),
+		} {
+			getSession(t, cli).Run(cmd)
+		}
+	})
+
+	for _, cmd := range []string{
+		"ip netns add " + netns,
+		"ip link add tsmss0 type veth peer name tsmss1",
+		"ip link set tsmss1 netns " + netns,
+		"ip addr add 10.123.0.1/24 dev tsmss0",
+		"ip link set tsmss0 up",
+		"ip netns exec " + netns + " ip addr add 10.123.0.2/24 dev tsmss1",
+		"ip netns exec " + netns + " ip link set tsmss1 up",
+		"ip netns exec " + netns + " ip link set lo up",
+		"ip netns exec " + netns + " ip route add default via 10.123.0.1",
+		"sysctl -w net.ipv4.ip_forward=1",
+		fmt.Sprintf("tailscale up --login-server=%s --advertise-routes=%s", h.loginServerURL, route),
+	} {
+		runCmd(cmd)
+	}
+	h.applyControlScenario(t, cli, func(p *testcontrol.Policy) {
+		p.AutoApproveRoutes = []netaddr.IPPrefix{netaddr.MustParseIPPrefix(route)}
+	})
+
+	srv := getSession(t, cli)
+	srv.Stdout = logger.FuncWriter(t.Logf)
+	srv.Stderr = logger.FuncWriter(t.Logf)
+	if err := srv.Start(fmt.Sprintf("ip netns exec %s /tcp_tester -server %s -bytes %d", netns, serverAddr, size)); err != nil {
+		t.Fatalf("can't start tcp_tester: %v", err)
+	}
+
+	retry(t, func() error {
+		conn, err := h.testerDialer.Dial("tcp", serverAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Minute))
+		n, err := io.Copy(io.Discard, conn)
+		if err != nil {
+			return fmt.Errorf("read %d of %d bytes through subnet router: %w", n, size, err)
+		}
+		if n != size {
+			return fmt.Errorf("read %d bytes through subnet router; want %d", n, size)
+		}
+		return nil
+	})
+}
+
+// testExitNode has the guest advertise itself as an exit node, which
+// control approves, and the tester node use it. It then checks that an
+// HTTP request from the tester to a non-Tailscale address, a server on
+// the host, leaves through the guest: the server sees it come from the
+// guest's address. Guests that can't forward IPv4 are skipped. Both
+// nodes stop offering and using the exit node afterwards.
+func (h *Harness) testExitNode(t *testing.T, d Distro, cli *ssh.Client, ipm ipMapping) {
+	h.needEmbeddedControl(t)
+	if outp, err := getSession(t, cli).CombinedOutput("sysctl -w net.ipv4.ip_forward=1"); err != nil {
+		t.Skipf("%s can't forward IPv4, so can't be an exit node: %v, output: %s", d.Name, err, outp)
+	}
+
+	runCmd := func(cmd string) []byte {
+		t.Helper()
+		outp, err := getSession(t, cli).CombinedOutput(cmd)
+		if err != nil {
+			t.Fatalf("%s: %v, output: %s", cmd, err, outp)
+		}
+		return outp
+	}
+	// The tester's up must mention all the flags makeTestNode used.
+	testerUp := func(exitNode string) {
+		t.Helper()
+		h.Tailscale(t, "up", "--login-server="+h.loginServerURL, "--hostname=tester", "--accept-routes", "--exit-node="+exitNode)
+	}
+
+	t.Cleanup(func() {
+		testerUp("")
+		getSession(t, cli).Run(fmt.Sprintf("tailscale up --login-server=%s --reset", h.loginServerURL))
+	})
+	runCmd(fmt.Sprintf("tailscale up --login-server=%s --advertise-exit-node", h.loginServerURL))
+	h.applyControlScenario(t, cli, func(p *testcontrol.Policy) {
+		p.AutoApproveRoutes = []netaddr.IPPrefix{
+			netaddr.MustParseIPPrefix("0.0.0.0/0"),
+			netaddr.MustParseIPPrefix("::/0"),
+		}
+	})
+
+	nk, ok := h.guestNodeKey(t, cli)
+	if !ok {
+		t.Fatal("can't find the guest's node key")
+	}
+	guestIP, err := netaddr.ParseIP(string(bytes.TrimSpace(runCmd("tailscale ip -4"))))
+	if err != nil {
+		t.Fatalf("can't parse the guest's Tailscale IP: %v", err)
+	}
+
+	// up rejects an --exit-node that the tester doesn't know offers to
+	// be one yet.
+	t0 := time.Now()
+	for {
+		outp := h.Tailscale(t, "status", "--json")
+		var st struct {
+			Peer map[string]struct{ ExitNodeOption bool }
+		}
+		if err := json.Unmarshal(outp, &st); err != nil {
+			t.Fatalf("can't parse tester's tailscale status --json: %v, output: %s", err, outp)
+		}
+		if st.Peer[nk.String()].ExitNodeOption {
+			break
+		}
+		if time.Since(t0) > time.Minute {
+			t.Fatal("tester never saw the guest offer to be an exit node")
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	testerUp(guestIP.String())
+
+	bindHost, _, err := net.SplitHostPort(strings.TrimPrefix(h.hostURL, "http://"))
+	if err != nil {
+		t.Fatalf("can't get the harness's address from %q: %v", h.hostURL, err)
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(bindHost, "0"))
+	if err != nil {
+		t.Fatalf("can't make HTTP server: %v", err)
+	}
+	srcs := make(chan string, 1)
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Logf("http connection from %s", r.RemoteAddr)
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			select {
+			case srcs <- host:
+			default:
+			}
+		}),
+	}
+	go s.Serve(ln)
+	defer s.Close()
+
+	hc := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return h.testerDialer.Dial(network, addr)
+			},
+			DisableKeepAlives: true,
+		},
+		Timeout: timeout,
+	}
+	retry(t, func() error {
+		res, err := hc.Get("http://" + ln.Addr().String())
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if src := <-srcs; src != ipm.ip {
+			return fmt.Errorf("request from the tester came from %s; want the guest's address %s", src, ipm.ip)
+		}
+		return nil
+	})
+}
+
+// testGracefulShutdownOffline stops tailscaled on the guest through the
+// init system and checks that the tester node, watching the guest with
+// "tailscale status --json", sees it go offline promptly. A clean stop
+// ends the guest's map poll right away, so control can tell its peers
+// at once; a crashed node is only noticed once its connection times
+// out. tailscaled is started again afterwards.
+func (h *Harness) testGracefulShutdownOffline(t *testing.T, d Distro, cli *ssh.Client) {
+	stop, start := tailscaledServiceCmds(t, d)
+
+	// A clean stop should be seen well within this; noticing a crash
+	// takes much longer.
+	const offlineWithin = 10 * time.Second
+
+	nk, ok := h.guestNodeKey(t, cli)
+	if !ok {
+		t.Fatal("can't find the guest's node key")
+	}
+	guestOnline := func() bool {
+		t.Helper()
+		outp := h.Tailscale(t, "status", "--json")
+		var st struct {
+			Peer map[string]struct{ Online bool }
+		}
+		if err := json.Unmarshal(outp, &st); err != nil {
+			t.Fatalf("can't parse tester's tailscale status --json: %v, output: %s", err, outp)
+		}
+		return st.Peer[nk.String()].Online
+	}
+	awaitOnline := func(want bool, within time.Duration) time.Duration {
+		t.Helper()
+		t0 := time.Now()
+		for guestOnline() != want {
+			if time.Since(t0) > within {
+				t.Fatalf("tester still sees guest online=%v after %v; want online=%v", !want, within, want)
+			}
+			time.Sleep(250 * time.Millisecond)
+		}
+		return time.Since(t0)
+	}
+	run := func(cmd string) {
+		t.Helper()
+		outp, err := getSession(t, cli).CombinedOutput(cmd)
+		if err != nil {
+			t.Fatalf("%s: %v, output: %s", cmd, err, outp)
+		}
+	}
+
+	awaitOnline(true, time.Minute)
+
+	run(stop)
+	took := awaitOnline(false, offlineWithin)
+	t.Logf("tester saw guest go offline %v after tailscaled stopped", took)
+
+	run(start)
+	if err := h.waitForTester(cli); err != nil {
+		t.Fatalf("after restarting tailscaled: %v", err)
+	}
+	awaitOnline(true, time.Minute)
+}
+
+// testFixedPort sets a non-default PORT in /etc/default/tailscaled, as
+// an operator pinning the WireGuard port for firewall rules would, and
+// restarts tailscaled. It checks that tailscaled listens on that UDP
+// port, tells control about endpoints using it, and can still reach
+// the tester. The default port is restored afterwards.
+func (h *Harness) testFixedPort(t *testing.T, d Distro, cli *ssh.Client) {
+	if strings.HasPrefix(d.Name, "nixos") {
+		t.Skip("NixOS configures tailscaled itself, not with /etc/default/tailscaled")
+	}
+	stop, start := tailscaledServiceCmds(t, d)
+
+	const port = 41999
+	run := func(cmd string) []byte {
+		t.Helper()
+		outp, err := getSession(t, cli).CombinedOutput(cmd)
+		if err != nil {
+			t.Fatalf("%s: %v, output: %s", cmd, err, outp)
+		}
+		return outp
+	}
+	setPort := func(port int) {
+		t.Helper()
+		run(fmt.Sprintf(`sed -i 's/^PORT=.*/PORT="%d"/' /etc/default/tailscaled`, port))
+		run(stop)
+		run(start)
+		if err := h.waitForTester(cli); err != nil {
+			t.Fatalf("with PORT=%d: %v", port, err)
+		}
+	}
+
+	setPort(port)
+	t.Cleanup(func() { setPort(41641) })
+
+	// Not every distro has ss, and busybox has only netstat.
+	outp := run("ss -ulnp 2>/dev/null || netstat -ulnp")
+	var bound bool
+	for _, line := range strings.Split(string(outp), "\n") {
+		if strings.Contains(line, fmt.Sprintf(":%d ", port)) && strings.Contains(line, "tailscaled") {
+			bound = true
+			break
+		}
+	}
+	if !bound {
+		t.Fatalf("tailscaled isn't listening on UDP port %d:\n%s", port, outp)
+	}
+
+	nk, ok := h.guestNodeKey(t, cli)
+	if !ok {
+		t.Fatal("can't find the guest's node key")
+	}
+	var eps []string
+	deadline := time.Now().Add(time.Minute)
+	for {
+		if n := h.cs.Node(nk); n != nil {
+			eps = n.Endpoints
+			if endpointsUsePort(eps, port) {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("guest's endpoints at control %q don't use port %d", eps, port)
+		}
+		time.Sleep(time.Second)
+	}
+
+	h.testPing(t, h.testerV4, cli)
+}
+
+// endpointsUsePort reports whether any of the "ip:port" endpoints in
+// eps has the given port.
+func endpointsUsePort(eps []string, port int) bool {
+	for _, ep := range eps {
+		if _, p, err := net.SplitHostPort(ep); err == nil && p == fmt.Sprint(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// testReadOnlyRoot restarts tailscaled on the guest with its root
+// filesystem mounted read-only and only the state directory writable,
+// like an appliance or IoT image would be. The VMs only have one disk,
+// so a tmpfs (seeded with the existing state) stands in for the
+// writable state mount.
+//
+// The guest's root stays read-only afterwards.
+func (h *Harness) testReadOnlyRoot(t *testing.T, d Distro, cli *ssh.Client) {
+	stop, start := tailscaledServiceCmds(t, d)
+
+	for _, cmd := range []string{
+		stop,
+		"mkdir -p /run/ts-state",
+		"cp -a /var/lib/tailscale/. /run/ts-state/",
+		"mount -t tmpfs tmpfs /var/lib/tailscale",
+		"cp -a /run/ts-state/. /var/lib/tailscale/",
+		"sync",
+		"mount -o remount,ro /",
+		start,
+	} {
+		outp, err := getSession(t, cli).CombinedOutput(cmd)
+		if err != nil {
+			t.Fatalf("%s: %v, output: %s", cmd, err, outp)
+		}
+	}
+
+	if outp, err := getSession(t, cli).CombinedOutput("touch /ro-root-test"); err == nil {
+		t.Fatalf("root filesystem is still writable: %s", outp)
+	}
+
+	if err := h.waitForTester(cli); err != nil {
+		t.Fatalf("with a read-only root: %v", err)
+	}
+
+	h.testPing(t, h.testerV4, cli)
+}
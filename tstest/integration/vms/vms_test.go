@@ -9,14 +9,24 @@
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,14 +34,20 @@
 	"text/template"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/sftp"
 	expect "github.com/tailscale/goexpect"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/sync/semaphore"
 	"inet.af/netaddr"
+	"tailscale.com/logtail/backoff"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/tstest/integration"
+	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/dnsname"
 )
 
 const (
@@ -43,9 +59,17 @@
 	runVMTests        = flag.Bool("run-vm-tests", false, "if set, run expensive VM based integration tests")
 	noS3              = flag.Bool("no-s3", false, "if set, always download images from the public internet (risks breaking)")
 	vmRamLimit        = flag.Int("ram-limit", 4096, "the maximum number of megabytes of ram that can be used for VMs, must be greater than or equal to 1024")
+	downloadLimit     = flag.Int("download-limit", 3, "the maximum number of distro images to download at once")
 	useVNC            = flag.Bool("use-vnc", false, "if set, display guest vms over VNC")
+	controlURL        = flag.String("control-url", "", "if set, register the guests and tester node with this already-running control server instead of an embedded one; it must let nodes in without an interactive login")
 	verboseLogcatcher = flag.Bool("verbose-logcatcher", true, "if set, print logcatcher to t.Logf")
 	verboseQemu       = flag.Bool("verbose-qemu", true, "if set, print qemu console to t.Logf")
+	sshTimeout        = flag.Duration("ssh-timeout", 0, "if non-zero, how long to keep trying to SSH into each guest, instead of a per-distro default based on how slowly it boots")
+	testerDERPMap     = flag.String("tester-derp-map", "", "if set, a JSON file of a DERP map the tester node gets instead of the harness's own, to put it on particular DERP regions; they're added to the guests' DERP map too")
+	testerDERPOnly    = flag.Bool("tester-derp-only", false, "if set, the tester node never talks to guests directly, so that the tests run relayed over DERP")
+	requireKVM        = flag.Bool("require-kvm", false, "if set, skip guests when /dev/kvm isn't usable, rather than running them much more slowly under TCG software emulation")
+	smoke             = flag.Bool("smoke", false, "if set, only check that each guest starts tailscaled and logs in, skipping the connectivity tests, for a quick first pass on a new distro")
+	forceRebuild      = flag.Bool("force-rebuild", false, "if set, rebuild tailscale and tailscaled rather than reusing the binaries cached by an earlier run of the same source")
 	distroRex         = func() *regexValue {
 		result := &regexValue{r: regexp.MustCompile(`.*`)}
 		flag.Var(result, "distro-regex", "The regex that matches what distros should be run")
@@ -55,7 +79,13 @@
 
 func TestMain(m *testing.M) {
 	flag.Parse()
+	if dir, err := os.UserCacheDir(); err == nil {
+		integration.UseBinaryCache(filepath.Join(dir, "tailscale", "vm-test", "bins"), *forceRebuild)
+	}
 	v := m.Run()
+	if err := reportResults(); err != nil {
+		fmt.Fprintf(os.Stderr, "can't write VM test report: %v\n", err)
+	}
 	integration.CleanupBinaries()
 	os.Exit(v)
 }
@@ -81,6 +111,562 @@ func TestDownloadImages(t *testing.T) {
 	}
 }
 
+func TestDaemonFlags(t *testing.T) {
+	got, err := daemonFlags([]string{"--tun=userspace-networking", "--socks5-server=localhost:1080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "--tun=userspace-networking --socks5-server=localhost:1080"; got != want {
+		t.Errorf("daemonFlags = %q; want %q", got, want)
+	}
+	for _, bad := range []string{"", "--foo=a b", `--foo="a"`, "--foo=$HOME"} {
+		if _, err := daemonFlags([]string{bad}); err == nil {
+			t.Errorf("daemonFlags accepted %q", bad)
+		}
+	}
+}
+
+func TestSelfNodeKey(t *testing.T) {
+	nk := key.NewNode().Public()
+	got, err := selfNodeKey([]byte(`{"BackendState":"Running","Self":{"PublicKey":"` + nk.String() + `"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nk {
+		t.Errorf("selfNodeKey = %v; want %v", got, nk)
+	}
+	if _, err := selfNodeKey([]byte(`{"BackendState":"NoState"}`)); err == nil {
+		t.Error("selfNodeKey succeeded without a Self key")
+	}
+}
+
+func TestPeerDNSName(t *testing.T) {
+	status := []byte(`{"Peer":{
+		"nodekey:1":{"DNSName":"tester.vms.tailnet.test.","TailscaleIPs":["100.64.0.1","fd7a:115c:a1e0:ab12:4843:cd96:6240:1"]},
+		"nodekey:2":{"DNSName":"","TailscaleIPs":["100.64.0.2"]}}}`)
+	for _, tt := range []struct {
+		ip      string
+		want    string
+		wantErr bool
+	}{
+		{ip: "100.64.0.1", want: "tester.vms.tailnet.test"},
+		{ip: "fd7a:115c:a1e0:ab12:4843:cd96:6240:1", want: "tester.vms.tailnet.test"},
+		{ip: "100.64.0.2", want: ""},
+		{ip: "100.64.0.3", wantErr: true},
+	} {
+		got, err := peerDNSName(status, netaddr.MustParseIP(tt.ip))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("peerDNSName(%s) error = %v; wantErr %v", tt.ip, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("peerDNSName(%s) = %q; want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestResolvedIPs(t *testing.T) {
+	tests := []struct {
+		name string
+		outp string
+		want []string
+	}{
+		{
+			name: "getent",
+			outp: "100.64.0.1      tester.vms.tailnet.test\n",
+			want: []string{"100.64.0.1"},
+		},
+		{
+			name: "busybox-nslookup",
+			outp: "Server:\t\t100.100.100.100\nAddress:\t100.100.100.100:53\n\nName:\ttester.vms.tailnet.test\nAddress: 100.64.0.1\n",
+			want: []string{"100.100.100.100", "100.64.0.1"},
+		},
+		{
+			name: "bind-nslookup",
+			outp: "Server:\t\t127.0.0.53\nAddress:\t127.0.0.53#53\n\nNon-authoritative answer:\nName:\ttester.vms.tailnet.test\nAddress: 100.64.0.1\n",
+			want: []string{"127.0.0.53", "100.64.0.1"},
+		},
+		{
+			name: "not-found",
+			outp: "** server can't find tester.vms.tailnet.test: NXDOMAIN\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, ip := range resolvedIPs([]byte(tt.outp)) {
+				got = append(got, ip.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolvedIPs = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTailscaleNetfilterRules(t *testing.T) {
+	outp := []byte(`-P INPUT ACCEPT
+-P FORWARD ACCEPT
+-N ts-forward
+-N ts-input
+-A INPUT -j ts-input
+-A FORWARD -j ts-forward
+-A ts-input -i lo -s 100.64.0.2/32 -j ACCEPT
+-A INPUT -p tcp --dport 22 -j ACCEPT
+-N its-fine
+`)
+	got := tailscaleNetfilterRules(outp)
+	want := []string{
+		"-N ts-forward",
+		"-N ts-input",
+		"-A INPUT -j ts-input",
+		"-A FORWARD -j ts-forward",
+		"-A ts-input -i lo -s 100.64.0.2/32 -j ACCEPT",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tailscaleNetfilterRules = %q; want %q", got, want)
+	}
+	if got := tailscaleNetfilterRules([]byte("-P INPUT ACCEPT\n-P FORWARD ACCEPT\n")); len(got) != 0 {
+		t.Errorf("tailscaleNetfilterRules of clean rules = %q; want none", got)
+	}
+}
+
+func TestTailscaleAddrs(t *testing.T) {
+	outp := []byte(`5: tailscale0    inet 100.64.0.2/32 scope global tailscale0\       valid_lft forever preferred_lft forever
+5: tailscale0    inet6 fd7a:115c:a1e0:ab12:4843:cd96:6240:2/128 scope global \       valid_lft forever preferred_lft forever
+5: tailscale0    inet6 fe80::1234/64 scope link stable-privacy \       valid_lft forever preferred_lft forever
+`)
+	got := tailscaleAddrs(outp)
+	want := []netaddr.IP{
+		netaddr.MustParseIP("100.64.0.2"),
+		netaddr.MustParseIP("fd7a:115c:a1e0:ab12:4843:cd96:6240:2"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tailscaleAddrs = %v; want %v", got, want)
+	}
+	if got := tailscaleAddrs([]byte("5: tailscale0    inet6 fe80::1234/64 scope link\n")); len(got) != 0 {
+		t.Errorf("tailscaleAddrs of a link-local address = %v; want none", got)
+	}
+}
+
+func TestOOMKilledProcs(t *testing.T) {
+	kernelLog := []byte(`[  812.441015] tailscaled invoked oom-killer: gfp_mask=0x100cca(GFP_HIGHUSER_MOVABLE), order=0, oom_score_adj=0
+[  812.443127] oom-kill:constraint=CONSTRAINT_NONE,nodemask=(null),cpuset=/,mems_allowed=0,global_oom,task_memcg=/system.slice/tailscaled.service,task=tailscaled,pid=912,uid=0
+[  812.443175] Out of memory: Killed process 912 (tailscaled) total-vm:812344kB, anon-rss:402112kB, file-rss:0kB, shmem-rss:0kB, UID:0 pgtables:1000kB oom_score_adj:0
+[  815.100000] Out of memory: Kill process 1001 (sshd) score 12 or sacrifice child
+[  815.100001] Killed process 1001 (sshd) total-vm:14000kB, anon-rss:1000kB, file-rss:0kB
+[  820.000000] Out of memory: Killed process 913 (tailscaled) total-vm:812344kB, anon-rss:402112kB
+`)
+	got := oomKilledProcs(kernelLog)
+	if want := []string{"tailscaled", "sshd"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("oomKilledProcs = %q; want %q", got, want)
+	}
+	if got := oomKilledProcs([]byte("[    0.000000] Linux version 5.15.0\n")); len(got) != 0 {
+		t.Errorf("oomKilledProcs of a log without OOM kills = %q; want none", got)
+	}
+}
+
+func TestControlHostinfo(t *testing.T) {
+	cs := &testcontrol.Server{}
+	cs.AddFakeNode()
+	n := cs.AllNodes()[0]
+	n.Hostinfo = (&tailcfg.Hostinfo{OS: "linux", DeviceModel: "test-model"}).View()
+	cs.UpdateNode(n)
+
+	h := &Harness{cs: cs}
+	hi := h.controlHostinfo(n.Key)
+	if !hi.Valid() {
+		t.Fatal("controlHostinfo returned an invalid Hostinfo for a known node")
+	}
+	if hi.OS() != "linux" || hi.DeviceModel() != "test-model" {
+		t.Errorf("controlHostinfo = %v; want OS linux and DeviceModel test-model", hi)
+	}
+	if h.controlHostinfo(key.NewNode().Public()).Valid() {
+		t.Error("controlHostinfo returned a valid Hostinfo for an unknown node")
+	}
+}
+
+func TestLogMilestoneRegexps(t *testing.T) {
+	tests := []struct {
+		rx   *regexp.Regexp
+		line string
+		want bool
+	}{
+		{derpConnectedRx, "magicsock: derp-1 connected; connGen=1", true},
+		{derpConnectedRx, "magicsock: [v1] derp-1 does not know about peer [abc], removing route", false},
+		{loginSucceededRx, "control: RegisterReq: got response; nodeKeyExpired=false, machineAuthorized=true; authURL=false", true},
+		{loginSucceededRx, "control: RegisterReq: got response; nodeKeyExpired=false, machineAuthorized=false; authURL=true", false},
+	}
+	for _, tt := range tests {
+		if got := tt.rx.MatchString(tt.line); got != tt.want {
+			t.Errorf("%#q matching %q = %v; want %v", tt.rx, tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestGuestClockSkew(t *testing.T) {
+	before := time.Unix(1650000000, 200e6)
+	after := before.Add(600 * time.Millisecond)
+	tests := []struct {
+		out     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{out: "1650000000\n", want: 0},
+		{out: "1650000090\n", want: 90 * time.Second},
+		{out: "1649996400", want: -time.Hour},
+		{out: "Thu Apr 14 UTC 2022", wantErr: true},
+		{out: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := guestClockSkew([]byte(tt.out), before, after)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("guestClockSkew(%q) error = %v; want error %v", tt.out, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("guestClockSkew(%q) = %v; want %v", tt.out, got, tt.want)
+		}
+	}
+}
+
+func TestUserData(t *testing.T) {
+	for _, pm := range []string{"", "apt", "apk", "dnf", "yum", "zypper", "ostree", "transactional-update"} {
+		d := Distro{Name: "test-" + pm, PackageManager: pm}
+		got, err := userData(d, "ssh-ed25519 AAAA test\n", "http://52.52.0.2:8081", 2222)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, runcmd, ok := strings.Cut(got, "\nruncmd:\n")
+		if !ok {
+			t.Fatalf("%s: user-data has no runcmd:\n%s", d.Name, got)
+		}
+		var steps []string
+		for _, line := range strings.Split(runcmd, "\n") {
+			if strings.TrimSpace(line) != "" {
+				steps = append(steps, line)
+			}
+		}
+		if steps[0] != " - set -e" {
+			t.Errorf("%s: runcmd starts with %q; want set -e so a failed install stops it before /myip", d.Name, steps[0])
+		}
+		wantMyIP := fmt.Sprintf(`until curl -fsS --max-time 10 "http://52.52.0.2:8081/myip/2222" -H "User-Agent: %s"; do [ $n -lt %d ] || exit 1;`, d.Name, myIPAttempts)
+		if last := steps[len(steps)-1]; !strings.Contains(last, wantMyIP) {
+			t.Errorf("%s: last runcmd step is %q; want it to retry /myip with %q", d.Name, last, wantMyIP)
+		}
+		if pm != "" && len(steps) < 3 {
+			t.Errorf("%s: runcmd has no install steps between set -e and /myip:\n%s", d.Name, runcmd)
+		}
+	}
+}
+
+func TestQemuNetArgs(t *testing.T) {
+	got, err := qemuNetArgs("user", 2222, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "user,hostfwd=::2222-:22,id=net0"; got[1] != want {
+		t.Errorf("user netdev = %q; want %q", got[1], want)
+	}
+
+	tap, mac := newTapName()
+	if len(tap) > 15 {
+		t.Errorf("tap name %q is longer than Linux allows", tap)
+	}
+	if _, err := net.ParseMAC(mac); err != nil {
+		t.Errorf("bad MAC %q: %v", mac, err)
+	}
+	if tap2, mac2 := newTapName(); tap2 == tap || mac2 == mac {
+		t.Errorf("newTapName returned %q, %q twice", tap, mac)
+	}
+	got, err = qemuNetArgs("tap", 2222, tap, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "tap,ifname=" + tap + ",script=no,downscript=no,id=net0"; got[1] != want {
+		t.Errorf("tap netdev = %q; want %q", got[1], want)
+	}
+	if !strings.HasSuffix(got[3], "mac="+mac) {
+		t.Errorf("tap device = %q; want it to use MAC %s", got[3], mac)
+	}
+
+	if _, err := qemuNetArgs("bridge", 2222, "", ""); err == nil {
+		t.Error("unknown mode succeeded")
+	}
+}
+
+func TestGuestAccel(t *testing.T) {
+	oldKVMUsable := kvmUsable
+	defer func() { kvmUsable = oldKVMUsable }()
+
+	d := Distro{Name: "test", Arch: runtime.GOARCH}
+	kvmUsable = func() error { return nil }
+	if accel, err := guestAccel(t.Logf, d, true); err != nil || accel != "kvm" {
+		t.Errorf("with KVM: guestAccel = %q, %v; want kvm", accel, err)
+	}
+
+	kvmUsable = func() error { return os.ErrPermission }
+	var warned bool
+	logf := func(format string, args ...interface{}) {
+		if strings.HasPrefix(format, "WARNING:") {
+			warned = true
+		}
+	}
+	if accel, err := guestAccel(logf, d, false); err != nil || accel != "tcg" {
+		t.Errorf("without KVM: guestAccel = %q, %v; want tcg", accel, err)
+	}
+	if !warned {
+		t.Error("guestAccel fell back to TCG without a warning")
+	}
+	if accel, err := guestAccel(t.Logf, d, true); err == nil {
+		t.Errorf("without KVM and with --require-kvm: guestAccel = %q; want error", accel)
+	}
+
+	foreign := Distro{Name: "foreign", Arch: "arm64"}
+	if runtime.GOARCH == "arm64" {
+		foreign.Arch = "amd64"
+	}
+	kvmUsable = func() error { return nil }
+	if accel, err := guestAccel(t.Logf, foreign, false); err == nil {
+		t.Errorf("foreign arch: guestAccel = %q; want error", accel)
+	}
+}
+
+func TestQemuMachine(t *testing.T) {
+	d := Distro{Name: "test", Arch: "amd64"}
+	for _, tt := range []struct {
+		accel   string
+		machine string
+		cpu     string
+	}{
+		{"kvm", "q35,accel=kvm,usb=off,vmport=off,dump-guest-core=off", "host"},
+		{"tcg", "q35,accel=tcg,usb=off,vmport=off,dump-guest-core=off", "max"},
+	} {
+		qemu, args := qemuMachine(t, d, tt.accel)
+		if qemu != "qemu-system-x86_64" {
+			t.Errorf("%s: qemu = %q", tt.accel, qemu)
+		}
+		if want := []string{"-machine", tt.machine, "-cpu", tt.cpu}; !reflect.DeepEqual(args, want) {
+			t.Errorf("%s: args = %q; want %q", tt.accel, args, want)
+		}
+	}
+}
+
+func TestSSHTimeoutFor(t *testing.T) {
+	d := Distro{Name: "test", PackageManager: "apt"}
+	kvm, tcg := &Harness{accel: "kvm"}, &Harness{accel: "tcg"}
+	if got, want := tcg.sshTimeoutFor(d), kvm.sshTimeoutFor(d)*tcgSlowdown; got != want {
+		t.Errorf("TCG sshTimeoutFor = %v; want %v", got, want)
+	}
+}
+
+func TestReadDERPMap(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	dm, err := readDERPMap(write("good.json", `{"Regions":{"900":{"RegionID":900,"RegionCode":"far","Nodes":[{"Name":"900a","RegionID":900,"HostName":"derp.example.com"}]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := dm.Regions[900]; r == nil || r.RegionCode != "far" || len(r.Nodes) != 1 {
+		t.Errorf("readDERPMap = %+v; want region 900 (far) with one node", dm.Regions)
+	}
+
+	for name, data := range map[string]string{
+		"empty.json":   `{"Regions":{}}`,
+		"notjson.json": `Regions: 900`,
+	} {
+		if _, err := readDERPMap(write(name, data)); err == nil {
+			t.Errorf("readDERPMap(%s) succeeded; want error", name)
+		}
+	}
+	if _, err := readDERPMap(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("readDERPMap of a missing file succeeded")
+	}
+}
+
+func TestIPMappingSSHAddr(t *testing.T) {
+	if got, want := (ipMapping{port: 2222, ip: "192.168.1.5"}).sshAddr(), "127.0.0.1:2222"; got != want {
+		t.Errorf("user-mode sshAddr = %q; want %q", got, want)
+	}
+	if got, want := (ipMapping{port: 2222, ip: "192.168.122.40", bridged: true}).sshAddr(), "192.168.122.40:22"; got != want {
+		t.Errorf("bridged sshAddr = %q; want %q", got, want)
+	}
+}
+
+func TestReservePort(t *testing.T) {
+	seen := map[int]bool{}
+	for i := 0; i < 20; i++ {
+		port, ln, err := reservePort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Release it straight away so the OS is free to hand the same
+		// number out again.
+		ln.Close()
+		if seen[port] {
+			t.Fatalf("port %d handed out twice", port)
+		}
+		seen[port] = true
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "image.qcow2", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "image.partial")
+	if err := os.WriteFile(path, content[:1000], 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumeDownload(ts.URL, path); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ranges, []string{"bytes=1000-"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("requested ranges %q; want %q", got, want)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("resumed download is %d bytes and doesn't match the original %d bytes", len(got), len(content))
+	}
+
+	// Resuming a complete file leaves it alone.
+	if err := resumeDownload(ts.URL, path); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("complete download changed by resuming: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	calls := 0
+	err := retryWithBackoff(t.Logf, "test", time.Minute, time.Millisecond, func() error {
+		calls++
+		if calls < 4 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil || calls != 4 {
+		t.Errorf("retryWithBackoff = %v after %d calls; want success after 4", err, calls)
+	}
+
+	errLast := errors.New("handshake failed")
+	calls = 0
+	start := time.Now()
+	err = retryWithBackoff(t.Logf, "test", 50*time.Millisecond, 10*time.Millisecond, func() error {
+		calls++
+		return errLast
+	})
+	if !errors.Is(err, errLast) {
+		t.Fatalf("retryWithBackoff = %v; want it to wrap the last error", err)
+	}
+	if want := fmt.Sprintf("after %d attempts", calls); !strings.Contains(err.Error(), want) {
+		t.Errorf("retryWithBackoff = %q; want it to say %q", err, want)
+	}
+	if calls < 2 {
+		t.Errorf("made %d attempts; want more than one", calls)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("took %v to give up after 50ms", d)
+	}
+}
+
+func TestDecompressImage(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	sum := sha256.Sum256(content)
+	wantHash := hex.EncodeToString(sum[:])
+
+	compressors := map[string]func(w io.Writer) io.WriteCloser{
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"zstd": func(w io.Writer) io.WriteCloser {
+			zw, err := zstd.NewWriter(w)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return zw
+		},
+	}
+	for _, compression := range []string{"gzip", "zstd", "xz"} {
+		t.Run(compression, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "image.qcow2."+compression)
+			if compress, ok := compressors[compression]; ok {
+				var buf bytes.Buffer
+				w := compress(&buf)
+				w.Write(content)
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(src, buf.Bytes(), 0666); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				if _, err := exec.LookPath("xz"); err != nil {
+					t.Skip("xz not found in $PATH")
+				}
+				cmd := exec.Command("xz", "--compress", "--stdout")
+				cmd.Stdin = bytes.NewReader(content)
+				out, err := cmd.Output()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(src, out, 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dst := filepath.Join(dir, "image.qcow2")
+			hash, err := decompressImage(compression, src, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hash != wantHash {
+				t.Errorf("hash = %s; want %s", hash, wantHash)
+			}
+			got, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("decompressed image is %d bytes and doesn't match the original %d bytes", len(got), len(content))
+			}
+		})
+	}
+
+	src := filepath.Join(t.TempDir(), "image.qcow2.lz4")
+	if err := os.WriteFile(src, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decompressImage("lz4", src, src+".out"); err == nil {
+		t.Error("decompressImage accepted unknown compression lz4")
+	}
+}
+
+var (
+	// derpConnectedRx matches magicsock's log line for a connection to
+	// a DERP server being established.
+	derpConnectedRx = regexp.MustCompile(`derp-\d+ connected`)
+	// loginSucceededRx matches controlclient's log line for control
+	// accepting the node's registration.
+	loginSucceededRx = regexp.MustCompile(`RegisterReq: got response; nodeKeyExpired=false, machineAuthorized=true`)
+)
+
 // run runs a command or fails the test.
 func run(t *testing.T, dir, prog string, args ...string) {
 	t.Helper()
@@ -114,6 +700,34 @@ func mkLayeredQcow(t *testing.T, tdir string, d Distro, qcowBase string) {
 	userDataTempl = template.Must(template.New("user-data.yaml").Parse(userDataTemplate))
 )
 
+// userData returns the cloud-init user-data for d's guest. Its runcmd
+// stops at the first step that fails, so that the guest only reports
+// its address to the harness at /myip once it's ready to be tested,
+// and retries that report for a while.
+func userData(d Distro, sshKey, hostURL string, port int) (string, error) {
+	var buf bytes.Buffer
+	err := userDataTempl.Execute(&buf, struct {
+		SSHKey           string
+		HostURL          string
+		Hostname         string
+		Port             int
+		InstallPre       string
+		Password         string
+		MyIPAttempts     int
+		MyIPRetrySeconds int
+	}{
+		SSHKey:           strings.TrimSpace(sshKey),
+		HostURL:          hostURL,
+		Hostname:         d.Name,
+		Port:             port,
+		InstallPre:       d.InstallPre(),
+		Password:         securePassword,
+		MyIPAttempts:     myIPAttempts,
+		MyIPRetrySeconds: myIPRetrySeconds,
+	})
+	return buf.String(), err
+}
+
 // mkSeed makes the cloud-init seed ISO that is used to configure a VM with
 // tailscale.
 func mkSeed(t *testing.T, d Distro, sshKey, hostURL, tdir string, port int) {
@@ -148,32 +762,11 @@ func mkSeed(t *testing.T, d Distro, sshKey, hostURL, tdir string, port int) {
 
 	// make user-data
 	{
-		fout, err := os.Create(filepath.Join(dir, "user-data"))
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		err = userDataTempl.Execute(fout, struct {
-			SSHKey     string
-			HostURL    string
-			Hostname   string
-			Port       int
-			InstallPre string
-			Password   string
-		}{
-			SSHKey:     strings.TrimSpace(sshKey),
-			HostURL:    hostURL,
-			Hostname:   d.Name,
-			Port:       port,
-			InstallPre: d.InstallPre(),
-			Password:   securePassword,
-		})
+		userData, err := userData(d, sshKey, hostURL, port)
 		if err != nil {
 			t.Fatal(err)
 		}
-
-		err = fout.Close()
-		if err != nil {
+		if err := os.WriteFile(filepath.Join(dir, "user-data"), []byte(userData), 0644); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -194,37 +787,54 @@ func mkSeed(t *testing.T, d Distro, sshKey, hostURL, tdir string, port int) {
 
 // ipMapping maps a hostname, SSH port and SSH IP together
 type ipMapping struct {
-	name string
-	port int
-	ip   string
-}
-
-// getProbablyFreePortNumber does what it says on the tin, but as a side effect
-// it is a kind of racy function. Do not use this carelessly.
-//
-// This is racy because it does not "lock" the port number with the OS. The
-// "random" port number that is returned here is most likely free to use, however
-// it is difficult to be 100% sure. This function should be used with care. It
-// will probably do what you want, but it is very easy to hold this wrong.
-func getProbablyFreePortNumber() (int, error) {
-	l, err := net.Listen("tcp", ":0")
-	if err != nil {
-		return 0, err
+	name    string
+	port    int
+	ip      string
+	bridged bool // guest is on --vm-bridge rather than behind qemu's NAT
+}
+
+// sshAddr returns the host:port to SSH into the guest at: the host
+// port forwarded to it, or with --vm-network=tap, its own address.
+func (m ipMapping) sshAddr() string {
+	if m.bridged {
+		return net.JoinHostPort(m.ip, "22")
 	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(m.port))
+}
 
-	defer l.Close()
+// usedPorts is the set of port numbers reservePort has handed out in
+// this process, so that two VMs never get the same one even if the OS
+// gives it out again after the reservation is released.
+var usedPorts struct {
+	sync.Mutex
+	ports map[int]bool
+}
 
-	_, port, err := net.SplitHostPort(l.Addr().String())
-	if err != nil {
-		return 0, err
-	}
+// reservePort finds a free TCP port and reserves it by holding a
+// listener on it. The caller should close the listener just before
+// handing the port to the process that will bind it, to keep the window
+// in which something else can take it as small as possible.
+func reservePort() (port int, ln net.Listener, err error) {
+	usedPorts.Lock()
+	defer usedPorts.Unlock()
 
-	portNum, err := strconv.Atoi(port)
-	if err != nil {
-		return 0, err
+	for i := 0; i < 100; i++ {
+		ln, err := net.Listen("tcp", ":0")
+		if err != nil {
+			return 0, nil, err
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		if usedPorts.ports[port] {
+			ln.Close()
+			continue
+		}
+		if usedPorts.ports == nil {
+			usedPorts.ports = map[int]bool{}
+		}
+		usedPorts.ports[port] = true
+		return port, ln, nil
 	}
-
-	return portNum, nil
+	return 0, nil, errors.New("can't find a port that hasn't already been handed out")
 }
 
 func setupTests(t *testing.T) {
@@ -238,7 +848,7 @@ func setupTests(t *testing.T) {
 
 	os.Setenv("CGO_ENABLED", "0")
 
-	if _, err := exec.LookPath("qemu-system-x86_64"); err != nil {
+	if _, err := exec.LookPath(qemuSystem[runtime.GOARCH]); err != nil {
 		t.Logf("hint: nix-shell -p go -p qemu -p cdrkit --run 'go test --v --timeout=60m --run-vm-tests'")
 		t.Fatalf("missing dependency: %v", err)
 	}
@@ -249,6 +859,85 @@ func setupTests(t *testing.T) {
 	}
 }
 
+// kvmUsable returns why the host can't run guests under KVM, or nil
+// if it can. It's a var for tests.
+var kvmUsable = func() error {
+	fi, err := os.Stat("/dev/kvm")
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeDevice == 0 {
+		return errors.New("/dev/kvm isn't a device")
+	}
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return nil
+}
+
+// guestAccel returns the qemu accelerator to run d's guest with: "kvm"
+// if the host can, or else "tcg" software emulation, unless requireKVM
+// is set. Emulating a foreign architecture is far too slow for the
+// test timeouts, so that's always an error.
+func guestAccel(logf logger.Logf, d Distro, requireKVM bool) (string, error) {
+	if d.GoArch() != runtime.GOARCH {
+		return "", fmt.Errorf("KVM can't run %s guests on a %s host", d.GoArch(), runtime.GOARCH)
+	}
+	if err := kvmUsable(); err != nil {
+		if requireKVM {
+			return "", fmt.Errorf("KVM isn't usable and --require-kvm is set: %v", err)
+		}
+		logf("WARNING: KVM isn't usable (%v); running %s under TCG software emulation, which is several times slower, so timeouts are %dx longer. Set --require-kvm to skip instead.", err, d.Name, tcgSlowdown)
+		return "tcg", nil
+	}
+	return "kvm", nil
+}
+
+// tcgSlowdown is how many times longer the harness waits for a guest
+// running under TCG than for one under KVM.
+const tcgSlowdown = 4
+
+// slowdown scales timeout for how h's guest is being run.
+func (h *Harness) slowdown(timeout time.Duration) time.Duration {
+	if h.accel == "tcg" {
+		return timeout * tcgSlowdown
+	}
+	return timeout
+}
+
+// testerOptsFromFlags returns the tester node's settings per the
+// --tester-derp-map and --tester-derp-only flags.
+func testerOptsFromFlags(t *testing.T) testerOpts {
+	t.Helper()
+	opts := testerOpts{DERPOnly: *testerDERPOnly}
+	if *testerDERPMap != "" {
+		dm, err := readDERPMap(*testerDERPMap)
+		if err != nil {
+			t.Fatalf("--tester-derp-map: %v", err)
+		}
+		opts.DERPMap = dm
+	}
+	return opts
+}
+
+// readDERPMap reads a DERP map from the JSON file at path.
+func readDERPMap(path string) (*tailcfg.DERPMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dm := new(tailcfg.DERPMap)
+	if err := json.Unmarshal(data, dm); err != nil {
+		return nil, fmt.Errorf("can't parse DERP map in %s: %v", path, err)
+	}
+	if len(dm.Regions) == 0 {
+		return nil, fmt.Errorf("DERP map in %s has no regions", path)
+	}
+	return dm, nil
+}
+
 var ramsem struct {
 	once sync.Once
 	sem  *semaphore.Weighted
@@ -262,23 +951,42 @@ func testOneDistribution(t *testing.T, n int, distro Distro) {
 	} else {
 		t.Skip("regex not matched")
 	}
+	accel, err := guestAccel(t.Logf, distro, *requireKVM)
+	if err != nil {
+		t.Skipf("can't run %s: %v", distro.Name, err)
+	}
 
 	ctx, done := context.WithCancel(context.Background())
 	t.Cleanup(done)
 
-	h := newHarness(t)
+	h := newHarness(t, testerOptsFromFlags(t))
+	h.accel = accel
+	h.xfail = distro.ExpectedFailures
+	h.smoke = *smoke
+	h.result = &distroResult{Name: distro.Name}
+	t.Cleanup(func() {
+		h.result.Result = testResult(t)
+		addResult(h.result)
+	})
 	dir := t.TempDir()
 
-	err := ramsem.sem.Acquire(ctx, int64(distro.MemoryMegs))
+	err = ramsem.sem.Acquire(ctx, int64(distro.MemoryMegs))
 	if err != nil {
 		t.Fatalf("can't acquire ram semaphore: %v", err)
 	}
 	t.Cleanup(func() { ramsem.sem.Release(int64(distro.MemoryMegs)) })
 
-	vm := h.mkVM(t, n, distro, h.pubKey, h.loginServerURL, dir)
+	bootStart := time.Now()
+	vm := h.mkVM(t, n, distro, h.pubKey, h.hostURL, dir)
 	vm.waitStartup(t)
+	ipm := h.waitForIPMap(t, vm, distro)
+	h.result.BootTime = reportDuration(time.Since(bootStart))
 
-	h.testDistro(t, distro, h.waitForIPMap(t, vm, distro))
+	if distro.GoOS() == "windows" {
+		h.testWindowsDistro(t, distro, ipm)
+		return
+	}
+	h.testDistro(t, distro, ipm)
 }
 
 func (h *Harness) waitForIPMap(t *testing.T, vm *vmInstance, distro Distro) ipMapping {
@@ -309,10 +1017,9 @@ func (h *Harness) setupSSHShell(t *testing.T, d Distro, ipm ipMapping) (*ssh.Cli
 	signer := h.signer
 
 	t.Helper()
-	port := ipm.port
-	hostport := fmt.Sprintf("127.0.0.1:%d", port)
+	hostport := ipm.sshAddr()
 	ccfg := &ssh.ClientConfig{
-		User:            "root",
+		User:            d.SSHUser(),
 		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer), ssh.Password(securePassword)},
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
@@ -321,52 +1028,151 @@ func (h *Harness) setupSSHShell(t *testing.T, d Distro, ipm ipMapping) (*ssh.Cli
 	// sometimes is slow at starting its sshd and will sometimes randomly kill
 	// SSH sessions on transition to multi-user.target. I don't know why they
 	// don't use socket activation.
-	const maxRetries = 5
-	var working bool
-	for i := 0; i < maxRetries; i++ {
-		cli, err := ssh.Dial("tcp", hostport, ccfg)
-		if err == nil {
-			working = true
-			cli.Close()
-			break
-		}
+	timeout := h.sshTimeoutFor(d)
+	cli, err := dialSSH(t, hostport, ccfg, timeout)
+	if err != nil {
+		t.Fatalf("can't connect to %s: %v", hostport, err)
+	}
+	cli.Close()
+
+	if d.Immutable() {
+		rebootIntoNewDeployment(t, hostport, ccfg, timeout)
+	}
+
+	t.Logf("about to ssh into %s", hostport)
+	cli, err = ssh.Dial("tcp", hostport, ccfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.GoOS() == "windows" {
+		h.copyWindowsBinaries(t, d, cli)
+	} else {
+		h.copyBinaries(t, d, cli)
+	}
+
+	return ccfg, cli
+}
 
-		time.Sleep(10 * time.Second)
+// sshTimeoutFor returns how long to keep trying to SSH into d's guest:
+// the --ssh-timeout flag if set, or else d.SSHTimeout, relaxed for TCG.
+func (h *Harness) sshTimeoutFor(d Distro) time.Duration {
+	if *sshTimeout != 0 {
+		return *sshTimeout
 	}
+	return h.slowdown(d.SSHTimeout())
+}
 
-	if !working {
-		t.Fatalf("can't connect to %s, tried %d times", hostport, maxRetries)
+// sshMaxBackoff caps the wait between attempts to SSH into a guest.
+const sshMaxBackoff = 15 * time.Second
+
+// dialSSH dials hostport, retrying with backoff until it succeeds or
+// timeout passes.
+func dialSSH(t *testing.T, hostport string, ccfg *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	var cli *ssh.Client
+	err := retryWithBackoff(t.Logf, "ssh "+hostport, timeout, sshMaxBackoff, func() (err error) {
+		cli, err = ssh.Dial("tcp", hostport, ccfg)
+		return err
+	})
+	return cli, err
+}
+
+// retryWithBackoff calls f until it succeeds or timeout passes, backing
+// off between attempts by up to maxBackoff. Once out of time, it
+// returns an error saying how many attempts it made, wrapping the last
+// one's error.
+func retryWithBackoff(logf logger.Logf, name string, timeout, maxBackoff time.Duration, f func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	bo := backoff.NewBackoff(name, logf, maxBackoff)
+	bo.LogLongerThan = time.Second
+	for attempts := 1; ; attempts++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("gave up after %d attempts in %v; last error: %w", attempts, timeout, err)
+		}
+		// Once ctx expires this returns early, for one last attempt.
+		bo.BackOff(ctx, err)
 	}
+}
+
+// rebootIntoNewDeployment reboots an immutable distro into the
+// deployment or snapshot with the packages installed by its InstallPre,
+// then waits up to timeout for SSH to come back and checks that
+// iptables is there.
+func rebootIntoNewDeployment(t *testing.T, hostport string, ccfg *ssh.ClientConfig, timeout time.Duration) {
+	t.Helper()
 
-	t.Logf("about to ssh into 127.0.0.1:%d", port)
 	cli, err := ssh.Dial("tcp", hostport, ccfg)
 	if err != nil {
 		t.Fatal(err)
 	}
-	h.copyBinaries(t, d, cli)
+	sess, err := cli.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The connection usually drops before reboot returns, so the error
+	// here says nothing useful.
+	sess.Run("systemctl reboot")
+	cli.Close()
 
-	return ccfg, cli
+	t.Log("rebooting into the new deployment")
+	time.Sleep(10 * time.Second)
+
+	cli, err = dialSSH(t, hostport, ccfg, timeout)
+	if err != nil {
+		t.Fatalf("can't connect to %s after reboot: %v", hostport, err)
+	}
+	defer cli.Close()
+
+	sess, err = cli.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outp, err := sess.CombinedOutput("command -v iptables"); err != nil {
+		t.Fatalf("iptables missing after reboot: %v, output: %s", err, outp)
+	}
 }
 
 func (h *Harness) testDistro(t *testing.T, d Distro, ipm ipMapping) {
 	loginServer := h.loginServerURL
 	ccfg, cli := h.setupSSHShell(t, d, ipm)
 
-	timeout := 30 * time.Second
+	timeout := h.slowdown(30 * time.Second)
+
+	// Cloud images don't always have tidy hostnames, so give the guest a
+	// messy one before tailscaled starts and make sure it gets sanitized
+	// into a usable DNS label below. Writing to /proc sidesteps any
+	// validation the distro's hostname(1) might do.
+	const weirdHostname = "Weird.Host_01"
+	h.runUnlessSmoke(t, "set-os-hostname", func(t *testing.T) {
+		sess := getSession(t, cli)
+		cmd := fmt.Sprintf("echo %s > /proc/sys/kernel/hostname && hostname", weirdHostname)
+		outp, err := sess.CombinedOutput(cmd)
+		if err != nil {
+			t.Fatalf("%s: %v, output: %s", cmd, err, outp)
+		}
+		if got := strings.TrimSpace(string(outp)); got != weirdHostname {
+			t.Fatalf("guest hostname is %q; want %q", got, weirdHostname)
+		}
+	})
+
+	// A guest clock that's far off breaks TLS to the control server,
+	// which would otherwise only show up as a confusing login failure.
+	h.runUnlessSmoke(t, "clock-skew", func(t *testing.T) {
+		checkGuestClock(t, d, cli)
+	})
 
-	t.Run("start-tailscale", func(t *testing.T) {
+	h.run(t, "start-tailscale", func(t *testing.T) {
 		var batch = []expect.Batcher{
 			&expect.BExp{R: `(\#)`},
 		}
 
 		switch d.InitSystem {
 		case "openrc":
-			// NOTE(Xe): this is a sin, however openrc doesn't really have the concept
-			// of service readiness. If this sleep is removed then tailscale will not be
-			// ready once the `tailscale up` command is sent. This is not ideal, but I
-			// am not really sure there is a good way around this without a delay of
-			// some kind.
-			batch = append(batch, &expect.BSnd{S: "rc-service tailscaled start && sleep 2\n"})
+			batch = append(batch, &expect.BSnd{S: "rc-service tailscaled start\n"})
 		case "systemd":
 			batch = append(batch, &expect.BSnd{S: "systemctl start tailscaled.service\n"})
 		}
@@ -374,17 +1180,26 @@ func (h *Harness) testDistro(t *testing.T, d Distro, ipm ipMapping) {
 		batch = append(batch, &expect.BExp{R: `(\#)`})
 
 		runTestCommands(t, timeout, cli, batch)
+
+		// Neither init system waits for tailscaled to be listening
+		// before it returns (openrc has no notion of readiness at
+		// all), so wait for it before the login below.
+		awaitTailscaledReady(t, cli, timeout)
 	})
 
-	t.Run("login", func(t *testing.T) {
+	loginStart := time.Now()
+	h.run(t, "login", func(t *testing.T) {
 		runTestCommands(t, timeout, cli, []expect.Batcher{
 			&expect.BSnd{S: fmt.Sprintf("tailscale up --login-server=%s\n", loginServer)},
 			&expect.BSnd{S: "echo Success.\n"},
 			&expect.BExp{R: `Success.`},
 		})
 	})
+	if h.result != nil {
+		h.result.LoginTime = reportDuration(time.Since(loginStart))
+	}
 
-	t.Run("tailscale status", func(t *testing.T) {
+	h.run(t, "tailscale status", func(t *testing.T) {
 		dur := 100 * time.Millisecond
 		var outp []byte
 		var err error
@@ -399,8 +1214,8 @@ func (h *Harness) testDistro(t *testing.T, d Distro, ipm ipMapping) {
 			outp, err = sess.CombinedOutput("tailscale status")
 			if err == nil {
 				t.Logf("tailscale status: %s", outp)
-				if !strings.Contains(string(outp), "100.64.0.1") {
-					t.Fatal("can't find tester IP")
+				if !strings.Contains(string(outp), h.testerV4.String()) {
+					t.Fatalf("can't find tester IP %v", h.testerV4)
 				}
 				return
 			}
@@ -411,8 +1226,102 @@ func (h *Harness) testDistro(t *testing.T, d Distro, ipm ipMapping) {
 		t.Log(string(outp))
 		t.Fatalf("error: %v", err)
 	})
+	if h.smoke {
+		return
+	}
+
+	h.run(t, "sanitized-hostname", func(t *testing.T) {
+		h.needEmbeddedControl(t)
+		const want = "weird-host-01"
+		for _, n := range h.cs.AllNodes() {
+			if n.Hostinfo.Hostname() != weirdHostname {
+				continue
+			}
+			if got := dnsname.SanitizeHostname(n.Hostinfo.Hostname()); got != want {
+				t.Fatalf("SanitizeHostname(%q) = %q; want %q", weirdHostname, got, want)
+			}
+			return
+		}
+		t.Fatalf("no node registered with control reported hostname %q", weirdHostname)
+	})
+
+	// What each node reports about itself in Hostinfo has to make it to
+	// control intact, whichever distro it's coming from.
+	h.run(t, "hostinfo", func(t *testing.T) {
+		nk, ok := h.guestNodeKey(t, cli)
+		if !ok {
+			t.Fatal("control doesn't know the guest's node key")
+		}
+		hi := h.controlHostinfo(nk)
+		if !hi.Valid() {
+			t.Fatal("control has no Hostinfo for the guest")
+		}
+		if got := hi.OS(); got != "linux" {
+			t.Errorf("guest reported OS %q; want %q", got, "linux")
+		}
+		if hi.OSVersion() == "" {
+			t.Error("guest reported an empty OSVersion")
+		}
+		if hi.IPNVersion() == "" {
+			t.Error("guest reported an empty IPNVersion")
+		}
+		if !h.controlHostinfo(h.testerNodeKey).Valid() {
+			t.Error("control has no Hostinfo for the tester")
+		}
+	})
+
+	h.run(t, "log-upload", func(t *testing.T) {
+		h.needEmbeddedControl(t)
+		deadline := time.Now().Add(time.Minute)
+		for h.lc.NumRequests() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("no logs were uploaded to %s by tailscaled on the guest", loginServer)
+			}
+			time.Sleep(time.Second)
+		}
+		t.Logf("got %d log upload requests from the guest", h.lc.NumRequests())
+	})
+
+	// The logs are otherwise only useful when reading a failed run by
+	// hand, so check the milestones a working node always logs.
+	h.run(t, "logged-derp-and-login", func(t *testing.T) {
+		for _, node := range []string{"guest", "tester"} {
+			h.awaitLogLine(t, node, derpConnectedRx, time.Minute)
+			h.awaitLogLine(t, node, loginSucceededRx, time.Minute)
+		}
+	})
+
+	// The shipped CLI must reject these the same way prefsFromUpArgs
+	// does in the cli package tests, regardless of which distro it's on.
+	h.run(t, "reject-bad-up-flags", func(t *testing.T) {
+		for _, tt := range []struct {
+			flags   string
+			wantErr string
+		}{
+			{"--exit-node-allow-lan-access", "--exit-node-allow-lan-access can only be used with --exit-node"},
+			{"--advertise-routes=0.0.0.0/0", "0.0.0.0/0 advertised without its IPv6 counterpart"},
+			{"--advertise-routes=::/0", "::/0 advertised without its IPv6 counterpart"},
+			{"--advertise-routes=1.2.3.4/16", "1.2.3.4/16 has non-address bits set; expected 1.2.0.0/16"},
+			{"--advertise-routes=foo", `"foo" is not a valid IP address or CIDR prefix`},
+			{"--advertise-tags=foo", "tags must start with 'tag:'"},
+			{"--netfilter-mode=bogus", `invalid value --netfilter-mode="bogus"`},
+		} {
+			t.Run(tt.flags, func(t *testing.T) {
+				sess := getSession(t, cli)
+				cmd := fmt.Sprintf("tailscale up --login-server=%s %s", loginServer, tt.flags)
+				outp, err := sess.CombinedOutput(cmd)
+				var exitErr *ssh.ExitError
+				if !errors.As(err, &exitErr) || exitErr.ExitStatus() == 0 {
+					t.Fatalf("%s: wanted non-zero exit status, got err=%v, output: %s", cmd, err, outp)
+				}
+				if !strings.Contains(string(outp), tt.wantErr) {
+					t.Fatalf("%s: wanted output to contain %q, got: %s", cmd, tt.wantErr, outp)
+				}
+			})
+		}
+	})
 
-	t.Run("dump routes", func(t *testing.T) {
+	h.run(t, "dump routes", func(t *testing.T) {
 		sess, err := cli.NewSession()
 		if err != nil {
 			t.Fatal(err)
@@ -438,13 +1347,27 @@ func (h *Harness) testDistro(t *testing.T, d Distro, ipm ipMapping) {
 		}
 	})
 
+	// Recorded in the summary rather than checked, so that failures
+	// of the connectivity steps below can be read against the guest's
+	// network.
+	h.run(t, "netcheck", func(t *testing.T) {
+		h.testNetcheck(t, cli)
+	})
+
 	for _, tt := range []struct {
 		ipProto string
 		addr    netaddr.IP
 	}{
 		{"ipv4", h.testerV4},
+		{"ipv6", h.testerV6},
 	} {
-		t.Run(tt.ipProto+"-address", func(t *testing.T) {
+		needStack := func(t *testing.T) {
+			if tt.ipProto == "ipv6" {
+				needGuestIPv6(t, cli)
+			}
+		}
+
+		h.run(t, tt.ipProto+"-address", func(t *testing.T) {
 			sess := getSession(t, cli)
 
 			ipBytes, err := sess.Output("tailscale ip -" + string(tt.ipProto[len(tt.ipProto)-1]))
@@ -452,63 +1375,85 @@ func (h *Harness) testDistro(t *testing.T, d Distro, ipm ipMapping) {
 				t.Fatalf("can't get IP: %v", err)
 			}
 
-			netaddr.MustParseIP(string(bytes.TrimSpace(ipBytes)))
+			got := netaddr.MustParseIP(string(bytes.TrimSpace(ipBytes)))
+			if h.cs == nil {
+				return
+			}
+			nk, ok := h.guestNodeKey(t, cli)
+			if !ok {
+				t.Fatal("control doesn't know the guest's node key")
+			}
+			if want, ok := h.assignedIP(nk, tt.ipProto == "ipv6"); !ok || got != want {
+				t.Fatalf("guest says its address is %v, but control assigned it %v", got, want)
+			}
 		})
 
-		t.Run("ping-"+tt.ipProto, func(t *testing.T) {
+		h.run(t, "ping-"+tt.ipProto, func(t *testing.T) {
+			needStack(t)
 			h.testPing(t, tt.addr, cli)
 		})
 
-		t.Run("outgoing-tcp-"+tt.ipProto, func(t *testing.T) {
+		h.run(t, "ping-paths-"+tt.ipProto, func(t *testing.T) {
+			needStack(t)
+			h.testPingPaths(t, tt.addr, cli)
+		})
+
+		h.run(t, "outgoing-tcp-"+tt.ipProto, func(t *testing.T) {
+			needStack(t)
 			h.testOutgoingTCP(t, tt.addr, cli)
 		})
 	}
 
-	t.Run("incoming-ssh-ipv4", func(t *testing.T) {
-		sess, err := cli.NewSession()
-		if err != nil {
-			t.Fatalf("can't make incoming session: %v", err)
-		}
-		defer sess.Close()
-		ipBytes, err := sess.Output("tailscale ip -4")
-		if err != nil {
-			t.Fatalf("can't run `tailscale ip -4`: %v", err)
-		}
-		ip := string(bytes.TrimSpace(ipBytes))
+	for _, ipv := range []string{"4", "6"} {
+		h.run(t, "incoming-ssh-ipv"+ipv, func(t *testing.T) {
+			if ipv == "6" {
+				needGuestIPv6(t, cli)
+			}
+			sess, err := cli.NewSession()
+			if err != nil {
+				t.Fatalf("can't make incoming session: %v", err)
+			}
+			defer sess.Close()
+			ipBytes, err := sess.Output("tailscale ip -" + ipv)
+			if err != nil {
+				t.Fatalf("can't run `tailscale ip -%s`: %v", ipv, err)
+			}
+			ip := string(bytes.TrimSpace(ipBytes))
 
-		conn, err := h.testerDialer.Dial("tcp", net.JoinHostPort(ip, "22"))
-		if err != nil {
-			t.Fatalf("can't dial connection to vm: %v", err)
-		}
-		defer conn.Close()
-		conn.SetDeadline(time.Now().Add(30 * time.Second))
+			conn, err := h.testerDialer.Dial("tcp", net.JoinHostPort(ip, "22"))
+			if err != nil {
+				t.Fatalf("can't dial connection to vm: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(30 * time.Second))
 
-		sshConn, chanchan, reqchan, err := ssh.NewClientConn(conn, net.JoinHostPort(ip, "22"), ccfg)
-		if err != nil {
-			t.Fatalf("can't negotiate connection over tailscale: %v", err)
-		}
-		defer sshConn.Close()
+			sshConn, chanchan, reqchan, err := ssh.NewClientConn(conn, net.JoinHostPort(ip, "22"), ccfg)
+			if err != nil {
+				t.Fatalf("can't negotiate connection over tailscale: %v", err)
+			}
+			defer sshConn.Close()
 
-		cli := ssh.NewClient(sshConn, chanchan, reqchan)
-		defer cli.Close()
+			cli := ssh.NewClient(sshConn, chanchan, reqchan)
+			defer cli.Close()
 
-		sess, err = cli.NewSession()
-		if err != nil {
-			t.Fatalf("can't make SSH session with VM: %v", err)
-		}
-		defer sess.Close()
+			sess, err = cli.NewSession()
+			if err != nil {
+				t.Fatalf("can't make SSH session with VM: %v", err)
+			}
+			defer sess.Close()
 
-		testIPBytes, err := sess.Output("tailscale ip -4")
-		if err != nil {
-			t.Fatalf("can't run command on remote VM: %v", err)
-		}
+			testIPBytes, err := sess.Output("tailscale ip -" + ipv)
+			if err != nil {
+				t.Fatalf("can't run command on remote VM: %v", err)
+			}
 
-		if !bytes.Equal(testIPBytes, ipBytes) {
-			t.Fatalf("wanted reported ip to be %q, got: %q", string(ipBytes), string(testIPBytes))
-		}
-	})
+			if !bytes.Equal(testIPBytes, ipBytes) {
+				t.Fatalf("wanted reported ip to be %q, got: %q", string(ipBytes), string(testIPBytes))
+			}
+		})
+	}
 
-	t.Run("outgoing-udp-ipv4", func(t *testing.T) {
+	h.run(t, "outgoing-udp-ipv4", func(t *testing.T) {
 		cwd, err := os.Getwd()
 		if err != nil {
 			t.Fatalf("can't get working directory: %v", err)
@@ -561,7 +1506,7 @@ func (h *Harness) testDistro(t *testing.T, d Distro, ipm ipMapping) {
 
 				_, port, _ := net.SplitHostPort(ln.LocalAddr().String())
 
-				cmd := fmt.Sprintf("/udp_tester -client %s\n", net.JoinHostPort("100.64.0.1", port))
+				cmd := fmt.Sprintf("/udp_tester -client %s\n", net.JoinHostPort(h.testerV4.String(), port))
 				t.Logf("sending packet: %s", cmd)
 				err = sess.Run(cmd)
 				if err != nil {
@@ -587,10 +1532,7 @@ func (h *Harness) testDistro(t *testing.T, d Distro, ipm ipMapping) {
 		}
 	})
 
-	t.Run("incoming-udp-ipv4", func(t *testing.T) {
-		// vms_test.go:947: can't dial: socks connect udp 127.0.0.1:36497->100.64.0.2:33409: network not implemented
-		t.Skip("can't make outgoing sockets over UDP with our socks server")
-
+	h.run(t, "incoming-udp-ipv4", func(t *testing.T) {
 		sess, err := cli.NewSession()
 		if err != nil {
 			t.Fatalf("can't open session: %v", err)
@@ -602,20 +1544,35 @@ func (h *Harness) testDistro(t *testing.T, d Distro, ipm ipMapping) {
 			t.Fatalf("can't nab ipv4 address: %v", err)
 		}
 
-		port, err := getProbablyFreePortNumber()
+		// The port is for udp_tester on the guest, so the host-side
+		// reservation isn't needed.
+		port, ln, err := reservePort()
 		if err != nil {
 			t.Fatalf("unable to fetch port number: %v", err)
 		}
+		ln.Close()
 
-		go func() {
-			time.Sleep(10 * time.Millisecond)
+		conn, err := h.dialTesterUDP(net.JoinHostPort(string(bytes.TrimSpace(ip)), strconv.Itoa(port)))
+		if err != nil {
+			t.Fatalf("can't dial: %v", err)
+		}
+		defer conn.Close()
 
-			conn, err := h.testerDialer.Dial("udp", net.JoinHostPort(string(bytes.TrimSpace(ip)), strconv.Itoa(port)))
-			if err != nil {
-				t.Errorf("can't dial: %v", err)
+		// udp_tester may not be listening yet when the first datagram
+		// arrives, so keep sending until it has heard one.
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			ticker := time.NewTicker(100 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				fmt.Fprint(conn, securePassword)
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				}
 			}
-
-			fmt.Fprint(conn, securePassword)
 		}()
 
 		sess, err = cli.NewSession()
@@ -637,7 +1594,7 @@ func (h *Harness) testDistro(t *testing.T, d Distro, ipm ipMapping) {
 		}
 	})
 
-	t.Run("dns-test", func(t *testing.T) {
+	h.run(t, "dns-test", func(t *testing.T) {
 		t.Run("etc-resolv-conf", func(t *testing.T) {
 			sess := getSession(t, cli)
 			sess.Stdout = logger.FuncWriter(t.Logf)
@@ -678,6 +1635,62 @@ func (h *Harness) testDistro(t *testing.T, d Distro, ipm ipMapping) {
 			})
 		}
 	})
+
+	h.run(t, "magicdns", func(t *testing.T) {
+		h.testMagicDNS(t, cli)
+	})
+
+	h.run(t, "hardened-service", func(t *testing.T) {
+		h.testHardenedService(t, d, cli)
+	})
+
+	h.run(t, "control-url-migration", func(t *testing.T) {
+		h.testControlURLMigration(t, cli)
+	})
+
+	h.run(t, "ephemeral-cleanup", func(t *testing.T) {
+		h.testEphemeralCleanup(t, d, cli)
+	})
+
+	h.run(t, "control-down-at-boot", func(t *testing.T) {
+		h.testControlDownAtBoot(t, d, cli)
+	})
+
+	h.run(t, "second-instance", func(t *testing.T) {
+		h.testSecondInstance(t, d, cli)
+	})
+
+	h.run(t, "subnet-large-transfer", func(t *testing.T) {
+		h.testSubnetLargeTransfer(t, cli)
+	})
+
+	h.run(t, "exit-node", func(t *testing.T) {
+		h.testExitNode(t, d, cli, ipm)
+	})
+
+	h.run(t, "graceful-shutdown-offline", func(t *testing.T) {
+		h.testGracefulShutdownOffline(t, d, cli)
+	})
+
+	h.run(t, "fixed-port", func(t *testing.T) {
+		h.testFixedPort(t, d, cli)
+	})
+
+	// This stops tailscaled to make it write out its coverage data, so
+	// it must come before read-only-root, which would keep it from
+	// doing so.
+	h.run(t, "collect-coverage", func(t *testing.T) {
+		h.collectCoverage(t, d, cli)
+	})
+
+	// This remounts the guest's root read-only, so it must stay last.
+	h.run(t, "read-only-root", func(t *testing.T) {
+		h.testReadOnlyRoot(t, d, cli)
+	})
+
+	h.run(t, "tailscale-down", func(t *testing.T) {
+		h.testDown(t, d, cli)
+	})
 }
 
 func runTestCommands(t *testing.T, timeout time.Duration, cli *ssh.Client, batch []expect.Batcher) {
@@ -704,8 +1717,71 @@ func runTestCommands(t *testing.T, timeout time.Duration, cli *ssh.Client, batch
 		sess.Stderr = logger.FuncWriter(t.Logf)
 		terr = sess.Run("journalctl -u tailscaled")
 		if terr != nil {
-			t.Fatalf("can't dump tailscaled logs on failed test: %v", terr)
+			t.Fatalf("can't dump tailscaled logs on failed test: %v%s", terr, guestOOMNote(cli))
 		}
-		t.Fatalf("not successful: %v", err)
+		t.Fatalf("not successful: %v%s", err, guestOOMNote(cli))
+	}
+}
+
+// fakeImageSource is an ImageSource that has only the images in its
+// map, keyed by distro name, and records which distros it was asked for.
+type fakeImageSource struct {
+	images     map[string][]byte
+	compressed bool
+	asked      []string
+}
+
+func (s *fakeImageSource) FetchImage(t *testing.T, d Distro, path string) (ok, compressed bool) {
+	s.asked = append(s.asked, d.Name)
+	img, ok := s.images[d.Name]
+	if !ok {
+		return false, false
+	}
+	if err := os.WriteFile(path, img, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return true, s.compressed
+}
+
+func TestFetchDistroImageSources(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	content := bytes.Repeat([]byte("qcow2 image "), 1024)
+	sum := sha256.Sum256(content)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(content)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d := Distro{
+		Name:        "fake-1.0",
+		URL:         "https://example.com/fake-1.0.qcow2.gz",
+		SHA256Sum:   hex.EncodeToString(sum[:]),
+		Compression: "gzip",
+	}
+
+	missing := &fakeImageSource{}
+	mirror := &fakeImageSource{images: map[string][]byte{d.Name: gz.Bytes()}, compressed: true}
+	last := &fakeImageSource{images: map[string][]byte{d.Name: []byte("wrong image")}}
+	defer func(old []ImageSource) { imageSources = old }(imageSources)
+	imageSources = []ImageSource{missing, mirror, last}
+
+	got, err := os.ReadFile(fetchDistro(t, d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("fetched image doesn't match the mirror's")
+	}
+	if len(missing.asked) != 1 || len(mirror.asked) != 1 || len(last.asked) != 0 {
+		t.Errorf("sources asked %q, %q, %q; want the first two once each", missing.asked, mirror.asked, last.asked)
+	}
+
+	// Now it's cached, so no source is asked again.
+	fetchDistro(t, d)
+	if len(mirror.asked) != 1 {
+		t.Errorf("mirror asked %d times; want it once, before the image was cached", len(mirror.asked))
 	}
 }
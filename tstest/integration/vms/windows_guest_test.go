@@ -0,0 +1,398 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package vms
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+	"unicode/utf16"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"tailscale.com/tstest/integration"
+)
+
+/*
+   There are no Windows cloud images to download, so Windows guests boot
+   an image prepared by hand (see README.md) with OpenSSH Server and
+   cloudbase-init[1] installed. cloudbase-init reads the same NoCloud seed
+   ISO that cloud-init does, and runs user-data that starts with
+   #ps1_sysnative as a PowerShell script, which does what the cloud-init
+   runcmd does for Linux guests: authorize our SSH key and report in to
+   the harness.
+
+   There's no shell prompt for goexpect to drive, so each step runs a
+   PowerShell script in its own SSH session and checks its output and
+   exit status instead.
+
+   [1]: https://cloudbase-init.readthedocs.io/
+*/
+
+const (
+	// windowsInstallDir is where the tailscale and tailscaled binaries
+	// under test go on Windows guests, as the MSI would put them.
+	windowsInstallDir = `C:\Program Files\Tailscale`
+
+	// windowsServiceName is the name tailscaled installs its Windows
+	// service under.
+	windowsServiceName = "Tailscale"
+)
+
+// windowsUserDataTemplate is the cloudbase-init user-data for Windows
+// guests. OpenSSH Server only reads administrators' keys from
+// administrators_authorized_keys, and only if nobody else can write it.
+const windowsUserDataTemplate = `#ps1_sysnative
+$ErrorActionPreference = "Stop"
+$keys = "$env:ProgramData\ssh\administrators_authorized_keys"
+Set-Content -Path $keys -Value "{{.SSHKey}}"
+icacls.exe $keys /inheritance:r /grant "Administrators:F" /grant "SYSTEM:F" | Out-Null
+Set-Service -Name sshd -StartupType Automatic
+Start-Service sshd
+if (-not (Get-NetFirewallRule -Name ts-vm-ssh -ErrorAction SilentlyContinue)) {
+    New-NetFirewallRule -Name ts-vm-ssh -DisplayName "SSH for Tailscale VM tests" -Direction Inbound -Protocol TCP -LocalPort 22 -Action Allow | Out-Null
+}
+Invoke-WebRequest -UseBasicParsing -Uri "{{.HostURL}}/myip/{{.Port}}" -UserAgent "{{.Hostname}}" | Out-Null
+`
+
+var windowsUserDataTempl = template.Must(template.New("user-data.ps1").Parse(windowsUserDataTemplate))
+
+// windowsUserData returns the user-data for d's guest.
+func windowsUserData(d Distro, sshKey, hostURL string, port int) (string, error) {
+	var buf bytes.Buffer
+	err := windowsUserDataTempl.Execute(&buf, struct {
+		SSHKey   string
+		HostURL  string
+		Hostname string
+		Port     int
+	}{
+		SSHKey:   strings.TrimSpace(sshKey),
+		HostURL:  hostURL,
+		Hostname: d.Name,
+		Port:     port,
+	})
+	return buf.String(), err
+}
+
+// mkWindowsSeed is the Windows counterpart of mkSeed: it makes the
+// seed ISO that cloudbase-init configures the guest from.
+func mkWindowsSeed(t *testing.T, d Distro, sshKey, hostURL, tdir string, port int) {
+	t.Helper()
+
+	dir := filepath.Join(tdir, d.Name, "seed")
+	os.MkdirAll(dir, 0700)
+
+	var metaData bytes.Buffer
+	err := metaDataTempl.Execute(&metaData, struct {
+		ID       string
+		Hostname string
+	}{
+		ID:       "31337",
+		Hostname: d.Name,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "meta-data"), metaData.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	userData, err := windowsUserData(d, sshKey, hostURL, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "user-data"), []byte(userData), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	run(t, tdir, "genisoimage",
+		"-output", filepath.Join(dir, "seed.iso"),
+		"-volid", "cidata", "-joliet", "-rock",
+		filepath.Join(dir, "meta-data"),
+		filepath.Join(dir, "user-data"),
+	)
+}
+
+// powerShellCommand returns the command line that runs script with
+// PowerShell on a Windows guest. The script goes in -EncodedCommand,
+// which is base64 of its UTF-16LE encoding, so it doesn't have to
+// survive the quoting of whatever shell sshd runs it with. The script
+// stops at the first error, which makes PowerShell exit non-zero.
+func powerShellCommand(script string) string {
+	script = "$ErrorActionPreference = 'Stop'\n$ProgressPreference = 'SilentlyContinue'\n" + script
+	u := utf16.Encode([]rune(script))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return "powershell.exe -NoProfile -NonInteractive -EncodedCommand " + base64.StdEncoding.EncodeToString(b)
+}
+
+// runPowerShell runs script on the Windows guest at the other end of
+// cli, returning its combined output.
+func runPowerShell(t *testing.T, cli *ssh.Client, script string) ([]byte, error) {
+	t.Helper()
+	return getSession(t, cli).CombinedOutput(powerShellCommand(script))
+}
+
+// mustPowerShell is like runPowerShell, but fails the test if script
+// does.
+func mustPowerShell(t *testing.T, cli *ssh.Client, script string) []byte {
+	t.Helper()
+	outp, err := runPowerShell(t, cli, script)
+	if err != nil {
+		t.Fatalf("%s: %v, output: %s", script, err, outp)
+	}
+	return outp
+}
+
+// windowsTailscale runs the tailscale CLI with args on the Windows
+// guest at the other end of cli, returning its standard output. Unlike
+// cmdlets, a program that fails doesn't stop a PowerShell script, so
+// its exit status is passed on explicitly.
+func windowsTailscale(t *testing.T, cli *ssh.Client, args string) ([]byte, error) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	sess := getSession(t, cli)
+	sess.Stdout = &stdout
+	sess.Stderr = &stderr
+	script := fmt.Sprintf("& '%s\\tailscale.exe' %s\nexit $LASTEXITCODE", windowsInstallDir, args)
+	if err := sess.Run(powerShellCommand(script)); err != nil {
+		return nil, fmt.Errorf("tailscale %s: %v, output: %s%s", args, err, stdout.Bytes(), stderr.Bytes())
+	}
+	return stdout.Bytes(), nil
+}
+
+// sftpWindowsPath returns the path that Windows' OpenSSH sftp-server
+// knows the Windows path p by.
+func sftpWindowsPath(p string) string {
+	return "/" + strings.ReplaceAll(p, `\`, "/")
+}
+
+// copyWindowsBinaries is the Windows counterpart of copyBinaries: it
+// copies the tailscale and tailscaled binaries under test to the
+// guest and installs tailscaled's service, without starting it.
+func (h *Harness) copyWindowsBinaries(t *testing.T, d Distro, conn *ssh.Client) {
+	if len(d.ExtraDaemonArgs) > 0 {
+		t.Fatalf("%s: ExtraDaemonArgs aren't supported for Windows guests", d.Name)
+	}
+
+	// Windows paths are easier to make from PowerShell than over sftp.
+	mustPowerShell(t, conn, fmt.Sprintf("New-Item -ItemType Directory -Force -Path '%s' | Out-Null", windowsInstallDir))
+
+	cli, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("can't connect over sftp to copy binaries: %v", err)
+	}
+	defer cli.Close()
+
+	binDir := integration.BinaryDirFor(t, "windows", d.GoArch())
+	for _, name := range []string{"tailscaled.exe", "tailscale.exe"} {
+		copyFile(t, cli, filepath.Join(binDir, name), sftpWindowsPath(windowsInstallDir+`\`+name))
+	}
+
+	script := fmt.Sprintf("& '%s\\tailscaled.exe' install-system-daemon\nif ($LASTEXITCODE -ne 0) { exit $LASTEXITCODE }\n", windowsInstallDir)
+	if h.logTarget != "" {
+		// Services don't get the SSH session's environment; the
+		// service control manager passes them their Environment
+		// value instead.
+		script += fmt.Sprintf("New-ItemProperty -Path 'HKLM:\\SYSTEM\\CurrentControlSet\\Services\\%s' -Name Environment -PropertyType MultiString -Value 'TS_LOG_TARGET=%s' -Force | Out-Null\n", windowsServiceName, h.logTarget)
+	}
+	mustPowerShell(t, conn, script)
+
+	t.Log("tailscale installed!")
+}
+
+// windowsBackendState is the Windows counterpart of guestBackendState.
+func windowsBackendState(t *testing.T, cli *ssh.Client) (string, error) {
+	t.Helper()
+	outp, err := windowsTailscale(t, cli, "status --json")
+	if err != nil {
+		return "", err
+	}
+	var st struct{ BackendState string }
+	if err := json.Unmarshal(outp, &st); err != nil {
+		t.Fatalf("can't parse tailscale status --json: %v, output: %s", err, outp)
+	}
+	return st.BackendState, nil
+}
+
+// awaitWindowsTailscaled waits for the Windows guest's tailscaled to
+// reach BackendState want, or if want is empty, to be up at all, as
+// awaitTailscaledReady does.
+func awaitWindowsTailscaled(t *testing.T, cli *ssh.Client, want string, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		st, err := windowsBackendState(t, cli)
+		ready := st == want
+		if want == "" {
+			ready = st != "" && st != "NoState" && st != "Stopped"
+		}
+		if ready {
+			t.Logf("tailscaled is up, in state %s", st)
+			return
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				t.Fatalf("tailscaled not responding after %v: %v", timeout, err)
+			}
+			t.Fatalf("tailscaled still in state %q after %v; want %q", st, timeout, want)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// testWindowsDistro is the Windows counterpart of testDistro. It
+// brings tailscaled up as an unattended service, which is how it's run
+// on Windows servers, and checks that it stays up across a restart of
+// the service with nobody logged in to connect to it.
+func (h *Harness) testWindowsDistro(t *testing.T, d Distro, ipm ipMapping) {
+	loginServer := h.loginServerURL
+	_, cli := h.setupSSHShell(t, d, ipm)
+
+	// Everything takes longer on Windows.
+	const timeout = 2 * time.Minute
+
+	h.run(t, "clock-skew", func(t *testing.T) {
+		checkGuestClock(t, d, cli)
+	})
+
+	h.run(t, "start-tailscale", func(t *testing.T) {
+		mustPowerShell(t, cli, "Start-Service "+windowsServiceName)
+		awaitWindowsTailscaled(t, cli, "", timeout)
+	})
+
+	loginStart := time.Now()
+	h.run(t, "login", func(t *testing.T) {
+		outp, err := windowsTailscale(t, cli, fmt.Sprintf("up --unattended --timeout=%v --login-server=%s", timeout, loginServer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("tailscale up: %s", outp)
+	})
+	if h.result != nil {
+		h.result.LoginTime = reportDuration(time.Since(loginStart))
+	}
+
+	h.run(t, "tailscale status", func(t *testing.T) {
+		outp, err := windowsTailscale(t, cli, "status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("tailscale status: %s", outp)
+		if !bytes.Contains(outp, []byte(h.testerV4.String())) {
+			t.Fatalf("can't find tester IP %v", h.testerV4)
+		}
+	})
+
+	h.run(t, "hostinfo", func(t *testing.T) {
+		h.needEmbeddedControl(t)
+		outp, err := windowsTailscale(t, cli, "status --json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nk, err := selfNodeKey(outp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hi := h.controlHostinfo(nk)
+		if !hi.Valid() {
+			t.Fatal("control has no Hostinfo for the guest")
+		}
+		if got := hi.OS(); got != "windows" {
+			t.Errorf("guest reported OS %q; want %q", got, "windows")
+		}
+		if hi.OSVersion() == "" {
+			t.Error("guest reported an empty OSVersion")
+		}
+	})
+
+	h.run(t, "ping-ipv4", func(t *testing.T) {
+		retry(t, func() error {
+			outp, err := windowsTailscale(t, cli, "ping --verbose "+h.testerV4.String())
+			if err == nil && !bytes.Contains(outp, []byte("pong")) {
+				err = fmt.Errorf("no pong, output: %s", outp)
+			}
+			return err
+		})
+	})
+
+	// With --unattended, tailscaled keeps running its profile when no
+	// GUI or CLI is connected, including after the service restarts.
+	h.run(t, "unattended-restart", func(t *testing.T) {
+		mustPowerShell(t, cli, "Restart-Service "+windowsServiceName)
+		awaitWindowsTailscaled(t, cli, "Running", timeout)
+
+		outp, err := windowsTailscale(t, cli, "debug prefs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var prefs struct{ ForceDaemon bool }
+		if err := json.Unmarshal(outp, &prefs); err != nil {
+			t.Fatalf("can't parse tailscale debug prefs: %v, output: %s", err, outp)
+		}
+		if !prefs.ForceDaemon {
+			t.Errorf("ForceDaemon is false after restart; prefs: %s", outp)
+		}
+	})
+}
+
+func TestWindowsUserData(t *testing.T) {
+	d := Distro{Name: "windows-server-2022", OS: "windows"}
+	got, err := windowsUserData(d, "ssh-ed25519 AAAA test\n", "http://52.52.0.2:8081", 2222)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "#ps1_sysnative\n") {
+		t.Errorf("user-data doesn't start with #ps1_sysnative, so cloudbase-init won't run it:\n%s", got)
+	}
+	for _, want := range []string{
+		`Set-Content -Path $keys -Value "ssh-ed25519 AAAA test"`,
+		`Invoke-WebRequest -UseBasicParsing -Uri "http://52.52.0.2:8081/myip/2222" -UserAgent "windows-server-2022"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("user-data lacks %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestPowerShellCommand(t *testing.T) {
+	cmd := powerShellCommand(`Get-Service "Tailscale"`)
+	const prefix = "powershell.exe -NoProfile -NonInteractive -EncodedCommand "
+	if !strings.HasPrefix(cmd, prefix) {
+		t.Fatalf("command %q doesn't start with %q", cmd, prefix)
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(cmd, prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b)%2 != 0 {
+		t.Fatalf("encoded command is %d bytes; want UTF-16", len(b))
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	const want = "$ErrorActionPreference = 'Stop'\n$ProgressPreference = 'SilentlyContinue'\nGet-Service \"Tailscale\""
+	if got := string(utf16.Decode(u)); got != want {
+		t.Errorf("script = %q; want %q", got, want)
+	}
+
+	if got, want := sftpWindowsPath(windowsInstallDir+`\tailscale.exe`), "/C:/Program Files/Tailscale/tailscale.exe"; got != want {
+		t.Errorf("sftpWindowsPath = %q; want %q", got, want)
+	}
+}
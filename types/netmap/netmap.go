@@ -264,6 +264,7 @@ func (nm *NetworkMap) JSON() string {
 const (
 	AllowSingleHosts WGConfigFlags = 1 << iota
 	AllowSubnetRoutes
+	NoUnselectedDefaultRoutes // only accept /0 routes from an explicitly selected exit node
 )
 
 // eqStringsIgnoreNil reports whether a and b have the same length and
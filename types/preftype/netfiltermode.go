@@ -18,6 +18,11 @@
 	NetfilterOn       NetfilterMode = 2 // manage tailscale chains and call them from main chains
 )
 
+// NetfilterBackendNftables is the value of the NetfilterBackend pref
+// that has tailscaled program nftables directly with the nft command,
+// instead of using iptables.
+const NetfilterBackendNftables = "nftables"
+
 func (m NetfilterMode) String() string {
 	switch m {
 	case NetfilterOff:
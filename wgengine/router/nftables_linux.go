@@ -0,0 +1,273 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// nftablesRunner is a netfilterRunner that programs nftables with the
+// nft command, for systems that have nftables but no iptables.
+//
+// It takes the same iptables-style arguments as the iptables runner
+// and translates the handful of rule shapes linuxRouter uses into nft
+// rules, in tables and chains named as iptables-nft would name them.
+// Each rule gets a comment holding its iptables form, which is how
+// Exists and Delete find it again.
+type nftablesRunner struct {
+	family string // "ip" or "ip6"
+	cmd    commandRunner
+}
+
+func newNftablesRunner(family string, cmd commandRunner) *nftablesRunner {
+	return &nftablesRunner{family: family, cmd: cmd}
+}
+
+// nftBaseChains are the iptables builtin chains that linuxRouter hooks
+// into, with the nft chain definitions that stand in for them.
+var nftBaseChains = map[string]string{
+	"filter/INPUT":    "type filter hook input priority 0 ;",
+	"filter/FORWARD":  "type filter hook forward priority 0 ;",
+	"nat/POSTROUTING": "type nat hook postrouting priority 100 ;",
+}
+
+func (n *nftablesRunner) nft(args ...string) error {
+	return n.cmd.run(append([]string{"nft"}, args...)...)
+}
+
+// ensureChain creates table, and chain in it if it's one of the base
+// chains that iptables would always have. nft's add commands are no-ops
+// for things that already exist.
+func (n *nftablesRunner) ensureChain(table, chain string) error {
+	if err := n.nft("add", "table", n.family, table); err != nil {
+		return err
+	}
+	def, ok := nftBaseChains[table+"/"+chain]
+	if !ok {
+		return nil
+	}
+	return n.nft(append([]string{"add", "chain", n.family, table, chain, "{"}, append(strings.Fields(def), "}")...)...)
+}
+
+func (n *nftablesRunner) addRule(verb, table, chain string, args []string) error {
+	expr, err := nftRuleExpr(n.family, args)
+	if err != nil {
+		return err
+	}
+	if err := n.ensureChain(table, chain); err != nil {
+		return err
+	}
+	cmd := append([]string{verb, "rule", n.family, table, chain}, expr...)
+	return n.nft(append(cmd, "comment", nftComment(args))...)
+}
+
+// Insert implements netfilterRunner. Only position 1, the start of the
+// chain, is supported, as that's all linuxRouter uses.
+func (n *nftablesRunner) Insert(table, chain string, pos int, args ...string) error {
+	if pos != 1 {
+		return fmt.Errorf("nftables: can't insert at position %d, only 1", pos)
+	}
+	return n.addRule("insert", table, chain, args)
+}
+
+func (n *nftablesRunner) Append(table, chain string, args ...string) error {
+	return n.addRule("add", table, chain, args)
+}
+
+// ruleHandle returns the handle of the rule made from args in chain,
+// or 0 if there isn't one.
+func (n *nftablesRunner) ruleHandle(table, chain string, args []string) (int, error) {
+	out, err := n.cmd.output("nft", "-a", "list", "chain", n.family, table, chain)
+	if err != nil {
+		return 0, err
+	}
+	comment := "comment " + nftComment(args) + " # handle "
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		_, handle, ok := strings.Cut(s.Text(), comment)
+		if !ok {
+			continue
+		}
+		return strconv.Atoi(strings.TrimSpace(handle))
+	}
+	return 0, s.Err()
+}
+
+// Exists implements netfilterRunner. A chain that doesn't exist yet
+// has no rules, so it's not an error.
+func (n *nftablesRunner) Exists(table, chain string, args ...string) (bool, error) {
+	if err := n.nft("list", "chain", n.family, table, chain); err != nil {
+		return false, nil
+	}
+	handle, err := n.ruleHandle(table, chain, args)
+	return handle != 0, err
+}
+
+func (n *nftablesRunner) Delete(table, chain string, args ...string) error {
+	handle, err := n.ruleHandle(table, chain, args)
+	if err != nil {
+		return err
+	}
+	if handle == 0 {
+		return fmt.Errorf("nftables: no rule %q in %s %s/%s", strings.Join(args, " "), n.family, table, chain)
+	}
+	return n.nft("delete", "rule", n.family, table, chain, "handle", strconv.Itoa(handle))
+}
+
+// ClearChain implements netfilterRunner. Like iptables, nft exits with
+// status 1 if the chain doesn't exist, which linuxRouter relies on.
+func (n *nftablesRunner) ClearChain(table, chain string) error {
+	return n.nft("flush", "chain", n.family, table, chain)
+}
+
+func (n *nftablesRunner) NewChain(table, chain string) error {
+	if err := n.ensureChain(table, chain); err != nil {
+		return err
+	}
+	return n.nft("add", "chain", n.family, table, chain)
+}
+
+func (n *nftablesRunner) DeleteChain(table, chain string) error {
+	return n.nft("delete", "chain", n.family, table, chain)
+}
+
+// nftComment returns the comment, quoted for nft, that marks the rule
+// made from the iptables arguments args.
+func nftComment(args []string) string {
+	return strconv.Quote(strings.Join(args, " "))
+}
+
+// nftMatchKeys are the nft expressions that iptables' simple matches
+// compare against. "-s" is prefixed with the address family.
+var nftMatchKeys = map[string][]string{
+	"-i": {"iifname"},
+	"-o": {"oifname"},
+	"-s": {"saddr"},
+}
+
+// nftRuleExpr translates the iptables rule args into the equivalent nft
+// rule expression for family, "ip" or "ip6". It understands only the
+// matches and targets linuxRouter uses.
+func nftRuleExpr(family string, args []string) ([]string, error) {
+	var expr []string
+	op := "" // "!=" after a "!"
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		next := func() (string, error) {
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("nftables: %s needs a value in %q", arg, args)
+			}
+			i++
+			return args[i], nil
+		}
+		if arg == "!" {
+			op = "!="
+			continue
+		}
+		var err error
+		var v string
+		switch arg {
+		case "-i", "-o", "-s":
+			if v, err = next(); err != nil {
+				return nil, err
+			}
+			switch arg {
+			case "-i", "-o":
+				v = strconv.Quote(v)
+			case "-s":
+				expr = append(expr, family)
+			}
+			expr = append(expr, nftMatchKeys[arg]...)
+			if op != "" {
+				expr = append(expr, op)
+			}
+			expr = append(expr, v)
+		case "-m":
+			// The match's own options follow; "-m mark" is all we use.
+			if v, err = next(); err != nil {
+				return nil, err
+			}
+			if v != "mark" {
+				return nil, fmt.Errorf("nftables: unsupported match -m %s", v)
+			}
+		case "--mark":
+			if v, err = next(); err != nil {
+				return nil, err
+			}
+			val, mask, hasMask := strings.Cut(v, "/")
+			if hasMask {
+				expr = append(expr, "meta", "mark", "and", mask, "==", val)
+			} else {
+				expr = append(expr, "meta", "mark", val)
+			}
+		case "-j":
+			if v, err = next(); err != nil {
+				return nil, err
+			}
+			verdict, err := nftTarget(family, v, args[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			return append(expr, verdict...), nil
+		default:
+			return nil, fmt.Errorf("nftables: unsupported iptables argument %q in %q", arg, args)
+		}
+		if arg != "-m" {
+			op = ""
+		}
+	}
+	return nil, fmt.Errorf("nftables: no -j target in %q", args)
+}
+
+// nftTarget translates the iptables target named by "-j target", whose
+// own options are rest, into an nft statement.
+func nftTarget(family, target string, rest []string) ([]string, error) {
+	opt := func(name string) (string, error) {
+		if len(rest) != 2 || rest[0] != name {
+			return "", fmt.Errorf("nftables: -j %s needs just %s, got %q", target, name, rest)
+		}
+		return rest[1], nil
+	}
+	noOpts := func(stmt ...string) ([]string, error) {
+		if len(rest) != 0 {
+			return nil, fmt.Errorf("nftables: unsupported options %q for -j %s", rest, target)
+		}
+		return stmt, nil
+	}
+	switch target {
+	case "ACCEPT", "DROP", "RETURN":
+		return noOpts(strings.ToLower(target))
+	case "MASQUERADE":
+		return noOpts("masquerade")
+	case "SNAT":
+		src, err := opt("--to-source")
+		if err != nil {
+			return nil, err
+		}
+		return []string{"snat", "to", src}, nil
+	case "MARK":
+		v, err := opt("--set-mark")
+		if err != nil {
+			return nil, err
+		}
+		val, mask, hasMask := strings.Cut(v, "/")
+		if !hasMask {
+			return []string{"meta", "mark", "set", val}, nil
+		}
+		m, err := strconv.ParseUint(mask, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("nftables: bad mark mask in %q: %v", v, err)
+		}
+		return []string{"meta", "mark", "set", "meta", "mark", "and", fmt.Sprintf("0x%x", ^uint32(m)), "or", val}, nil
+	}
+	if strings.HasPrefix(target, "ts-") {
+		return noOpts("jump", target)
+	}
+	return nil, fmt.Errorf("nftables: unsupported target -j %s", target)
+}
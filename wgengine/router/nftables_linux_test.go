@@ -0,0 +1,389 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"tailscale.com/types/logger"
+	"tailscale.com/types/preftype"
+	"tailscale.com/wgengine/monitor"
+)
+
+func TestNftRuleExpr(t *testing.T) {
+	tests := []struct {
+		family string
+		args   string
+		want   string
+	}{
+		{"ip", "-i lo -s 100.101.102.104 -j ACCEPT", `iifname "lo" ip saddr 100.101.102.104 accept`},
+		{"ip", "! -i tailscale0 -s 100.64.0.0/10 -j DROP", `iifname != "tailscale0" ip saddr 100.64.0.0/10 drop`},
+		{"ip", "! -i tailscale0 -s 100.115.92.0/23 -j RETURN", `iifname != "tailscale0" ip saddr 100.115.92.0/23 return`},
+		{"ip6", "-i lo -s fd7a:115c:a1e0::1 -j ACCEPT", `iifname "lo" ip6 saddr fd7a:115c:a1e0::1 accept`},
+		{"ip", "-i tailscale0 -j MARK --set-mark 0x40000", `iifname "tailscale0" meta mark set 0x40000`},
+		{"ip", "-i tailscale0 -j MARK --set-mark 0x40000/0xff0000", `iifname "tailscale0" meta mark set meta mark and 0xff00ffff or 0x40000`},
+		{"ip", "-m mark --mark 0x40000 -j ACCEPT", `meta mark 0x40000 accept`},
+		{"ip", "-m mark --mark 0x40000/0xff0000 -j ACCEPT", `meta mark and 0xff0000 == 0x40000 accept`},
+		{"ip", "-o tailscale0 -j ACCEPT", `oifname "tailscale0" accept`},
+		{"ip", "-j ts-input", `jump ts-input`},
+		{"ip", "-m mark --mark 0x40000 -j MASQUERADE", `meta mark 0x40000 masquerade`},
+		{"ip", "-m mark --mark 0x40000 -j SNAT --to-source 100.64.1.2", `meta mark 0x40000 snat to 100.64.1.2`},
+
+		{"ip", "-i lo", "error"},
+		{"ip", "-i", "error"},
+		{"ip", "-m conntrack --ctstate NEW -j ACCEPT", "error"},
+		{"ip", "-j LOG", "error"},
+		{"ip", "-j ACCEPT --foo", "error"},
+		{"ip", "-j SNAT", "error"},
+		{"ip", "-d 10.0.0.1 -j ACCEPT", "error"},
+	}
+	for _, tt := range tests {
+		got, err := nftRuleExpr(tt.family, strings.Fields(tt.args))
+		if tt.want == "error" {
+			if err == nil {
+				t.Errorf("nftRuleExpr(%q, %q) = %q; want error", tt.family, tt.args, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("nftRuleExpr(%q, %q): %v", tt.family, tt.args, err)
+			continue
+		}
+		if g := strings.Join(got, " "); g != tt.want {
+			t.Errorf("nftRuleExpr(%q, %q)\n got: %s\nwant: %s", tt.family, tt.args, g, tt.want)
+		}
+	}
+}
+
+// fakeNft is a commandRunner that implements the nft invocations
+// nftablesRunner makes, keeping the rules in memory.
+type fakeNft struct {
+	t          *testing.T
+	chains     map[string][]fakeNftRule // "family table chain" => rules
+	tables     map[string]bool          // "family table"
+	nextHandle int
+}
+
+type fakeNftRule struct {
+	handle int
+	rule   string
+}
+
+func newFakeNft(t *testing.T) *fakeNft {
+	return &fakeNft{
+		t:      t,
+		chains: map[string][]fakeNftRule{},
+		tables: map[string]bool{},
+	}
+}
+
+// errNoChain mimics nft exiting with status 1 for a missing chain.
+var errNoChain = errors.New("exitcode:1")
+
+func (f *fakeNft) run(args ...string) error {
+	_, err := f.do(args)
+	return err
+}
+
+func (f *fakeNft) output(args ...string) ([]byte, error) {
+	return f.do(args)
+}
+
+func (f *fakeNft) do(args []string) ([]byte, error) {
+	cmd := strings.Join(args, " ")
+	if args[0] != "nft" {
+		f.t.Errorf("unexpected invocation %q", cmd)
+		return nil, errExec
+	}
+	args = args[1:]
+	list := len(args) > 0 && args[0] == "-a"
+	if list {
+		args = args[1:]
+	}
+	if len(args) == 2 && args[0] == "list" && args[1] == "tables" {
+		return nil, nil
+	}
+	if len(args) < 4 {
+		f.t.Errorf("unexpected invocation %q", cmd)
+		return nil, errExec
+	}
+	verb, what, table := args[0], args[1], args[2]+" "+args[3]
+	if what == "table" && verb == "add" && len(args) == 4 {
+		f.tables[table] = true
+		return nil, nil
+	}
+	if len(args) < 5 {
+		f.t.Errorf("unexpected invocation %q", cmd)
+		return nil, errExec
+	}
+	chain := table + " " + args[4]
+	rules, ok := f.chains[chain]
+	switch verb + " " + what {
+	case "add chain":
+		if !f.tables[table] {
+			f.t.Errorf("%q: no table %q", cmd, table)
+			return nil, errExec
+		}
+		if !ok {
+			f.chains[chain] = nil
+		}
+		return nil, nil
+	case "list chain":
+		if !ok {
+			return nil, errNoChain
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "table %s {\n\tchain %s {\n", args[2], args[4])
+		for _, r := range rules {
+			fmt.Fprintf(&b, "\t\t%s", r.rule)
+			if list {
+				fmt.Fprintf(&b, " # handle %d", r.handle)
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("\t}\n}\n")
+		return []byte(b.String()), nil
+	case "flush chain":
+		if !ok {
+			return nil, errNoChain
+		}
+		f.chains[chain] = nil
+		return nil, nil
+	case "delete chain":
+		if !ok {
+			return nil, errNoChain
+		}
+		if len(rules) > 0 {
+			f.t.Errorf("%q: chain not empty", cmd)
+			return nil, errExec
+		}
+		delete(f.chains, chain)
+		return nil, nil
+	case "add rule", "insert rule":
+		if !ok {
+			return nil, errNoChain
+		}
+		f.nextHandle++
+		r := fakeNftRule{f.nextHandle, strings.Join(args[5:], " ")}
+		if verb == "insert" {
+			f.chains[chain] = append([]fakeNftRule{r}, rules...)
+		} else {
+			f.chains[chain] = append(rules, r)
+		}
+		return nil, nil
+	case "delete rule":
+		if len(args) != 7 || args[5] != "handle" {
+			break
+		}
+		h, _ := strconv.Atoi(args[6])
+		for i, r := range rules {
+			if r.handle == h {
+				f.chains[chain] = append(rules[:i:i], rules[i+1:]...)
+				return nil, nil
+			}
+		}
+		return nil, errExec
+	}
+	f.t.Errorf("unexpected invocation %q", cmd)
+	return nil, errExec
+}
+
+// String returns the rules of every chain, one per line, sorted by
+// chain, without their comments.
+func (f *fakeNft) String() string {
+	var chains []string
+	for c := range f.chains {
+		chains = append(chains, c)
+	}
+	sort.Strings(chains)
+	var b strings.Builder
+	for _, c := range chains {
+		fmt.Fprintf(&b, "%s\n", c)
+		for _, r := range f.chains[c] {
+			rule, _, _ := strings.Cut(r.rule, " comment ")
+			fmt.Fprintf(&b, "\t%s\n", rule)
+		}
+	}
+	return b.String()
+}
+
+func TestNftablesRunner(t *testing.T) {
+	f := newFakeNft(t)
+	n := newNftablesRunner("ip", f)
+
+	if err := n.ClearChain("filter", "ts-input"); errCode(err) != 1 {
+		t.Fatalf("ClearChain of missing chain = %v; want exit code 1", err)
+	}
+	if err := n.NewChain("filter", "ts-input"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Append("filter", "INPUT", "-j", "ts-input"); err != nil {
+		t.Fatal(err)
+	}
+	drop := []string{"!", "-i", "tailscale0", "-s", "100.64.0.0/10", "-j", "DROP"}
+	accept := []string{"-i", "lo", "-s", "100.101.102.104", "-j", "ACCEPT"}
+	if err := n.Append("filter", "ts-input", drop...); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Insert("filter", "ts-input", 1, accept...); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Insert("filter", "ts-input", 2, accept...); err == nil {
+		t.Error("Insert at position 2 succeeded; want error")
+	}
+
+	const want = `ip filter INPUT
+	jump ts-input
+ip filter ts-input
+	iifname "lo" ip saddr 100.101.102.104 accept
+	iifname != "tailscale0" ip saddr 100.64.0.0/10 drop
+`
+	if got := f.String(); got != want {
+		t.Fatalf("rules:\n%s\nwant:\n%s", got, want)
+	}
+
+	for _, tt := range []struct {
+		chain string
+		args  []string
+		want  bool
+	}{
+		{"ts-input", accept, true},
+		{"ts-input", drop, true},
+		{"ts-input", []string{"-j", "ACCEPT"}, false},
+		{"ts-forward", accept, false},
+	} {
+		got, err := n.Exists("filter", tt.chain, tt.args...)
+		if err != nil {
+			t.Errorf("Exists(%s, %q): %v", tt.chain, tt.args, err)
+		} else if got != tt.want {
+			t.Errorf("Exists(%s, %q) = %v; want %v", tt.chain, tt.args, got, tt.want)
+		}
+	}
+
+	if err := n.Delete("filter", "ts-input", accept...); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Delete("filter", "ts-input", accept...); err == nil {
+		t.Error("second Delete succeeded; want error")
+	}
+	if ok, _ := n.Exists("filter", "ts-input", accept...); ok {
+		t.Error("rule still exists after Delete")
+	}
+	if err := n.Delete("filter", "INPUT", "-j", "ts-input"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.ClearChain("filter", "ts-input"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.DeleteChain("filter", "ts-input"); err != nil {
+		t.Fatal(err)
+	}
+	const wantEmpty = "ip filter INPUT\n"
+	if got := f.String(); got != wantEmpty {
+		t.Errorf("rules after cleanup:\n%s\nwant:\n%s", got, wantEmpty)
+	}
+}
+
+// nftOS is a commandRunner that sends nft commands to a fakeNft and
+// everything else to a fakeOS.
+type nftOS struct {
+	*fakeOS
+	nft *fakeNft
+}
+
+func (o nftOS) run(args ...string) error {
+	if args[0] == "nft" {
+		return o.nft.run(args...)
+	}
+	return o.fakeOS.run(args...)
+}
+
+func (o nftOS) output(args ...string) ([]byte, error) {
+	if args[0] == "nft" {
+		return o.nft.output(args...)
+	}
+	return o.fakeOS.output(args...)
+}
+
+func TestRouterNetfilterBackend(t *testing.T) {
+	mon, err := monitor.New(logger.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon.Start()
+	defer mon.Close()
+
+	fake := NewFakeOS(t)
+	nft := newFakeNft(t)
+	router, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", mon, fake.netfilter4, fake.netfilter6, nftOS{fake, nft}, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	if err := router.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{
+		LocalAddrs:       mustCIDRs("100.101.102.104/10"),
+		SubnetRoutes:     mustCIDRs("10.0.0.0/8"),
+		SNATSubnetRoutes: true,
+		NetfilterMode:    netfilterOn,
+	}
+	if err := router.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.netfilter4.n["filter/ts-input"]) == 0 {
+		t.Fatal("no iptables rules with the default backend")
+	}
+	if got := nft.String(); got != "" {
+		t.Fatalf("nft rules with the default backend:\n%s", got)
+	}
+
+	cfg.NetfilterBackend = preftype.NetfilterBackendNftables
+	if err := router.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for chain, rules := range fake.netfilter4.n {
+		if strings.HasPrefix(chain, "filter/ts-") || strings.HasPrefix(chain, "nat/ts-") || len(rules) > 0 {
+			t.Errorf("iptables %s left behind after switching to nftables: %q", chain, rules)
+		}
+	}
+	got := nft.String()
+	for _, want := range []string{
+		"ip filter INPUT\n\tjump ts-input\n",
+		"ip nat POSTROUTING\n\tjump ts-postrouting\n",
+		"ip nat ts-postrouting\n\tmeta mark 0x40000 masquerade\n",
+		"ip6 filter FORWARD\n\tjump ts-forward\n",
+		"\tiifname \"lo\" ip saddr 100.101.102.104 accept\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("nft rules missing %q; got:\n%s", want, got)
+		}
+	}
+
+	cfg.NetfilterBackend = ""
+	if err := router.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for chain, rules := range nft.chains {
+		if len(rules) > 0 {
+			t.Errorf("nft chain %q left behind after switching back: %q", chain, rules)
+		}
+	}
+	if len(fake.netfilter4.n["filter/ts-input"]) == 0 {
+		t.Error("no iptables rules after switching back")
+	}
+
+	cfg.NetfilterBackend = "bogus"
+	if err := router.Set(cfg); err == nil {
+		t.Error("Set with unknown backend succeeded")
+	}
+}
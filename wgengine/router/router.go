@@ -69,7 +69,9 @@ type Config struct {
 	// Linux-only things below, ignored on other platforms.
 	SubnetRoutes     []netaddr.IPPrefix     // subnets being advertised to other Tailscale nodes
 	SNATSubnetRoutes bool                   // SNAT traffic to local subnets
+	SNATSource       netaddr.IP             // if non-zero, SNAT to this address instead of masquerading
 	NetfilterMode    preftype.NetfilterMode // how much to manage netfilter rules
+	NetfilterBackend string                 // "" for iptables, or preftype.NetfilterBackendNftables
 }
 
 // shutdownConfig is a routing configuration that removes all router
@@ -92,6 +92,7 @@ type linuxRouter struct {
 	routes           map[netaddr.IPPrefix]bool
 	localRoutes      map[netaddr.IPPrefix]bool
 	snatSubnetRoutes bool
+	snatSource       netaddr.IP
 	netfilterMode    preftype.NetfilterMode
 
 	// ruleRestorePending is whether a timer has been started to
@@ -107,6 +108,12 @@ type linuxRouter struct {
 	ipt4 netfilterRunner
 	ipt6 netfilterRunner
 	cmd  commandRunner
+
+	// netfilterBackend is the Config.NetfilterBackend that ipt4 and
+	// ipt6 program, and iptables4 and iptables6 are the iptables
+	// runners to go back to after using another backend.
+	netfilterBackend     string
+	iptables4, iptables6 netfilterRunner
 }
 
 func newUserspaceRouter(logf logger.Logf, tunDev tun.Device, linkMon *monitor.Mon) (Router, error) {
@@ -115,9 +122,15 @@ func newUserspaceRouter(logf logger.Logf, tunDev tun.Device, linkMon *monitor.Mo
 		return nil, err
 	}
 
-	ipt4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
-	if err != nil {
-		return nil, err
+	// Without iptables, the router can still run with netfilter off or
+	// with the nftables backend, so a missing iptables is only an
+	// error once something tries to use it.
+	var ipt4 netfilterRunner
+	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4); err != nil {
+		logf("iptables unavailable: %v", err)
+		ipt4 = unavailableNetfilter{err}
+	} else {
+		ipt4 = ipt
 	}
 
 	v6err := checkIPv6(logf)
@@ -134,9 +147,11 @@ func newUserspaceRouter(logf logger.Logf, tunDev tun.Device, linkMon *monitor.Mo
 	if supportsV6 {
 		// The iptables package probes for `ip6tables` and errors out
 		// if unavailable. We want that to be a non-fatal error.
-		ipt6, err = iptables.NewWithProtocol(iptables.ProtocolIPv6)
-		if err != nil {
-			return nil, err
+		if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6); err != nil {
+			logf("ip6tables unavailable: %v", err)
+			ipt6 = unavailableNetfilter{err}
+		} else {
+			ipt6 = ipt
 		}
 	}
 
@@ -157,9 +172,11 @@ func newUserspaceRouterAdvanced(logf logger.Logf, tunname string, linkMon *monit
 		v6Available:    supportsV6,
 		v6NATAvailable: supportsV6NAT,
 
-		ipt4: netfilter4,
-		ipt6: netfilter6,
-		cmd:  cmd,
+		ipt4:      netfilter4,
+		ipt6:      netfilter6,
+		iptables4: netfilter4,
+		iptables6: netfilter6,
+		cmd:       cmd,
 
 		ipRuleFixLimiter: rate.NewLimiter(rate.Every(5*time.Second), 10),
 	}
@@ -292,7 +309,11 @@ func (r *linuxRouter) Set(cfg *Config) error {
 		cfg = &shutdownConfig
 	}
 
-	if err := r.setNetfilterMode(cfg.NetfilterMode); err != nil {
+	if err := r.setNetfilterBackend(cfg.NetfilterBackend); err != nil {
+		// Leave netfilter off rather than quietly using another
+		// backend than the one asked for.
+		errs = append(errs, err)
+	} else if err := r.setNetfilterMode(cfg.NetfilterMode); err != nil {
 		errs = append(errs, err)
 	}
 
@@ -315,22 +336,60 @@ func (r *linuxRouter) Set(cfg *Config) error {
 	r.addrs = newAddrs
 
 	switch {
-	case cfg.SNATSubnetRoutes == r.snatSubnetRoutes:
+	case cfg.SNATSubnetRoutes == r.snatSubnetRoutes && cfg.SNATSource == r.snatSource:
 		// state already correct, nothing to do.
 	case cfg.SNATSubnetRoutes:
+		if r.snatSubnetRoutes {
+			// Only the source changed; replace the old rule.
+			if err := r.delSNATRule(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		r.snatSource = cfg.SNATSource
 		if err := r.addSNATRule(); err != nil {
 			errs = append(errs, err)
 		}
 	default:
-		if err := r.delSNATRule(); err != nil {
-			errs = append(errs, err)
+		if r.snatSubnetRoutes {
+			if err := r.delSNATRule(); err != nil {
+				errs = append(errs, err)
+			}
 		}
 	}
 	r.snatSubnetRoutes = cfg.SNATSubnetRoutes
+	r.snatSource = cfg.SNATSource
 
 	return multierr.New(errs...)
 }
 
+// setNetfilterBackend switches the runners that program netfilter to
+// those for backend, after removing everything the current ones set
+// up, as the runners for one backend can't see the other's rules.
+func (r *linuxRouter) setNetfilterBackend(backend string) error {
+	if backend == r.netfilterBackend {
+		return nil
+	}
+	if err := r.setNetfilterMode(netfilterOff); err != nil {
+		return err
+	}
+	switch backend {
+	case "":
+		r.ipt4, r.ipt6 = r.iptables4, r.iptables6
+	case preftype.NetfilterBackendNftables:
+		if err := r.cmd.run("nft", "list", "tables"); err != nil {
+			return fmt.Errorf("nftables netfilter backend unavailable: %w", err)
+		}
+		r.ipt4 = newNftablesRunner("ip", r.cmd)
+		if r.v6Available {
+			r.ipt6 = newNftablesRunner("ip6", r.cmd)
+		}
+	default:
+		return fmt.Errorf("unknown netfilter backend %q", backend)
+	}
+	r.netfilterBackend = backend
+	return nil
+}
+
 // setNetfilterMode switches the router to the given netfilter
 // mode. Netfilter state is created or deleted appropriately to
 // reflect the new mode, and r.snatSubnetRoutes is updated to reflect
@@ -1346,11 +1405,12 @@ func (r *linuxRouter) addSNATRule() error {
 		return nil
 	}
 
-	args := []string{"-m", "mark", "--mark", tailscaleSubnetRouteMark, "-j", "MASQUERADE"}
+	args := snatRuleArgs(r.snatSource, false)
 	if err := r.ipt4.Append("nat", "ts-postrouting", args...); err != nil {
 		return fmt.Errorf("adding %v in v4/nat/ts-postrouting: %w", args, err)
 	}
 	if r.v6NATAvailable {
+		args := snatRuleArgs(r.snatSource, true)
 		if err := r.ipt6.Append("nat", "ts-postrouting", args...); err != nil {
 			return fmt.Errorf("adding %v in v6/nat/ts-postrouting: %w", args, err)
 		}
@@ -1365,11 +1425,12 @@ func (r *linuxRouter) delSNATRule() error {
 		return nil
 	}
 
-	args := []string{"-m", "mark", "--mark", tailscaleSubnetRouteMark, "-j", "MASQUERADE"}
+	args := snatRuleArgs(r.snatSource, false)
 	if err := r.ipt4.Delete("nat", "ts-postrouting", args...); err != nil {
 		return fmt.Errorf("deleting %v in v4/nat/ts-postrouting: %w", args, err)
 	}
 	if r.v6NATAvailable {
+		args := snatRuleArgs(r.snatSource, true)
 		if err := r.ipt6.Delete("nat", "ts-postrouting", args...); err != nil {
 			return fmt.Errorf("deleting %v in v6/nat/ts-postrouting: %w", args, err)
 		}
@@ -1377,6 +1438,18 @@ func (r *linuxRouter) delSNATRule() error {
 	return nil
 }
 
+// snatRuleArgs returns the ts-postrouting rule that source NATs
+// subnet-routed traffic for the IPv6 table if is6, else the IPv4 one.
+// The rule rewrites to src if it's of the table's family, and
+// masquerades as the outgoing interface's address otherwise.
+func snatRuleArgs(src netaddr.IP, is6 bool) []string {
+	args := []string{"-m", "mark", "--mark", tailscaleSubnetRouteMark}
+	if !src.IsZero() && src.Is6() == is6 {
+		return append(args, "-j", "SNAT", "--to-source", src.String())
+	}
+	return append(args, "-j", "MASQUERADE")
+}
+
 // cidrDiff calls add and del as needed to make the set of prefixes in
 // old and new match. Returns a map reflecting the actual new state
 // (which may be somewhere in between old and new if some commands
@@ -1556,3 +1629,25 @@ func nlAddrOfPrefix(p netaddr.IPPrefix) *netlink.Addr {
 		IPNet: p.IPNet(),
 	}
 }
+
+// unavailableNetfilter is the netfilterRunner used in place of iptables
+// when it isn't installed. Every call fails with err.
+type unavailableNetfilter struct {
+	err error
+}
+
+func (u unavailableNetfilter) fail() error {
+	return fmt.Errorf("%w; use --netfilter-mode=off, or the nftables backend as in --netfilter-mode=on/nftables", u.err)
+}
+
+func (u unavailableNetfilter) Insert(table, chain string, pos int, args ...string) error {
+	return u.fail()
+}
+func (u unavailableNetfilter) Append(table, chain string, args ...string) error { return u.fail() }
+func (u unavailableNetfilter) Exists(table, chain string, args ...string) (bool, error) {
+	return false, u.fail()
+}
+func (u unavailableNetfilter) Delete(table, chain string, args ...string) error { return u.fail() }
+func (u unavailableNetfilter) ClearChain(table, chain string) error             { return u.fail() }
+func (u unavailableNetfilter) NewChain(table, chain string) error               { return u.fail() }
+func (u unavailableNetfilter) DeleteChain(table, chain string) error            { return u.fail() }
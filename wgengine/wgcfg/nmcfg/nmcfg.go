@@ -49,8 +49,25 @@ func cidrIsSubnet(node *tailcfg.Node, cidr netaddr.IPPrefix) bool {
 	return true
 }
 
+// routeInFilter reports whether the subnet route r is within one of
+// the prefixes in filter, or filter is empty.
+func routeInFilter(filter []netaddr.IPPrefix, r netaddr.IPPrefix) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		if f.Bits() <= r.Bits() && f.Contains(r.IP()) {
+			return true
+		}
+	}
+	return false
+}
+
 // WGCfg returns the NetworkMaps's Wireguard configuration.
-func WGCfg(nm *netmap.NetworkMap, logf logger.Logf, flags netmap.WGConfigFlags, exitNode tailcfg.StableNodeID) (*wgcfg.Config, error) {
+//
+// With netmap.AllowSubnetRoutes, subnet routes are accepted only if
+// they're within one of the prefixes in routeFilter, unless it's empty.
+func WGCfg(nm *netmap.NetworkMap, logf logger.Logf, flags netmap.WGConfigFlags, exitNode tailcfg.StableNodeID, routeFilter []netaddr.IPPrefix) (*wgcfg.Config, error) {
 	cfg := &wgcfg.Config{
 		Name:       "tailscale",
 		PrivateKey: nm.PrivateKey,
@@ -81,7 +98,7 @@ func WGCfg(nm *netmap.NetworkMap, logf logger.Logf, flags netmap.WGConfigFlags,
 
 		didExitNodeWarn := false
 		for _, allowedIP := range peer.AllowedIPs {
-			if allowedIP.Bits() == 0 && peer.StableID != exitNode {
+			if allowedIP.Bits() == 0 && (peer.StableID != exitNode || (exitNode == "" && flags&netmap.NoUnselectedDefaultRoutes != 0)) {
 				if didExitNodeWarn {
 					// Don't log about both the IPv4 /0 and IPv6 /0.
 					continue
@@ -99,7 +116,7 @@ func WGCfg(nm *netmap.NetworkMap, logf logger.Logf, flags netmap.WGConfigFlags,
 				fmt.Fprintf(skippedIPs, "%v from %q (%v)", allowedIP.IP(), nodeDebugName(peer), peer.Key.ShortString())
 				continue
 			} else if cidrIsSubnet(peer, allowedIP) {
-				if (flags & netmap.AllowSubnetRoutes) == 0 {
+				if (flags&netmap.AllowSubnetRoutes) == 0 || !routeInFilter(routeFilter, allowedIP) {
 					if skippedSubnets.Len() > 0 {
 						skippedSubnets.WriteString(", ")
 					}
@@ -0,0 +1,123 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nmcfg
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+func TestWGCfgRouteFilter(t *testing.T) {
+	pfx := netaddr.MustParseIPPrefix
+	self := pfx("100.64.0.2/32")
+	nm := &netmap.NetworkMap{
+		Peers: []*tailcfg.Node{{
+			Name:      "router.example.ts.net.",
+			Key:       key.NewNode().Public(),
+			DERP:      "127.3.3.40:1",
+			Addresses: []netaddr.IPPrefix{self},
+			AllowedIPs: []netaddr.IPPrefix{
+				self,
+				pfx("10.20.1.0/24"),
+				pfx("10.21.0.0/16"),
+				pfx("10.0.0.0/8"),
+			},
+		}},
+	}
+	tests := []struct {
+		name   string
+		flags  netmap.WGConfigFlags
+		filter []netaddr.IPPrefix
+		want   []netaddr.IPPrefix
+	}{
+		{
+			name:  "no-subnets",
+			flags: netmap.AllowSingleHosts,
+			want:  []netaddr.IPPrefix{self},
+		},
+		{
+			name:  "all-subnets",
+			flags: netmap.AllowSingleHosts | netmap.AllowSubnetRoutes,
+			want:  []netaddr.IPPrefix{self, pfx("10.20.1.0/24"), pfx("10.21.0.0/16"), pfx("10.0.0.0/8")},
+		},
+		{
+			name:   "filtered",
+			flags:  netmap.AllowSingleHosts | netmap.AllowSubnetRoutes,
+			filter: []netaddr.IPPrefix{pfx("10.20.0.0/16")},
+			want:   []netaddr.IPPrefix{self, pfx("10.20.1.0/24")},
+		},
+		{
+			name:   "filter-without-subnets",
+			flags:  netmap.AllowSingleHosts,
+			filter: []netaddr.IPPrefix{pfx("10.20.0.0/16")},
+			want:   []netaddr.IPPrefix{self},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := WGCfg(nm, t.Logf, tt.flags, "", tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cfg.Peers) != 1 {
+				t.Fatalf("got %d peers; want 1", len(cfg.Peers))
+			}
+			if got := cfg.Peers[0].AllowedIPs; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AllowedIPs = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWGCfgUnselectedDefaultRoute(t *testing.T) {
+	pfx := netaddr.MustParseIPPrefix
+	self := pfx("100.64.0.3/32")
+	nm := &netmap.NetworkMap{
+		Peers: []*tailcfg.Node{{
+			// No StableID, as sent by older control servers, so
+			// it matches the empty exit node ID.
+			Name:       "exit.example.ts.net.",
+			Key:        key.NewNode().Public(),
+			DERP:       "127.3.3.40:1",
+			Addresses:  []netaddr.IPPrefix{self},
+			AllowedIPs: []netaddr.IPPrefix{self, pfx("0.0.0.0/0"), pfx("::/0")},
+		}},
+	}
+	tests := []struct {
+		name  string
+		flags netmap.WGConfigFlags
+		want  []netaddr.IPPrefix
+	}{
+		{
+			name:  "default",
+			flags: netmap.AllowSingleHosts | netmap.AllowSubnetRoutes,
+			want:  []netaddr.IPPrefix{self, pfx("0.0.0.0/0"), pfx("::/0")},
+		},
+		{
+			name:  "no-unselected-default-routes",
+			flags: netmap.AllowSingleHosts | netmap.AllowSubnetRoutes | netmap.NoUnselectedDefaultRoutes,
+			want:  []netaddr.IPPrefix{self},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := WGCfg(nm, t.Logf, tt.flags, "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cfg.Peers) != 1 {
+				t.Fatalf("got %d peers; want 1", len(cfg.Peers))
+			}
+			if got := cfg.Peers[0].AllowedIPs; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AllowedIPs = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}